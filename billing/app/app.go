@@ -0,0 +1,179 @@
+// Package app wires billing's HTTP server, consumers and jobs. cmd/billing runs it on its
+// own, devstack runs it next to gwapi in one process with a shared in-process bus.
+package app
+
+import (
+	"billing/internal/commands"
+	"billing/internal/config"
+	"billing/internal/consumer"
+	"billing/internal/deadletter"
+	"billing/internal/events"
+	"billing/internal/http-server/handlers"
+	"billing/internal/jobs/chainsigner"
+	"billing/internal/jobs/interest"
+	"billing/internal/jobs/webhooks"
+	"billing/internal/lib/envelope"
+	"billing/internal/lib/hashchain"
+	"billing/internal/retry"
+	"billing/internal/service"
+	"billing/internal/storage/postgresql"
+	"bus"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// LoadConfig reads the config file at path, overridden by the environment, and validates
+// it.
+func LoadConfig(path string) (*config.Config, error) {
+	const op = "app.LoadConfig"
+
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: invalid config:\n%w", op, err)
+	}
+
+	return cfg, nil
+}
+
+// NewService connects to the database and returns the service with its storage, which
+// the caller closes.
+func NewService(cfg *config.Config, log *slog.Logger) (*service.Service, *postgresql.Storage, error) {
+	repo, err := postgresql.New(cfg.DataSourceName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var signer *hashchain.Signer
+	if cfg.Chain.SigningKeyPath != "" {
+		signer, err = hashchain.LoadSigner(cfg.Chain.SigningKeyPath)
+		if err != nil {
+			repo.Close()
+			return nil, nil, err
+		}
+	}
+
+	return service.New(log, repo, repo, repo, repo, repo, repo, repo, repo, repo, signer), repo, nil
+}
+
+// Run starts the server, the consumers and the jobs, and serves until ctx is done.
+// Messages are consumed from subscriber and published to publisher, which the caller
+// closes.
+func Run(ctx context.Context, log *slog.Logger, cfg *config.Config, publisher bus.Publisher, subscriber bus.Subscriber) error {
+	const op = "app.Run"
+
+	service, repo, err := NewService(cfg, log)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer repo.Close()
+
+	contentType, err := envelope.ContentType(cfg.Kafka.Encoding)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	deadLetters := deadletter.NewWriter(publisher)
+
+	retries := retry.NewWriter(publisher, retry.Policy{
+		MaxAttempts: cfg.Retry.MaxAttempts,
+		Backoff:     cfg.Retry.Backoff,
+		MaxBackoff:  cfg.Retry.MaxBackoff,
+	})
+
+	transactionEvents := events.NewWriter(publisher, cfg.Events.Topic, contentType)
+
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+
+	publishers := []commands.EventPublisher{transactionEvents}
+
+	// Webhook deliveries are queued with the transaction events and sent by the dispatcher
+	if cfg.Webhooks.Enabled {
+		publishers = append(publishers, webhooks.NewNotifier(service))
+
+		dispatcher := webhooks.NewDispatcher(log, service, cfg.Webhooks.Timeout, retry.Policy{
+			MaxAttempts: cfg.Webhooks.MaxAttempts,
+			Backoff:     cfg.Webhooks.Backoff,
+			MaxBackoff:  cfg.Webhooks.MaxBackoff,
+		}, cfg.Webhooks.Interval)
+		go dispatcher.Run(jobsCtx)
+	}
+
+	commandHandlers := commands.New(log, service, publishers...)
+
+	// The first middleware is the outermost, so Retries decides on the final outcome
+	cons := consumer.New(log, subscriber, cfg.Consumer.Workers, cfg.Consumer.QueueSize, cfg.Retry.MaxAttempts)
+	cons.Use(
+		consumer.Retries(log, retries, deadLetters, commandHandlers.Failed),
+		consumer.Logging(log),
+		consumer.Metrics(),
+		consumer.AuditContext(),
+		consumer.Dedup(log),
+	)
+	cons.Handle(envelope.TypeInvoice, commandHandlers.Invoice)
+	cons.Handle(envelope.TypeWithdraw, commandHandlers.Withdraw)
+
+	for _, topic := range cfg.Consumer.Topics {
+		go cons.Run(jobsCtx, consumer.Topic{Name: topic.Name, GroupID: topic.GroupID, LegacyType: topic.Type})
+	}
+
+	if cfg.Interest.Enabled {
+		interestJob := interest.New(log, service, cfg.Interest.Interval)
+		go interestJob.Run(jobsCtx)
+	}
+
+	if cfg.Chain.SigningKeyPath != "" {
+		chainSignerJob := chainsigner.New(log, service, cfg.Chain.SignInterval)
+		go chainSignerJob.Run(jobsCtx)
+	}
+
+	handler := handlers.New(service, commandHandlers.Publishing(), service, service, service, service, service, service)
+
+	router := handler.InitRoutes()
+
+	log.Info("starting server", slog.String("address", cfg.HTTPServer.Address))
+
+	srv := &http.Server{
+		Addr:        ":" + cfg.HTTPServer.Address,
+		Handler:     router,
+		ReadTimeout: cfg.HTTPServer.Timeout,
+		IdleTimeout: cfg.HTTPServer.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+	}()
+
+	log.Info("server started")
+
+	select {
+	case <-ctx.Done():
+	case err := <-serveErr:
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("stopping server")
+
+	stopJobs()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTPServer.Timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("server stopped")
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"billing/app"
+	"billing/internal/config"
+	"billing/internal/deadletter"
+	"billing/internal/lib/hashchain"
+	"billing/internal/lib/logger/sl"
+	"billing/internal/replay"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `usage: billing [command]
+
+Without a command billing starts the server. Commands:
+  dump-config                   print the effective config as YAML, with secrets masked
+  verify-chain [wallet_id ...]  verify the transaction hash chain of the given or all wallets
+  dlq list [-limit n] topic     print the dead-lettered messages of a topic
+  dlq redrive [-partition p -offset o | -idle d] topic
+                                publish dead-lettered messages to their original topic again,
+                                either the one at the given offset or all not re-driven yet
+  replay [-partition p] [-from-offset o] [-to-offset o] [-from t] [-to t] [-dry-run] [-dsn url] topic
+                                apply the invoices or withdrawals of a topic again, skipping
+                                the ones that were applied before; -from and -to are RFC 3339
+`
+
+// runCommand runs a one-off administrative command and returns the process exit code.
+func runCommand(cfg *config.Config, log *slog.Logger, args []string) int {
+	switch args[0] {
+	case "verify-chain":
+		return verifyChain(cfg, log, args[1:])
+	case "dlq":
+		return deadLetterCommand(cfg, log, args[1:])
+	case "replay":
+		return replayTopic(cfg, log, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+}
+
+// dumpConfig prints the config after defaults and environment overrides were applied,
+// then the problems that keep it from validating, if any.
+func dumpConfig() int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode config: %v\n", err)
+		return 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// verifyChain prints one JSON report per wallet and exits with 1 if any chain is broken.
+func verifyChain(cfg *config.Config, log *slog.Logger, args []string) int {
+	fs := flag.NewFlagSet("verify-chain", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	service, repo, err := app.NewService(cfg, log)
+	if err != nil {
+		log.Error("failed to initialize service", sl.Err(err))
+		return 1
+	}
+	defer repo.Close()
+
+	wallets := fs.Args()
+	if len(wallets) == 0 {
+		wallets, err = service.GetChainWallets()
+		if err != nil {
+			log.Error("failed to list wallets", sl.Err(err))
+			return 1
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	code := 0
+
+	for _, walletID := range wallets {
+		var report hashchain.Report
+
+		report, err = service.VerifyChain(walletID)
+		if err != nil {
+			log.Error("failed to verify chain", slog.String("wallet_id", walletID), sl.Err(err))
+			return 1
+		}
+
+		enc.Encode(report)
+
+		if !report.Valid {
+			code = 1
+		}
+	}
+
+	return code
+}
+
+func deadLetterCommand(cfg *config.Config, log *slog.Logger, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "list":
+		return listDeadLetters(cfg, log, args[1:])
+	case "redrive":
+		return redriveDeadLetters(cfg, log, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+}
+
+// listDeadLetters prints one JSON object per dead-lettered message.
+func listDeadLetters(cfg *config.Config, log *slog.Logger, args []string) int {
+	fs := flag.NewFlagSet("dlq list", flag.ContinueOnError)
+	limit := fs.Int("limit", 100, "maximum number of messages, 0 for all")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+
+	err := deadletter.List(context.Background(), cfg.Kafka.Brokers, fs.Arg(0), *limit, func(m deadletter.Message) error {
+		return enc.Encode(m)
+	})
+	if err != nil {
+		log.Error("failed to list dead-lettered messages", sl.Err(err))
+		return 1
+	}
+
+	return 0
+}
+
+// redriveDeadLetters prints one JSON object per re-driven message.
+func redriveDeadLetters(cfg *config.Config, log *slog.Logger, args []string) int {
+	fs := flag.NewFlagSet("dlq redrive", flag.ContinueOnError)
+	partition := fs.Int("partition", 0, "partition of the message to re-drive")
+	offset := fs.Int64("offset", -1, "offset of the message to re-drive, all messages if not set")
+	idle := fs.Duration("idle", 5*time.Second, "stop re-driving all messages after no new one arrived for this long")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	topic := fs.Arg(0)
+	enc := json.NewEncoder(os.Stdout)
+
+	if *offset >= 0 {
+		m, err := deadletter.Redrive(context.Background(), cfg.Kafka.Brokers, topic, *partition, *offset)
+		if err != nil {
+			log.Error("failed to re-drive dead-lettered message", sl.Err(err))
+			return 1
+		}
+
+		enc.Encode(m)
+
+		return 0
+	}
+
+	redrove, err := deadletter.RedriveAll(context.Background(), cfg.Kafka.Brokers, cfg.DeadLetter.RedriveGroupID, topic, *idle, func(m deadletter.Message) {
+		enc.Encode(m)
+	})
+	if err != nil {
+		log.Error("failed to re-drive dead-lettered messages", slog.Int("redriven", redrove), sl.Err(err))
+		return 1
+	}
+
+	log.Info("re-drove dead-lettered messages", slog.String("topic", topic), slog.Int("redriven", redrove))
+
+	return 0
+}
+
+// replayTopic prints one JSON object per replayed message and exits with 1 if a message
+// failed with an error that may go away on another replay.
+func replayTopic(cfg *config.Config, log *slog.Logger, args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	partition := fs.Int("partition", -1, "partition to replay, all if not set")
+	fromOffset := fs.Int64("from-offset", -1, "first offset to replay in every partition")
+	toOffset := fs.Int64("to-offset", -1, "offset to stop before in every partition")
+	from := fs.String("from", "", "replay messages produced at or after this time")
+	to := fs.String("to", "", "replay messages produced before this time")
+	dryRun := fs.Bool("dry-run", false, "only report which messages would be applied")
+	dsn := fs.String("dsn", "", "database to replay into, the configured one if not set")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	rng := replay.Range{
+		Partition:  *partition,
+		FromOffset: *fromOffset,
+		ToOffset:   *toOffset,
+	}
+
+	var err error
+	for _, t := range []struct {
+		value string
+		dst   *time.Time
+	}{{*from, &rng.From}, {*to, &rng.To}} {
+		if t.value == "" {
+			continue
+		}
+
+		*t.dst, err = time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid time %q: %v\n", t.value, err)
+			return 2
+		}
+	}
+
+	topic := fs.Arg(0)
+
+	legacyType := ""
+	for _, t := range cfg.Consumer.Topics {
+		if t.Name == topic {
+			legacyType = t.Type
+		}
+	}
+
+	target := *cfg
+	if *dsn != "" {
+		target.DataSourceName = *dsn
+	}
+
+	service, repo, err := app.NewService(&target, log)
+	if err != nil {
+		log.Error("failed to initialize service", sl.Err(err))
+		return 1
+	}
+	defer repo.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	outcomes := map[string]int{}
+
+	replayer := replay.New(cfg.Kafka.Brokers, service, *dryRun)
+
+	err = replayer.Replay(context.Background(), topic, legacyType, rng, func(r replay.Result) error {
+		outcomes[r.Outcome]++
+		return enc.Encode(r)
+	})
+	if err != nil {
+		log.Error("failed to replay topic", sl.Err(err))
+		return 1
+	}
+
+	attrs := []any{slog.String("topic", topic), slog.Bool("dry_run", *dryRun)}
+	for outcome, n := range outcomes {
+		attrs = append(attrs, slog.Int(outcome, n))
+	}
+	log.Info("replayed topic", attrs...)
+
+	if outcomes[replay.OutcomeFailed] > 0 {
+		return 1
+	}
+
+	return 0
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
+	"billing/app"
 	"billing/internal/config"
-	"billing/internal/http-server/handlers"
-	"billing/internal/readers/invoiceReader"
-	"billing/internal/readers/withdrawReader"
-	"billing/internal/service"
-	"billing/internal/storage/postgresql"
+	"billing/internal/lib/logger/sl"
+	"bus"
+	"bus/kafka"
+	"bus/memory"
 	"context"
+	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -22,10 +22,19 @@ const (
 )
 
 func main() {
+	// dump-config runs before validation so that it also shows a config that doesn't load
+	if len(os.Args) > 1 && os.Args[1] == "dump-config" {
+		os.Exit(dumpConfig())
+	}
+
 	cfg := config.MustLoad()
 
 	log := setupLogger(cfg.Env)
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, log, os.Args[1:]))
+	}
+
 	log.Info(
 		"starting url-shortener",
 		slog.String("env", cfg.Env),
@@ -33,67 +42,39 @@ func main() {
 	)
 	log.Debug("debug messages are enabled")
 
-	repo, err := postgresql.New(cfg.DataSourceName)
+	publisher, subscriber, err := newBus(cfg)
 	if err != nil {
-		log.Error("failed to initialize storage", err)
+		log.Error("failed to initialize bus", sl.Err(err))
 		os.Exit(1)
 	}
+	defer publisher.Close()
 
-	service := service.New(log, repo, repo, repo, repo)
-
-	withdrawReader := withdrawReader.New(service)
-	invoiceReader := invoiceReader.New(service)
-
-	go withdrawReader.Read()
-	go invoiceReader.Read()
-
-	handler := handlers.New(service, service, service)
-
-	router := handler.InitRoutes()
-
-	log.Info("starting server", slog.String("address", cfg.HTTPServer.Address))
-
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	srv := &http.Server{
-		Addr:        ":" + cfg.HTTPServer.Address,
-		Handler:     router,
-		ReadTimeout: cfg.HTTPServer.Timeout,
-		IdleTimeout: cfg.HTTPServer.IdleTimeout,
+	if err := app.Run(ctx, log, cfg, publisher, subscriber); err != nil {
+		log.Error("failed to run", sl.Err(err))
+		os.Exit(1)
 	}
+}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Error("failed to start server")
+// newBus returns the transport selected by the config.
+func newBus(cfg *config.Config) (bus.Publisher, bus.Subscriber, error) {
+	switch cfg.Bus.Transport {
+	case "kafka":
+		// Every outcome event must be stored by all replicas before its offset is committed
+		publisher, err := kafka.NewPublisher(cfg.Kafka.Brokers, kafka.WriterConfig{RequiredAcks: "all"})
+		if err != nil {
+			return nil, nil, err
 		}
-	}()
-
-	log.Info("server started")
-
-	<-done
-	log.Info("stopping server")
-
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTPServer.Timeout)
-	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Error("failed to stop server", err)
-
-		return
+		return publisher, kafka.NewSubscriber(cfg.Kafka.Brokers), nil
+	case "memory":
+		b := memory.New(cfg.Bus.Partitions)
+		return b, b, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown bus transport %q", cfg.Bus.Transport)
 	}
-
-	log.Info("server stopped")
-
-	// err = repo.CreateWallet()
-	// if err != nil {
-	// 	log.Error("failed to create wallet", err)
-	// 	os.Exit(1)
-	// }
-
-	// var balances []balance.BalanceResponse
-	// balances, err = repo.GetBalance("")
-
 }
 
 func setupLogger(env string) *slog.Logger {
@@ -0,0 +1,194 @@
+package commands
+
+import (
+	"billing/internal/consumer"
+	"billing/internal/events"
+	"billing/internal/lib/balance"
+	"billing/internal/lib/envelope"
+	"billing/internal/lib/iwrequest"
+	"billing/internal/lib/logger/sl"
+	"billing/internal/lib/operation"
+	"billing/internal/lib/transaction"
+	"billing/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Commands handles the invoice and withdraw commands gwapi sends and publishes their
+// outcome to every publisher.
+type Commands struct {
+	log           *slog.Logger
+	billingWorker BillingWorker
+	publishers    []EventPublisher
+}
+
+type BillingWorker interface {
+	Invoice(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error)
+	Withdraw(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error)
+	GetTransaction(id int) (*transaction.Transaction, error)
+	GetBalance(walletID string) ([]balance.BalanceResponse, error)
+}
+
+type EventPublisher interface {
+	Publish(ctx context.Context, e events.Event) error
+}
+
+func New(log *slog.Logger, billingWorker BillingWorker, publishers ...EventPublisher) *Commands {
+	return &Commands{
+		log:           log,
+		billingWorker: billingWorker,
+		publishers:    publishers,
+	}
+}
+
+// Invoice handles envelope.TypeInvoice messages.
+func (c *Commands) Invoice(ctx context.Context, m *consumer.Message) error {
+	const op = "commands.Invoice"
+
+	request, err := iwrequest.Decode(m.Envelope)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", op, consumer.ErrUndecodable, err)
+	}
+
+	transactionID, err := c.billingWorker.Invoice(ctx, request.WalletID, "Invoice", request.Currency, request.Amount)
+
+	return c.processed(ctx, m.OperationID, op, transactionID, err)
+}
+
+// Withdraw handles envelope.TypeWithdraw messages.
+func (c *Commands) Withdraw(ctx context.Context, m *consumer.Message) error {
+	const op = "commands.Withdraw"
+
+	request, err := iwrequest.Decode(m.Envelope)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", op, consumer.ErrUndecodable, err)
+	}
+
+	transactionID, err := c.billingWorker.Withdraw(ctx, request.WalletID, "Withdraw", request.Currency, request.Amount)
+
+	return c.processed(ctx, m.OperationID, op, transactionID, err)
+}
+
+// Failed publishes that a message was dead-lettered. It is passed to consumer.Retries.
+func (c *Commands) Failed(ctx context.Context, m *consumer.Message, cause error) error {
+	const op = "commands.Failed"
+
+	// The payload is reported as far as it can be decoded
+	request, _ := iwrequest.Decode(m.Envelope)
+
+	transactionType := "Invoice"
+	if m.Envelope.Type == envelope.TypeWithdraw {
+		transactionType = "Withdraw"
+	}
+
+	event := events.Rejected(m.OperationID, request.WalletID, transactionType, request.Currency, request.Amount, cause)
+
+	for _, publisher := range c.publishers {
+		err := consumer.UntilDone(ctx, c.log, func() error {
+			return publisher.Publish(ctx, event)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return nil
+}
+
+// processed publishes the outcome of the transaction billing recorded for the message,
+// together with the resulting balance. A redelivered message is published again, since
+// the event may have been lost, and storage.ErrMessageProcessed is passed on to
+// consumer.Dedup.
+func (c *Commands) processed(ctx context.Context, operationID string, op string, transactionID int, err error) error {
+	if err != nil && !errors.Is(err, storage.ErrMessageProcessed) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// A message that was processed before its transaction was recorded has nothing to report
+	if transactionID == 0 {
+		return err
+	}
+
+	var event events.Event
+
+	doneErr := consumer.UntilDone(ctx, c.log, func() error {
+		var err error
+		event, err = c.processedEvent(operationID, transactionID)
+		return err
+	})
+	if doneErr != nil {
+		return fmt.Errorf("%s: %w", op, doneErr)
+	}
+
+	for _, publisher := range c.publishers {
+		doneErr := consumer.UntilDone(ctx, c.log, func() error {
+			return publisher.Publish(ctx, event)
+		})
+		if doneErr != nil {
+			return fmt.Errorf("%s: %w", op, doneErr)
+		}
+	}
+
+	return err
+}
+
+func (c *Commands) processedEvent(operationID string, transactionID int) (events.Event, error) {
+	t, err := c.billingWorker.GetTransaction(transactionID)
+	if err != nil {
+		return events.Event{}, err
+	}
+
+	balances, err := c.billingWorker.GetBalance(t.WalletID)
+	if err != nil {
+		return events.Event{}, err
+	}
+
+	return events.Processed(operationID, *t, balances), nil
+}
+
+// Publishing applies invoices and withdrawals that arrive outside of the consumer, through
+// the HTTP API, and publishes their outcome like the consumer does. Publishing is best
+// effort, so that the caller doesn't wait on an unavailable publisher.
+type Publishing struct {
+	c *Commands
+}
+
+func (c *Commands) Publishing() *Publishing {
+	return &Publishing{c: c}
+}
+
+func (p *Publishing) Invoice(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error) {
+	transactionID, err := p.c.billingWorker.Invoice(ctx, walletID, transactionType, currency, amount)
+	p.publish(ctx, transactionID, err)
+
+	return transactionID, err
+}
+
+func (p *Publishing) Withdraw(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error) {
+	transactionID, err := p.c.billingWorker.Withdraw(ctx, walletID, transactionType, currency, amount)
+	p.publish(ctx, transactionID, err)
+
+	return transactionID, err
+}
+
+func (p *Publishing) publish(ctx context.Context, transactionID int, err error) {
+	const op = "commands.Publishing.publish"
+
+	if transactionID == 0 || (err != nil && !errors.Is(err, storage.ErrMessageProcessed)) {
+		return
+	}
+
+	event, err := p.c.processedEvent(operation.IDFrom(ctx), transactionID)
+	if err != nil {
+		p.c.log.Error("failed to build transaction event", slog.String("op", op), sl.Err(err))
+		return
+	}
+
+	for _, publisher := range p.c.publishers {
+		if err := publisher.Publish(ctx, event); err != nil {
+			p.c.log.Error("failed to publish transaction event", slog.String("op", op), slog.Int("transaction_id", transactionID), sl.Err(err))
+		}
+	}
+}
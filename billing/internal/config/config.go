@@ -1,41 +1,234 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
+// Config is read from the YAML file at CONFIG_PATH, if set. Environment variables override
+// the file, e.g. HTTP_SERVER_ADDRESS or KAFKA_BROKERS=a:9092,b:9092; the consumed topics can
+// only be set in the file.
 type Config struct {
-	Env            string `yaml:"env" env-default:"local"`
-	DataSourceName string `yaml:"data_source_name" env-default:"postgres://postgres:postgres@db:5432/postgres?sslmode=disable"`
-	HTTPServer     `yaml:"http_server"`
+	Env            string `yaml:"env" env:"ENV" env-default:"local"`
+	DataSourceName string `yaml:"data_source_name" env:"DATA_SOURCE_NAME" env-default:"postgres://postgres:postgres@db:5432/postgres?sslmode=disable"`
+	HTTPServer     `yaml:"http_server" env-prefix:"HTTP_SERVER_"`
+	Interest       `yaml:"interest" env-prefix:"INTEREST_"`
+	Chain          `yaml:"chain" env-prefix:"CHAIN_"`
+	Bus            `yaml:"bus" env-prefix:"BUS_"`
+	Kafka          `yaml:"kafka" env-prefix:"KAFKA_"`
+	Events         `yaml:"events" env-prefix:"EVENTS_"`
+	Retry          `yaml:"retry" env-prefix:"RETRY_"`
+	Consumer       `yaml:"consumer" env-prefix:"CONSUMER_"`
+	DeadLetter     `yaml:"dead_letter" env-prefix:"DEAD_LETTER_"`
+	Webhooks       `yaml:"webhooks" env-prefix:"WEBHOOKS_"`
 }
 
 type HTTPServer struct {
-	Address     string        `yaml:"address"`
-	Timeout     time.Duration `yaml:"timeout"`
-	IdleTimeout time.Duration `yaml:"idle-timeout"`
+	Address     string        `yaml:"address" env:"ADDRESS" env-default:"8081"`
+	Timeout     time.Duration `yaml:"timeout" env:"TIMEOUT" env-default:"4s"`
+	IdleTimeout time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT" env-default:"60s"`
 }
 
+type Interest struct {
+	Enabled  bool          `yaml:"enabled" env:"ENABLED"`
+	Interval time.Duration `yaml:"interval" env:"INTERVAL" env-default:"1h"`
+}
+
+// Chain configures signing of the transaction hash chain heads. Signing is off unless
+// SigningKeyPath points to a PEM encoded PKCS #8 Ed25519 private key.
+type Chain struct {
+	SigningKeyPath string        `yaml:"signing_key_path" env:"SIGNING_KEY_PATH"`
+	SignInterval   time.Duration `yaml:"sign_interval" env:"SIGN_INTERVAL" env-default:"1h"`
+}
+
+// Bus selects the message transport, "kafka" or "memory". The in-process memory
+// transport needs no broker but loses its messages on exit, it's meant for local
+// development and tests.
+type Bus struct {
+	Transport  string `yaml:"transport" env:"TRANSPORT" env-default:"kafka"`
+	Partitions int    `yaml:"partitions" env:"PARTITIONS" env-default:"6"`
+}
+
+// Kafka configures the brokers and the encoding of the messages billing produces, "json"
+// or "protobuf". Consumed messages are decoded by their content-type header.
+type Kafka struct {
+	Brokers  []string `yaml:"brokers" env:"BROKERS" env-default:"kafka:9093"`
+	Encoding string   `yaml:"encoding" env:"ENCODING" env-default:"json"`
+}
+
+// Events configures the topic billing publishes the outcome of every command to.
+type Events struct {
+	Topic string `yaml:"topic" env:"TOPIC" env-default:"transaction-events"`
+}
+
+// Retry configures the retry topics of messages that failed with a transient error.
+// Attempt n is delayed by Backoff * 2^(n-1), capped at MaxBackoff.
+type Retry struct {
+	MaxAttempts int           `yaml:"max_attempts" env:"MAX_ATTEMPTS" env-default:"5"`
+	Backoff     time.Duration `yaml:"backoff" env:"BACKOFF" env-default:"1s"`
+	MaxBackoff  time.Duration `yaml:"max_backoff" env:"MAX_BACKOFF" env-default:"5m"`
+}
+
+// Consumer configures the consumed topics and how many messages of a topic are handled
+// in parallel. Messages of the same wallet are always handled one after another.
+// QueueSize is how many messages a worker holds before the fetching waits for it.
+type Consumer struct {
+	Workers   int     `yaml:"workers" env:"WORKERS" env-default:"8"`
+	QueueSize int     `yaml:"queue_size" env:"QUEUE_SIZE" env-default:"16"`
+	Topics    []Topic `yaml:"topics"`
+}
+
+// Topic is a consumed topic. Type is the message type of the bare payloads on it that
+// were produced before the envelope.
+type Topic struct {
+	Name    string `yaml:"name"`
+	GroupID string `yaml:"group_id"`
+	Type    string `yaml:"type"`
+}
+
+// DeadLetter configures the dlq admin commands. RedriveGroupID is the consumer group that
+// remembers which dead-lettered messages were re-driven already.
+type DeadLetter struct {
+	RedriveGroupID string `yaml:"redrive_group_id" env:"REDRIVE_GROUP_ID" env-default:"billing-dlq-redrive"`
+}
+
+// defaultTopics are consumed if the config lists none.
+var defaultTopics = []Topic{
+	{Name: "invoices", GroupID: "10", Type: "invoice"},
+	{Name: "withdraws", GroupID: "11", Type: "withdraw"},
+}
+
+// Webhooks configures the delivery of transaction events to subscribed endpoints. Attempt
+// n of a delivery is delayed by Backoff * 2^(n-1), capped at MaxBackoff.
+type Webhooks struct {
+	Enabled     bool          `yaml:"enabled" env:"ENABLED"`
+	Interval    time.Duration `yaml:"interval" env:"INTERVAL" env-default:"1s"`
+	Timeout     time.Duration `yaml:"timeout" env:"TIMEOUT" env-default:"10s"`
+	MaxAttempts int           `yaml:"max_attempts" env:"MAX_ATTEMPTS" env-default:"8"`
+	Backoff     time.Duration `yaml:"backoff" env:"BACKOFF" env-default:"10s"`
+	MaxBackoff  time.Duration `yaml:"max_backoff" env:"MAX_BACKOFF" env-default:"1h"`
+}
+
+// MustLoad reads and validates the config and exits with the problems found if it is
+// invalid.
 func MustLoad() *Config {
-	//env
-	configPath := os.Getenv("CONFIG_PATH")
-	if configPath == "" {
-		log.Fatal("CONFIG_PATH is not set")
+	cfg, err := Load()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// check if file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		log.Fatalf("config file does not exist: %s", configPath)
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid config:\n%s", err)
 	}
 
-	var cfg Config
-	if err := cleanenv.ReadConfig(configPath, &cfg); err != nil {
-		log.Fatalf("cannot read config: %s", err)
+	return cfg
+}
+
+// Load reads the config from CONFIG_PATH, or from the environment alone if it is not set,
+// without validating it.
+func Load() (*Config, error) {
+	return LoadFile(os.Getenv("CONFIG_PATH"))
+}
+
+// LoadFile reads the config from the file at configPath, or from the environment alone if
+// it is empty, without validating it.
+func LoadFile(configPath string) (*Config, error) {
+	// cleanenv would replace a false from the file with an env-default of true, so
+	// switches that are on by default are set before the file is read
+	cfg := Config{
+		Interest: Interest{Enabled: true},
+		Webhooks: Webhooks{Enabled: true},
+	}
+
+	if configPath != "" {
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			return nil, fmt.Errorf("config file does not exist: %s", configPath)
+		}
+
+		if err := cleanenv.ReadConfig(configPath, &cfg); err != nil {
+			return nil, fmt.Errorf("cannot read config: %w", err)
+		}
+	} else if err := cleanenv.ReadEnv(&cfg); err != nil {
+		return nil, fmt.Errorf("cannot read config from the environment: %w", err)
+	}
+
+	if len(cfg.Consumer.Topics) == 0 {
+		cfg.Consumer.Topics = defaultTopics
+	}
+
+	return &cfg, nil
+}
+
+// Validate returns every problem of the config, one per line, named by its YAML key.
+func (c *Config) Validate() error {
+	var errs []error
+
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.DataSourceName != "", "data_source_name is required")
+
+	check(c.HTTPServer.Address != "", "http_server.address is required")
+	check(c.HTTPServer.Timeout > 0, "http_server.timeout must be positive")
+	check(c.HTTPServer.IdleTimeout > 0, "http_server.idle_timeout must be positive")
+
+	check(!c.Interest.Enabled || c.Interest.Interval > 0, "interest.interval must be positive")
+	check(c.Chain.SigningKeyPath == "" || c.Chain.SignInterval > 0, "chain.sign_interval must be positive")
+
+	check(c.Bus.Transport == "kafka" || c.Bus.Transport == "memory", "bus.transport must be kafka or memory, got %q", c.Bus.Transport)
+	check(c.Bus.Partitions > 0, "bus.partitions must be positive")
+
+	check(c.Bus.Transport != "kafka" || len(c.Kafka.Brokers) > 0, "kafka.brokers is required")
+	for i, broker := range c.Kafka.Brokers {
+		check(broker != "", "kafka.brokers[%d] is empty", i)
+	}
+	check(c.Kafka.Encoding == "json" || c.Kafka.Encoding == "protobuf", "kafka.encoding must be json or protobuf, got %q", c.Kafka.Encoding)
+
+	check(c.Events.Topic != "", "events.topic is required")
+
+	check(c.Retry.MaxAttempts > 0, "retry.max_attempts must be positive")
+	check(c.Retry.Backoff > 0, "retry.backoff must be positive")
+	check(c.Retry.MaxBackoff >= c.Retry.Backoff, "retry.max_backoff must not be less than retry.backoff")
+
+	check(c.Consumer.Workers > 0, "consumer.workers must be positive")
+	check(c.Consumer.QueueSize > 0, "consumer.queue_size must be positive")
+	seen := map[string]bool{}
+	for i, topic := range c.Consumer.Topics {
+		check(topic.Name != "", "consumer.topics[%d].name is required", i)
+		check(topic.GroupID != "", "consumer.topics[%d].group_id is required", i)
+		check(topic.Name != c.Events.Topic, "consumer.topics[%d].name must not be the events topic", i)
+		check(!seen[topic.Name], "consumer.topics[%d].name %q is listed twice", i, topic.Name)
+		seen[topic.Name] = true
+	}
+
+	check(c.DeadLetter.RedriveGroupID != "", "dead_letter.redrive_group_id is required")
+
+	if c.Webhooks.Enabled {
+		check(c.Webhooks.Interval > 0, "webhooks.interval must be positive")
+		check(c.Webhooks.Timeout > 0, "webhooks.timeout must be positive")
+		check(c.Webhooks.MaxAttempts > 0, "webhooks.max_attempts must be positive")
+		check(c.Webhooks.Backoff > 0, "webhooks.backoff must be positive")
+		check(c.Webhooks.MaxBackoff >= c.Webhooks.Backoff, "webhooks.max_backoff must not be less than webhooks.backoff")
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the config that is safe to print: the database password is
+// masked.
+func (c Config) Redacted() Config {
+	if u, err := url.Parse(c.DataSourceName); err == nil && u.User != nil {
+		c.DataSourceName = u.Redacted()
 	}
 
-	return &cfg
+	return c
 }
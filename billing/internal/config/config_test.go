@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadFileSwitches(t *testing.T) {
+	tests := []struct {
+		name         string
+		file         string
+		wantInterest bool
+		wantWebhooks bool
+	}{
+		{"default", "env: local\n", true, true},
+		{"interest disabled", "interest:\n  enabled: false\n", false, true},
+		{"webhooks disabled", "webhooks:\n  enabled: false\n", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Interest.Enabled != tt.wantInterest {
+				t.Errorf("interest.enabled = %t, want %t", cfg.Interest.Enabled, tt.wantInterest)
+			}
+			if cfg.Webhooks.Enabled != tt.wantWebhooks {
+				t.Errorf("webhooks.enabled = %t, want %t", cfg.Webhooks.Enabled, tt.wantWebhooks)
+			}
+		})
+	}
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("INTEREST_ENABLED", "false")
+
+		cfg, err := LoadFile("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Interest.Enabled {
+			t.Error("INTEREST_ENABLED=false is ignored")
+		}
+	})
+}
@@ -0,0 +1,200 @@
+package consumer
+
+import (
+	"billing/internal/lib/envelope"
+	"billing/internal/lib/logger/sl"
+	"billing/internal/lib/operation"
+	"billing/internal/retry"
+	"billing/internal/workerpool"
+	"bus"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUndecodable marks messages that can't be decoded. They are dead-lettered at once.
+	ErrUndecodable = errors.New("undecodable message")
+	ErrUnknownType = errors.New("no handler for message type")
+)
+
+// Message is a consumed message with its envelope decoded.
+type Message struct {
+	bus.Message
+
+	Envelope    envelope.Envelope
+	OperationID string
+
+	decodeErr error
+}
+
+type HandlerFunc func(ctx context.Context, m *Message) error
+
+// Middleware wraps the handling of every message, whatever its type.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Topic is a topic to consume. LegacyType is the message type of the bare payloads that
+// were produced before the envelope.
+type Topic struct {
+	Name       string
+	GroupID    string
+	LegacyType string
+}
+
+// Consumer consumes topics and their retry topics, and routes every message to the
+// handler registered for its message type through the middleware.
+type Consumer struct {
+	log           *slog.Logger
+	subscriber    bus.Subscriber
+	workers       int
+	queueSize     int
+	retryAttempts int
+	handlers      map[string]HandlerFunc
+	middleware    []Middleware
+}
+
+func New(log *slog.Logger, subscriber bus.Subscriber, workers int, queueSize int, retryAttempts int) *Consumer {
+	return &Consumer{
+		log:           log,
+		subscriber:    subscriber,
+		workers:       workers,
+		queueSize:     queueSize,
+		retryAttempts: retryAttempts,
+		handlers:      map[string]HandlerFunc{},
+	}
+}
+
+// Handle registers the handler of a message type.
+func (c *Consumer) Handle(messageType string, handler HandlerFunc) {
+	c.handlers[messageType] = handler
+}
+
+// Use appends middleware. The first middleware is the outermost.
+func (c *Consumer) Use(middleware ...Middleware) {
+	c.middleware = append(c.middleware, middleware...)
+}
+
+// Run consumes the topic and each of its retry topics until ctx is done.
+func (c *Consumer) Run(ctx context.Context, topic Topic) {
+	handler := c.route
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		handler = c.middleware[i](handler)
+	}
+
+	var wg sync.WaitGroup
+
+	consume := func(name string, groupID string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.consume(ctx, name, groupID, topic.LegacyType, handler)
+		}()
+	}
+
+	consume(topic.Name, topic.GroupID)
+	for attempt := 1; attempt <= c.retryAttempts; attempt++ {
+		consume(retry.Topic(topic.Name, attempt), fmt.Sprintf("%s-retry-%d", topic.GroupID, attempt))
+	}
+
+	wg.Wait()
+}
+
+func (c *Consumer) consume(ctx context.Context, topic string, groupID string, legacyType string, handler HandlerFunc) {
+	log := c.log.With(slog.String("topic", topic), slog.String("group_id", groupID))
+
+	subscription := c.subscriber.Subscribe(topic, groupID)
+	defer subscription.Close()
+
+	// Workers commit the offsets once the messages were handled
+	pool := workerpool.New(ctx, log, c.workers, c.queueSize, subscription, func(ctx context.Context, message bus.Message) error {
+		return handler(ctx, decode(message, legacyType))
+	})
+	defer pool.Close()
+
+	for {
+		// Fetch without committing, the offset is committed once the message was handled
+		message, err := subscription.Fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Error("failed to fetch message", sl.Err(err))
+			continue
+		}
+
+		// Messages from a retry topic are held back until their attempt is due
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(retry.NotBefore(message))):
+		}
+
+		pool.Submit(message)
+	}
+}
+
+// route calls the handler of the message's type.
+func (c *Consumer) route(ctx context.Context, m *Message) error {
+	if m.decodeErr != nil {
+		return m.decodeErr
+	}
+
+	handler, ok := c.handlers[m.Envelope.Type]
+	if !ok {
+		return fmt.Errorf("%w: %w: %q", ErrUndecodable, ErrUnknownType, m.Envelope.Type)
+	}
+
+	return handler(ctx, m)
+}
+
+// decode unwraps the envelope by the content-type header. A decoding error is kept on the
+// message, so that the middleware sees it like any other failure.
+func decode(message bus.Message, legacyType string) *Message {
+	m := &Message{Message: message}
+	m.OperationID = m.Header(operation.HeaderID)
+
+	env, err := envelope.Decode(message.Value, m.Header(envelope.HeaderContentType), legacyType)
+	if err != nil {
+		m.decodeErr = fmt.Errorf("%w: %w", ErrUndecodable, err)
+		return m
+	}
+
+	m.Envelope = env
+
+	// The envelope ID is the gateway's operation ID
+	if m.OperationID == "" {
+		m.OperationID = env.ID
+	}
+
+	return m
+}
+
+// UntilDone retries fn with backoff until it succeeds or ctx is done. It is used for
+// writes that have to happen before the offset of a message can be committed; it returns
+// ctx.Err() if they didn't, so that the message is left uncommitted.
+func UntilDone(ctx context.Context, log *slog.Logger, fn func() error) error {
+	backoff := minBackoff
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		log.Error("retrying", slog.Duration("backoff", backoff), sl.Err(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
@@ -0,0 +1,485 @@
+package consumer
+
+import (
+	"billing/internal/deadletter"
+	"billing/internal/lib/envelope"
+	"billing/internal/lib/message"
+	"billing/internal/retry"
+	"billing/internal/storage"
+	"bus"
+	"bus/memory"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const maxAttempts = 2
+
+var invoices = Topic{Name: "invoices", GroupID: "billing", LegacyType: envelope.TypeInvoice}
+
+func discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// recorder keeps what the handler saw of every call.
+type recorder struct {
+	mu    sync.Mutex
+	calls []call
+	ch    chan struct{}
+}
+
+type call struct {
+	key       string
+	topic     string
+	attempt   int
+	messageID string
+}
+
+func newRecorder() *recorder {
+	return &recorder{ch: make(chan struct{}, 100)}
+}
+
+func (r *recorder) record(ctx context.Context, m *Message) call {
+	c := call{key: string(m.Key), topic: m.Topic, attempt: retry.Attempt(m.Message), messageID: message.IDFrom(ctx)}
+
+	r.mu.Lock()
+	r.calls = append(r.calls, c)
+	r.mu.Unlock()
+
+	r.ch <- struct{}{}
+
+	return c
+}
+
+func (r *recorder) get() []call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]call(nil), r.calls...)
+}
+
+// wait waits for n more calls.
+func (r *recorder) wait(t *testing.T, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("handler called %d times, waited for %d more", len(r.get()), n-i)
+		}
+	}
+}
+
+// start runs the consumer on the memory bus. The returned stop cancels it and waits until
+// every fetched message went through the middleware.
+func start(c *Consumer) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		c.Run(ctx, invoices)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// newConsumer returns a consumer with the middleware of the billing service. onFailed
+// collects the errors of the dead-lettered messages.
+func newConsumer(b *memory.Bus, failed *[]error) *Consumer {
+	var mu sync.Mutex
+
+	onFailed := func(ctx context.Context, m *Message, cause error) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		*failed = append(*failed, cause)
+		return nil
+	}
+
+	retries := retry.NewWriter(b, retry.Policy{MaxAttempts: maxAttempts, Backoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	c := New(discard(), b, 2, 4, maxAttempts)
+	c.Use(
+		Retries(discard(), retries, deadletter.NewWriter(b), onFailed),
+		Logging(discard()),
+		Metrics(),
+		AuditContext(),
+		Dedup(discard()),
+	)
+
+	return c
+}
+
+func publish(t *testing.T, b *memory.Bus, key string, value string, headers ...bus.Header) {
+	t.Helper()
+
+	err := b.Publish(context.Background(), bus.Message{Topic: invoices.Name, Key: []byte(key), Value: []byte(value), Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func invoice(walletID string) string {
+	return fmt.Sprintf(`{"wallet_id":%q,"currency":"USD","amount":10}`, walletID)
+}
+
+// fetch returns the next message of the topic.
+func fetch(t *testing.T, b *memory.Bus, topic string) bus.Message {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub := b.Subscribe(topic, "test")
+	defer sub.Close()
+
+	m, err := sub.Fetch(ctx)
+	if err != nil {
+		t.Fatalf("fetch from %s: %v", topic, err)
+	}
+
+	return m
+}
+
+func assertEmpty(t *testing.T, b *memory.Bus, topic string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	sub := b.Subscribe(topic, "test")
+	defer sub.Close()
+
+	if m, err := sub.Fetch(ctx); err == nil {
+		t.Errorf("%s has message %s", topic, m.Value)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	b := memory.New(1)
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	trace := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		events = append(events, event)
+	}
+
+	layer := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, m *Message) error {
+				trace(name + " before")
+				err := next(ctx, m)
+				trace(name + " after")
+				return err
+			}
+		}
+	}
+
+	r := newRecorder()
+
+	c := New(discard(), b, 1, 1, maxAttempts)
+	c.Use(layer("a"), layer("b"))
+	c.Use(layer("c"))
+	c.Handle(envelope.TypeInvoice, func(ctx context.Context, m *Message) error {
+		trace("handler")
+		r.record(ctx, m)
+		return nil
+	})
+
+	stop := start(c)
+	publish(t, b, "w-1", invoice("w-1"))
+	r.wait(t, 1)
+	stop()
+
+	want := []string{"a before", "b before", "c before", "handler", "c after", "b after", "a after"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
+
+// TestDedupAcrossRetries has the first attempt apply the change but fail afterwards, as
+// when the connection drops before the commit is acknowledged. The retry must carry the
+// same message ID, so storage recognises it.
+func TestDedupAcrossRetries(t *testing.T) {
+	b := memory.New(1)
+	r := newRecorder()
+
+	var (
+		mu        sync.Mutex
+		processed = map[string]bool{}
+	)
+
+	var failed []error
+	c := newConsumer(b, &failed)
+	c.Handle(envelope.TypeInvoice, func(ctx context.Context, m *Message) error {
+		call := r.record(ctx, m)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if processed[call.messageID] {
+			return fmt.Errorf("storage.PerformInvoiceTransaction: %w", storage.ErrMessageProcessed)
+		}
+		processed[call.messageID] = true
+
+		if call.key == "w-2" && call.attempt == 0 {
+			return errors.New("connection reset by peer")
+		}
+
+		return nil
+	})
+
+	stop := start(c)
+
+	// The second message is at offset 1 of invoices and at offset 0 of its retry topic
+	publish(t, b, "w-1", invoice("w-1"))
+	publish(t, b, "w-2", invoice("w-2"))
+	r.wait(t, 3)
+	stop()
+
+	var retried []call
+	for _, c := range r.get() {
+		if c.key == "w-2" {
+			retried = append(retried, c)
+		}
+	}
+
+	if len(retried) != 2 {
+		t.Fatalf("w-2 handled %d times, want 2: %+v", len(retried), r.get())
+	}
+	if retried[1].topic != retry.Topic(invoices.Name, 1) || retried[1].attempt != 1 {
+		t.Errorf("retry = %+v", retried[1])
+	}
+	if want := message.ID("", invoices.Name, 0, 1); retried[0].messageID != want || retried[1].messageID != want {
+		t.Errorf("message IDs %q and %q, want %q for both", retried[0].messageID, retried[1].messageID, want)
+	}
+
+	// The redelivery counts as handled, it is neither retried again nor dead-lettered
+	assertEmpty(t, b, retry.Topic(invoices.Name, 2))
+	assertEmpty(t, b, deadletter.Topic(invoices.Name))
+	if len(failed) != 0 {
+		t.Errorf("failed = %v", failed)
+	}
+}
+
+func TestDedupPrefersOperationID(t *testing.T) {
+	b := memory.New(1)
+	r := newRecorder()
+
+	var failed []error
+	c := newConsumer(b, &failed)
+	c.Handle(envelope.TypeInvoice, func(ctx context.Context, m *Message) error {
+		if call := r.record(ctx, m); call.attempt == 0 {
+			return errors.New("connection reset by peer")
+		}
+		return nil
+	})
+
+	stop := start(c)
+	publish(t, b, "w-1", `{"id":"op-1","type":"invoice","version":1,"payload":{"wallet_id":"w-1","currency":"USD","amount":10}}`)
+	r.wait(t, 2)
+	stop()
+
+	for _, c := range r.get() {
+		if c.messageID != "op-1" {
+			t.Errorf("attempt %d has message ID %q, want op-1", c.attempt, c.messageID)
+		}
+	}
+}
+
+func TestRetryOrDeadLetter(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		headers    []bus.Header
+		err        error
+		wantCalls  int
+		wantReason string
+	}{
+		{
+			name:       "rejected",
+			value:      invoice("w-1"),
+			err:        fmt.Errorf("storage.PerformInvoiceTransaction: %w", storage.ErrWalletNotFound),
+			wantCalls:  1,
+			wantReason: deadletter.ReasonRejected,
+		},
+		{
+			name:       "transient until the attempts are used up",
+			value:      invoice("w-1"),
+			err:        errors.New("connection reset by peer"),
+			wantCalls:  1 + maxAttempts,
+			wantReason: deadletter.ReasonRetriesExhausted,
+		},
+		{
+			name:       "unknown content type",
+			value:      invoice("w-1"),
+			headers:    []bus.Header{{Key: envelope.HeaderContentType, Value: []byte("text/plain")}},
+			wantCalls:  0,
+			wantReason: deadletter.ReasonUndecodable,
+		},
+		{
+			name:       "malformed value",
+			value:      `{"wallet_id":`,
+			wantCalls:  0,
+			wantReason: deadletter.ReasonUndecodable,
+		},
+		{
+			name:       "unknown message type",
+			value:      `{"id":"op-1","type":"refund","version":1,"payload":{}}`,
+			wantCalls:  0,
+			wantReason: deadletter.ReasonUndecodable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := memory.New(1)
+			r := newRecorder()
+
+			var failed []error
+			c := newConsumer(b, &failed)
+			c.Handle(envelope.TypeInvoice, func(ctx context.Context, m *Message) error {
+				r.record(ctx, m)
+				return tt.err
+			})
+
+			stop := start(c)
+			publish(t, b, "w-1", tt.value, tt.headers...)
+
+			dead := fetch(t, b, deadletter.Topic(invoices.Name))
+			stop()
+
+			if got := dead.Header(deadletter.HeaderReason); got != tt.wantReason {
+				t.Errorf("reason = %q, want %q", got, tt.wantReason)
+			}
+			if dead.Header(deadletter.HeaderOriginalTopic) != invoices.Name || dead.Header(deadletter.HeaderOriginalOffset) != "0" {
+				t.Errorf("dead letter doesn't point at the original: %+v", dead.Headers)
+			}
+			if string(dead.Value) != tt.value {
+				t.Errorf("value = %s, want %s", dead.Value, tt.value)
+			}
+
+			calls := r.get()
+			if len(calls) != tt.wantCalls {
+				t.Fatalf("handler called %d times, want %d", len(calls), tt.wantCalls)
+			}
+			for i, c := range calls {
+				want := invoices.Name
+				if i > 0 {
+					want = retry.Topic(invoices.Name, i)
+				}
+				if c.topic != want || c.attempt != i {
+					t.Errorf("call %d = %+v, want attempt %d from %s", i, c, i, want)
+				}
+			}
+			if tt.wantCalls > 1 {
+				if got := dead.Header(retry.HeaderAttempt); got != strconv.Itoa(tt.wantCalls-1) {
+					t.Errorf("dead-lettered after attempt %s, want %d", got, tt.wantCalls-1)
+				}
+			}
+
+			assertEmpty(t, b, retry.Topic(invoices.Name, maxAttempts+1))
+			if len(failed) != 1 {
+				t.Errorf("onFailed called %d times, want 1", len(failed))
+			}
+		})
+	}
+}
+
+func TestUntilDone(t *testing.T) {
+	attempts := 0
+	err := UntilDone(context.Background(), discard(), func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("broker down")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("UntilDone() = %v after %d attempts, want nil after 3", err, attempts)
+	}
+}
+
+func TestUntilDoneStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	err := UntilDone(ctx, discard(), func() error {
+		return errors.New("broker down")
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("UntilDone() = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("UntilDone() returned after %s", elapsed)
+	}
+}
+
+// TestShutdown stops the consumer while the handler waits on a database that doesn't
+// answer. The handler sees the cancellation and the message is neither retried nor
+// dead-lettered, so it is delivered again after the restart.
+func TestShutdown(t *testing.T) {
+	b := memory.New(1)
+	r := newRecorder()
+
+	var failed []error
+	c := newConsumer(b, &failed)
+	c.Handle(envelope.TypeInvoice, func(ctx context.Context, m *Message) error {
+		r.record(ctx, m)
+
+		<-ctx.Done()
+		return fmt.Errorf("storage.PerformInvoiceTransaction: %w", ctx.Err())
+	})
+
+	stop := start(c)
+	publish(t, b, "w-1", invoice("w-1"))
+	r.wait(t, 1)
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumer didn't stop")
+	}
+
+	assertEmpty(t, b, retry.Topic(invoices.Name, 1))
+	assertEmpty(t, b, deadletter.Topic(invoices.Name))
+	if len(failed) != 0 {
+		t.Errorf("failed = %v", failed)
+	}
+
+	// The offset wasn't committed, the group gets the message again
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	sub := b.Subscribe(invoices.Name, invoices.GroupID)
+	defer sub.Close()
+
+	if m, err := sub.Fetch(ctx); err != nil || string(m.Value) != invoice("w-1") {
+		t.Errorf("Fetch() = %s, %v, want the message again", m.Value, err)
+	}
+}
@@ -0,0 +1,180 @@
+package consumer
+
+import (
+	"billing/internal/deadletter"
+	"billing/internal/lib/audit"
+	"billing/internal/lib/logger/sl"
+	"billing/internal/lib/message"
+	"billing/internal/lib/operation"
+	"billing/internal/retry"
+	"billing/internal/storage"
+	"bus"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// metrics counts messages per topic and outcome, published under "consumer" in
+// /debug/vars.
+var metrics = expvar.NewMap("consumer")
+
+type DeadLetterWriter interface {
+	Send(ctx context.Context, message bus.Message, reason string, cause error) error
+}
+
+// RetryWriter schedules another attempt of a message and reports false once the message
+// used up its attempts.
+type RetryWriter interface {
+	Send(ctx context.Context, message bus.Message, cause error) (bool, error)
+}
+
+// Retries hands failed messages on to the next retry topic if the failure is transient,
+// and to the dead-letter topic otherwise or once the attempts are used up. onFailed is
+// called for every message that is dead-lettered. Both writes are retried until they
+// succeed, because the offset of the message is committed afterwards. Once ctx is done
+// the message is neither retried nor dead-lettered, and ctx.Err() is returned so that its
+// offset isn't committed.
+func Retries(log *slog.Logger, retries RetryWriter, deadLetters DeadLetterWriter, onFailed func(ctx context.Context, m *Message, cause error) error) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, m *Message) error {
+			err := next(ctx, m)
+			if err == nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			log := log.With(slog.String("topic", m.Topic), slog.Int("partition", m.Partition), slog.Int64("offset", m.Offset))
+
+			reason := deadletter.ReasonRejected
+
+			switch {
+			case errors.Is(err, ErrUndecodable):
+				reason = deadletter.ReasonUndecodable
+			case retry.IsTransient(err):
+				var scheduled bool
+
+				doneErr := UntilDone(ctx, log, func() error {
+					var sendErr error
+					scheduled, sendErr = retries.Send(ctx, m.Message, err)
+					return sendErr
+				})
+				if doneErr != nil {
+					return doneErr
+				}
+
+				if scheduled {
+					metrics.Add(m.Topic+".retried", 1)
+					log.Warn("scheduled retry", slog.Int("attempt", retry.Attempt(m.Message)+1), sl.Err(err))
+					return nil
+				}
+
+				reason = deadletter.ReasonRetriesExhausted
+			}
+
+			log.Error("dead-lettering message", slog.String("reason", reason), sl.Err(err))
+
+			doneErr := UntilDone(ctx, log, func() error {
+				return deadLetters.Send(ctx, m.Message, reason, err)
+			})
+			if doneErr != nil {
+				return doneErr
+			}
+
+			metrics.Add(m.Topic+".dead_lettered", 1)
+
+			if onFailed != nil {
+				return onFailed(ctx, m, err)
+			}
+
+			return nil
+		}
+	}
+}
+
+// Logging logs every handled message.
+func Logging(log *slog.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, m *Message) error {
+			start := time.Now()
+
+			err := next(ctx, m)
+
+			attrs := []any{
+				slog.String("topic", m.Topic),
+				slog.Int("partition", m.Partition),
+				slog.Int64("offset", m.Offset),
+				slog.String("type", m.Envelope.Type),
+				slog.String("operation_id", m.OperationID),
+				slog.Duration("duration", time.Since(start)),
+			}
+
+			if err != nil {
+				log.Warn("message failed", append(attrs, sl.Err(err))...)
+			} else {
+				log.Debug("message handled", attrs...)
+			}
+
+			return err
+		}
+	}
+}
+
+// Metrics counts handled and failed messages per topic.
+func Metrics() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, m *Message) error {
+			err := next(ctx, m)
+
+			metrics.Add(m.Topic+".handled", 1)
+			if err != nil {
+				metrics.Add(m.Topic+".failed", 1)
+			}
+
+			return err
+		}
+	}
+}
+
+// AuditContext records the message as the source of the changes it makes, with the
+// actor and operation ID the producer sent.
+func AuditContext() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, m *Message) error {
+			actor := m.Header("actor")
+			if actor == "" {
+				actor = "kafka"
+			}
+
+			ctx = audit.WithSource(ctx, fmt.Sprintf("kafka:%s/%d@%d", m.Topic, m.Partition, m.Offset))
+			ctx = audit.WithActor(ctx, actor)
+			ctx = operation.WithID(ctx, m.OperationID)
+
+			return next(ctx, m)
+		}
+	}
+}
+
+// Dedup gives the message an ID that storage records in the same database transaction as
+// the change it makes. A redelivered message is recognised by it and counts as handled.
+func Dedup(log *slog.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, m *Message) error {
+			topic, partition, offset := retry.Origin(m.Message)
+			id := message.ID(m.OperationID, topic, partition, offset)
+
+			err := next(message.WithID(ctx, id), m)
+			if errors.Is(err, storage.ErrMessageProcessed) {
+				metrics.Add(m.Topic+".duplicates", 1)
+				log.Info("skipped redelivered message", slog.String("message_id", id), slog.String("topic", m.Topic), slog.Int64("offset", m.Offset))
+				return nil
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package deadletter
+
+import (
+	"billing/internal/retry"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// The admin commands read partitions and offsets, so unlike Writer they talk to Kafka
+// directly instead of through the bus.
+
+// Message is a dead-lettered message as shown by the admin command.
+type Message struct {
+	Partition         int               `json:"partition"`
+	Offset            int64             `json:"offset"`
+	Key               string            `json:"key,omitempty"`
+	Value             string            `json:"value"`
+	Reason            string            `json:"reason"`
+	Error             string            `json:"error"`
+	OriginalTopic     string            `json:"original_topic"`
+	OriginalPartition int               `json:"original_partition"`
+	OriginalOffset    int64             `json:"original_offset"`
+	FailedAt          time.Time         `json:"failed_at"`
+	Headers           map[string]string `json:"headers,omitempty"`
+}
+
+// List calls fn for up to limit messages of the dead-letter topic of topic, partition by
+// partition. A limit of 0 lists every message.
+func List(ctx context.Context, brokers []string, topic string, limit int, fn func(Message) error) error {
+	const op = "deadletter.List"
+
+	dlq := Topic(topic)
+
+	partitions, err := readPartitions(ctx, brokers, dlq)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	listed := 0
+	for _, partition := range partitions {
+		first, last, err := readOffsets(ctx, brokers, dlq, partition)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		if first >= last {
+			continue
+		}
+
+		err = readRange(ctx, brokers, dlq, partition, first, last, func(m kafka.Message) (bool, error) {
+			if err := fn(decode(m)); err != nil {
+				return false, err
+			}
+
+			listed++
+
+			return limit == 0 || listed < limit, nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		if limit > 0 && listed >= limit {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Redrive publishes the dead-lettered message at partition and offset to its original
+// topic again.
+func Redrive(ctx context.Context, brokers []string, topic string, partition int, offset int64) (Message, error) {
+	const op = "deadletter.Redrive"
+
+	first, last, err := readOffsets(ctx, brokers, Topic(topic), partition)
+	if err != nil {
+		return Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if offset < first || offset >= last {
+		return Message{}, fmt.Errorf("%s: no message at partition %d offset %d", op, partition, offset)
+	}
+
+	var found *kafka.Message
+
+	err = readRange(ctx, brokers, Topic(topic), partition, offset, offset+1, func(m kafka.Message) (bool, error) {
+		if m.Offset == offset {
+			found = &m
+		}
+
+		return false, nil
+	})
+	if err != nil {
+		return Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if found == nil {
+		return Message{}, fmt.Errorf("%s: no message at partition %d offset %d", op, partition, offset)
+	}
+
+	writer := newRedriveWriter(brokers)
+	defer writer.Close()
+
+	if err := writer.WriteMessages(ctx, redriven(*found)); err != nil {
+		return Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return decode(*found), nil
+}
+
+// RedriveAll publishes every dead-lettered message of topic that wasn't re-driven yet to
+// its original topic. The consumer group groupID remembers which messages were re-driven.
+// It stops once no new message arrived for idle.
+func RedriveAll(ctx context.Context, brokers []string, groupID string, topic string, idle time.Duration, fn func(Message)) (int, error) {
+	const op = "deadletter.RedriveAll"
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     brokers,
+		GroupID:     groupID,
+		Topic:       Topic(topic),
+		StartOffset: kafka.FirstOffset,
+		MaxBytes:    10e6,
+	})
+	defer reader.Close()
+
+	writer := newRedriveWriter(brokers)
+	defer writer.Close()
+
+	redrove := 0
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, idle)
+		m, err := reader.FetchMessage(fetchCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return redrove, nil
+		}
+		if err != nil {
+			return redrove, fmt.Errorf("%s: %w", op, err)
+		}
+
+		if err := writer.WriteMessages(ctx, redriven(m)); err != nil {
+			return redrove, fmt.Errorf("%s: %w", op, err)
+		}
+
+		if err := reader.CommitMessages(ctx, m); err != nil {
+			return redrove, fmt.Errorf("%s: %w", op, err)
+		}
+
+		redrove++
+		fn(decode(m))
+	}
+}
+
+func newRedriveWriter(brokers []string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}
+}
+
+// redriven restores the message as it was consumed from the original topic, so that a
+// re-driven message starts over with all its retry attempts.
+func redriven(m kafka.Message) kafka.Message {
+	msg := kafka.Message{
+		Topic: header(m, HeaderOriginalTopic),
+		Key:   m.Key,
+		Value: m.Value,
+	}
+
+	if msg.Topic == "" {
+		msg.Topic = strings.TrimSuffix(m.Topic, ".dlq")
+	}
+
+	for _, h := range m.Headers {
+		if !isDeadLetterHeader(h.Key) && !retry.IsRetryHeader(h.Key) {
+			msg.Headers = append(msg.Headers, h)
+		}
+	}
+
+	return msg
+}
+
+func decode(m kafka.Message) Message {
+	msg := Message{
+		Partition:     m.Partition,
+		Offset:        m.Offset,
+		Key:           string(m.Key),
+		Value:         string(m.Value),
+		Reason:        header(m, HeaderReason),
+		Error:         header(m, HeaderError),
+		OriginalTopic: header(m, HeaderOriginalTopic),
+	}
+
+	msg.OriginalPartition, _ = strconv.Atoi(header(m, HeaderOriginalPartition))
+	msg.OriginalOffset, _ = strconv.ParseInt(header(m, HeaderOriginalOffset), 10, 64)
+	msg.FailedAt, _ = time.Parse(time.RFC3339Nano, header(m, HeaderFailedAt))
+
+	for _, h := range m.Headers {
+		if isDeadLetterHeader(h.Key) {
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = map[string]string{}
+		}
+		msg.Headers[h.Key] = string(h.Value)
+	}
+
+	return msg
+}
+
+func header(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+
+	return ""
+}
+
+func readPartitions(ctx context.Context, brokers []string, topic string) ([]int, error) {
+	conn, err := kafka.DialContext(ctx, "tcp", brokers[0])
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(partitions))
+	for _, p := range partitions {
+		ids = append(ids, p.ID)
+	}
+
+	return ids, nil
+}
+
+func readOffsets(ctx context.Context, brokers []string, topic string, partition int) (int64, int64, error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", brokers[0], topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	return conn.ReadOffsets()
+}
+
+// readRange reads the messages of a partition in [first, last) until fn returns false.
+func readRange(ctx context.Context, brokers []string, topic string, partition int, first int64, last int64, fn func(kafka.Message) (bool, error)) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   brokers,
+		Topic:     topic,
+		Partition: partition,
+		MaxBytes:  10e6,
+	})
+	defer reader.Close()
+
+	if err := reader.SetOffset(first); err != nil {
+		return err
+	}
+
+	for {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		more, err := fn(m)
+		if err != nil {
+			return err
+		}
+
+		if !more || m.Offset+1 >= last {
+			return nil
+		}
+	}
+}
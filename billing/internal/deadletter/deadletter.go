@@ -0,0 +1,79 @@
+package deadletter
+
+import (
+	"billing/internal/retry"
+	"bus"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers added to a message when it is dead-lettered. The original headers are kept.
+const (
+	HeaderReason            = "dlq-reason"
+	HeaderError             = "dlq-error"
+	HeaderOriginalTopic     = "dlq-original-topic"
+	HeaderOriginalPartition = "dlq-original-partition"
+	HeaderOriginalOffset    = "dlq-original-offset"
+	HeaderFailedAt          = "dlq-failed-at"
+)
+
+const (
+	// ReasonUndecodable marks a message whose value can't be decoded.
+	ReasonUndecodable = "undecodable"
+	// ReasonRejected marks a message billing refused to apply, e.g. for an unknown wallet.
+	ReasonRejected = "rejected"
+	// ReasonRetriesExhausted marks a message that kept failing with transient errors.
+	ReasonRetriesExhausted = "retries_exhausted"
+)
+
+// Topic returns the dead-letter topic of a topic.
+func Topic(topic string) string {
+	return topic + ".dlq"
+}
+
+// Writer publishes messages that can't be applied to the dead-letter topic of the topic
+// they were first consumed from, also when they failed on a retry topic.
+type Writer struct {
+	publisher bus.Publisher
+}
+
+func NewWriter(publisher bus.Publisher) *Writer {
+	return &Writer{publisher: publisher}
+}
+
+func (w *Writer) Send(ctx context.Context, message bus.Message, reason string, cause error) error {
+	const op = "deadletter.Writer.Send"
+
+	topic, partition, offset := retry.Origin(message)
+
+	headers := append([]bus.Header{}, message.Headers...)
+	headers = append(headers,
+		bus.Header{Key: HeaderReason, Value: []byte(reason)},
+		bus.Header{Key: HeaderError, Value: []byte(cause.Error())},
+		bus.Header{Key: HeaderOriginalTopic, Value: []byte(topic)},
+		bus.Header{Key: HeaderOriginalPartition, Value: []byte(strconv.Itoa(partition))},
+		bus.Header{Key: HeaderOriginalOffset, Value: []byte(strconv.FormatInt(offset, 10))},
+		bus.Header{Key: HeaderFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+
+	err := w.publisher.Publish(ctx, bus.Message{
+		Topic:   Topic(topic),
+		Key:     message.Key,
+		Value:   message.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// isDeadLetterHeader reports whether the header was added when the message was
+// dead-lettered.
+func isDeadLetterHeader(key string) bool {
+	return strings.HasPrefix(key, "dlq-")
+}
@@ -0,0 +1,153 @@
+package events
+
+import (
+	"billing/internal/lib/balance"
+	"billing/internal/lib/envelope"
+	"billing/internal/lib/transaction"
+	"bus"
+	"bus/pb"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	TypeCompleted = "transaction.completed"
+	TypeFailed    = "transaction.failed"
+)
+
+// Event reports the outcome of a command. A failed command has a transaction only if
+// billing recorded one, e.g. for a withdrawal that exceeded the balance.
+type Event struct {
+	Type            string                   `json:"type"`
+	OperationID     string                   `json:"operation_id,omitempty"`
+	WalletID        string                   `json:"wallet_id"`
+	TransactionID   int                      `json:"transaction_id,omitempty"`
+	TransactionType string                   `json:"transaction_type"`
+	Currency        string                   `json:"currency"`
+	Amount          float64                  `json:"amount"`
+	Status          string                   `json:"status"`
+	DateCreated     *time.Time               `json:"date_created,omitempty"`
+	Balance         *balance.BalanceResponse `json:"balance,omitempty"`
+	Error           string                   `json:"error,omitempty"`
+	OccurredAt      time.Time                `json:"occurred_at"`
+}
+
+// Processed builds the event of a command that billing recorded as a transaction, with
+// the balance of the transaction's currency after it was applied.
+func Processed(operationID string, t transaction.Transaction, balances []balance.BalanceResponse) Event {
+	e := Event{
+		Type:            TypeCompleted,
+		OperationID:     operationID,
+		WalletID:        t.WalletID,
+		TransactionID:   t.ID,
+		TransactionType: t.Type,
+		Currency:        t.Currency,
+		Amount:          t.Amount,
+		Status:          t.Status,
+		DateCreated:     &t.DateCreated,
+		OccurredAt:      time.Now().UTC(),
+	}
+
+	if t.Status != "Success" {
+		e.Type = TypeFailed
+	}
+
+	for i := range balances {
+		if balances[i].Currency == t.Currency {
+			e.Balance = &balances[i]
+		}
+	}
+
+	return e
+}
+
+// Rejected builds the event of a command that billing couldn't apply.
+func Rejected(operationID string, walletID string, transactionType string, currency string, amount float64, cause error) Event {
+	return Event{
+		Type:            TypeFailed,
+		OperationID:     operationID,
+		WalletID:        walletID,
+		TransactionType: transactionType,
+		Currency:        currency,
+		Amount:          amount,
+		Status:          "Error",
+		Error:           cause.Error(),
+		OccurredAt:      time.Now().UTC(),
+	}
+}
+
+type Writer struct {
+	publisher   bus.Publisher
+	topic       string
+	contentType string
+}
+
+// NewWriter publishes events to topic encoded as contentType, envelope.ContentTypeJSON or
+// envelope.ContentTypeProtobuf.
+func NewWriter(publisher bus.Publisher, topic string, contentType string) *Writer {
+	return &Writer{
+		publisher:   publisher,
+		topic:       topic,
+		contentType: contentType,
+	}
+}
+
+// Publish sends the event keyed by wallet, so that the events of a wallet stay in order.
+func (w *Writer) Publish(ctx context.Context, e Event) error {
+	const op = "events.Writer.Publish"
+
+	value, err := w.encode(e)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = w.publisher.Publish(ctx, bus.Message{
+		Topic: w.topic,
+		Key:   []byte(e.WalletID),
+		Value: value,
+		Headers: []bus.Header{
+			{Key: envelope.HeaderContentType, Value: []byte(w.contentType)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (w *Writer) encode(e Event) ([]byte, error) {
+	if w.contentType != envelope.ContentTypeProtobuf {
+		return json.Marshal(e)
+	}
+
+	m := pb.TransactionResult{
+		Type:            e.Type,
+		OperationID:     e.OperationID,
+		WalletID:        e.WalletID,
+		TransactionID:   int64(e.TransactionID),
+		TransactionType: e.TransactionType,
+		Currency:        e.Currency,
+		Amount:          e.Amount,
+		Status:          e.Status,
+		Error:           e.Error,
+		OccurredAt:      e.OccurredAt,
+	}
+
+	if e.DateCreated != nil {
+		m.DateCreated = *e.DateCreated
+	}
+
+	if e.Balance != nil {
+		m.Balance = &pb.Balance{
+			WalletID:     e.Balance.WalletID,
+			Currency:     e.Balance.Currency,
+			Amount:       e.Balance.Amount,
+			FrozenAmount: e.Balance.FrozenAmount,
+		}
+	}
+
+	return m.Marshal(), nil
+}
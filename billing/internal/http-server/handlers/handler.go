@@ -1,12 +1,24 @@
 package handlers
 
 import (
+	"billing/internal/lib/audit"
 	"billing/internal/lib/balance"
+	"billing/internal/lib/hashchain"
+	"billing/internal/lib/interest"
 	"billing/internal/lib/iwrequest"
+	"billing/internal/lib/message"
+	"billing/internal/lib/operation"
+	"billing/internal/lib/statement"
 	"billing/internal/lib/transaction"
+	"billing/internal/lib/webhook"
+	"billing/internal/storage"
+	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -16,27 +28,73 @@ type Handler struct {
 	walletWorker        WalletWorker
 	billingWorker       BillingWorker
 	transactionProvider TransactionProvider
+	statementWriter     StatementWriter
+	interestRateWorker  InterestRateWorker
+	auditProvider       AuditProvider
+	chainVerifier       ChainVerifier
+	webhookWorker       WebhookWorker
 }
 
 type WalletWorker interface {
-	CreateWallet() (string, string, error)
+	CreateWallet(ctx context.Context, accountID string) (string, string, error)
+	GetWalletAccount(walletID string) (string, error)
 	GetBalance(walletID string) ([]balance.BalanceResponse, error)
 }
 
 type BillingWorker interface {
-	Invoice(walletID string, transactionType string, currency string, amount float64) (int, error)
-	Withdraw(walletID string, transactionType string, currency string, amount float64) (int, error)
+	Invoice(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error)
+	Withdraw(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error)
 }
 
 type TransactionProvider interface {
 	GetTransaction(id int) (*transaction.Transaction, error)
+	GetTransactionByOperation(operationID string) (*transaction.Transaction, error)
 }
 
-func New(walletWorker WalletWorker, billingWorker BillingWorker, transactionProvider TransactionProvider) *Handler {
+type StatementWriter interface {
+	WriteStatement(walletID string, from time.Time, to time.Time, enc statement.Encoder) error
+}
+
+type InterestRateWorker interface {
+	GetInterestRates() ([]interest.Rate, error)
+	SetInterestRate(ctx context.Context, currency string, annualRate float64) (*interest.Rate, error)
+}
+
+type AuditProvider interface {
+	GetAuditEntries(filter audit.Filter) ([]audit.Entry, error)
+}
+
+type ChainVerifier interface {
+	VerifyChain(walletID string) (hashchain.Report, error)
+}
+
+type WebhookWorker interface {
+	CreateWebhookSubscription(ctx context.Context, request webhook.SubscriptionRequest) (*webhook.Subscription, error)
+	GetWebhookSubscriptions(accountID string) ([]webhook.Subscription, error)
+	DeleteWebhookSubscription(ctx context.Context, id int) error
+	GetWebhookDeliveries(filter webhook.DeliveryFilter) ([]webhook.Delivery, error)
+	RedeliverWebhook(ctx context.Context, id int) (*webhook.Delivery, error)
+}
+
+func New(
+	walletWorker WalletWorker,
+	billingWorker BillingWorker,
+	transactionProvider TransactionProvider,
+	statementWriter StatementWriter,
+	interestRateWorker InterestRateWorker,
+	auditProvider AuditProvider,
+	chainVerifier ChainVerifier,
+	webhookWorker WebhookWorker,
+) *Handler {
 	return &Handler{
 		walletWorker:        walletWorker,
 		billingWorker:       billingWorker,
 		transactionProvider: transactionProvider,
+		statementWriter:     statementWriter,
+		interestRateWorker:  interestRateWorker,
+		auditProvider:       auditProvider,
+		chainVerifier:       chainVerifier,
+		webhookWorker:       webhookWorker,
 	}
 }
 
@@ -44,25 +102,75 @@ func (h *Handler) InitRoutes() *gin.Engine {
 	router := gin.New()
 
 	router.Use(cors.Default())
+	router.Use(auditContext)
 
 	router.GET("/balance/:id", h.getBalance)
 	router.GET("/wallet", h.createWallet)
+	router.GET("/wallet/:id", h.getWallet)
 	router.POST("/invoice", h.postInvoice)
 	router.POST("/withdraw", h.postWithdraw)
 	router.GET("/transaction/:id", h.getTransaction)
+	router.GET("/operation/:id", h.getOperation)
+	router.GET("/wallet/:id/statement", h.getStatement)
+	router.GET("/interest/rates", h.getInterestRates)
+	router.PUT("/interest/rates/:currency", h.putInterestRate)
+	router.GET("/audit", h.getAudit)
+	router.GET("/wallet/:id/chain/verify", h.verifyChain)
+	router.POST("/webhooks", h.createWebhook)
+	router.GET("/webhooks", h.getWebhooks)
+	router.DELETE("/webhooks/:id", h.deleteWebhook)
+	router.GET("/webhooks/deliveries", h.getWebhookDeliveries)
+	router.POST("/webhooks/deliveries/:id/redeliver", h.redeliverWebhook)
+
+	// Consumer metrics
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
 
 	return router
 }
 
+// auditContext records who called the route and through which route for the audit log.
+// The actor and operation ID are taken from the X-Actor and Operation-Id headers set by the gateway.
+// The operation ID also deduplicates invoices and withdrawals, like it does for Kafka messages.
+func auditContext(c *gin.Context) {
+	operationID := c.GetHeader(operation.HeaderID)
+
+	ctx := audit.WithActor(c.Request.Context(), c.GetHeader("X-Actor"))
+	ctx = audit.WithSource(ctx, "http:"+c.Request.Method+" "+c.FullPath())
+	ctx = operation.WithID(ctx, operationID)
+	if operationID != "" {
+		ctx = message.WithID(ctx, message.ID(operationID, "", 0, 0))
+	}
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+}
+
 func (h *Handler) getTransaction(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		c.JSON(500, gin.H{"error": "internal error"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
-	fmt.Println(1)
 
 	transaction, err := h.transactionProvider.GetTransaction(id)
+	if errors.Is(err, storage.ErrTransactionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "transaction not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"transaction": transaction})
+}
+
+func (h *Handler) getOperation(c *gin.Context) {
+	transaction, err := h.transactionProvider.GetTransactionByOperation(c.Param("id"))
+	if errors.Is(err, storage.ErrTransactionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "operation not processed"})
+		return
+	}
 	if err != nil {
 		c.JSON(500, gin.H{"error": "internal error"})
 		return
@@ -84,7 +192,11 @@ func (h *Handler) getBalance(c *gin.Context) {
 }
 
 func (h *Handler) createWallet(c *gin.Context) {
-	id, account_id, err := h.walletWorker.CreateWallet()
+	id, account_id, err := h.walletWorker.CreateWallet(c.Request.Context(), c.Query("account_id"))
+	if errors.Is(err, storage.ErrAccountHasWallet) {
+		c.JSON(http.StatusConflict, gin.H{"error": "account has a wallet already"})
+		return
+	}
 	if err != nil {
 		c.JSON(500, gin.H{"error": "internal error"})
 		return
@@ -93,6 +205,22 @@ func (h *Handler) createWallet(c *gin.Context) {
 	c.JSON(200, gin.H{"wallet_id": id, "account_id": account_id})
 }
 
+func (h *Handler) getWallet(c *gin.Context) {
+	wallet_id := c.Param("id")
+
+	account_id, err := h.walletWorker.GetWalletAccount(wallet_id)
+	if errors.Is(err, storage.ErrWalletNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "wallet not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"wallet_id": wallet_id, "account_id": account_id})
+}
+
 func (h *Handler) postInvoice(c *gin.Context) {
 	var request iwrequest.IWRequest
 
@@ -101,28 +229,317 @@ func (h *Handler) postInvoice(c *gin.Context) {
 		return
 	}
 
-	transaction_id, err := h.billingWorker.Invoice(request.WalletID, "Invoice", request.Currency, request.Amount)
+	transaction_id, err := h.billingWorker.Invoice(c.Request.Context(), request.WalletID, "Invoice", request.Currency, request.Amount)
+
+	h.respondTransaction(c, transaction_id, err)
+}
+
+func (h *Handler) postWithdraw(c *gin.Context) {
+	var request iwrequest.IWRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transaction_id, err := h.billingWorker.Withdraw(c.Request.Context(), request.WalletID, "Withdraw", request.Currency, request.Amount)
+
+	h.respondTransaction(c, transaction_id, err)
+}
+
+// respondTransaction answers an invoice or withdraw with the transaction it recorded and
+// the transaction's status. A request repeated with the same Operation-Id header gets the
+// transaction of the first one.
+func (h *Handler) respondTransaction(c *gin.Context, transactionID int, err error) {
+	switch {
+	case errors.Is(err, storage.ErrWalletNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "wallet not found"})
+		return
+	case errors.Is(err, storage.ErrSubwalletNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "wallet has no balance in this currency"})
+		return
+	case err != nil && !errors.Is(err, storage.ErrMessageProcessed):
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	response := gin.H{"transaction_id": transactionID}
+
+	if transactionID != 0 {
+		transaction, err := h.transactionProvider.GetTransaction(transactionID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+
+		response["status"] = transaction.Status
+	}
+
+	c.JSON(200, response)
+}
+
+func (h *Handler) getStatement(c *gin.Context) {
+	wallet_id := c.Param("id")
+
+	from, err := parseStatementTime(c.Query("from"), time.Unix(0, 0), false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+		return
+	}
+
+	to, err := parseStatementTime(c.Query("to"), time.Now(), true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+		return
+	}
+
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	format := c.DefaultQuery("format", statement.FormatJSON)
+
+	enc, err := statement.NewEncoder(format, c.Writer)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Type", statement.ContentType(format))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%s.%s\"", wallet_id, statement.FileExtension(format)))
+	c.Status(http.StatusOK)
+
+	if err := h.statementWriter.WriteStatement(wallet_id, from, to, enc); err != nil {
+		// Once the body has started streaming the status can't be changed anymore,
+		// so the client only sees a truncated document.
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Type")
+			c.Writer.Header().Del("Content-Disposition")
+
+			if errors.Is(err, storage.ErrWalletNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "wallet not found"})
+				return
+			}
+
+			c.JSON(500, gin.H{"error": "internal error"})
+			return
+		}
+		c.Error(err)
+	}
+}
+
+// parseStatementTime accepts RFC 3339 timestamps and plain dates. A plain date used as the
+// end of the period is inclusive, so it is moved to the start of the following day.
+func parseStatementTime(value string, def time.Time, end bool) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+func (h *Handler) getInterestRates(c *gin.Context) {
+	rates, err := h.interestRateWorker.GetInterestRates()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"rates": rates})
+}
+
+func (h *Handler) putInterestRate(c *gin.Context) {
+	var request interest.RateRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rate, err := h.interestRateWorker.SetInterestRate(c.Request.Context(), c.Param("currency"), *request.AnnualRate)
 	if err != nil {
 		c.JSON(500, gin.H{"error": "internal error"})
 		return
 	}
 
-	c.JSON(200, gin.H{"transaction_id": transaction_id})
+	c.JSON(200, gin.H{"rate": rate})
 }
 
-func (h *Handler) postWithdraw(c *gin.Context) {
-	var request iwrequest.IWRequest
+func (h *Handler) getAudit(c *gin.Context) {
+	filter := audit.Filter{
+		Actor:     c.Query("actor"),
+		Source:    c.Query("source"),
+		Operation: c.Query("operation"),
+	}
+
+	var err error
+
+	if filter.From, err = parseStatementTime(c.Query("from"), time.Time{}, false); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: " + err.Error()})
+		return
+	}
+
+	if filter.To, err = parseStatementTime(c.Query("to"), time.Time{}, true); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: " + err.Error()})
+		return
+	}
+
+	if value := c.Query("before_id"); value != "" {
+		if filter.BeforeID, err = strconv.ParseInt(value, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid before_id"})
+			return
+		}
+	}
+
+	if value := c.Query("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit <= 0 || filter.Limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+	}
+
+	entries, err := h.auditProvider.GetAuditEntries(filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"entries": entries})
+}
+
+func (h *Handler) verifyChain(c *gin.Context) {
+	wallet_id := c.Param("id")
+
+	report, err := h.chainVerifier.VerifyChain(wallet_id)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"report": report})
+}
+
+func (h *Handler) createWebhook(c *gin.Context) {
+	var request webhook.SubscriptionRequest
 
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	transaction_id, err := h.billingWorker.Withdraw(request.WalletID, "Withdraw", request.Currency, request.Amount)
+	sub, err := h.webhookWorker.CreateWebhookSubscription(c.Request.Context(), request)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"webhook": sub})
+}
+
+func (h *Handler) getWebhooks(c *gin.Context) {
+	accountID := c.Query("account_id")
+	if accountID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "account_id is required"})
+		return
+	}
+
+	subs, err := h.webhookWorker.GetWebhookSubscriptions(accountID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"webhooks": subs})
+}
+
+func (h *Handler) deleteWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	err = h.webhookWorker.DeleteWebhookSubscription(c.Request.Context(), id)
+	if errors.Is(err, storage.ErrWebhookNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "webhook not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// getWebhookDeliveries lists deliveries, newest first. Failed deliveries are selected with
+// status=failed.
+func (h *Handler) getWebhookDeliveries(c *gin.Context) {
+	filter := webhook.DeliveryFilter{
+		AccountID: c.Query("account_id"),
+		Status:    c.Query("status"),
+		Limit:     100,
+	}
+
+	var err error
+
+	if value := c.Query("subscription_id"); value != "" {
+		if filter.SubscriptionID, err = strconv.Atoi(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid subscription_id"})
+			return
+		}
+	}
+
+	if value := c.Query("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit <= 0 || filter.Limit > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+	}
+
+	deliveries, err := h.webhookWorker.GetWebhookDeliveries(filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "internal error"})
+		return
+	}
+
+	c.JSON(200, gin.H{"deliveries": deliveries})
+}
+
+func (h *Handler) redeliverWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	delivery, err := h.webhookWorker.RedeliverWebhook(c.Request.Context(), id)
+	if errors.Is(err, storage.ErrDeliveryNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+		return
+	}
+	if errors.Is(err, storage.ErrDeliveryNotFailed) {
+		c.JSON(http.StatusConflict, gin.H{"error": "only failed deliveries can be redelivered"})
+		return
+	}
 	if err != nil {
 		c.JSON(500, gin.H{"error": "internal error"})
 		return
 	}
 
-	c.JSON(200, gin.H{"transaction_id": transaction_id})
+	c.JSON(200, gin.H{"delivery": delivery})
 }
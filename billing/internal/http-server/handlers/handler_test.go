@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/statement"
+	"billing/internal/storage"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeStatements writes an empty statement for the wallets it knows.
+type fakeStatements struct {
+	wallets map[string]bool
+}
+
+func (f fakeStatements) WriteStatement(walletID string, from time.Time, to time.Time, enc statement.Encoder) error {
+	if !f.wallets[walletID] {
+		return fmt.Errorf("service.WriteStatement: %w", storage.ErrWalletNotFound)
+	}
+
+	if err := enc.Begin(statement.Statement{WalletID: walletID, From: from, To: to, GeneratedAt: time.Now()}); err != nil {
+		return err
+	}
+
+	return enc.End()
+}
+
+func TestGetStatement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := New(nil, nil, nil, fakeStatements{wallets: map[string]bool{"w-1": true}}, nil, nil, nil, nil).InitRoutes()
+
+	tests := []struct {
+		name            string
+		target          string
+		wantStatus      int
+		wantContentType string
+	}{
+		{"known wallet", "/wallet/w-1/statement?format=camt053", http.StatusOK, "application/xml"},
+		{"unknown wallet", "/wallet/w-2/statement?format=camt053", http.StatusNotFound, "application/json; charset=utf-8"},
+		{"unknown format", "/wallet/w-1/statement?format=pdf", http.StatusBadRequest, "application/json; charset=utf-8"},
+		{"empty period", "/wallet/w-1/statement?from=2024-01-02&to=2024-01-01", http.StatusBadRequest, "application/json; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if rec.Code != http.StatusOK && rec.Header().Get("Content-Disposition") != "" {
+				t.Error("error response is offered as a download")
+			}
+		})
+	}
+}
+
+// fakeAudit records the filter of the last query.
+type fakeAudit struct {
+	filter *audit.Filter
+}
+
+func (f fakeAudit) GetAuditEntries(filter audit.Filter) ([]audit.Entry, error) {
+	*f.filter = filter
+	return nil, nil
+}
+
+func TestGetAuditLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var filter audit.Filter
+	router := New(nil, nil, nil, nil, nil, fakeAudit{filter: &filter}, nil, nil).InitRoutes()
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantLimit  int
+	}{
+		{"no limit", "", http.StatusOK, 0},
+		{"smallest", "?limit=1", http.StatusOK, 1},
+		{"largest", "?limit=1000", http.StatusOK, 1000},
+		{"zero", "?limit=0", http.StatusBadRequest, 0},
+		{"negative", "?limit=-5", http.StatusBadRequest, 0},
+		{"too large", "?limit=1001", http.StatusBadRequest, 0},
+		{"not a number", "?limit=ten", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter = audit.Filter{Limit: -1}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/audit"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if rec.Code == http.StatusOK && filter.Limit != tt.wantLimit {
+				t.Errorf("limit %d passed on, want %d", filter.Limit, tt.wantLimit)
+			}
+			if rec.Code != http.StatusOK && filter.Limit != -1 {
+				t.Error("the entries were queried")
+			}
+		})
+	}
+}
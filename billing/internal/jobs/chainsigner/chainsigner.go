@@ -0,0 +1,53 @@
+package chainsigner
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/logger/sl"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Job periodically signs the wallets' chain heads with billing's signing key.
+type Job struct {
+	log         *slog.Logger
+	chainWorker ChainWorker
+	interval    time.Duration
+}
+
+type ChainWorker interface {
+	SignChainHeads(ctx context.Context) (int, error)
+}
+
+func New(log *slog.Logger, chainWorker ChainWorker, interval time.Duration) *Job {
+	return &Job{
+		log:         log,
+		chainWorker: chainWorker,
+		interval:    interval,
+	}
+}
+
+func (j *Job) Run(ctx context.Context) {
+	const op = "jobs.chainsigner.Run"
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	ctx = audit.WithActor(ctx, audit.ActorSystem)
+	ctx = audit.WithSource(ctx, "job:chainsigner")
+
+	for {
+		signed, err := j.chainWorker.SignChainHeads(ctx)
+		if err != nil {
+			j.log.Error("failed to sign chain heads", slog.String("op", op), sl.Err(err))
+		} else if signed > 0 {
+			j.log.Info("chain heads signed", slog.String("op", op), slog.Int("heads", signed))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package interest
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/logger/sl"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Job accrues interest for every completed day (UTC) and posts the accruals of every
+// completed month. It resumes from the last accrued day, so days missed while billing
+// was down are caught up on the next run.
+type Job struct {
+	log            *slog.Logger
+	interestWorker InterestWorker
+	interval       time.Duration
+}
+
+type InterestWorker interface {
+	GetLastAccruedDay() (time.Time, bool, error)
+	AccrueInterest(ctx context.Context, day time.Time) (int, error)
+	PostInterest(ctx context.Context, before time.Time) (int, error)
+}
+
+func New(log *slog.Logger, interestWorker InterestWorker, interval time.Duration) *Job {
+	return &Job{
+		log:            log,
+		interestWorker: interestWorker,
+		interval:       interval,
+	}
+}
+
+func (j *Job) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	ctx = audit.WithActor(ctx, audit.ActorSystem)
+	ctx = audit.WithSource(ctx, "job:interest")
+
+	for {
+		if err := j.runOnce(ctx, time.Now()); err != nil {
+			j.log.Error("interest run failed", sl.Err(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *Job) runOnce(ctx context.Context, now time.Time) error {
+	const op = "jobs.interest.runOnce"
+
+	today := truncateDay(now)
+
+	next := today.AddDate(0, 0, -1)
+	last, ok, err := j.interestWorker.GetLastAccruedDay()
+	if err != nil {
+		return err
+	}
+	if ok {
+		next = truncateDay(last).AddDate(0, 0, 1)
+	}
+
+	for day := next; day.Before(today); day = day.AddDate(0, 0, 1) {
+		// Post the previous month before accruing the first day of a new one, so that
+		// the posted interest is part of the balance it accrues on.
+		if err := j.post(ctx, monthStart(day)); err != nil {
+			return err
+		}
+
+		accrued, err := j.interestWorker.AccrueInterest(ctx, day)
+		if err != nil {
+			return err
+		}
+
+		j.log.Info("interest accrued", slog.String("op", op), slog.String("day", day.Format(time.DateOnly)), slog.Int("accruals", accrued))
+	}
+
+	return j.post(ctx, monthStart(today))
+}
+
+func (j *Job) post(ctx context.Context, before time.Time) error {
+	const op = "jobs.interest.post"
+
+	posted, err := j.interestWorker.PostInterest(ctx, before)
+	if err != nil {
+		return err
+	}
+
+	if posted > 0 {
+		j.log.Info("interest posted", slog.String("op", op), slog.String("before", before.Format(time.DateOnly)), slog.Int("transactions", posted))
+	}
+
+	return nil
+}
+
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,208 @@
+package webhooks
+
+import (
+	"billing/internal/events"
+	"billing/internal/lib/logger/sl"
+	"billing/internal/lib/webhook"
+	"billing/internal/retry"
+	"billing/internal/storage"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const batchSize = 100
+
+// Payload is the body of a delivery.
+type Payload struct {
+	ID        string       `json:"id"`
+	Type      string       `json:"type"`
+	CreatedAt time.Time    `json:"created_at"`
+	Data      events.Event `json:"data"`
+}
+
+// Notifier queues transaction events for the webhook subscriptions of the wallet's
+// account. It is an event publisher next to the Kafka events writer.
+type Notifier struct {
+	webhookWorker WebhookWorker
+}
+
+type WebhookWorker interface {
+	EnqueueWebhookEvent(walletID string, eventID string, eventType string, payload []byte) (int, error)
+	ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]webhook.Delivery, error)
+	RecordWebhookAttempt(id int, status string, statusCode int, lastError string, nextAttemptAt time.Time) error
+}
+
+func NewNotifier(webhookWorker WebhookWorker) *Notifier {
+	return &Notifier{webhookWorker: webhookWorker}
+}
+
+// Publish queues the event. An event that is published again, e.g. for a redelivered
+// command, keeps its ID and is only queued once.
+func (n *Notifier) Publish(ctx context.Context, e events.Event) error {
+	const op = "jobs.webhooks.Notifier.Publish"
+
+	// Rejected commands may not name a known wallet, there is no account to notify
+	if e.WalletID == "" {
+		return nil
+	}
+
+	id := e.OperationID
+	if id == "" {
+		id = "transaction-" + strconv.Itoa(e.TransactionID)
+	}
+	id = e.Type + ":" + id
+
+	payload, err := json.Marshal(Payload{
+		ID:        id,
+		Type:      e.Type,
+		CreatedAt: e.OccurredAt,
+		Data:      e,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = n.webhookWorker.EnqueueWebhookEvent(e.WalletID, id, e.Type, payload)
+	if errors.Is(err, storage.ErrWalletNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Dispatcher delivers queued events. A delivery that gets no 2xx response is attempted
+// again with exponential backoff and fails for good once the policy's attempts are used
+// up. Failed deliveries can be redelivered through the API.
+type Dispatcher struct {
+	log           *slog.Logger
+	webhookWorker WebhookWorker
+	client        *http.Client
+	policy        retry.Policy
+	interval      time.Duration
+}
+
+func NewDispatcher(log *slog.Logger, webhookWorker WebhookWorker, timeout time.Duration, policy retry.Policy, interval time.Duration) *Dispatcher {
+	return &Dispatcher{
+		log:           log,
+		webhookWorker: webhookWorker,
+		client: &http.Client{
+			Timeout: timeout,
+			// Payloads only go to the URL the subscriber registered, a redirect is
+			// answered like any other response that isn't 2xx
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		policy:   policy,
+		interval: interval,
+	}
+}
+
+func (d *Dispatcher) Run(ctx context.Context) {
+	const op = "jobs.webhooks.Run"
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		// Claimed deliveries are not due again before their attempts timed out
+		deliveries, err := d.webhookWorker.ClaimDueWebhookDeliveries(batchSize, 2*d.client.Timeout)
+		if err != nil {
+			d.log.Error("failed to claim webhook deliveries", slog.String("op", op), sl.Err(err))
+		}
+
+		for _, delivery := range deliveries {
+			d.deliver(ctx, delivery)
+		}
+
+		// Keep going while there is a backlog
+		if len(deliveries) == batchSize && ctx.Err() == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery webhook.Delivery) {
+	const op = "jobs.webhooks.deliver"
+
+	log := d.log.With(slog.String("op", op), slog.Int("delivery_id", delivery.ID), slog.Int("subscription_id", delivery.SubscriptionID))
+
+	statusCode, err := d.post(ctx, delivery)
+
+	// A delivery cut off by shutdown isn't an attempt, it is due again once its claim
+	// runs out
+	if ctx.Err() != nil {
+		log.Info("webhook delivery interrupted by shutdown")
+		return
+	}
+
+	status := webhook.StatusDelivered
+	lastError := ""
+	nextAttemptAt := time.Now()
+
+	if err != nil {
+		attempt := delivery.Attempts + 1
+		lastError = err.Error()
+
+		if attempt >= d.policy.MaxAttempts {
+			status = webhook.StatusFailed
+			log.Warn("webhook delivery failed", slog.Int("attempts", attempt), sl.Err(err))
+		} else {
+			status = webhook.StatusPending
+			nextAttemptAt = nextAttemptAt.Add(d.policy.Delay(attempt))
+			log.Info("webhook delivery will be retried", slog.Int("attempt", attempt), slog.Time("next_attempt_at", nextAttemptAt), sl.Err(err))
+		}
+	}
+
+	if err := d.webhookWorker.RecordWebhookAttempt(delivery.ID, status, statusCode, lastError, nextAttemptAt); err != nil {
+		log.Error("failed to record webhook attempt", sl.Err(err))
+	}
+}
+
+// post sends the signed payload and returns the response status, 0 if there was none.
+func (d *Dispatcher) post(ctx context.Context, delivery webhook.Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.HeaderID, delivery.EventID)
+	req.Header.Set(webhook.HeaderEvent, delivery.EventType)
+	req.Header.Set(webhook.HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(webhook.HeaderSignature, webhook.Sign(delivery.Secret, now, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,178 @@
+package webhooks
+
+import (
+	"billing/internal/lib/webhook"
+	"billing/internal/retry"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// attempt is a recorded delivery attempt.
+type attempt struct {
+	id            int
+	status        string
+	statusCode    int
+	lastError     string
+	nextAttemptAt time.Time
+}
+
+// fakeWorker records the delivery attempts. Calls it doesn't implement panic on the nil
+// WebhookWorker.
+type fakeWorker struct {
+	WebhookWorker
+	attempts []attempt
+}
+
+func (w *fakeWorker) RecordWebhookAttempt(id int, status string, statusCode int, lastError string, nextAttemptAt time.Time) error {
+	w.attempts = append(w.attempts, attempt{id, status, statusCode, lastError, nextAttemptAt})
+	return nil
+}
+
+func discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+const secret = "whsec_test"
+
+// subscriber answers status to deliveries with a valid signature and 400 to the others.
+// Requests to /elsewhere are counted in redirected.
+func subscriber(t *testing.T, status int, redirected *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hook", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		timestamp, err := strconv.ParseInt(r.Header.Get(webhook.HeaderTimestamp), 10, 64)
+		if err != nil || r.Header.Get(webhook.HeaderSignature) != webhook.Sign(secret, time.Unix(timestamp, 0), body) ||
+			r.Header.Get(webhook.HeaderID) != "transaction.completed:op-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if status == http.StatusFound {
+			http.Redirect(w, r, "/elsewhere", status)
+			return
+		}
+		w.WriteHeader(status)
+	})
+	mux.HandleFunc("/elsewhere", func(w http.ResponseWriter, r *http.Request) {
+		redirected.Add(1)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestDeliver(t *testing.T) {
+	policy := retry.Policy{MaxAttempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name           string
+		status         int
+		url            string
+		attempts       int
+		wantStatus     string
+		wantStatusCode int
+		wantError      bool
+		wantDelay      time.Duration
+	}{
+		{"delivered", http.StatusNoContent, "", 0, webhook.StatusDelivered, http.StatusNoContent, false, 0},
+		{"delivered on the last attempt", http.StatusOK, "", 2, webhook.StatusDelivered, http.StatusOK, false, 0},
+		{"first failure", http.StatusInternalServerError, "", 0, webhook.StatusPending, http.StatusInternalServerError, true, time.Minute},
+		{"second failure", http.StatusServiceUnavailable, "", 1, webhook.StatusPending, http.StatusServiceUnavailable, true, 2 * time.Minute},
+		{"last attempt failed", http.StatusInternalServerError, "", 2, webhook.StatusFailed, http.StatusInternalServerError, true, 0},
+		{"unreachable", 0, closed.URL, 0, webhook.StatusPending, 0, true, time.Minute},
+		{"unreachable on the last attempt", 0, closed.URL, 2, webhook.StatusFailed, 0, true, 0},
+		{"redirect", http.StatusFound, "", 0, webhook.StatusPending, http.StatusFound, true, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var redirected atomic.Int32
+
+			url := tt.url
+			if url == "" {
+				url = subscriber(t, tt.status, &redirected).URL + "/hook"
+			}
+
+			worker := &fakeWorker{}
+			d := NewDispatcher(discard(), worker, time.Second, policy, time.Minute)
+
+			before := time.Now()
+			d.deliver(context.Background(), webhook.Delivery{
+				ID:        7,
+				EventID:   "transaction.completed:op-1",
+				EventType: "transaction.completed",
+				Payload:   []byte(`{"id":"transaction.completed:op-1"}`),
+				Attempts:  tt.attempts,
+				URL:       url,
+				Secret:    secret,
+			})
+
+			if len(worker.attempts) != 1 {
+				t.Fatalf("%d attempts recorded, want 1", len(worker.attempts))
+			}
+			got := worker.attempts[0]
+
+			if got.id != 7 || got.status != tt.wantStatus || got.statusCode != tt.wantStatusCode || (got.lastError != "") != tt.wantError {
+				t.Errorf("attempt %+v, want %s with status code %d", got, tt.wantStatus, tt.wantStatusCode)
+			}
+			if got.nextAttemptAt.Before(before.Add(tt.wantDelay)) || got.nextAttemptAt.After(time.Now().Add(tt.wantDelay)) {
+				t.Errorf("next attempt at %s, want %s after %s", got.nextAttemptAt, tt.wantDelay, before)
+			}
+			if redirected.Load() != 0 {
+				t.Error("the redirect was followed")
+			}
+		})
+	}
+}
+
+func TestDeliverShutdown(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+
+	// The subscriber takes longer than the shutdown
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	worker := &fakeWorker{}
+	d := NewDispatcher(discard(), worker, 10*time.Second, retry.Policy{MaxAttempts: 3, Backoff: time.Minute, MaxBackoff: time.Hour}, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	delivered := make(chan struct{})
+	go func() {
+		d.deliver(ctx, webhook.Delivery{ID: 7, Payload: []byte(`{}`), URL: server.URL, Secret: secret})
+		close(delivered)
+	}()
+
+	<-received
+	cancel()
+
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatal("deliver() didn't return after the context was cancelled")
+	}
+
+	// The claim runs out and the delivery is attempted again with the same count
+	if len(worker.attempts) != 0 {
+		t.Errorf("attempts %+v recorded on shutdown", worker.attempts)
+	}
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	ActorSystem    = "system"
+	ActorAnonymous = "anonymous"
+	SourceUnknown  = "unknown"
+)
+
+type Entry struct {
+	ID         int64           `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Actor      string          `json:"actor"`
+	Source     string          `json:"source"`
+	Operation  string          `json:"operation"`
+	Params     json.RawMessage `json:"params,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// WithResult returns the entry with the result of the operation it records.
+func (e Entry) WithResult(result any) Entry {
+	if result != nil {
+		e.Result, _ = json.Marshal(result)
+	}
+
+	return e
+}
+
+// Filter selects audit entries. Empty fields don't filter, Source matches by prefix
+// (e.g. "kafka:invoices"), and entries are returned newest first starting below BeforeID.
+type Filter struct {
+	Actor     string
+	Source    string
+	Operation string
+	From      time.Time
+	To        time.Time
+	BeforeID  int64
+	Limit     int
+}
+
+type ctxKey int
+
+const (
+	actorKey ctxKey = iota
+	sourceKey
+)
+
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey, source)
+}
+
+func ActorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey).(string); ok && actor != "" {
+		return actor
+	}
+
+	return ActorAnonymous
+}
+
+func SourceFrom(ctx context.Context) string {
+	if source, ok := ctx.Value(sourceKey).(string); ok && source != "" {
+		return source
+	}
+
+	return SourceUnknown
+}
@@ -0,0 +1,120 @@
+package envelope
+
+import (
+	"bus/pb"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Message types of the commands gwapi sends to billing.
+const (
+	TypeInvoice  = "invoice"
+	TypeWithdraw = "withdraw"
+)
+
+// VersionLegacy is the version of bare payloads that were produced before the envelope.
+const VersionLegacy = 0
+
+// HeaderContentType tells how a message is encoded. Messages without it are JSON.
+const (
+	HeaderContentType   = "content-type"
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+	ErrUnknownContentType = errors.New("unknown content type")
+)
+
+// Envelope wraps every command payload with what a consumer needs to know about it before
+// decoding the payload itself.
+type Envelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	Version       int             `json:"version"`
+	ProducedAt    time.Time       `json:"produced_at"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+
+	// ContentType is the encoding of the envelope and its payload.
+	ContentType string `json:"-"`
+}
+
+// ContentType returns the content type of an encoding name as used in the config.
+func ContentType(encoding string) (string, error) {
+	const op = "envelope.ContentType"
+
+	switch encoding {
+	case "", "json":
+		return ContentTypeJSON, nil
+	case "protobuf":
+		return ContentTypeProtobuf, nil
+	default:
+		return "", fmt.Errorf("%s: unknown encoding %q", op, encoding)
+	}
+}
+
+// Decode unwraps a message value encoded as contentType, JSON if it is empty. A JSON value
+// without version and payload is a legacy bare payload and is returned as the payload of a
+// VersionLegacy envelope of legacyType.
+func Decode(value []byte, contentType string, legacyType string) (Envelope, error) {
+	const op = "envelope.Decode"
+
+	var (
+		env Envelope
+		err error
+	)
+
+	switch contentType {
+	case "", ContentTypeJSON:
+		env, err = decodeJSON(value, legacyType)
+	case ContentTypeProtobuf:
+		env, err = decodeProtobuf(value)
+	default:
+		err = fmt.Errorf("%w: %q", ErrUnknownContentType, contentType)
+	}
+	if err != nil {
+		return Envelope{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return env, nil
+}
+
+func decodeJSON(value []byte, legacyType string) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(value, &env); err != nil {
+		return Envelope{}, err
+	}
+
+	if env.Version == VersionLegacy && env.Payload == nil {
+		env = Envelope{
+			Type:    legacyType,
+			Version: VersionLegacy,
+			Payload: value,
+		}
+	}
+
+	env.ContentType = ContentTypeJSON
+
+	return env, nil
+}
+
+func decodeProtobuf(value []byte) (Envelope, error) {
+	var m pb.Envelope
+	if err := m.Unmarshal(value); err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		ID:            m.ID,
+		Type:          m.Type,
+		Version:       m.Version,
+		ProducedAt:    m.ProducedAt,
+		CorrelationID: m.CorrelationID,
+		Payload:       m.Payload,
+		ContentType:   ContentTypeProtobuf,
+	}, nil
+}
@@ -0,0 +1,157 @@
+package hashchain
+
+import (
+	"billing/internal/lib/transaction"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Record is a settled transaction together with its link in the wallet's hash chain.
+type Record struct {
+	transaction.Transaction
+	Seq      int64
+	PrevHash string
+	Hash     string
+}
+
+// Head is the latest link of a wallet's chain.
+type Head struct {
+	WalletID    string    `json:"wallet_id"`
+	Seq         int64     `json:"seq"`
+	Hash        string    `json:"hash"`
+	DateUpdated time.Time `json:"date_updated"`
+}
+
+type Break struct {
+	TransactionID int    `json:"transaction_id,omitempty"`
+	Seq           int64  `json:"seq"`
+	Reason        string `json:"reason"`
+}
+
+type Report struct {
+	WalletID          string `json:"wallet_id"`
+	Valid             bool   `json:"valid"`
+	Checked           int    `json:"checked"`
+	SignaturesChecked int    `json:"signatures_checked"`
+	FirstBroken       *Break `json:"first_broken,omitempty"`
+}
+
+// Hash links a transaction to the previous hash of its wallet's chain. Every field that
+// describes the money movement is covered, so editing any of them breaks the chain.
+func Hash(seq int64, prevHash string, t transaction.Transaction) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\n%s\n%d\n%s\n%s\n%s\n%s\n%s\n%s",
+		seq,
+		prevHash,
+		t.ID,
+		t.WalletID,
+		t.Currency,
+		t.Type,
+		t.Status,
+		strconv.FormatFloat(t.Amount, 'g', -1, 64),
+		t.DateCreated.UTC().Format(time.RFC3339Nano),
+	)))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Verifier walks a wallet's chain in sequence order and remembers the first broken link.
+type Verifier struct {
+	report     Report
+	seq        int64
+	prevHash   string
+	signatures map[int64][]Signature
+	signer     *Signer
+}
+
+// NewVerifier checks the chain against the heads signed with the signer's key as well
+// when a signer is given.
+func NewVerifier(walletID string, signatures []Signature, signer *Signer) *Verifier {
+	v := &Verifier{
+		report:     Report{WalletID: walletID, Valid: true},
+		signatures: map[int64][]Signature{},
+		signer:     signer,
+	}
+
+	if signer != nil {
+		for _, sig := range signatures {
+			if sig.KeyID == signer.KeyID() {
+				v.signatures[sig.Seq] = append(v.signatures[sig.Seq], sig)
+			}
+		}
+	}
+
+	return v
+}
+
+// Add checks the next record and reports whether the chain is still intact.
+func (v *Verifier) Add(r Record) bool {
+	if !v.report.Valid {
+		return false
+	}
+
+	v.report.Checked++
+
+	switch {
+	case r.Seq == 0:
+		return v.broken(r, "transaction is not part of the chain")
+	case r.Seq != v.seq+1:
+		return v.broken(r, fmt.Sprintf("expected link %d, links are missing", v.seq+1))
+	case r.PrevHash != v.prevHash:
+		return v.broken(r, "prev_hash does not match the previous link")
+	case Hash(r.Seq, r.PrevHash, r.Transaction) != r.Hash:
+		return v.broken(r, "hash does not match the transaction, the row was modified")
+	}
+
+	for _, sig := range v.signatures[r.Seq] {
+		v.report.SignaturesChecked++
+
+		if !v.signer.Verify(sig) {
+			return v.broken(r, "signature of the chain head is invalid")
+		}
+		if sig.Hash != r.Hash {
+			return v.broken(r, "hash differs from the signed chain head")
+		}
+	}
+	delete(v.signatures, r.Seq)
+
+	v.seq = r.Seq
+	v.prevHash = r.Hash
+
+	return true
+}
+
+// Finish compares the end of the walked chain with the stored head, which detects removed
+// trailing links, and returns the report.
+func (v *Verifier) Finish(head *Head) Report {
+	if !v.report.Valid {
+		return v.report
+	}
+
+	switch {
+	case head == nil && v.seq > 0:
+		v.report.Valid = false
+		v.report.FirstBroken = &Break{Seq: v.seq, Reason: "chain head is missing"}
+	case head != nil && (head.Seq != v.seq || head.Hash != v.prevHash):
+		v.report.Valid = false
+		v.report.FirstBroken = &Break{Seq: v.seq + 1, Reason: fmt.Sprintf("chain head is at link %d, links are missing", head.Seq)}
+	case len(v.signatures) > 0:
+		v.report.Valid = false
+		v.report.FirstBroken = &Break{Seq: v.seq + 1, Reason: "signed chain head is missing from the chain"}
+	}
+
+	return v.report
+}
+
+func (v *Verifier) broken(r Record, reason string) bool {
+	v.report.Valid = false
+	v.report.FirstBroken = &Break{
+		TransactionID: r.ID,
+		Seq:           r.Seq,
+		Reason:        reason,
+	}
+
+	return false
+}
@@ -0,0 +1,299 @@
+package hashchain
+
+import (
+	"billing/internal/lib/transaction"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSigner(t *testing.T) *Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewSigner(key)
+}
+
+// chain links the transactions of w-1 and returns the records with their head.
+func chain(transactions []transaction.Transaction) ([]Record, *Head) {
+	var records []Record
+
+	prevHash := ""
+	for i, tx := range transactions {
+		seq := int64(i + 1)
+		hash := Hash(seq, prevHash, tx)
+
+		records = append(records, Record{Transaction: tx, Seq: seq, PrevHash: prevHash, Hash: hash})
+		prevHash = hash
+	}
+
+	last := records[len(records)-1]
+
+	return records, &Head{WalletID: "w-1", Seq: last.Seq, Hash: last.Hash, DateUpdated: last.DateCreated}
+}
+
+func transactions() []transaction.Transaction {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	return []transaction.Transaction{
+		{ID: 11, WalletID: "w-1", Currency: "USD", Type: "Invoice", Status: "Success", Amount: 100, DateCreated: created},
+		{ID: 12, WalletID: "w-1", Currency: "USD", Type: "Withdraw", Status: "Success", Amount: 30, DateCreated: created.Add(time.Minute)},
+		{ID: 13, WalletID: "w-1", Currency: "USD", Type: "Invoice", Status: "Success", Amount: 12.5, DateCreated: created.Add(2 * time.Minute)},
+		{ID: 14, WalletID: "w-1", Currency: "USD", Type: "Withdraw", Status: "Success", Amount: 40, DateCreated: created.Add(3 * time.Minute)},
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	signer := newSigner(t)
+	forger := newSigner(t)
+
+	signedAt := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// tamper changes the chain and the signatures of its heads after they were made
+		tamper         func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature)
+		wantBrokenSeq  int64
+		wantBrokenTx   int
+		wantReason     string
+		wantSignatures int
+	}{
+		{
+			name: "intact",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				return records, head, signatures
+			},
+			wantSignatures: 2,
+		},
+		{
+			name: "changed amount",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				records[1].Amount = 3000
+				return records, head, signatures
+			},
+			wantBrokenSeq: 2,
+			wantBrokenTx:  12,
+			wantReason:    "the row was modified",
+		},
+		{
+			name: "changed amount with the hashes recomputed",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				txs := transactions()
+				txs[1].Amount = 3000
+
+				records, head = chain(txs)
+				return records, head, signatures
+			},
+			wantBrokenSeq: 2,
+			wantBrokenTx:  12,
+			wantReason:    "hash differs from the signed chain head",
+		},
+		{
+			name: "entries swapped",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				records[1].Transaction, records[2].Transaction = records[2].Transaction, records[1].Transaction
+				return records, head, signatures
+			},
+			wantBrokenSeq: 2,
+			wantBrokenTx:  13,
+			wantReason:    "the row was modified",
+		},
+		{
+			name: "links out of order",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				records[1], records[2] = records[2], records[1]
+				return records, head, signatures
+			},
+			wantBrokenSeq: 3,
+			wantBrokenTx:  13,
+			wantReason:    "expected link 2",
+		},
+		{
+			name: "entries reordered with the hashes recomputed",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				txs := transactions()
+				txs[1], txs[2] = txs[2], txs[1]
+
+				records, head = chain(txs)
+				return records, head, signatures
+			},
+			wantBrokenSeq: 2,
+			wantBrokenTx:  13,
+			wantReason:    "hash differs from the signed chain head",
+		},
+		{
+			name: "link removed",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				return append(records[:1], records[2:]...), head, signatures
+			},
+			wantBrokenSeq: 3,
+			wantBrokenTx:  13,
+			wantReason:    "expected link 2",
+		},
+		{
+			name: "last link removed",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				return records[:3], head, signatures
+			},
+			wantBrokenSeq: 4,
+			wantReason:    "chain head is at link 4",
+		},
+		{
+			name: "last link and head removed",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				records = records[:3]
+				last := records[2]
+
+				return records, &Head{WalletID: "w-1", Seq: last.Seq, Hash: last.Hash}, signatures
+			},
+			wantBrokenSeq: 4,
+			wantReason:    "signed chain head is missing",
+		},
+		{
+			name: "head signature forged for a rewritten chain",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				txs := transactions()
+				txs[3].Amount = 4
+
+				records, head = chain(txs)
+
+				// The forger can't sign with the original key, so it signs with its own
+				// under the original key ID
+				forged := forger.Sign(*head, signedAt)
+				forged.KeyID = signer.KeyID()
+
+				return records, head, append(signatures[:1], forged)
+			},
+			wantBrokenSeq: 4,
+			wantBrokenTx:  14,
+			wantReason:    "signature of the chain head is invalid",
+		},
+		{
+			name: "signed hash changed",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				signatures[0].Hash = records[0].Hash
+				return records, head, signatures
+			},
+			wantBrokenSeq: 2,
+			wantBrokenTx:  12,
+			wantReason:    "signature of the chain head is invalid",
+		},
+		{
+			name: "transaction outside the chain",
+			tamper: func(records []Record, head *Head, signatures []Signature) ([]Record, *Head, []Signature) {
+				records[0].Seq = 0
+				return records, head, signatures
+			},
+			wantBrokenTx: 11,
+			wantReason:   "not part of the chain",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, head := chain(transactions())
+
+			// Heads were signed at links 2 and 4
+			signatures := []Signature{
+				signer.Sign(Head{WalletID: "w-1", Seq: 2, Hash: records[1].Hash}, signedAt),
+				signer.Sign(*head, signedAt),
+			}
+
+			records, head, signatures = tt.tamper(records, head, signatures)
+
+			v := NewVerifier("w-1", signatures, signer)
+			for _, r := range records {
+				if !v.Add(r) {
+					break
+				}
+			}
+			report := v.Finish(head)
+
+			if tt.wantReason == "" {
+				if !report.Valid || report.FirstBroken != nil {
+					t.Fatalf("report %+v, break %+v, want valid", report, report.FirstBroken)
+				}
+				if report.Checked != len(records) || report.SignaturesChecked != tt.wantSignatures {
+					t.Errorf("checked %d links and %d signatures, want %d and %d", report.Checked, report.SignaturesChecked, len(records), tt.wantSignatures)
+				}
+				return
+			}
+
+			if report.Valid || report.FirstBroken == nil {
+				t.Fatalf("report %+v, want a break", report)
+			}
+
+			got := *report.FirstBroken
+			if got.Seq != tt.wantBrokenSeq || got.TransactionID != tt.wantBrokenTx || !strings.Contains(got.Reason, tt.wantReason) {
+				t.Errorf("break %+v, want link %d of transaction %d: %q", got, tt.wantBrokenSeq, tt.wantBrokenTx, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestVerifierWithoutSigner(t *testing.T) {
+	records, head := chain(transactions())
+
+	// Without the key a rewritten chain can't be told apart, signatures are not checked
+	v := NewVerifier("w-1", []Signature{{WalletID: "w-1", Seq: 4, Hash: "forged"}}, nil)
+	for _, r := range records {
+		v.Add(r)
+	}
+
+	if report := v.Finish(head); !report.Valid || report.SignaturesChecked != 0 {
+		t.Errorf("report %+v, want valid without checked signatures", report)
+	}
+}
+
+func TestSignatureOfOtherKeysIsIgnored(t *testing.T) {
+	signer, other := newSigner(t), newSigner(t)
+
+	records, head := chain(transactions())
+
+	v := NewVerifier("w-1", []Signature{other.Sign(*head, time.Now())}, signer)
+	for _, r := range records {
+		v.Add(r)
+	}
+
+	if report := v.Finish(head); !report.Valid || report.SignaturesChecked != 0 {
+		t.Errorf("report %+v, want valid without checked signatures", report)
+	}
+}
+
+func TestSignerVerify(t *testing.T) {
+	signer := newSigner(t)
+
+	sig := signer.Sign(Head{WalletID: "w-1", Seq: 4, Hash: "abc"}, time.Now())
+	if !signer.Verify(sig) {
+		t.Fatal("Verify() of its own signature = false")
+	}
+
+	tests := []struct {
+		name   string
+		change func(s *Signature)
+	}{
+		{"wallet", func(s *Signature) { s.WalletID = "w-2" }},
+		{"seq", func(s *Signature) { s.Seq = 5 }},
+		{"hash", func(s *Signature) { s.Hash = "abd" }},
+		{"signed at", func(s *Signature) { s.SignedAt = s.SignedAt.Add(time.Second) }},
+		{"key id", func(s *Signature) { s.KeyID = "0000000000000000" }},
+		{"not base64", func(s *Signature) { s.Signature = "!" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := sig
+			tt.change(&changed)
+
+			if signer.Verify(changed) {
+				t.Error("Verify() = true")
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package hashchain
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ErrInvalidKey = errors.New("signing key must be a PEM encoded PKCS #8 Ed25519 private key")
+
+type Signature struct {
+	WalletID  string    `json:"wallet_id"`
+	Seq       int64     `json:"seq"`
+	Hash      string    `json:"hash"`
+	KeyID     string    `json:"key_id"`
+	Signature string    `json:"signature"`
+	SignedAt  time.Time `json:"signed_at"`
+}
+
+// Signer signs chain heads with an Ed25519 key so that a rewritten chain can be told
+// apart from the original even if every hash in it was recomputed.
+type Signer struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+func LoadSigner(path string) (*Signer, error) {
+	const op = "hashchain.LoadSigner"
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: %w", op, ErrInvalidKey)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, ErrInvalidKey)
+	}
+
+	return NewSigner(key), nil
+}
+
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+
+	return &Signer{
+		keyID: hex.EncodeToString(sum[:8]),
+		key:   key,
+	}
+}
+
+func (s *Signer) KeyID() string {
+	return s.keyID
+}
+
+func (s *Signer) Sign(head Head, signedAt time.Time) Signature {
+	sig := Signature{
+		WalletID: head.WalletID,
+		Seq:      head.Seq,
+		Hash:     head.Hash,
+		KeyID:    s.keyID,
+		SignedAt: signedAt.UTC().Truncate(time.Microsecond),
+	}
+	sig.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, signedMessage(sig)))
+
+	return sig
+}
+
+// Verify reports whether the signature was made by this signer's key. Signatures made
+// with other keys can't be checked and are reported as invalid.
+func (s *Signer) Verify(sig Signature) bool {
+	if sig.KeyID != s.keyID {
+		return false
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(s.key.Public().(ed25519.PublicKey), signedMessage(sig), raw)
+}
+
+func signedMessage(sig Signature) []byte {
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n%s", sig.WalletID, sig.Seq, sig.Hash, sig.SignedAt.UTC().Format(time.RFC3339Nano)))
+}
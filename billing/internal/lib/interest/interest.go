@@ -0,0 +1,14 @@
+package interest
+
+import "time"
+
+type Rate struct {
+	Currency    string    `json:"currency"`
+	AnnualRate  float64   `json:"annual_rate"`
+	DateUpdated time.Time `json:"date_updated"`
+}
+
+// RateRequest sets the annual rate of a currency as a fraction, e.g. 0.05 for 5%.
+type RateRequest struct {
+	AnnualRate *float64 `json:"annual_rate" binding:"required,gte=0,lte=1"`
+}
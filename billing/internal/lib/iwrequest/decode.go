@@ -0,0 +1,51 @@
+package iwrequest
+
+import (
+	"billing/internal/lib/envelope"
+	"bus/pb"
+	"encoding/json"
+	"fmt"
+)
+
+// decoders holds a decoder for every schema version consumers accept, so producers can
+// move to a new version once all consumers understand it.
+var decoders = map[int]func(payload []byte, contentType string) (IWRequest, error){
+	envelope.VersionLegacy: decodeV1,
+	1:                      decodeV1,
+}
+
+// Decode decodes the invoice or withdraw payload of the envelope by its schema version.
+func Decode(env envelope.Envelope) (IWRequest, error) {
+	const op = "iwrequest.Decode"
+
+	decode, ok := decoders[env.Version]
+	if !ok {
+		return IWRequest{}, fmt.Errorf("%s: %w: %d", op, envelope.ErrUnsupportedVersion, env.Version)
+	}
+
+	request, err := decode(env.Payload, env.ContentType)
+	if err != nil {
+		return IWRequest{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return request, nil
+}
+
+// decodeV1 decodes the payload gwapi sent before and with the first envelope version.
+func decodeV1(payload []byte, contentType string) (IWRequest, error) {
+	if contentType == envelope.ContentTypeProtobuf {
+		var m pb.Command
+		if err := m.Unmarshal(payload); err != nil {
+			return IWRequest{}, err
+		}
+
+		return IWRequest{WalletID: m.WalletID, Currency: m.Currency, Amount: m.Amount}, nil
+	}
+
+	var request IWRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return IWRequest{}, err
+	}
+
+	return request, nil
+}
@@ -0,0 +1,30 @@
+package message
+
+import (
+	"context"
+	"fmt"
+)
+
+type ctxKey struct{}
+
+// ID identifies a consumed message for deduplication. The gateway's operation ID is
+// preferred, because it stays the same when the producer publishes a command twice;
+// otherwise the message's position in the topic is used.
+func ID(operationID string, topic string, partition int, offset int64) string {
+	if operationID != "" {
+		return operationID
+	}
+
+	return fmt.Sprintf("%s/%d/%d", topic, partition, offset)
+}
+
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// IDFrom returns the ID of the message or request being processed, or "" if it has none.
+func IDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+
+	return id
+}
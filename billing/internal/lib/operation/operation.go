@@ -0,0 +1,19 @@
+package operation
+
+import "context"
+
+// HeaderID carries the gateway's operation ID on Kafka messages and HTTP requests.
+const HeaderID = "operation-id"
+
+type ctxKey struct{}
+
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// IDFrom returns the operation ID of the command being processed, or "" if it has none.
+func IDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+
+	return id
+}
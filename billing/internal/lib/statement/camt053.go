@@ -0,0 +1,214 @@
+package statement
+
+import (
+	"billing/internal/lib/transaction"
+	"encoding/xml"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	camt053Namespace  = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"
+	camt053TimeLayout = "2006-01-02T15:04:05Z"
+	camt053MaxID      = 35
+	camt053MaxAcctID  = 34
+	// camt053NoCurrency is the ISO 4217 code for no currency, the statement of a wallet
+	// without currencies is in it
+	camt053NoCurrency = "XXX"
+)
+
+type camtAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camtBalance struct {
+	XMLName   xml.Name   `xml:"Bal"`
+	Code      string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount    camtAmount `xml:"Amt"`
+	CdtDbtInd string     `xml:"CdtDbtInd"`
+	DateTime  string     `xml:"Dt>DtTm"`
+}
+
+type camtEntry struct {
+	XMLName     xml.Name   `xml:"Ntry"`
+	Ref         string     `xml:"NtryRef"`
+	Amount      camtAmount `xml:"Amt"`
+	CdtDbtInd   string     `xml:"CdtDbtInd"`
+	Status      string     `xml:"Sts"`
+	BookingDate string     `xml:"BookgDt>DtTm"`
+	ValueDate   string     `xml:"ValDt>DtTm"`
+	AcctSvcrRef string     `xml:"AcctSvcrRef"`
+	BankTxCode  string     `xml:"BkTxCd>Prtry>Cd"`
+	Issuer      string     `xml:"BkTxCd>Prtry>Issr"`
+}
+
+// camt053Encoder writes an ISO 20022 camt.053.001.02 bank-to-customer statement with
+// one Stmt per currency. Balances are known before the entries are streamed, which lets
+// the encoder keep the element order required by the schema.
+type camt053Encoder struct {
+	w   io.Writer
+	enc *xml.Encoder
+	st  Statement
+	seq int
+	err error
+}
+
+func newCAMT053Encoder(w io.Writer) *camt053Encoder {
+	return &camt053Encoder{w: w, enc: xml.NewEncoder(w)}
+}
+
+func (e *camt053Encoder) Begin(st Statement) error {
+	e.st = st
+
+	if _, err := io.WriteString(e.w, xml.Header); err != nil {
+		return err
+	}
+
+	e.start(xml.StartElement{
+		Name: xml.Name{Local: "Document"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: camt053Namespace}},
+	})
+	e.start(xml.StartElement{Name: xml.Name{Local: "BkToCstmrStmt"}})
+	e.start(xml.StartElement{Name: xml.Name{Local: "GrpHdr"}})
+	e.leaf("MsgId", camtID(ofxBankID+st.GeneratedAt.UTC().Format(ofxTimeLayout)+compactWalletID(st.WalletID), camt053MaxID))
+	e.leaf("CreDtTm", st.GeneratedAt.UTC().Format(camt053TimeLayout))
+	e.end("GrpHdr")
+
+	return e.err
+}
+
+func (e *camt053Encoder) BeginSection(sec Section) error {
+	e.seq++
+
+	e.start(xml.StartElement{Name: xml.Name{Local: "Stmt"}})
+	e.leaf("Id", camtID(compactWalletID(e.st.WalletID), camt053MaxID-len(sec.Currency)-1)+"-"+sec.Currency)
+	e.leaf("ElctrncSeqNb", strconv.Itoa(e.seq))
+	e.leaf("CreDtTm", e.st.GeneratedAt.UTC().Format(camt053TimeLayout))
+	e.start(xml.StartElement{Name: xml.Name{Local: "FrToDt"}})
+	e.leaf("FrDtTm", e.st.From.UTC().Format(camt053TimeLayout))
+	e.leaf("ToDtTm", e.st.To.UTC().Format(camt053TimeLayout))
+	e.end("FrToDt")
+	e.start(xml.StartElement{Name: xml.Name{Local: "Acct"}})
+	e.start(xml.StartElement{Name: xml.Name{Local: "Id"}})
+	e.start(xml.StartElement{Name: xml.Name{Local: "Othr"}})
+	e.leaf("Id", camtID(compactWalletID(e.st.WalletID), camt053MaxAcctID))
+	e.end("Othr")
+	e.end("Id")
+	e.leaf("Ccy", sec.Currency)
+	e.end("Acct")
+
+	if e.err != nil {
+		return e.err
+	}
+
+	e.err = e.enc.Encode(e.balance("OPBD", sec.Currency, sec.OpeningBalance, e.st.From.UTC().Format(camt053TimeLayout)))
+	if e.err != nil {
+		return e.err
+	}
+
+	e.err = e.enc.Encode(e.balance("CLBD", sec.Currency, sec.ClosingBalance, e.st.To.UTC().Format(camt053TimeLayout)))
+
+	return e.err
+}
+
+func (e *camt053Encoder) Entry(t transaction.Transaction) error {
+	amount := SignedAmount(t)
+	date := t.DateCreated.UTC().Format(camt053TimeLayout)
+
+	return e.enc.Encode(camtEntry{
+		Ref:         strconv.Itoa(t.ID),
+		Amount:      camtAmount{Currency: t.Currency, Value: camtAmountValue(amount)},
+		CdtDbtInd:   creditDebit(amount),
+		Status:      "BOOK",
+		BookingDate: date,
+		ValueDate:   date,
+		AcctSvcrRef: strconv.Itoa(t.ID),
+		BankTxCode:  t.Type,
+		Issuer:      ofxBankID,
+	})
+}
+
+func (e *camt053Encoder) EndSection(sec Section) error {
+	e.end("Stmt")
+
+	return e.err
+}
+
+func (e *camt053Encoder) End() error {
+	// The schema requires at least one statement
+	if e.seq == 0 && e.err == nil {
+		empty := Section{Currency: camt053NoCurrency}
+
+		if err := e.BeginSection(empty); err != nil {
+			return err
+		}
+		if err := e.EndSection(empty); err != nil {
+			return err
+		}
+	}
+
+	e.end("BkToCstmrStmt")
+	e.end("Document")
+
+	if e.err != nil {
+		return e.err
+	}
+
+	return e.enc.Flush()
+}
+
+func (e *camt053Encoder) balance(code string, currency string, amount float64, dateTime string) camtBalance {
+	return camtBalance{
+		Code:      code,
+		Amount:    camtAmount{Currency: currency, Value: camtAmountValue(amount)},
+		CdtDbtInd: creditDebit(amount),
+		DateTime:  dateTime,
+	}
+}
+
+func (e *camt053Encoder) start(el xml.StartElement) {
+	if e.err == nil {
+		e.err = e.enc.EncodeToken(el)
+	}
+}
+
+func (e *camt053Encoder) end(name string) {
+	if e.err == nil {
+		e.err = e.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+	}
+}
+
+func (e *camt053Encoder) leaf(name string, value string) {
+	if e.err == nil {
+		e.err = e.enc.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: name}})
+	}
+}
+
+// camtAmountValue formats the absolute amount with at most the 5 fraction digits the schema allows.
+func camtAmountValue(amount float64) string {
+	return strconv.FormatFloat(math.Round(math.Abs(amount)*1e5)/1e5, 'f', -1, 64)
+}
+
+func creditDebit(amount float64) string {
+	if amount < 0 {
+		return "DBIT"
+	}
+
+	return "CRDT"
+}
+
+// compactWalletID drops the dashes of a UUID wallet ID so it fits the Max34Text/Max35Text identifiers.
+func compactWalletID(walletID string) string {
+	return strings.ReplaceAll(walletID, "-", "")
+}
+
+func camtID(id string, max int) string {
+	if len(id) > max {
+		return id[:max]
+	}
+
+	return id
+}
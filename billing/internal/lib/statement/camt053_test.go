@@ -0,0 +1,247 @@
+package statement
+
+import (
+	"billing/internal/lib/transaction"
+	"bytes"
+	"encoding/xml"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const walletID = "0b7e5a52-64a4-4f45-9d67-6f1d3c2a9e10"
+
+type camtSection struct {
+	Section
+	Entries []transaction.Transaction
+}
+
+// camtDocument is the part of a camt.053 document the tests look at.
+type camtDocument struct {
+	XMLName    xml.Name `xml:"urn:iso:std:iso:20022:tech:xsd:camt.053.001.02 Document"`
+	Statements []struct {
+		ID       string `xml:"Id"`
+		Seq      int    `xml:"ElctrncSeqNb"`
+		Currency string `xml:"Acct>Ccy"`
+		Balances []struct {
+			Code      string     `xml:"Tp>CdOrPrtry>Cd"`
+			Amount    camtAmount `xml:"Amt"`
+			CdtDbtInd string     `xml:"CdtDbtInd"`
+		} `xml:"Bal"`
+		Entries []struct {
+			Ref       string     `xml:"NtryRef"`
+			Amount    camtAmount `xml:"Amt"`
+			CdtDbtInd string     `xml:"CdtDbtInd"`
+			Code      string     `xml:"BkTxCd>Prtry>Cd"`
+		} `xml:"Ntry"`
+	} `xml:"BkToCstmrStmt>Stmt"`
+}
+
+func encodeCAMT053(t *testing.T, sections []camtSection) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	enc, err := NewEncoder(FormatCAMT053, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := Statement{
+		WalletID:    walletID,
+		From:        time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:          time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		GeneratedAt: time.Date(2024, 2, 1, 8, 30, 0, 0, time.UTC),
+	}
+
+	if err := enc.Begin(st); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sec := range sections {
+		if err := enc.BeginSection(sec.Section); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range sec.Entries {
+			if err := enc.Entry(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := enc.EndSection(sec.Section); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := enc.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// validateCAMT053 checks the document against the camt.053.001.02 schema in testdata with
+// xmllint, if it is installed.
+func validateCAMT053(t *testing.T, doc []byte) {
+	t.Helper()
+
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Log("xmllint not found, schema validation skipped")
+		return
+	}
+
+	path := filepath.Join(t.TempDir(), "statement.xml")
+	if err := os.WriteFile(path, doc, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(xmllint, "--noout", "--schema", filepath.Join("testdata", "camt.053.001.02.xsd"), path).CombinedOutput()
+	if err != nil {
+		t.Fatalf("document doesn't validate: %v\n%s\n%s", err, out, doc)
+	}
+}
+
+func entry(id int, currency string, typ string, amount float64) transaction.Transaction {
+	return transaction.Transaction{
+		ID:          id,
+		WalletID:    walletID,
+		Currency:    currency,
+		Type:        typ,
+		Status:      "Success",
+		Amount:      amount,
+		DateCreated: time.Date(2024, 1, 10, 12, 0, id, 0, time.UTC),
+	}
+}
+
+func TestCAMT053(t *testing.T) {
+	tests := []struct {
+		name     string
+		sections []camtSection
+		check    func(t *testing.T, doc camtDocument)
+	}{
+		{
+			name: "multi currency",
+			sections: []camtSection{
+				{
+					Section: Section{Currency: "EUR", OpeningBalance: 50, ClosingBalance: 130.5},
+					Entries: []transaction.Transaction{entry(1, "EUR", "Invoice", 100.5), entry(2, "EUR", "Withdraw", 20)},
+				},
+				{
+					Section: Section{Currency: "USD", OpeningBalance: 10, ClosingBalance: -5},
+					Entries: []transaction.Transaction{entry(3, "USD", "Withdraw", 15)},
+				},
+			},
+			check: func(t *testing.T, doc camtDocument) {
+				if len(doc.Statements) != 2 {
+					t.Fatalf("%d statements, want 2", len(doc.Statements))
+				}
+
+				eur, usd := doc.Statements[0], doc.Statements[1]
+
+				if eur.Currency != "EUR" || usd.Currency != "USD" || eur.Seq != 1 || usd.Seq != 2 {
+					t.Errorf("statements = %+v", doc.Statements)
+				}
+				if !strings.HasSuffix(eur.ID, "-EUR") || len(eur.ID) > 35 {
+					t.Errorf("statement Id = %q", eur.ID)
+				}
+
+				if len(eur.Entries) != 2 || len(usd.Entries) != 1 {
+					t.Fatalf("entries %d and %d, want 2 and 1", len(eur.Entries), len(usd.Entries))
+				}
+				if e := eur.Entries[0]; e.CdtDbtInd != "CRDT" || e.Amount.Value != "100.5" || e.Amount.Currency != "EUR" || e.Code != "Invoice" {
+					t.Errorf("invoice entry = %+v", e)
+				}
+				if e := eur.Entries[1]; e.CdtDbtInd != "DBIT" || e.Amount.Value != "20" {
+					t.Errorf("withdrawal entry = %+v", e)
+				}
+
+				// A negative closing balance is its absolute value debited
+				if b := usd.Balances[1]; b.Code != "CLBD" || b.CdtDbtInd != "DBIT" || b.Amount.Value != "5" || b.Amount.Currency != "USD" {
+					t.Errorf("closing balance = %+v", b)
+				}
+				if b := usd.Balances[0]; b.Code != "OPBD" || b.CdtDbtInd != "CRDT" || b.Amount.Value != "10" {
+					t.Errorf("opening balance = %+v", b)
+				}
+			},
+		},
+		{
+			name: "amount formatting",
+			sections: []camtSection{{
+				Section: Section{Currency: "EUR", OpeningBalance: 0.1 + 0.2, ClosingBalance: 123456789.123456},
+				Entries: []transaction.Transaction{
+					entry(1, "EUR", "Invoice", 0.000001),
+					entry(2, "EUR", "Invoice", 2.1234567),
+					entry(3, "EUR", "Withdraw", 1e-5),
+				},
+			}},
+			check: func(t *testing.T, doc camtDocument) {
+				st := doc.Statements[0]
+
+				want := []string{"0.3", "123456789.12346"}
+				for i, b := range st.Balances {
+					if b.Amount.Value != want[i] {
+						t.Errorf("balance %s = %s, want %s", b.Code, b.Amount.Value, want[i])
+					}
+				}
+
+				want = []string{"0", "2.12346", "0.00001"}
+				for i, e := range st.Entries {
+					if e.Amount.Value != want[i] {
+						t.Errorf("entry %s = %s, want %s", e.Ref, e.Amount.Value, want[i])
+					}
+				}
+				if st.Entries[2].CdtDbtInd != "DBIT" {
+					t.Errorf("withdrawal of 0.00001 is %s", st.Entries[2].CdtDbtInd)
+				}
+			},
+		},
+		{
+			name:     "empty period",
+			sections: []camtSection{{Section: Section{Currency: "EUR", OpeningBalance: 42, ClosingBalance: 42}}},
+			check: func(t *testing.T, doc camtDocument) {
+				st := doc.Statements[0]
+
+				if len(st.Entries) != 0 || len(st.Balances) != 2 {
+					t.Fatalf("statement = %+v", st)
+				}
+				if st.Balances[0].Amount.Value != "42" || st.Balances[1].Amount.Value != "42" {
+					t.Errorf("balances = %+v", st.Balances)
+				}
+			},
+		},
+		{
+			name: "wallet without currencies",
+			check: func(t *testing.T, doc camtDocument) {
+				// The schema requires a statement, the wallet gets one without a currency
+				if len(doc.Statements) != 1 {
+					t.Fatalf("%d statements, want 1", len(doc.Statements))
+				}
+
+				st := doc.Statements[0]
+				if len(st.Entries) != 0 || st.Balances[0].Amount.Currency != "XXX" || st.Balances[0].Amount.Value != "0" {
+					t.Errorf("statement = %+v", st)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeCAMT053(t, tt.sections)
+
+			validateCAMT053(t, data)
+
+			var doc camtDocument
+			if err := xml.Unmarshal(data, &doc); err != nil {
+				t.Fatalf("unmarshal: %v\n%s", err, data)
+			}
+
+			tt.check(t, doc)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package statement
+
+import (
+	"billing/internal/lib/transaction"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+type csvEncoder struct {
+	w       *csv.Writer
+	st      Statement
+	balance float64
+}
+
+func newCSVEncoder(w io.Writer) *csvEncoder {
+	return &csvEncoder{w: csv.NewWriter(w)}
+}
+
+func (e *csvEncoder) Begin(st Statement) error {
+	e.st = st
+
+	return e.w.Write([]string{"currency", "record", "transaction_id", "date", "type", "amount", "balance"})
+}
+
+func (e *csvEncoder) BeginSection(sec Section) error {
+	e.balance = sec.OpeningBalance
+
+	return e.w.Write([]string{sec.Currency, "opening_balance", "", e.st.From.Format(time.RFC3339), "", "", formatAmount(sec.OpeningBalance)})
+}
+
+func (e *csvEncoder) Entry(t transaction.Transaction) error {
+	e.balance += SignedAmount(t)
+
+	return e.w.Write([]string{
+		t.Currency,
+		"transaction",
+		strconv.Itoa(t.ID),
+		t.DateCreated.Format(time.RFC3339),
+		t.Type,
+		formatAmount(SignedAmount(t)),
+		formatAmount(e.balance),
+	})
+}
+
+func (e *csvEncoder) EndSection(sec Section) error {
+	return e.w.Write([]string{sec.Currency, "closing_balance", "", e.st.To.Format(time.RFC3339), "", "", formatAmount(sec.ClosingBalance)})
+}
+
+func (e *csvEncoder) End() error {
+	e.w.Flush()
+
+	return e.w.Error()
+}
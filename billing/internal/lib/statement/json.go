@@ -0,0 +1,93 @@
+package statement
+
+import (
+	"billing/internal/lib/transaction"
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// jsonEncoder writes the statement as a single JSON document, one value at a time.
+type jsonEncoder struct {
+	w            *bufio.Writer
+	firstSection bool
+	firstEntry   bool
+}
+
+func newJSONEncoder(w io.Writer) *jsonEncoder {
+	return &jsonEncoder{w: bufio.NewWriter(w)}
+}
+
+func (e *jsonEncoder) Begin(st Statement) error {
+	e.firstSection = true
+
+	header, err := json.Marshal(struct {
+		WalletID    string    `json:"wallet_id"`
+		From        time.Time `json:"from"`
+		To          time.Time `json:"to"`
+		GeneratedAt time.Time `json:"generated_at"`
+	}{st.WalletID, st.From, st.To, st.GeneratedAt})
+	if err != nil {
+		return err
+	}
+
+	// Reopen the header object so that the currencies can be streamed into it.
+	e.w.Write(header[:len(header)-1])
+	_, err = e.w.WriteString(`,"currencies":[`)
+
+	return err
+}
+
+func (e *jsonEncoder) BeginSection(sec Section) error {
+	if !e.firstSection {
+		e.w.WriteByte(',')
+	}
+	e.firstSection = false
+	e.firstEntry = true
+
+	currency, err := json.Marshal(sec.Currency)
+	if err != nil {
+		return err
+	}
+
+	e.w.WriteString(`{"currency":`)
+	e.w.Write(currency)
+	e.w.WriteString(`,"opening_balance":`)
+	e.w.WriteString(formatAmount(sec.OpeningBalance))
+	_, err = e.w.WriteString(`,"transactions":[`)
+
+	return err
+}
+
+func (e *jsonEncoder) Entry(t transaction.Transaction) error {
+	if !e.firstEntry {
+		e.w.WriteByte(',')
+	}
+	e.firstEntry = false
+
+	entry, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(entry)
+
+	return err
+}
+
+func (e *jsonEncoder) EndSection(sec Section) error {
+	e.w.WriteString(`],"closing_balance":`)
+	e.w.WriteString(formatAmount(sec.ClosingBalance))
+	_, err := e.w.WriteString("}")
+
+	return err
+}
+
+func (e *jsonEncoder) End() error {
+	if _, err := e.w.WriteString("]}\n"); err != nil {
+		return err
+	}
+
+	return e.w.Flush()
+}
@@ -0,0 +1,146 @@
+package statement
+
+import (
+	"billing/internal/lib/transaction"
+	"encoding/xml"
+	"io"
+	"strconv"
+)
+
+const (
+	ofxHeader     = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n" + `<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n"
+	ofxTimeLayout = "20060102150405"
+	ofxBankID     = "BWG"
+)
+
+type ofxTransaction struct {
+	XMLName xml.Name `xml:"STMTTRN"`
+	Type    string   `xml:"TRNTYPE"`
+	Posted  string   `xml:"DTPOSTED"`
+	Amount  string   `xml:"TRNAMT"`
+	FITID   string   `xml:"FITID"`
+	Name    string   `xml:"NAME"`
+}
+
+// ofxEncoder writes an OFX 2.2 bank statement response with one STMTTRNRS per currency.
+// OFX has no opening balance field, so it is reported in BALLIST next to the ledger balance.
+type ofxEncoder struct {
+	w   io.Writer
+	enc *xml.Encoder
+	st  Statement
+	err error
+}
+
+func newOFXEncoder(w io.Writer) *ofxEncoder {
+	return &ofxEncoder{w: w, enc: xml.NewEncoder(w)}
+}
+
+func (e *ofxEncoder) Begin(st Statement) error {
+	e.st = st
+
+	if _, err := io.WriteString(e.w, ofxHeader); err != nil {
+		return err
+	}
+
+	e.start("OFX")
+	e.start("SIGNONMSGSRSV1")
+	e.start("SONRS")
+	e.status()
+	e.leaf("DTSERVER", st.GeneratedAt.UTC().Format(ofxTimeLayout))
+	e.leaf("LANGUAGE", "ENG")
+	e.end("SONRS")
+	e.end("SIGNONMSGSRSV1")
+	e.start("BANKMSGSRSV1")
+
+	return e.err
+}
+
+func (e *ofxEncoder) BeginSection(sec Section) error {
+	e.start("STMTTRNRS")
+	e.leaf("TRNUID", "0")
+	e.status()
+	e.start("STMTRS")
+	e.leaf("CURDEF", sec.Currency)
+	e.start("BANKACCTFROM")
+	e.leaf("BANKID", ofxBankID)
+	e.leaf("ACCTID", e.st.WalletID)
+	e.leaf("ACCTTYPE", "CHECKING")
+	e.end("BANKACCTFROM")
+	e.start("BANKTRANLIST")
+	e.leaf("DTSTART", e.st.From.UTC().Format(ofxTimeLayout))
+	e.leaf("DTEND", e.st.To.UTC().Format(ofxTimeLayout))
+
+	return e.err
+}
+
+func (e *ofxEncoder) Entry(t transaction.Transaction) error {
+	trnType := "CREDIT"
+	if SignedAmount(t) < 0 {
+		trnType = "DEBIT"
+	}
+
+	return e.enc.Encode(ofxTransaction{
+		Type:   trnType,
+		Posted: t.DateCreated.UTC().Format(ofxTimeLayout),
+		Amount: formatAmount(SignedAmount(t)),
+		FITID:  strconv.Itoa(t.ID),
+		Name:   t.Type,
+	})
+}
+
+func (e *ofxEncoder) EndSection(sec Section) error {
+	e.end("BANKTRANLIST")
+	e.start("LEDGERBAL")
+	e.leaf("BALAMT", formatAmount(sec.ClosingBalance))
+	e.leaf("DTASOF", e.st.To.UTC().Format(ofxTimeLayout))
+	e.end("LEDGERBAL")
+	e.start("BALLIST")
+	e.start("BAL")
+	e.leaf("NAME", "OPENING")
+	e.leaf("DESC", "Opening balance")
+	e.leaf("BALTYPE", "DOLLAR")
+	e.leaf("VALUE", formatAmount(sec.OpeningBalance))
+	e.leaf("DTASOF", e.st.From.UTC().Format(ofxTimeLayout))
+	e.end("BAL")
+	e.end("BALLIST")
+	e.end("STMTRS")
+	e.end("STMTTRNRS")
+
+	return e.err
+}
+
+func (e *ofxEncoder) End() error {
+	e.end("BANKMSGSRSV1")
+	e.end("OFX")
+
+	if e.err != nil {
+		return e.err
+	}
+
+	return e.enc.Flush()
+}
+
+func (e *ofxEncoder) status() {
+	e.start("STATUS")
+	e.leaf("CODE", "0")
+	e.leaf("SEVERITY", "INFO")
+	e.end("STATUS")
+}
+
+func (e *ofxEncoder) start(name string) {
+	if e.err == nil {
+		e.err = e.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: name}})
+	}
+}
+
+func (e *ofxEncoder) end(name string) {
+	if e.err == nil {
+		e.err = e.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}})
+	}
+}
+
+func (e *ofxEncoder) leaf(name string, value string) {
+	if e.err == nil {
+		e.err = e.enc.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: name}})
+	}
+}
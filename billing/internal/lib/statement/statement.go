@@ -0,0 +1,92 @@
+package statement
+
+import (
+	"billing/internal/lib/transaction"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	FormatCSV     = "csv"
+	FormatJSON    = "json"
+	FormatOFX     = "ofx"
+	FormatCAMT053 = "camt053"
+)
+
+var ErrUnknownFormat = errors.New("unknown statement format")
+
+// Statement describes the wallet and period a statement is generated for. To is exclusive.
+type Statement struct {
+	WalletID    string
+	From        time.Time
+	To          time.Time
+	GeneratedAt time.Time
+}
+
+// Section holds the balances of a single currency of the wallet for the statement period.
+type Section struct {
+	Currency       string
+	OpeningBalance float64
+	ClosingBalance float64
+}
+
+// Encoder writes a statement as it is produced: Begin once, then for every currency
+// BeginSection, its entries in date order and EndSection, and finally End.
+type Encoder interface {
+	Begin(st Statement) error
+	BeginSection(sec Section) error
+	Entry(t transaction.Transaction) error
+	EndSection(sec Section) error
+	End() error
+}
+
+func NewEncoder(format string, w io.Writer) (Encoder, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVEncoder(w), nil
+	case FormatJSON:
+		return newJSONEncoder(w), nil
+	case FormatOFX:
+		return newOFXEncoder(w), nil
+	case FormatCAMT053:
+		return newCAMT053Encoder(w), nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+func ContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv; charset=utf-8"
+	case FormatOFX:
+		return "application/x-ofx"
+	case FormatCAMT053:
+		return "application/xml"
+	default:
+		return "application/json; charset=utf-8"
+	}
+}
+
+func FileExtension(format string) string {
+	if format == FormatCAMT053 {
+		return "xml"
+	}
+
+	return format
+}
+
+// SignedAmount returns the effect the transaction has on the balance of its currency.
+func SignedAmount(t transaction.Transaction) float64 {
+	if t.Type == "Withdraw" {
+		return -t.Amount
+	}
+
+	return t.Amount
+}
+
+func formatAmount(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', -1, 64)
+}
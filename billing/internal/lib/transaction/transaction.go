@@ -3,9 +3,12 @@ package transaction
 import "time"
 
 type Transaction struct {
+	ID          int       `json:"id"`
 	WalletID    string    `json:"wallet_id"`
+	Currency    string    `json:"currency"`
 	Type        string    `json:"type"`
 	Status      string    `json:"status"`
 	Amount      float64   `json:"amount"`
 	DateCreated time.Time `json:"date_created"`
+	OperationID string    `json:"operation_id,omitempty"`
 }
@@ -0,0 +1,41 @@
+package webhook
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	timestamp := time.Unix(1700000000, 0)
+	body := []byte(`{"id":"e-1"}`)
+
+	// HMAC-SHA256 of `1700000000.{"id":"e-1"}` keyed with whsec_test
+	want := "sha256=48772b28582ffa69eed3c6d56b138febc0e79565f0d8418d090328a1fe544d71"
+	if got := Sign("whsec_test", timestamp, body); got != want {
+		t.Fatalf("Sign() = %s, want %s", got, want)
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp time.Time
+		body      []byte
+	}{
+		{"other secret", "whsec_other", timestamp, body},
+		{"other timestamp", "whsec_test", timestamp.Add(time.Second), body},
+		{"other body", "whsec_test", timestamp, []byte(`{"id":"e-2"}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sign(tt.secret, tt.timestamp, tt.body); got == want {
+				t.Errorf("Sign() = %s, the same signature", got)
+			}
+		})
+	}
+
+	// Only whole seconds are sent in the timestamp header
+	if got := Sign("whsec_test", timestamp.Add(500*time.Millisecond), body); got != want {
+		t.Errorf("Sign() within the same second = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,332 @@
+package replay
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/envelope"
+	"billing/internal/lib/iwrequest"
+	"billing/internal/lib/message"
+	"billing/internal/lib/operation"
+	"billing/internal/lib/transaction"
+	"billing/internal/retry"
+	"billing/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Outcomes of a replayed message.
+const (
+	// OutcomeApplied marks a message that was applied by the replay.
+	OutcomeApplied = "applied"
+	// OutcomeSkipped marks a message that was applied before.
+	OutcomeSkipped = "skipped"
+	// OutcomePending marks a message a dry run would apply.
+	OutcomePending = "pending"
+	// OutcomeRejected marks a message billing refused, e.g. for an unknown wallet.
+	OutcomeRejected = "rejected"
+	// OutcomeUndecodable marks a message whose value can't be decoded.
+	OutcomeUndecodable = "undecodable"
+	// OutcomeFailed marks a message that failed with an error that may go away.
+	OutcomeFailed = "failed"
+)
+
+// Range selects the messages of a topic to replay. Offsets are used per partition and
+// take precedence over times. Unset bounds are -1 and the zero time.
+type Range struct {
+	// Partition is the only partition replayed, or -1 for all.
+	Partition  int
+	FromOffset int64
+	// ToOffset is exclusive.
+	ToOffset int64
+	From     time.Time
+	// To is exclusive.
+	To time.Time
+}
+
+// Result reports what happened to a replayed message.
+type Result struct {
+	Partition     int       `json:"partition"`
+	Offset        int64     `json:"offset"`
+	Time          time.Time `json:"time"`
+	MessageID     string    `json:"message_id,omitempty"`
+	Type          string    `json:"type,omitempty"`
+	WalletID      string    `json:"wallet_id,omitempty"`
+	Currency      string    `json:"currency,omitempty"`
+	Amount        float64   `json:"amount,omitempty"`
+	Outcome       string    `json:"outcome"`
+	TransactionID int       `json:"transaction_id,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// Replayer applies the invoices and withdrawals of a topic again. Messages are
+// recognised by the same ID the consumer records, so messages that were applied before
+// are skipped. Messages without an operation ID that were consumed before billing
+// recorded processed messages can't be recognised and are applied again.
+type Replayer struct {
+	brokers       []string
+	billingWorker BillingWorker
+	dryRun        bool
+}
+
+type BillingWorker interface {
+	Invoice(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error)
+	Withdraw(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error)
+	IsMessageProcessed(messageID string) (bool, error)
+	GetTransactionByOperation(operationID string) (*transaction.Transaction, error)
+}
+
+// New replays from the brokers into billingWorker. A dry run only reports which messages
+// would be applied.
+func New(brokers []string, billingWorker BillingWorker, dryRun bool) *Replayer {
+	return &Replayer{
+		brokers:       brokers,
+		billingWorker: billingWorker,
+		dryRun:        dryRun,
+	}
+}
+
+// Replay replays the messages of topic in rng partition by partition, in offset order,
+// and calls fn with the result of each. legacyType is the message type of bare payloads
+// produced before the envelope.
+func (r *Replayer) Replay(ctx context.Context, topic string, legacyType string, rng Range, fn func(Result) error) error {
+	const op = "replay.Replayer.Replay"
+
+	partitions, err := r.readPartitions(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	for _, partition := range partitions {
+		if rng.Partition >= 0 && partition != rng.Partition {
+			continue
+		}
+
+		first, last, err := r.readBounds(ctx, topic, partition, rng)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		if first >= last {
+			continue
+		}
+
+		err = r.readRange(ctx, topic, partition, first, last, func(m kafka.Message) error {
+			return fn(r.replay(ctx, m, legacyType))
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return nil
+}
+
+// replay applies one message, or checks whether it would be applied on a dry run.
+func (r *Replayer) replay(ctx context.Context, m kafka.Message, legacyType string) Result {
+	result := Result{
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Time:      m.Time,
+	}
+
+	env, err := envelope.Decode(m.Value, header(m, envelope.HeaderContentType), legacyType)
+	if err != nil {
+		return failed(result, OutcomeUndecodable, err)
+	}
+
+	request, err := iwrequest.Decode(env)
+	if err != nil {
+		return failed(result, OutcomeUndecodable, err)
+	}
+
+	operationID := header(m, operation.HeaderID)
+	if operationID == "" {
+		operationID = env.ID
+	}
+
+	result.MessageID = message.ID(operationID, m.Topic, m.Partition, m.Offset)
+	result.Type = env.Type
+	result.WalletID = request.WalletID
+	result.Currency = request.Currency
+	result.Amount = request.Amount
+
+	applied, transactionID, err := r.applied(result.MessageID, operationID)
+	if err != nil {
+		return failed(result, OutcomeFailed, err)
+	}
+
+	if applied {
+		result.Outcome = OutcomeSkipped
+		result.TransactionID = transactionID
+		return result
+	}
+
+	if r.dryRun {
+		result.Outcome = OutcomePending
+		return result
+	}
+
+	ctx = audit.WithSource(ctx, fmt.Sprintf("replay:%s/%d@%d", m.Topic, m.Partition, m.Offset))
+	ctx = audit.WithActor(ctx, "replay")
+	ctx = operation.WithID(ctx, operationID)
+	ctx = message.WithID(ctx, result.MessageID)
+
+	switch env.Type {
+	case envelope.TypeInvoice:
+		transactionID, err = r.billingWorker.Invoice(ctx, request.WalletID, "Invoice", request.Currency, request.Amount)
+	case envelope.TypeWithdraw:
+		transactionID, err = r.billingWorker.Withdraw(ctx, request.WalletID, "Withdraw", request.Currency, request.Amount)
+	default:
+		return failed(result, OutcomeUndecodable, fmt.Errorf("unknown message type %q", env.Type))
+	}
+
+	result.TransactionID = transactionID
+
+	switch {
+	case err == nil:
+		result.Outcome = OutcomeApplied
+	case errors.Is(err, storage.ErrMessageProcessed):
+		result.Outcome = OutcomeSkipped
+	case retry.IsTransient(err):
+		return failed(result, OutcomeFailed, err)
+	default:
+		return failed(result, OutcomeRejected, err)
+	}
+
+	return result
+}
+
+// applied reports whether the message was applied before, by its message ID or by a
+// transaction recorded for its operation.
+func (r *Replayer) applied(messageID string, operationID string) (bool, int, error) {
+	processed, err := r.billingWorker.IsMessageProcessed(messageID)
+	if err != nil || processed {
+		return processed, 0, err
+	}
+
+	if operationID == "" {
+		return false, 0, nil
+	}
+
+	t, err := r.billingWorker.GetTransactionByOperation(operationID)
+	if errors.Is(err, storage.ErrTransactionNotFound) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+
+	return true, t.ID, nil
+}
+
+func failed(result Result, outcome string, err error) Result {
+	result.Outcome = outcome
+	result.Error = err.Error()
+
+	return result
+}
+
+func (r *Replayer) readPartitions(ctx context.Context, topic string) ([]int, error) {
+	conn, err := kafka.DialContext(ctx, "tcp", r.brokers[0])
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(partitions))
+	for _, p := range partitions {
+		ids = append(ids, p.ID)
+	}
+
+	return ids, nil
+}
+
+// readBounds returns the offsets [first, last) of the partition selected by rng.
+func (r *Replayer) readBounds(ctx context.Context, topic string, partition int, rng Range) (int64, int64, error) {
+	conn, err := kafka.DialLeader(ctx, "tcp", r.brokers[0], topic, partition)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	first, last, err := conn.ReadOffsets()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch {
+	case rng.FromOffset >= 0:
+		first = max(first, rng.FromOffset)
+	case !rng.From.IsZero():
+		offset, err := conn.ReadOffset(rng.From)
+		if err != nil {
+			return 0, 0, err
+		}
+		first = max(first, offset)
+	}
+
+	switch {
+	case rng.ToOffset >= 0:
+		last = min(last, rng.ToOffset)
+	case !rng.To.IsZero():
+		offset, err := conn.ReadOffset(rng.To)
+		if err != nil {
+			return 0, 0, err
+		}
+		last = min(last, offset)
+	}
+
+	return first, last, nil
+}
+
+// readRange reads the messages of a partition in [first, last).
+func (r *Replayer) readRange(ctx context.Context, topic string, partition int, first int64, last int64, fn func(kafka.Message) error) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   r.brokers,
+		Topic:     topic,
+		Partition: partition,
+		MaxBytes:  10e6,
+	})
+	defer reader.Close()
+
+	if err := reader.SetOffset(first); err != nil {
+		return err
+	}
+
+	for {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		if m.Offset >= last {
+			return nil
+		}
+
+		if err := fn(m); err != nil {
+			return err
+		}
+
+		if m.Offset+1 >= last {
+			return nil
+		}
+	}
+}
+
+func header(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,269 @@
+package replay
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/envelope"
+	"billing/internal/lib/message"
+	"billing/internal/lib/operation"
+	"billing/internal/lib/transaction"
+	"billing/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// call is an invoice or withdrawal the replay applied, with what it found in the context.
+type call struct {
+	transactionType string
+	walletID        string
+	operationID     string
+	messageID       string
+	actor           string
+	source          string
+}
+
+// fakeWorker knows the processed message IDs and the transactions of operations, and
+// answers every invoice and withdrawal with transaction 42 or err.
+type fakeWorker struct {
+	processed    map[string]bool
+	processedErr error
+	operations   map[string]int
+	err          error
+	calls        []call
+}
+
+func (w *fakeWorker) Invoice(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error) {
+	return w.apply(ctx, walletID, transactionType)
+}
+
+func (w *fakeWorker) Withdraw(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error) {
+	return w.apply(ctx, walletID, transactionType)
+}
+
+func (w *fakeWorker) apply(ctx context.Context, walletID string, transactionType string) (int, error) {
+	w.calls = append(w.calls, call{
+		transactionType: transactionType,
+		walletID:        walletID,
+		operationID:     operation.IDFrom(ctx),
+		messageID:       message.IDFrom(ctx),
+		actor:           audit.ActorFrom(ctx),
+		source:          audit.SourceFrom(ctx),
+	})
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	return 42, nil
+}
+
+func (w *fakeWorker) IsMessageProcessed(messageID string) (bool, error) {
+	return w.processed[messageID], w.processedErr
+}
+
+func (w *fakeWorker) GetTransactionByOperation(operationID string) (*transaction.Transaction, error) {
+	id, ok := w.operations[operationID]
+	if !ok {
+		return nil, fmt.Errorf("storage.GetTransactionByOperation: %w", storage.ErrTransactionNotFound)
+	}
+
+	return &transaction.Transaction{ID: id}, nil
+}
+
+// enveloped is a message at invoices/2/17 with a version 1 JSON envelope of type, and the
+// operation-id header if operationID isn't empty.
+func enveloped(envelopeID string, typ string, operationID string) kafka.Message {
+	m := kafka.Message{
+		Topic:     "invoices",
+		Partition: 2,
+		Offset:    17,
+		Value: []byte(fmt.Sprintf(`{"id":%q,"type":%q,"version":1,"payload":{"wallet_id":"w-1","currency":"USD","amount":10}}`,
+			envelopeID, typ)),
+		Headers: []kafka.Header{{Key: envelope.HeaderContentType, Value: []byte(envelope.ContentTypeJSON)}},
+	}
+
+	if operationID != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: operation.HeaderID, Value: []byte(operationID)})
+	}
+
+	return m
+}
+
+// legacy is a bare invoice payload at invoices/2/17, produced before the envelope.
+func legacy() kafka.Message {
+	return kafka.Message{
+		Topic:     "invoices",
+		Partition: 2,
+		Offset:    17,
+		Value:     []byte(`{"wallet_id":"w-1","currency":"USD","amount":10}`),
+	}
+}
+
+func TestReplay(t *testing.T) {
+	source := "replay:invoices/2@17"
+
+	tests := []struct {
+		name              string
+		dryRun            bool
+		worker            *fakeWorker
+		message           kafka.Message
+		wantOutcome       string
+		wantMessageID     string
+		wantTransactionID int
+		wantError         bool
+		wantCalls         []call
+	}{
+		{
+			name:              "invoice applied",
+			worker:            &fakeWorker{},
+			message:           enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:       OutcomeApplied,
+			wantMessageID:     "op-1",
+			wantTransactionID: 42,
+			wantCalls:         []call{{"Invoice", "w-1", "op-1", "op-1", "replay", source}},
+		},
+		{
+			name:              "withdrawal applied",
+			worker:            &fakeWorker{},
+			message:           enveloped("e-1", envelope.TypeWithdraw, "op-1"),
+			wantOutcome:       OutcomeApplied,
+			wantMessageID:     "op-1",
+			wantTransactionID: 42,
+			wantCalls:         []call{{"Withdraw", "w-1", "op-1", "op-1", "replay", source}},
+		},
+		{
+			name:              "envelope ID without operation header",
+			worker:            &fakeWorker{},
+			message:           enveloped("e-1", envelope.TypeInvoice, ""),
+			wantOutcome:       OutcomeApplied,
+			wantMessageID:     "e-1",
+			wantTransactionID: 42,
+			wantCalls:         []call{{"Invoice", "w-1", "e-1", "e-1", "replay", source}},
+		},
+		{
+			name:              "legacy payload",
+			worker:            &fakeWorker{},
+			message:           legacy(),
+			wantOutcome:       OutcomeApplied,
+			wantMessageID:     "invoices/2/17",
+			wantTransactionID: 42,
+			wantCalls:         []call{{"Invoice", "w-1", "", "invoices/2/17", "replay", source}},
+		},
+		{
+			name:          "skipped by message ID",
+			worker:        &fakeWorker{processed: map[string]bool{"op-1": true}},
+			message:       enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:   OutcomeSkipped,
+			wantMessageID: "op-1",
+		},
+		{
+			name:          "legacy payload skipped by message ID",
+			worker:        &fakeWorker{processed: map[string]bool{"invoices/2/17": true}},
+			message:       legacy(),
+			wantOutcome:   OutcomeSkipped,
+			wantMessageID: "invoices/2/17",
+		},
+		{
+			name:              "skipped by operation",
+			worker:            &fakeWorker{operations: map[string]int{"op-1": 7}},
+			message:           enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:       OutcomeSkipped,
+			wantMessageID:     "op-1",
+			wantTransactionID: 7,
+		},
+		{
+			name:          "recorded while replaying",
+			worker:        &fakeWorker{err: fmt.Errorf("storage.PerformInvoiceTransaction: %w", storage.ErrMessageProcessed)},
+			message:       enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:   OutcomeSkipped,
+			wantMessageID: "op-1",
+			wantCalls:     []call{{"Invoice", "w-1", "op-1", "op-1", "replay", source}},
+		},
+		{
+			name:          "pending on dry run",
+			dryRun:        true,
+			worker:        &fakeWorker{},
+			message:       enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:   OutcomePending,
+			wantMessageID: "op-1",
+		},
+		{
+			name:              "skipped on dry run",
+			dryRun:            true,
+			worker:            &fakeWorker{operations: map[string]int{"op-1": 7}},
+			message:           enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:       OutcomeSkipped,
+			wantMessageID:     "op-1",
+			wantTransactionID: 7,
+		},
+		{
+			name:          "rejected",
+			worker:        &fakeWorker{err: fmt.Errorf("storage.PerformInvoiceTransaction: %w", storage.ErrWalletNotFound)},
+			message:       enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:   OutcomeRejected,
+			wantMessageID: "op-1",
+			wantError:     true,
+			wantCalls:     []call{{"Invoice", "w-1", "op-1", "op-1", "replay", source}},
+		},
+		{
+			name:          "failed",
+			worker:        &fakeWorker{err: fmt.Errorf("storage.PerformInvoiceTransaction: %w", context.DeadlineExceeded)},
+			message:       enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:   OutcomeFailed,
+			wantMessageID: "op-1",
+			wantError:     true,
+			wantCalls:     []call{{"Invoice", "w-1", "op-1", "op-1", "replay", source}},
+		},
+		{
+			name:          "failed to check the message",
+			worker:        &fakeWorker{processedErr: errors.New("connection refused")},
+			message:       enveloped("e-1", envelope.TypeInvoice, "op-1"),
+			wantOutcome:   OutcomeFailed,
+			wantMessageID: "op-1",
+			wantError:     true,
+		},
+		{
+			name:          "unknown type",
+			worker:        &fakeWorker{},
+			message:       enveloped("e-1", "refund", "op-1"),
+			wantOutcome:   OutcomeUndecodable,
+			wantMessageID: "op-1",
+			wantError:     true,
+		},
+		{
+			name:        "not JSON",
+			worker:      &fakeWorker{},
+			message:     kafka.Message{Topic: "invoices", Partition: 2, Offset: 17, Value: []byte("invoice w-1 10 USD")},
+			wantOutcome: OutcomeUndecodable,
+			wantError:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(nil, tt.worker, tt.dryRun)
+
+			got := r.replay(context.Background(), tt.message, envelope.TypeInvoice)
+
+			if got.Outcome != tt.wantOutcome || got.MessageID != tt.wantMessageID || got.TransactionID != tt.wantTransactionID {
+				t.Errorf("result %+v, want %s of %s with transaction %d", got, tt.wantOutcome, tt.wantMessageID, tt.wantTransactionID)
+			}
+			if (got.Error != "") != tt.wantError {
+				t.Errorf("error %q, want one: %t", got.Error, tt.wantError)
+			}
+			if got.Partition != 2 || got.Offset != 17 {
+				t.Errorf("result at %d@%d, want 2@17", got.Partition, got.Offset)
+			}
+			if got.Outcome != OutcomeUndecodable && (got.WalletID != "w-1" || got.Currency != "USD" || got.Amount != 10) {
+				t.Errorf("result %+v doesn't carry the request", got)
+			}
+			if !reflect.DeepEqual(tt.worker.calls, tt.wantCalls) {
+				t.Errorf("calls %+v, want %+v", tt.worker.calls, tt.wantCalls)
+			}
+		})
+	}
+}
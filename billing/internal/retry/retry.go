@@ -0,0 +1,166 @@
+package retry
+
+import (
+	"billing/internal/storage"
+	"bus"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Headers added to a message when it is scheduled for another attempt. The original
+// headers are kept.
+const (
+	HeaderAttempt           = "retry-attempt"
+	HeaderNotBefore         = "retry-not-before"
+	HeaderError             = "retry-error"
+	HeaderOriginalTopic     = "retry-original-topic"
+	HeaderOriginalPartition = "retry-original-partition"
+	HeaderOriginalOffset    = "retry-original-offset"
+)
+
+// Policy spaces out the attempts of a message exponentially. Attempt n waits
+// Backoff * 2^(n-1), but never longer than MaxBackoff.
+type Policy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+}
+
+func (p Policy) Delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	return min(delay, p.MaxBackoff)
+}
+
+// Topic returns the retry topic of a topic for the given attempt. Every attempt has its
+// own topic, so all messages in a topic wait for the same delay and stay in order.
+func Topic(topic string, attempt int) string {
+	return fmt.Sprintf("%s.retry.%d", topic, attempt)
+}
+
+// Attempt returns the number of retries the message already is, 0 for a message that was
+// consumed from its original topic.
+func Attempt(message bus.Message) int {
+	attempt, _ := strconv.Atoi(message.Header(HeaderAttempt))
+
+	return attempt
+}
+
+// NotBefore returns when the message is due. It's the zero time for a message that was
+// consumed from its original topic.
+func NotBefore(message bus.Message) time.Time {
+	notBefore, _ := time.Parse(time.RFC3339Nano, message.Header(HeaderNotBefore))
+
+	return notBefore
+}
+
+// Origin returns the position the message was first consumed from, which stays the same
+// across retries.
+func Origin(message bus.Message) (string, int, int64) {
+	topic := message.Header(HeaderOriginalTopic)
+	if topic == "" {
+		return message.Topic, message.Partition, message.Offset
+	}
+
+	partition, _ := strconv.Atoi(message.Header(HeaderOriginalPartition))
+	offset, _ := strconv.ParseInt(message.Header(HeaderOriginalOffset), 10, 64)
+
+	return topic, partition, offset
+}
+
+// IsTransient reports whether a failed attempt may succeed later. Rejections by billing,
+// such as an unknown wallet, and errors the database raises for the data itself are
+// permanent. Connection problems, serialization failures, deadlocks and errors that
+// can't be classified are retried.
+func IsTransient(err error) bool {
+	if errors.Is(err, storage.ErrWalletNotFound) || errors.Is(err, storage.ErrSubwalletNotFound) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case strings.HasPrefix(pgErr.Code, "08"), // connection exception
+			strings.HasPrefix(pgErr.Code, "53"), // insufficient resources
+			strings.HasPrefix(pgErr.Code, "57"), // operator intervention, e.g. shutdown
+			pgErr.Code == "40001",               // serialization failure
+			pgErr.Code == "40P01",               // deadlock detected
+			pgErr.Code == "55P03":               // lock not available
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Connection problems surface as network, driver or context errors. They are retried
+	// like every other error that can't be classified, which ends up in the dead-letter
+	// topic once its attempts are used up.
+	return true
+}
+
+// Writer schedules failed messages for another attempt on the retry topic of the attempt.
+type Writer struct {
+	publisher bus.Publisher
+	policy    Policy
+}
+
+func NewWriter(publisher bus.Publisher, policy Policy) *Writer {
+	return &Writer{
+		publisher: publisher,
+		policy:    policy,
+	}
+}
+
+// Send schedules the next attempt of the message and reports false without sending it if
+// the message used up all its attempts.
+func (w *Writer) Send(ctx context.Context, message bus.Message, cause error) (bool, error) {
+	const op = "retry.Writer.Send"
+
+	attempt := Attempt(message) + 1
+	if attempt > w.policy.MaxAttempts {
+		return false, nil
+	}
+
+	topic, partition, offset := Origin(message)
+
+	headers := []bus.Header{
+		{Key: HeaderAttempt, Value: []byte(strconv.Itoa(attempt))},
+		{Key: HeaderNotBefore, Value: []byte(time.Now().Add(w.policy.Delay(attempt)).UTC().Format(time.RFC3339Nano))},
+		{Key: HeaderError, Value: []byte(cause.Error())},
+		{Key: HeaderOriginalTopic, Value: []byte(topic)},
+		{Key: HeaderOriginalPartition, Value: []byte(strconv.Itoa(partition))},
+		{Key: HeaderOriginalOffset, Value: []byte(strconv.FormatInt(offset, 10))},
+	}
+	for _, h := range message.Headers {
+		if !IsRetryHeader(h.Key) {
+			headers = append(headers, h)
+		}
+	}
+
+	err := w.publisher.Publish(ctx, bus.Message{
+		Topic:   Topic(topic, attempt),
+		Key:     message.Key,
+		Value:   message.Value,
+		Headers: headers,
+	})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return true, nil
+}
+
+// IsRetryHeader reports whether the header was added when the message was scheduled for
+// a retry.
+func IsRetryHeader(key string) bool {
+	return strings.HasPrefix(key, "retry-")
+}
@@ -0,0 +1,188 @@
+package retry
+
+import (
+	"billing/internal/storage"
+	"bus"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func pgError(code string) error {
+	return &pgconn.PgError{Code: code, Message: "pg error " + code}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"wallet not found", storage.ErrWalletNotFound, false},
+		{"wrapped subwallet not found", fmt.Errorf("storage.PerformWithdrawTransaction: %w", storage.ErrSubwalletNotFound), false},
+
+		{"check violation", pgError("23514"), false},
+		{"unique violation", pgError("23505"), false},
+		{"foreign key violation", pgError("23503"), false},
+		{"numeric value out of range", pgError("22003"), false},
+		{"invalid text representation", pgError("22P02"), false},
+		{"raised by a function", pgError("P0001"), false},
+		{"undefined table", pgError("42P01"), false},
+
+		{"connection failure", pgError("08006"), true},
+		{"too many connections", pgError("53300"), true},
+		{"admin shutdown", pgError("57P01"), true},
+		{"serialization failure", pgError("40001"), true},
+		{"deadlock", pgError("40P01"), true},
+		{"lock not available", pgError("55P03"), true},
+		{"wrapped serialization failure", fmt.Errorf("storage.PerformInvoiceTransaction: %w", pgError("40001")), true},
+		{"wrapped check violation", fmt.Errorf("storage.PerformInvoiceTransaction: %w", pgError("23514")), false},
+
+		{"deadline exceeded", context.DeadlineExceeded, true},
+		{"canceled", context.Canceled, true},
+		{"wrapped deadline", fmt.Errorf("storage.PerformInvoiceTransaction: %w", context.DeadlineExceeded), true},
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"unclassified", errors.New("something went wrong"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	policy := Policy{MaxAttempts: 6, Backoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, w := range want {
+		if got := policy.Delay(i + 1); got != w {
+			t.Errorf("Delay(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
+
+// fakePublisher keeps the published messages.
+type fakePublisher struct {
+	bus.Publisher
+
+	err       error
+	published []bus.Message
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, messages ...bus.Message) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	f.published = append(f.published, messages...)
+
+	return nil
+}
+
+// consumed returns the message as it is consumed from the topic it was published to.
+func consumed(m bus.Message, offset int64) bus.Message {
+	m.Partition = 2
+	m.Offset = offset
+
+	return m
+}
+
+func TestSendProgression(t *testing.T) {
+	publisher := &fakePublisher{}
+	policy := Policy{MaxAttempts: 3, Backoff: time.Second, MaxBackoff: time.Minute}
+	w := NewWriter(publisher, policy)
+
+	message := bus.Message{
+		Topic:     "invoices",
+		Partition: 4,
+		Offset:    17,
+		Key:       []byte("w-1"),
+		Value:     []byte(`{"wallet_id":"w-1"}`),
+		Headers:   []bus.Header{{Key: "operation-id", Value: []byte("op-1")}},
+	}
+
+	if got := Attempt(message); got != 0 {
+		t.Fatalf("Attempt() of the original = %d", got)
+	}
+	if got := NotBefore(message); !got.IsZero() {
+		t.Fatalf("NotBefore() of the original = %s", got)
+	}
+
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		before := time.Now()
+
+		cause := fmt.Errorf("attempt %d: %w", attempt, pgError("40001"))
+
+		sent, err := w.Send(context.Background(), message, cause)
+		if err != nil || !sent {
+			t.Fatalf("attempt %d: Send() = %v, %v", attempt, sent, err)
+		}
+		if len(publisher.published) != attempt {
+			t.Fatalf("attempt %d: %d messages published", attempt, len(publisher.published))
+		}
+
+		next := publisher.published[attempt-1]
+
+		if want := "invoices.retry." + strconv.Itoa(attempt); next.Topic != want {
+			t.Errorf("attempt %d: topic %q, want %q", attempt, next.Topic, want)
+		}
+		if got := Attempt(next); got != attempt {
+			t.Errorf("attempt %d: Attempt() = %d", attempt, got)
+		}
+		if topic, partition, offset := Origin(next); topic != "invoices" || partition != 4 || offset != 17 {
+			t.Errorf("attempt %d: Origin() = %s, %d, %d", attempt, topic, partition, offset)
+		}
+		if notBefore := NotBefore(next); notBefore.Before(before.Add(policy.Delay(attempt))) || notBefore.After(time.Now().Add(policy.Delay(attempt))) {
+			t.Errorf("attempt %d: NotBefore() = %s, want %s after %s", attempt, notBefore, policy.Delay(attempt), before)
+		}
+		if got := next.Header(HeaderError); got != cause.Error() {
+			t.Errorf("attempt %d: error header %q", attempt, got)
+		}
+		if next.Header("operation-id") != "op-1" || string(next.Key) != "w-1" || string(next.Value) != string(message.Value) {
+			t.Errorf("attempt %d: message %+v doesn't carry the original", attempt, next)
+		}
+
+		// The retry headers of the previous attempt are replaced, not repeated
+		count := 0
+		for _, h := range next.Headers {
+			if h.Key == HeaderAttempt {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("attempt %d: %d attempt headers", attempt, count)
+		}
+
+		message = consumed(next, int64(100+attempt))
+	}
+
+	// The last attempt failed too, the message goes to the dead-letter topic
+	sent, err := w.Send(context.Background(), message, pgError("40001"))
+	if err != nil || sent {
+		t.Fatalf("Send() after %d attempts = %v, %v, want false", policy.MaxAttempts, sent, err)
+	}
+	if len(publisher.published) != policy.MaxAttempts {
+		t.Errorf("%d messages published, want %d", len(publisher.published), policy.MaxAttempts)
+	}
+}
+
+func TestSendPublishError(t *testing.T) {
+	w := NewWriter(&fakePublisher{err: errors.New("broker down")}, Policy{MaxAttempts: 1, Backoff: time.Second, MaxBackoff: time.Second})
+
+	sent, err := w.Send(context.Background(), bus.Message{Topic: "invoices"}, errors.New("failed"))
+	if err == nil || sent {
+		t.Errorf("Send() = %v, %v, want an error", sent, err)
+	}
+}
@@ -1,10 +1,23 @@
 package service
 
 import (
+	"billing/internal/lib/audit"
 	"billing/internal/lib/balance"
+	"billing/internal/lib/hashchain"
+	"billing/internal/lib/interest"
+	"billing/internal/lib/logger/sl"
+	"billing/internal/lib/message"
+	"billing/internal/lib/operation"
+	"billing/internal/lib/statement"
 	"billing/internal/lib/transaction"
+	"billing/internal/lib/webhook"
+	"billing/internal/storage"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"time"
 )
 
 type Service struct {
@@ -13,6 +26,12 @@ type Service struct {
 	balanceProvider     BalanceProvider
 	billingProvider     BillingProvider
 	transactionProvider TransactionProvider
+	statementProvider   StatementProvider
+	interestProvider    InterestProvider
+	auditLog            AuditLog
+	chainProvider       ChainProvider
+	webhookProvider     WebhookProvider
+	chainSigner         *hashchain.Signer
 }
 
 func New(
@@ -21,6 +40,12 @@ func New(
 	balanceProvider BalanceProvider,
 	billingProvider BillingProvider,
 	transactionProvider TransactionProvider,
+	statementProvider StatementProvider,
+	interestProvider InterestProvider,
+	auditLog AuditLog,
+	chainProvider ChainProvider,
+	webhookProvider WebhookProvider,
+	chainSigner *hashchain.Signer,
 ) *Service {
 	return &Service{
 		log:                 log,
@@ -28,11 +53,17 @@ func New(
 		balanceProvider:     balanceProvider,
 		billingProvider:     billingProvider,
 		transactionProvider: transactionProvider,
+		statementProvider:   statementProvider,
+		interestProvider:    interestProvider,
+		auditLog:            auditLog,
+		chainProvider:       chainProvider,
+		webhookProvider:     webhookProvider,
+		chainSigner:         chainSigner,
 	}
 }
 
 type WalletCreator interface {
-	CreateWallet() (string, string, error)
+	CreateWallet(accountID string, entry audit.Entry) (string, string, error)
 }
 
 type BalanceProvider interface {
@@ -40,12 +71,53 @@ type BalanceProvider interface {
 }
 
 type BillingProvider interface {
-	PerformWithdrawTransaction(walletID string, transactionType string, currency string, amount float64) (int, error)
-	PerformInvoiceTransaction(walletID string, transactionType string, currency string, amount float64) (int, error)
+	PerformWithdrawTransaction(messageID string, operationID string, walletID string, transactionType string, currency string, amount float64, entry audit.Entry) (int, error)
+	PerformInvoiceTransaction(messageID string, operationID string, walletID string, transactionType string, currency string, amount float64, entry audit.Entry) (int, error)
+	IsMessageProcessed(messageID string) (bool, error)
 }
 
 type TransactionProvider interface {
 	GetTransaction(id int) (*transaction.Transaction, error)
+	GetTransactionByOperation(operationID string) (*transaction.Transaction, error)
+}
+
+type StatementProvider interface {
+	GetStatementSections(walletID string, from time.Time, to time.Time) ([]statement.Section, error)
+	StreamStatementEntries(walletID string, from time.Time, to time.Time, fn func(transaction.Transaction) error) error
+}
+
+type InterestProvider interface {
+	GetInterestRates() ([]interest.Rate, error)
+	SetInterestRate(currency string, annualRate float64, entry audit.Entry) (*interest.Rate, error)
+	GetLastAccruedDay() (time.Time, bool, error)
+	AccrueInterest(day time.Time, entry audit.Entry) (int, error)
+	PostInterest(before time.Time, entry audit.Entry) (int, error)
+}
+
+type AuditLog interface {
+	AppendAudit(entry audit.Entry) error
+	GetAuditEntries(filter audit.Filter) ([]audit.Entry, error)
+}
+
+type ChainProvider interface {
+	StreamChain(walletID string, fn func(hashchain.Record) error) error
+	GetChainHead(walletID string) (*hashchain.Head, error)
+	GetChainWallets() ([]string, error)
+	GetChainSignatures(walletID string) ([]hashchain.Signature, error)
+	GetUnsignedChainHeads(keyID string) ([]hashchain.Head, error)
+	AddChainSignatures(sigs []hashchain.Signature, entry audit.Entry) error
+}
+
+type WebhookProvider interface {
+	CreateWebhookSubscription(sub webhook.Subscription, entry audit.Entry) (*webhook.Subscription, error)
+	GetWebhookSubscriptions(accountID string) ([]webhook.Subscription, error)
+	DeleteWebhookSubscription(id int, entry audit.Entry) error
+	GetWalletAccount(walletID string) (string, error)
+	EnqueueWebhookDeliveries(accountID string, eventID string, eventType string, payload []byte) (int, error)
+	ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]webhook.Delivery, error)
+	RecordWebhookAttempt(id int, status string, statusCode int, lastError string, nextAttemptAt time.Time) error
+	GetWebhookDeliveries(filter webhook.DeliveryFilter) ([]webhook.Delivery, error)
+	RedeliverWebhook(id int, entry audit.Entry) (*webhook.Delivery, error)
 }
 
 func (s *Service) GetTransaction(id int) (*transaction.Transaction, error) {
@@ -59,17 +131,56 @@ func (s *Service) GetTransaction(id int) (*transaction.Transaction, error) {
 	return transact, nil
 }
 
-func (s *Service) CreateWallet() (string, string, error) {
+func (s *Service) GetTransactionByOperation(operationID string) (*transaction.Transaction, error) {
+	const op = "service.GetTransactionByOperation"
+
+	transact, err := s.transactionProvider.GetTransactionByOperation(operationID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return transact, nil
+}
+
+func (s *Service) IsMessageProcessed(messageID string) (bool, error) {
+	const op = "service.IsMessageProcessed"
+
+	processed, err := s.billingProvider.IsMessageProcessed(messageID)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return processed, nil
+}
+
+// CreateWallet creates a wallet for the account, or for a new account if accountID is
+// empty.
+func (s *Service) CreateWallet(ctx context.Context, accountID string) (string, string, error) {
 	const op = "service.CreateWallet"
 
-	id, account_id, err := s.walletCreator.CreateWallet()
+	entry := s.auditEntry(ctx, op, map[string]any{"account_id": accountID})
+
+	id, account_id, err := s.walletCreator.CreateWallet(accountID, entry)
 	if err != nil {
+		s.auditFailure(entry, err)
 		return "", "", fmt.Errorf("%s: %w", op, err)
 	}
 
 	return id, account_id, nil
 }
 
+// GetWalletAccount returns the account the wallet belongs to.
+func (s *Service) GetWalletAccount(walletID string) (string, error) {
+	const op = "service.GetWalletAccount"
+
+	accountID, err := s.webhookProvider.GetWalletAccount(walletID)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return accountID, nil
+}
+
 func (s *Service) GetBalance(walletID string) ([]balance.BalanceResponse, error) {
 	const op = "service.GetBalance"
 
@@ -81,24 +192,306 @@ func (s *Service) GetBalance(walletID string) ([]balance.BalanceResponse, error)
 	return balances, nil
 }
 
-func (s *Service) Withdraw(walletID string, transactionType string, currency string, amount float64) (int, error) {
+func (s *Service) Withdraw(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error) {
 	const op = "service.Withdraw"
 
-	id, err := s.billingProvider.PerformWithdrawTransaction(walletID, transactionType, currency, amount)
+	operationID := operation.IDFrom(ctx)
+	messageID := message.IDFrom(ctx)
+
+	entry := s.auditEntry(ctx, op, map[string]any{
+		"operation_id": operationID,
+		"message_id":   messageID,
+		"wallet_id":    walletID,
+		"type":         transactionType,
+		"currency":     currency,
+		"amount":       amount,
+	})
+
+	id, err := s.billingProvider.PerformWithdrawTransaction(messageID, operationID, walletID, transactionType, currency, amount, entry)
+	if errors.Is(err, storage.ErrMessageProcessed) {
+		// Redelivered message, the first delivery was applied and audited
+		return id, fmt.Errorf("%s: %w", op, err)
+	}
 	if err != nil {
+		s.auditFailure(entry, err)
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return id, nil
 }
 
-func (s *Service) Invoice(walletID string, transactionType string, currency string, amount float64) (int, error) {
+func (s *Service) Invoice(ctx context.Context, walletID string, transactionType string, currency string, amount float64) (int, error) {
 	const op = "service.Invoice"
 
-	id, err := s.billingProvider.PerformInvoiceTransaction(walletID, transactionType, currency, amount)
+	operationID := operation.IDFrom(ctx)
+	messageID := message.IDFrom(ctx)
+
+	entry := s.auditEntry(ctx, op, map[string]any{
+		"operation_id": operationID,
+		"message_id":   messageID,
+		"wallet_id":    walletID,
+		"type":         transactionType,
+		"currency":     currency,
+		"amount":       amount,
+	})
+
+	id, err := s.billingProvider.PerformInvoiceTransaction(messageID, operationID, walletID, transactionType, currency, amount, entry)
+	if errors.Is(err, storage.ErrMessageProcessed) {
+		// Redelivered message, the first delivery was applied and audited
+		return id, fmt.Errorf("%s: %w", op, err)
+	}
 	if err != nil {
+		s.auditFailure(entry, err)
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return id, nil
 }
+
+// WriteStatement streams the statement of the wallet for [from, to) into enc. Every currency
+// of the wallet gets a section, including the ones without transactions in the period.
+func (s *Service) WriteStatement(walletID string, from time.Time, to time.Time, enc statement.Encoder) error {
+	const op = "service.WriteStatement"
+
+	sections, err := s.statementProvider.GetStatementSections(walletID, from, to)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = enc.Begin(statement.Statement{
+		WalletID:    walletID,
+		From:        from,
+		To:          to,
+		GeneratedAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// Sections and entries are both ordered by currency, so they can be merged while streaming.
+	current := -1
+	advance := func() error {
+		if current >= 0 {
+			if err := enc.EndSection(sections[current]); err != nil {
+				return err
+			}
+		}
+		current++
+		if current < len(sections) {
+			return enc.BeginSection(sections[current])
+		}
+		return nil
+	}
+
+	err = s.statementProvider.StreamStatementEntries(walletID, from, to, func(t transaction.Transaction) error {
+		for current < len(sections) && (current < 0 || sections[current].Currency != t.Currency) {
+			if err := advance(); err != nil {
+				return err
+			}
+		}
+		if current >= len(sections) {
+			return fmt.Errorf("no balance for currency %q", t.Currency)
+		}
+		return enc.Entry(t)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	for current < len(sections) {
+		if err := advance(); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := enc.End(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Service) GetInterestRates() ([]interest.Rate, error) {
+	const op = "service.GetInterestRates"
+
+	rates, err := s.interestProvider.GetInterestRates()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return rates, nil
+}
+
+func (s *Service) SetInterestRate(ctx context.Context, currency string, annualRate float64) (*interest.Rate, error) {
+	const op = "service.SetInterestRate"
+
+	entry := s.auditEntry(ctx, op, map[string]any{"currency": currency, "annual_rate": annualRate})
+
+	rate, err := s.interestProvider.SetInterestRate(currency, annualRate, entry)
+	if err != nil {
+		s.auditFailure(entry, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return rate, nil
+}
+
+func (s *Service) GetLastAccruedDay() (time.Time, bool, error) {
+	const op = "service.GetLastAccruedDay"
+
+	day, ok, err := s.interestProvider.GetLastAccruedDay()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return day, ok, nil
+}
+
+func (s *Service) AccrueInterest(ctx context.Context, day time.Time) (int, error) {
+	const op = "service.AccrueInterest"
+
+	entry := s.auditEntry(ctx, op, map[string]any{"day": day.Format(time.DateOnly)})
+
+	accrued, err := s.interestProvider.AccrueInterest(day, entry)
+	if err != nil {
+		s.auditFailure(entry, err)
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return accrued, nil
+}
+
+func (s *Service) PostInterest(ctx context.Context, before time.Time) (int, error) {
+	const op = "service.PostInterest"
+
+	entry := s.auditEntry(ctx, op, map[string]any{"before": before.Format(time.DateOnly)})
+
+	posted, err := s.interestProvider.PostInterest(before, entry)
+	if err != nil {
+		s.auditFailure(entry, err)
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return posted, nil
+}
+
+func (s *Service) GetAuditEntries(filter audit.Filter) ([]audit.Entry, error) {
+	const op = "service.GetAuditEntries"
+
+	entries, err := s.auditLog.GetAuditEntries(filter)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return entries, nil
+}
+
+// VerifyChain walks the wallet's transaction hash chain and reports the first broken link.
+// Signed chain heads are checked as well when billing has a signing key configured.
+func (s *Service) VerifyChain(walletID string) (hashchain.Report, error) {
+	const op = "service.VerifyChain"
+
+	var signatures []hashchain.Signature
+	if s.chainSigner != nil {
+		var err error
+		signatures, err = s.chainProvider.GetChainSignatures(walletID)
+		if err != nil {
+			return hashchain.Report{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	verifier := hashchain.NewVerifier(walletID, signatures, s.chainSigner)
+
+	err := s.chainProvider.StreamChain(walletID, func(r hashchain.Record) error {
+		verifier.Add(r)
+		return nil
+	})
+	if err != nil {
+		return hashchain.Report{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	head, err := s.chainProvider.GetChainHead(walletID)
+	if err != nil {
+		return hashchain.Report{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return verifier.Finish(head), nil
+}
+
+func (s *Service) GetChainWallets() ([]string, error) {
+	const op = "service.GetChainWallets"
+
+	wallets, err := s.chainProvider.GetChainWallets()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return wallets, nil
+}
+
+// SignChainHeads signs every chain head that moved since it was last signed. It does
+// nothing if no signing key is configured.
+func (s *Service) SignChainHeads(ctx context.Context) (int, error) {
+	const op = "service.SignChainHeads"
+
+	if s.chainSigner == nil {
+		return 0, nil
+	}
+
+	heads, err := s.chainProvider.GetUnsignedChainHeads(s.chainSigner.KeyID())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if len(heads) == 0 {
+		return 0, nil
+	}
+
+	sigs := make([]hashchain.Signature, 0, len(heads))
+	for _, head := range heads {
+		sigs = append(sigs, s.chainSigner.Sign(head, time.Now()))
+	}
+
+	entry := s.auditEntry(ctx, op, map[string]any{"key_id": s.chainSigner.KeyID()})
+
+	if err := s.chainProvider.AddChainSignatures(sigs, entry); err != nil {
+		s.auditFailure(entry, err)
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return len(heads), nil
+}
+
+// auditEntry starts the audit entry of a mutating call. The actor and source come from ctx.
+// The storage appends it within the transaction of the change, so that no change is
+// committed without its entry.
+func (s *Service) auditEntry(ctx context.Context, operation string, params any) audit.Entry {
+	entry := audit.Entry{
+		OccurredAt: time.Now(),
+		Actor:      audit.ActorFrom(ctx),
+		Source:     audit.SourceFrom(ctx),
+		Operation:  operation,
+	}
+
+	if params != nil {
+		entry.Params, _ = json.Marshal(params)
+	}
+
+	return entry
+}
+
+// auditFailure records a call that failed. Its transaction was rolled back together with
+// the entry, which is appended on its own instead; nothing changed, so failing to record it
+// is only logged.
+func (s *Service) auditFailure(entry audit.Entry, opErr error) {
+	entry.Error = opErr.Error()
+
+	if err := s.auditLog.AppendAudit(entry); err != nil {
+		s.log.Error("failed to append audit entry",
+			slog.String("operation", entry.Operation),
+			slog.String("actor", entry.Actor),
+			slog.String("source", entry.Source),
+			sl.Err(err),
+		)
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/message"
+	"billing/internal/lib/operation"
+	"billing/internal/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// fakeStorage applies nothing, it keeps the entries it was given within a change and the
+// ones appended on their own.
+type fakeStorage struct {
+	BillingProvider
+	AuditLog
+
+	err      error
+	inTx     []audit.Entry
+	appended []audit.Entry
+}
+
+func (f *fakeStorage) PerformInvoiceTransaction(messageID string, operationID string, walletID string, transactionType string, currency string, amount float64, entry audit.Entry) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	f.inTx = append(f.inTx, entry.WithResult(map[string]any{"transaction_id": 7}))
+
+	return 7, nil
+}
+
+func (f *fakeStorage) CreateWallet(accountID string, entry audit.Entry) (string, string, error) {
+	if f.err != nil {
+		return "", "", f.err
+	}
+
+	f.inTx = append(f.inTx, entry)
+
+	return "w-1", accountID, nil
+}
+
+func (f *fakeStorage) AppendAudit(entry audit.Entry) error {
+	f.appended = append(f.appended, entry)
+	return nil
+}
+
+func newTestService(f *fakeStorage) *Service {
+	return New(slog.New(slog.NewTextHandler(io.Discard, nil)), f, nil, f, nil, nil, nil, f, nil, nil, nil)
+}
+
+func testContext() context.Context {
+	ctx := audit.WithActor(context.Background(), "jwt:alice")
+	ctx = audit.WithSource(ctx, "kafka:invoices")
+	ctx = operation.WithID(ctx, "op-1")
+
+	return message.WithID(ctx, "msg-1")
+}
+
+func TestInvoiceAuditsWithinTheChange(t *testing.T) {
+	f := &fakeStorage{}
+
+	id, err := newTestService(f).Invoice(testContext(), "w-1", "Invoice", "USD", 10)
+	if err != nil || id != 7 {
+		t.Fatalf("Invoice() = %d, %v", id, err)
+	}
+
+	if len(f.appended) != 0 {
+		t.Errorf("appended %d entries outside the change", len(f.appended))
+	}
+	if len(f.inTx) != 1 {
+		t.Fatalf("passed %d entries to the change, want 1", len(f.inTx))
+	}
+
+	entry := f.inTx[0]
+	if entry.Actor != "jwt:alice" || entry.Source != "kafka:invoices" || entry.Operation != "service.Invoice" {
+		t.Errorf("entry = %+v", entry)
+	}
+
+	var params map[string]any
+	if err := json.Unmarshal(entry.Params, &params); err != nil {
+		t.Fatal(err)
+	}
+	if params["operation_id"] != "op-1" || params["message_id"] != "msg-1" || params["wallet_id"] != "w-1" || params["amount"] != 10.0 {
+		t.Errorf("params = %v", params)
+	}
+
+	if string(entry.Result) != `{"transaction_id":7}` {
+		t.Errorf("result = %s", entry.Result)
+	}
+}
+
+func TestInvoiceFailureIsAuditedOnItsOwn(t *testing.T) {
+	f := &fakeStorage{err: errors.New("insufficient funds")}
+
+	if _, err := newTestService(f).Invoice(testContext(), "w-1", "Invoice", "USD", 10); err == nil {
+		t.Fatal("Invoice() succeeded")
+	}
+
+	if len(f.appended) != 1 {
+		t.Fatalf("appended %d entries, want 1", len(f.appended))
+	}
+
+	entry := f.appended[0]
+	if entry.Error != "insufficient funds" || entry.Actor != "jwt:alice" || entry.Result != nil {
+		t.Errorf("entry = %+v", entry)
+	}
+}
+
+func TestInvoiceRedeliveryIsNotAudited(t *testing.T) {
+	f := &fakeStorage{err: storage.ErrMessageProcessed}
+
+	if _, err := newTestService(f).Invoice(testContext(), "w-1", "Invoice", "USD", 10); !errors.Is(err, storage.ErrMessageProcessed) {
+		t.Fatalf("Invoice() error = %v, want ErrMessageProcessed", err)
+	}
+
+	if len(f.appended) != 0 || len(f.inTx) != 0 {
+		t.Errorf("audited a redelivered message: %d appended, %d within the change", len(f.appended), len(f.inTx))
+	}
+}
+
+func TestCreateWalletAnonymous(t *testing.T) {
+	f := &fakeStorage{}
+
+	if _, _, err := newTestService(f).CreateWallet(context.Background(), "acc-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.inTx) != 1 || f.inTx[0].Actor != audit.ActorAnonymous || f.inTx[0].Source != audit.SourceUnknown {
+		t.Errorf("entries = %+v", f.inTx)
+	}
+}
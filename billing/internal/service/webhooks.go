@@ -0,0 +1,135 @@
+package service
+
+import (
+	"billing/internal/lib/webhook"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// CreateWebhookSubscription subscribes an endpoint of an account to transaction events.
+// The returned subscription carries the secret, which is not shown again.
+func (s *Service) CreateWebhookSubscription(ctx context.Context, request webhook.SubscriptionRequest) (*webhook.Subscription, error) {
+	const op = "service.CreateWebhookSubscription"
+
+	secret := request.Secret
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	eventTypes := request.EventTypes
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+
+	// The secret is kept out of the audit log
+	entry := s.auditEntry(ctx, op, map[string]any{"account_id": request.AccountID, "url": request.URL, "event_types": eventTypes})
+
+	sub, err := s.webhookProvider.CreateWebhookSubscription(webhook.Subscription{
+		AccountID:  request.AccountID,
+		URL:        request.URL,
+		EventTypes: eventTypes,
+		Secret:     secret,
+	}, entry)
+	if err != nil {
+		s.auditFailure(entry, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return sub, nil
+}
+
+func (s *Service) GetWebhookSubscriptions(accountID string) ([]webhook.Subscription, error) {
+	const op = "service.GetWebhookSubscriptions"
+
+	subs, err := s.webhookProvider.GetWebhookSubscriptions(accountID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return subs, nil
+}
+
+func (s *Service) DeleteWebhookSubscription(ctx context.Context, id int) error {
+	const op = "service.DeleteWebhookSubscription"
+
+	entry := s.auditEntry(ctx, op, map[string]any{"id": id})
+
+	err := s.webhookProvider.DeleteWebhookSubscription(id, entry)
+	if err != nil {
+		s.auditFailure(entry, err)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// EnqueueWebhookEvent queues the event for the subscriptions of the wallet's account and
+// returns how many deliveries were queued.
+func (s *Service) EnqueueWebhookEvent(walletID string, eventID string, eventType string, payload []byte) (int, error) {
+	const op = "service.EnqueueWebhookEvent"
+
+	accountID, err := s.webhookProvider.GetWalletAccount(walletID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	enqueued, err := s.webhookProvider.EnqueueWebhookDeliveries(accountID, eventID, eventType, payload)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return enqueued, nil
+}
+
+func (s *Service) ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]webhook.Delivery, error) {
+	const op = "service.ClaimDueWebhookDeliveries"
+
+	deliveries, err := s.webhookProvider.ClaimDueWebhookDeliveries(limit, lease)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deliveries, nil
+}
+
+func (s *Service) RecordWebhookAttempt(id int, status string, statusCode int, lastError string, nextAttemptAt time.Time) error {
+	const op = "service.RecordWebhookAttempt"
+
+	if err := s.webhookProvider.RecordWebhookAttempt(id, status, statusCode, lastError, nextAttemptAt); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Service) GetWebhookDeliveries(filter webhook.DeliveryFilter) ([]webhook.Delivery, error) {
+	const op = "service.GetWebhookDeliveries"
+
+	deliveries, err := s.webhookProvider.GetWebhookDeliveries(filter)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deliveries, nil
+}
+
+func (s *Service) RedeliverWebhook(ctx context.Context, id int) (*webhook.Delivery, error) {
+	const op = "service.RedeliverWebhook"
+
+	entry := s.auditEntry(ctx, op, map[string]any{"id": id})
+
+	delivery, err := s.webhookProvider.RedeliverWebhook(id, entry)
+	if err != nil {
+		s.auditFailure(entry, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return delivery, nil
+}
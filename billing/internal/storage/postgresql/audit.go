@@ -0,0 +1,115 @@
+package postgresql
+
+import (
+	"billing/internal/lib/audit"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const defaultAuditLimit = 100
+
+// execer runs a statement on the database or within a transaction.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// AppendAudit records an operation that changed nothing, e.g. one that failed. The entries
+// of changes are appended within the transaction that makes them.
+func (s *Storage) AppendAudit(entry audit.Entry) error {
+	const op = "storage.postgresql.AppendAudit"
+
+	if err := appendAudit(s.db, entry); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func appendAudit(db execer, entry audit.Entry) error {
+	_, err := db.Exec("INSERT INTO audit_log (occurred_at, actor, source, operation, params, result, error) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		entry.OccurredAt, entry.Actor, entry.Source, entry.Operation, nullJSON(entry.Params), nullJSON(entry.Result), sql.NullString{String: entry.Error, Valid: entry.Error != ""})
+
+	return err
+}
+
+func (s *Storage) GetAuditEntries(filter audit.Filter) ([]audit.Entry, error) {
+	const op = "storage.postgresql.GetAuditEntries"
+
+	var (
+		conditions []string
+		args       []any
+	)
+
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Actor != "" {
+		where("actor = $%d", filter.Actor)
+	}
+	if filter.Source != "" {
+		where("source LIKE $%d || '%%'", filter.Source)
+	}
+	if filter.Operation != "" {
+		where("operation = $%d", filter.Operation)
+	}
+	if !filter.From.IsZero() {
+		where("occurred_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("occurred_at < $%d", filter.To)
+	}
+	if filter.BeforeID > 0 {
+		where("id < $%d", filter.BeforeID)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+
+	query := "SELECT id, occurred_at, actor, source, operation, params, result, error FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var entries []audit.Entry
+	for rows.Next() {
+		var (
+			e              audit.Entry
+			params, result []byte
+			errText        sql.NullString
+		)
+		if err := rows.Scan(&e.ID, &e.OccurredAt, &e.Actor, &e.Source, &e.Operation, &params, &result, &errText); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		e.Params = params
+		e.Result = result
+		e.Error = errText.String
+		entries = append(entries, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return entries, nil
+}
+
+func nullJSON(raw []byte) any {
+	if len(raw) == 0 {
+		return nil
+	}
+
+	return string(raw)
+}
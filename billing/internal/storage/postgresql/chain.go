@@ -0,0 +1,215 @@
+package postgresql
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/hashchain"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// sealTransaction appends a settled transaction to its wallet's hash chain. The chain head
+// row is locked until the surrounding transaction ends, so links of a wallet are strictly
+// sequential even with concurrent writers.
+func (s *Storage) sealTransaction(tx *sql.Tx, transactionID int) error {
+	const op = "storage.postgresql.sealTransaction"
+
+	var r hashchain.Record
+
+	err := tx.QueryRow("SELECT id, wallet_id, currency, amount, type, date_created, status FROM transactions WHERE id = $1", transactionID).
+		Scan(&r.ID, &r.WalletID, &r.Currency, &r.Amount, &r.Type, &r.DateCreated, &r.Status)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = tx.Exec("INSERT INTO chain_heads (wallet_id, seq, hash, date_updated) VALUES ($1, 0, '', $2) ON CONFLICT (wallet_id) DO NOTHING", r.WalletID, time.Now())
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var seq int64
+	err = tx.QueryRow("SELECT seq, hash FROM chain_heads WHERE wallet_id = $1 FOR UPDATE", r.WalletID).Scan(&seq, &r.PrevHash)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	r.Seq = seq + 1
+	r.Hash = hashchain.Hash(r.Seq, r.PrevHash, r.Transaction)
+
+	_, err = tx.Exec("UPDATE transactions SET chain_seq = $1, prev_hash = $2, hash = $3 WHERE id = $4", r.Seq, r.PrevHash, r.Hash, r.ID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = tx.Exec("UPDATE chain_heads SET seq = $1, hash = $2, date_updated = $3 WHERE wallet_id = $4", r.Seq, r.Hash, time.Now(), r.WalletID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// StreamChain calls fn for every settled transaction of the wallet in chain order. Settled
+// transactions that are missing from the chain come last with a zero Seq.
+func (s *Storage) StreamChain(walletID string, fn func(hashchain.Record) error) error {
+	const op = "storage.postgresql.StreamChain"
+
+	rows, err := s.db.Query(`SELECT id, wallet_id, currency, amount, type, date_created, status,
+		COALESCE(chain_seq, 0), COALESCE(prev_hash, ''), COALESCE(hash, '')
+		FROM transactions
+		WHERE wallet_id = $1 AND (chain_seq IS NOT NULL OR status <> 'Created')
+		ORDER BY chain_seq NULLS LAST, id`, walletID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r hashchain.Record
+		if err := rows.Scan(&r.ID, &r.WalletID, &r.Currency, &r.Amount, &r.Type, &r.DateCreated, &r.Status, &r.Seq, &r.PrevHash, &r.Hash); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		if err := fn(r); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// GetChainHead returns nil if the wallet has no chained transactions yet.
+func (s *Storage) GetChainHead(walletID string) (*hashchain.Head, error) {
+	const op = "storage.postgresql.GetChainHead"
+
+	var head hashchain.Head
+
+	err := s.db.QueryRow("SELECT wallet_id, seq, hash, date_updated FROM chain_heads WHERE wallet_id = $1", walletID).
+		Scan(&head.WalletID, &head.Seq, &head.Hash, &head.DateUpdated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &head, nil
+}
+
+func (s *Storage) GetChainWallets() ([]string, error) {
+	const op = "storage.postgresql.GetChainWallets"
+
+	rows, err := s.db.Query("SELECT id FROM wallets ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var wallets []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		wallets = append(wallets, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return wallets, nil
+}
+
+// GetUnsignedChainHeads returns the heads whose current link has no signature with the key.
+func (s *Storage) GetUnsignedChainHeads(keyID string) ([]hashchain.Head, error) {
+	const op = "storage.postgresql.GetUnsignedChainHeads"
+
+	rows, err := s.db.Query(`SELECT h.wallet_id, h.seq, h.hash, h.date_updated
+		FROM chain_heads h
+		WHERE h.seq > 0 AND NOT EXISTS (
+			SELECT 1 FROM chain_head_signatures sig
+			WHERE sig.wallet_id = h.wallet_id AND sig.seq = h.seq AND sig.key_id = $1
+		)
+		ORDER BY h.wallet_id`, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var heads []hashchain.Head
+	for rows.Next() {
+		var head hashchain.Head
+		if err := rows.Scan(&head.WalletID, &head.Seq, &head.Hash, &head.DateUpdated); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		heads = append(heads, head)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return heads, nil
+}
+
+// AddChainSignatures stores the signatures and records them in the audit log as entry, all
+// or nothing.
+func (s *Storage) AddChainSignatures(sigs []hashchain.Signature, entry audit.Entry) error {
+	const op = "storage.postgresql.AddChainSignatures"
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	for _, sig := range sigs {
+		_, err = tx.Exec(`INSERT INTO chain_head_signatures (wallet_id, seq, hash, key_id, signature, signed_at)
+			VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (wallet_id, seq, key_id) DO NOTHING`,
+			sig.WalletID, sig.Seq, sig.Hash, sig.KeyID, sig.Signature, sig.SignedAt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := appendAudit(tx, entry.WithResult(map[string]any{"signed": len(sigs)})); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) GetChainSignatures(walletID string) ([]hashchain.Signature, error) {
+	const op = "storage.postgresql.GetChainSignatures"
+
+	rows, err := s.db.Query("SELECT wallet_id, seq, hash, key_id, signature, signed_at FROM chain_head_signatures WHERE wallet_id = $1 ORDER BY seq", walletID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var signatures []hashchain.Signature
+	for rows.Next() {
+		var sig hashchain.Signature
+		if err := rows.Scan(&sig.WalletID, &sig.Seq, &sig.Hash, &sig.KeyID, &sig.Signature, &sig.SignedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		signatures = append(signatures, sig)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return signatures, nil
+}
@@ -0,0 +1,237 @@
+package postgresql
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/interest"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func (s *Storage) GetInterestRates() ([]interest.Rate, error) {
+	const op = "storage.postgresql.GetInterestRates"
+
+	var rates []interest.Rate
+
+	rows, err := s.db.Query("SELECT currency, annual_rate, date_updated FROM interest_rates ORDER BY currency")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r interest.Rate
+		if err := rows.Scan(&r.Currency, &r.AnnualRate, &r.DateUpdated); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		rates = append(rates, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return rates, nil
+}
+
+// SetInterestRate sets the rate of the currency and records it in the audit log as entry.
+func (s *Storage) SetInterestRate(currency string, annualRate float64, entry audit.Entry) (*interest.Rate, error) {
+	const op = "storage.postgresql.SetInterestRate"
+
+	rate := interest.Rate{
+		Currency:    currency,
+		AnnualRate:  annualRate,
+		DateUpdated: time.Now(),
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO interest_rates (currency, annual_rate, date_updated) VALUES ($1, $2, $3)
+		ON CONFLICT (currency) DO UPDATE SET annual_rate = EXCLUDED.annual_rate, date_updated = EXCLUDED.date_updated`,
+		rate.Currency, rate.AnnualRate, rate.DateUpdated)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := appendAudit(tx, entry.WithResult(rate)); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &rate, nil
+}
+
+// GetLastAccruedDay returns the latest day interest was accrued for, or false if it never was.
+func (s *Storage) GetLastAccruedDay() (time.Time, bool, error) {
+	const op = "storage.postgresql.GetLastAccruedDay"
+
+	var day sql.NullTime
+
+	err := s.db.QueryRow("SELECT MAX(day) FROM interest_days").Scan(&day)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return day.Time, day.Valid, nil
+}
+
+// AccrueInterest records one day of interest on every positive end-of-day balance with a
+// configured rate. The day is claimed in interest_days within the same database transaction,
+// so running it again for an accrued day is a no-op that returns 0. The run is recorded in
+// the audit log as entry.
+func (s *Storage) AccrueInterest(day time.Time, entry audit.Entry) (int, error) {
+	const op = "storage.postgresql.AccrueInterest"
+
+	daysInYear := time.Date(day.Year()+1, 1, 1, 0, 0, 0, 0, time.UTC).Sub(time.Date(day.Year(), 1, 1, 0, 0, 0, 0, time.UTC)).Hours() / 24
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO interest_days (day, date_processed) VALUES ($1, $2) ON CONFLICT (day) DO NOTHING", day, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if claimed == 0 {
+		// Accrued before, the run is still audited
+		if err := appendAudit(tx, entry.WithResult(map[string]any{"accruals": 0})); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		return 0, nil
+	}
+
+	res, err = tx.Exec(`INSERT INTO interest_accruals (wallet_id, currency, day, balance, annual_rate, amount)
+		SELECT t.wallet_id, t.currency, $1::date, SUM(`+signedAmount+`), r.annual_rate, SUM(`+signedAmount+`) * r.annual_rate / $3::float8
+		FROM transactions t
+		JOIN interest_rates r ON r.currency = t.currency
+		WHERE t.status = 'Success' AND t.date_created < $2 AND r.annual_rate > 0
+		GROUP BY t.wallet_id, t.currency, r.annual_rate
+		HAVING SUM(`+signedAmount+`) > 0
+		ON CONFLICT DO NOTHING`,
+		day, day.AddDate(0, 0, 1), daysInYear)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	accrued, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := appendAudit(tx, entry.WithResult(map[string]any{"accruals": accrued})); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return int(accrued), nil
+}
+
+type interestPosting struct {
+	walletID string
+	currency string
+	month    time.Time
+	amount   float64
+}
+
+// PostInterest turns the unposted accruals of every month that starts before the given time
+// into one Interest transaction per wallet, currency and month, and credits the subwallets.
+// A run that posted anything is recorded in the audit log as entry.
+func (s *Storage) PostInterest(before time.Time, entry audit.Entry) (int, error) {
+	const op = "storage.postgresql.PostInterest"
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	// Lock the pending accruals so that concurrent runs can't post them twice.
+	_, err = tx.Exec("SELECT 1 FROM interest_accruals WHERE transaction_id IS NULL AND day < $1 FOR UPDATE", before)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	rows, err := tx.Query(`SELECT wallet_id, currency, date_trunc('month', day)::date, SUM(amount)
+		FROM interest_accruals
+		WHERE transaction_id IS NULL AND day < $1
+		GROUP BY wallet_id, currency, date_trunc('month', day)
+		ORDER BY 3, 1, 2`, before)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var postings []interestPosting
+	for rows.Next() {
+		var p interestPosting
+		if err := rows.Scan(&p.walletID, &p.currency, &p.month, &p.amount); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+		postings = append(postings, p)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	for _, p := range postings {
+		monthEnd := p.month.AddDate(0, 1, 0)
+
+		var transactionID int
+		err = tx.QueryRow("INSERT INTO transactions (wallet_id, currency, amount, type, date_created, status) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+			p.walletID, p.currency, p.amount, "Interest", monthEnd, "Success").Scan(&transactionID)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		if err := s.sealTransaction(tx, transactionID); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		_, err = tx.Exec("UPDATE subwallets SET amount = amount + $1 WHERE wallet_id = $2 AND currency = $3", p.amount, p.walletID, p.currency)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+
+		_, err = tx.Exec("UPDATE interest_accruals SET transaction_id = $1 WHERE wallet_id = $2 AND currency = $3 AND day >= $4 AND day < $5 AND transaction_id IS NULL",
+			transactionID, p.walletID, p.currency, p.month, monthEnd)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if len(postings) > 0 {
+		if err := appendAudit(tx, entry.WithResult(map[string]any{"transactions": len(postings)})); err != nil {
+			return 0, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return len(postings), nil
+}
@@ -0,0 +1,84 @@
+package postgresql
+
+import (
+	"billing/internal/storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// claimMessage records the message as processed by the surrounding transaction. If the
+// message was processed before, the transaction it created is returned together with
+// storage.ErrMessageProcessed. A concurrent redelivery waits on the row until the first
+// one commits or rolls back.
+func (s *Storage) claimMessage(tx *sql.Tx, messageID string) (int, error) {
+	const op = "storage.postgresql.claimMessage"
+
+	if messageID == "" {
+		return 0, nil
+	}
+
+	res, err := tx.Exec("INSERT INTO processed_messages (message_id, processed_at) VALUES ($1, $2) ON CONFLICT (message_id) DO NOTHING", messageID, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	claimed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if claimed == 1 {
+		return 0, nil
+	}
+
+	var transactionID sql.NullInt64
+	err = tx.QueryRow("SELECT transaction_id FROM processed_messages WHERE message_id = $1", messageID).Scan(&transactionID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return int(transactionID.Int64), storage.ErrMessageProcessed
+}
+
+func (s *Storage) completeMessage(tx *sql.Tx, messageID string, transactionID int) error {
+	const op = "storage.postgresql.completeMessage"
+
+	if messageID == "" {
+		return nil
+	}
+
+	_, err := tx.Exec("UPDATE processed_messages SET transaction_id = $1 WHERE message_id = $2", transactionID, messageID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// IsMessageProcessed reports whether the message was processed before.
+func (s *Storage) IsMessageProcessed(messageID string) (bool, error) {
+	const op = "storage.postgresql.IsMessageProcessed"
+
+	var processed bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM processed_messages WHERE message_id = $1)", messageID).Scan(&processed)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return processed, nil
+}
+
+// walletError maps a missing wallet, which the database reports as a foreign key
+// violation, to storage.ErrWalletNotFound.
+func walletError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return storage.ErrWalletNotFound
+	}
+
+	return err
+}
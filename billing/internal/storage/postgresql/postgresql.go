@@ -1,13 +1,17 @@
 package postgresql
 
 import (
+	"billing/internal/lib/audit"
 	"billing/internal/lib/balance"
 	"billing/internal/lib/transaction"
+	"billing/internal/storage"
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
@@ -43,21 +47,40 @@ func (s *Storage) Close() error {
 	return nil
 }
 
-func (s *Storage) CreateWallet() (string, string, error) {
+// CreateWallet creates a wallet for the account, or for a new account if account_id is
+// empty. An account has one wallet at most. The wallet is recorded in the audit log as
+// entry.
+func (s *Storage) CreateWallet(account_id string, entry audit.Entry) (string, string, error) {
 	const op = "storage.postgresql.CreateWallet"
 
-	stmt, err := s.db.Prepare("INSERT INTO wallets (id, account_id) VALUES ($1, $2)")
+	tx, err := s.db.Begin()
 	if err != nil {
 		return "", "", fmt.Errorf("%s: %w", op, err)
 	}
+	defer tx.Rollback()
 
 	id := gofakeit.UUID()
-	account_id := gofakeit.Email()
-	_, err = stmt.Exec(id, account_id)
+	if account_id == "" {
+		account_id = gofakeit.Email()
+	}
+
+	_, err = tx.Exec("INSERT INTO wallets (id, account_id) VALUES ($1, $2)", id, account_id)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return "", "", fmt.Errorf("%s: %w", op, storage.ErrAccountHasWallet)
+	}
 	if err != nil {
 		return "", "", fmt.Errorf("%s: %w", op, err)
 	}
 
+	if err := appendAudit(tx, entry.WithResult(map[string]any{"wallet_id": id, "account_id": account_id})); err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
 	return id, account_id, nil
 }
 
@@ -97,19 +120,43 @@ func (s *Storage) GetTransaction(id int) (*transaction.Transaction, error) {
 
 	var status transaction.Transaction
 
-	stmt, err := s.db.Prepare("SELECT wallet_id, amount, type, date_created, status FROM transactions WHERE id = $1")
+	stmt, err := s.db.Prepare("SELECT id, wallet_id, currency, amount, type, date_created, status FROM transactions WHERE id = $1")
 	if err != nil {
 		return &transaction.Transaction{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = stmt.QueryRow(id).Scan(&status.WalletID, &status.Amount, &status.Type, &status.DateCreated, &status.Status)
+	err = stmt.QueryRow(id).Scan(&status.ID, &status.WalletID, &status.Currency, &status.Amount, &status.Type, &status.DateCreated, &status.Status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &transaction.Transaction{}, fmt.Errorf("%s: %w", op, storage.ErrTransactionNotFound)
+	}
 	if err != nil {
 		return &transaction.Transaction{}, fmt.Errorf("%s: %w", op, err)
 	}
 	return &status, nil
 }
 
-func (s *Storage) PerformInvoiceTransaction(walletID string, transactionType string, currency string, amount float64) (int, error) {
+// GetTransactionByOperation returns the transaction created for the given gateway operation.
+func (s *Storage) GetTransactionByOperation(operationID string) (*transaction.Transaction, error) {
+	const op = "storage.postgresql.GetTransactionByOperation"
+
+	var t transaction.Transaction
+
+	err := s.db.QueryRow("SELECT id, wallet_id, currency, amount, type, date_created, status, operation_id FROM transactions WHERE operation_id = $1", operationID).
+		Scan(&t.ID, &t.WalletID, &t.Currency, &t.Amount, &t.Type, &t.DateCreated, &t.Status, &t.OperationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrTransactionNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &t, nil
+}
+
+// PerformInvoiceTransaction deduplicates on messageID: a message that was processed before
+// returns the transaction it created together with storage.ErrMessageProcessed. The
+// transaction is recorded in the audit log as entry.
+func (s *Storage) PerformInvoiceTransaction(messageID string, operationID string, walletID string, transactionType string, currency string, amount float64, entry audit.Entry) (int, error) {
 	const op = "storage.postgresql.PerformTransaction"
 
 	tx, err := s.db.Begin()
@@ -117,50 +164,64 @@ func (s *Storage) PerformInvoiceTransaction(walletID string, transactionType str
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
-	defer func() {
-		// If there's an error, roll back the transaction
-		if err != nil {
-			tx.Rollback()
-			return
-		}
+	// Rolling back after a successful commit is a no-op
+	defer tx.Rollback()
 
-		// If no error occurred, commit the transaction
-		err = tx.Commit()
-		if err != nil {
-			fmt.Println(fmt.Errorf("error committing transaction -- %s: %w", op, err))
-			return
-			// Handle commit error, log or return it as needed
-		}
-	}()
+	if transactionID, err := s.claimMessage(tx, messageID); err != nil {
+		return transactionID, fmt.Errorf("%s: %w", op, err)
+	}
 
 	// Step 1: Top up frozen balance
-	err = s.invoice(walletID, currency, amount)
+	err = s.invoice(tx, walletID, currency, amount)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
 	// Step 2: Create transaction
-	transactionID, err := s.createTransaction(walletID, amount, transactionType)
+	transactionID, err := s.createTransaction(tx, operationID, walletID, currency, amount, transactionType)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
 	// Step 3: Add frozen balance to regular balance
-	err = s.addFBalanceInvoice(walletID, currency)
+	err = s.addFBalanceInvoice(tx, walletID, currency)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
 	// Step 4: Change transaction status
-	err = s.editTransaction(transactionID, "Success")
+	err = s.editTransaction(tx, transactionID, "Success")
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
+	// Step 5: Chain the settled transaction to the wallet's previous one
+	err = s.sealTransaction(tx, transactionID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.completeMessage(tx, messageID, transactionID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = appendAudit(tx, entry.WithResult(map[string]any{"transaction_id": transactionID}))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
 	return transactionID, nil
 }
 
-func (s *Storage) PerformWithdrawTransaction(walletID string, transactionType string, currency string, amount float64) (int, error) {
+// PerformWithdrawTransaction deduplicates on messageID: a message that was processed before
+// returns the transaction it created together with storage.ErrMessageProcessed. The
+// transaction is recorded in the audit log as entry.
+func (s *Storage) PerformWithdrawTransaction(messageID string, operationID string, walletID string, transactionType string, currency string, amount float64, entry audit.Entry) (int, error) {
 	const op = "storage.postgresql.PerformTransaction"
 
 	tx, err := s.db.Begin()
@@ -168,51 +229,63 @@ func (s *Storage) PerformWithdrawTransaction(walletID string, transactionType st
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-			return
-		}
+	defer tx.Rollback()
 
-		err = tx.Commit()
-		if err != nil {
-			fmt.Println(fmt.Errorf("error committing transaction -- %s: %w", op, err))
-			return
-			// Handle commit error, log or return it as needed
-		}
-	}()
+	if transactionID, err := s.claimMessage(tx, messageID); err != nil {
+		return transactionID, fmt.Errorf("%s: %w", op, err)
+	}
 
 	// Step 1: Top up frozen balance
-	err = s.withdraw(walletID, currency, amount)
+	err = s.withdraw(tx, walletID, currency, amount)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
 	// Step 2: Create transaction
-	transactionID, err := s.createTransaction(walletID, amount, transactionType)
+	transactionID, err := s.createTransaction(tx, operationID, walletID, currency, amount, transactionType)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
 	// Step 3: Add frozen balance to regular balance
-	err = s.addFBalanceWithdraw(walletID, currency, transactionID, amount)
+	err = s.addFBalanceWithdraw(tx, walletID, currency, transactionID, amount)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// Step 4: Chain the settled transaction to the wallet's previous one
+	err = s.sealTransaction(tx, transactionID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.completeMessage(tx, messageID, transactionID)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
+	err = appendAudit(tx, entry.WithResult(map[string]any{"transaction_id": transactionID}))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
 	return transactionID, nil
 }
 
-func (s *Storage) invoice(walletID string, currency string, amount float64) error {
+func (s *Storage) invoice(tx *sql.Tx, walletID string, currency string, amount float64) error {
 	const op = "storage.postgresql.Invoice"
 
 	// Check if a subwallet already exists for the given wallet_id and currency
 	var existingAmount float64
-	err := s.db.QueryRow("SELECT frozen_amount FROM subwallets WHERE wallet_id = $1 AND currency = $2", walletID, currency).Scan(&existingAmount)
+	err := tx.QueryRow("SELECT frozen_amount FROM subwallets WHERE wallet_id = $1 AND currency = $2 FOR UPDATE", walletID, currency).Scan(&existingAmount)
 	if err == nil {
 		// Subwallet already exists, update the frozen_amount
 		newAmount := existingAmount + amount
-		_, err = s.db.Exec("UPDATE subwallets SET frozen_amount = $1 WHERE wallet_id = $2 AND currency = $3", newAmount, walletID, currency)
+		_, err = tx.Exec("UPDATE subwallets SET frozen_amount = $1 WHERE wallet_id = $2 AND currency = $3", newAmount, walletID, currency)
 		if err != nil {
 			return fmt.Errorf("%s: %w", op, err)
 		}
@@ -223,7 +296,7 @@ func (s *Storage) invoice(walletID string, currency string, amount float64) erro
 	}
 
 	// Subwallet does not exist, insert a new one
-	stmt, err := s.db.Prepare("INSERT INTO subwallets (wallet_id, currency, amount, frozen_amount) VALUES ($1, $2, $3, $4)")
+	stmt, err := tx.Prepare("INSERT INTO subwallets (wallet_id, currency, amount, frozen_amount) VALUES ($1, $2, $3, $4)")
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
@@ -231,24 +304,24 @@ func (s *Storage) invoice(walletID string, currency string, amount float64) erro
 
 	_, err = stmt.Exec(walletID, currency, 0.0, amount)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return fmt.Errorf("%s: %w", op, walletError(err))
 	}
 
 	return nil
 }
 
-func (s *Storage) withdraw(walletID string, currency string, amount float64) error {
+func (s *Storage) withdraw(tx *sql.Tx, walletID string, currency string, amount float64) error {
 	const op = "storage.postgresql.Withdraw"
 
 	// Check if a subwallet already exists for the given wallet_id and currency
 	var existingAmount float64
-	err := s.db.QueryRow("SELECT frozen_amount FROM subwallets WHERE wallet_id = $1 AND currency = $2", walletID, currency).Scan(&existingAmount)
+	err := tx.QueryRow("SELECT frozen_amount FROM subwallets WHERE wallet_id = $1 AND currency = $2 FOR UPDATE", walletID, currency).Scan(&existingAmount)
 	if err == nil {
 		// Subwallet already exists, check if there is sufficient balance for withdrawal
 
 		// if existingAmount >= amount {
 		newAmount := existingAmount - amount
-		_, err := s.db.Exec("UPDATE subwallets SET frozen_amount = $1 WHERE wallet_id = $2 AND currency = $3", newAmount, walletID, currency)
+		_, err := tx.Exec("UPDATE subwallets SET frozen_amount = $1 WHERE wallet_id = $2 AND currency = $3", newAmount, walletID, currency)
 		if err != nil {
 			return fmt.Errorf("%s: %w", op, err)
 		}
@@ -262,20 +335,20 @@ func (s *Storage) withdraw(walletID string, currency string, amount float64) err
 	}
 
 	// Subwallet does not exist, cannot withdraw
-	return fmt.Errorf("%s: subwallet does not exist for withdrawal", op)
+	return fmt.Errorf("%s: %w", op, storage.ErrSubwalletNotFound)
 }
 
-func (s *Storage) createTransaction(walletID string, amount float64, typeO string) (int, error) {
+func (s *Storage) createTransaction(tx *sql.Tx, operationID string, walletID string, currency string, amount float64, typeO string) (int, error) {
 	const op = "storage.postgresql.CreateWallet"
 
 	var lastInsertId int
 
-	stmt, err := s.db.Prepare("INSERT INTO transactions (wallet_id, amount, type, date_created, status) VALUES ($1, $2, $3, $4, $5) RETURNING id")
+	stmt, err := tx.Prepare("INSERT INTO transactions (wallet_id, currency, amount, type, date_created, status, operation_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id")
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = stmt.QueryRow(walletID, amount, typeO, time.Now(), "Created").Scan(&lastInsertId)
+	err = stmt.QueryRow(walletID, currency, amount, typeO, time.Now(), "Created", sql.NullString{String: operationID, Valid: operationID != ""}).Scan(&lastInsertId)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
@@ -283,10 +356,10 @@ func (s *Storage) createTransaction(walletID string, amount float64, typeO strin
 	return lastInsertId, nil
 }
 
-func (s *Storage) editTransaction(id int, status string) error {
+func (s *Storage) editTransaction(tx *sql.Tx, id int, status string) error {
 	const op = "storage.postgresql.EditWallet"
 
-	stmt, err := s.db.Prepare("UPDATE transactions SET status = $1 WHERE id = $2")
+	stmt, err := tx.Prepare("UPDATE transactions SET status = $1 WHERE id = $2")
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
@@ -299,10 +372,10 @@ func (s *Storage) editTransaction(id int, status string) error {
 	return nil
 }
 
-func (s *Storage) addFBalanceInvoice(walletID string, currency string) error {
+func (s *Storage) addFBalanceInvoice(tx *sql.Tx, walletID string, currency string) error {
 	const op = "storage.postgresql.MoveFBalance"
 
-	stmt, err := s.db.Prepare("UPDATE subwallets SET amount = amount + frozen_amount, frozen_amount = 0 WHERE wallet_id = $1 AND currency = $2")
+	stmt, err := tx.Prepare("UPDATE subwallets SET amount = amount + frozen_amount, frozen_amount = 0 WHERE wallet_id = $1 AND currency = $2")
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
@@ -316,17 +389,17 @@ func (s *Storage) addFBalanceInvoice(walletID string, currency string) error {
 	return nil
 }
 
-func (s *Storage) addFBalanceWithdraw(walletID string, currency string, transactionID int, frozen_amount float64) error {
+func (s *Storage) addFBalanceWithdraw(tx *sql.Tx, walletID string, currency string, transactionID int, frozen_amount float64) error {
 	const op = "storage.postgresql.MoveFBalance"
 
 	var amount float64
-	err := s.db.QueryRow("SELECT amount FROM subwallets WHERE wallet_id = $1 AND currency = $2", walletID, currency).Scan(&amount)
+	err := tx.QueryRow("SELECT amount FROM subwallets WHERE wallet_id = $1 AND currency = $2", walletID, currency).Scan(&amount)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
 	if amount-frozen_amount >= 0 {
-		stmt, err := s.db.Prepare("UPDATE subwallets SET amount = amount + frozen_amount, frozen_amount = frozen_amount + $1 WHERE wallet_id = $2 AND currency = $3")
+		stmt, err := tx.Prepare("UPDATE subwallets SET amount = amount + frozen_amount, frozen_amount = frozen_amount + $1 WHERE wallet_id = $2 AND currency = $3")
 		if err != nil {
 			return fmt.Errorf("%s: %w", op, err)
 		}
@@ -337,13 +410,13 @@ func (s *Storage) addFBalanceWithdraw(walletID string, currency string, transact
 			return fmt.Errorf("%s: %w", op, err)
 		}
 
-		err = s.editTransaction(transactionID, "Success")
+		err = s.editTransaction(tx, transactionID, "Success")
 		if err != nil {
 			return fmt.Errorf("%s: %w", op, err)
 		}
 
 	} else {
-		stmt, err := s.db.Prepare("UPDATE subwallets SET frozen_amount = frozen_amount + $1 WHERE wallet_id = $2 AND currency = $3")
+		stmt, err := tx.Prepare("UPDATE subwallets SET frozen_amount = frozen_amount + $1 WHERE wallet_id = $2 AND currency = $3")
 		if err != nil {
 			return fmt.Errorf("%s: %w", op, err)
 		}
@@ -354,7 +427,7 @@ func (s *Storage) addFBalanceWithdraw(walletID string, currency string, transact
 			return fmt.Errorf("%s: %w", op, err)
 		}
 
-		err = s.editTransaction(transactionID, "Error")
+		err = s.editTransaction(tx, transactionID, "Error")
 		if err != nil {
 			return fmt.Errorf("%s: %w", op, err)
 		}
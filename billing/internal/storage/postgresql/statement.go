@@ -0,0 +1,102 @@
+package postgresql
+
+import (
+	"billing/internal/lib/statement"
+	"billing/internal/lib/transaction"
+	"billing/internal/storage"
+	"fmt"
+	"time"
+)
+
+// signedAmount is the SQL expression for the effect a transaction has on its subwallet balance.
+const signedAmount = "CASE WHEN t.type = 'Withdraw' THEN -t.amount ELSE t.amount END"
+
+// GetStatementSections returns the balances of every currency of the wallet for the period,
+// or storage.ErrWalletNotFound if there is no such wallet.
+func (s *Storage) GetStatementSections(walletID string, from time.Time, to time.Time) ([]statement.Section, error) {
+	const op = "storage.postgresql.GetStatementSections"
+
+	var sections []statement.Section
+
+	stmt, err := s.db.Prepare(`SELECT sub.currency,
+		COALESCE(SUM(CASE WHEN t.date_created < $2 THEN ` + signedAmount + ` END), 0),
+		COALESCE(SUM(CASE WHEN t.date_created < $3 THEN ` + signedAmount + ` END), 0)
+		FROM subwallets sub
+		LEFT JOIN transactions t ON t.wallet_id = sub.wallet_id AND t.currency = sub.currency AND t.status = 'Success'
+		WHERE sub.wallet_id = $1
+		GROUP BY sub.currency
+		ORDER BY sub.currency`)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(walletID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sec statement.Section
+		if err := rows.Scan(&sec.Currency, &sec.OpeningBalance, &sec.ClosingBalance); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		sections = append(sections, sec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// A wallet without currencies has no sections either
+	if len(sections) == 0 {
+		var exists bool
+		if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM wallets WHERE id = $1)", walletID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("%s: %w", op, storage.ErrWalletNotFound)
+		}
+	}
+
+	return sections, nil
+}
+
+// StreamStatementEntries calls fn for every settled transaction of the wallet in [from, to),
+// ordered by currency and date, without loading the whole range into memory.
+func (s *Storage) StreamStatementEntries(walletID string, from time.Time, to time.Time, fn func(transaction.Transaction) error) error {
+	const op = "storage.postgresql.StreamStatementEntries"
+
+	stmt, err := s.db.Prepare(`SELECT id, wallet_id, currency, amount, type, date_created, status
+		FROM transactions
+		WHERE wallet_id = $1 AND status = 'Success' AND date_created >= $2 AND date_created < $3
+		ORDER BY currency, date_created, id`)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(walletID, from, to)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t transaction.Transaction
+		if err := rows.Scan(&t.ID, &t.WalletID, &t.Currency, &t.Amount, &t.Type, &t.DateCreated, &t.Status); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		if err := fn(t); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
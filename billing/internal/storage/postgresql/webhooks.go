@@ -0,0 +1,351 @@
+package postgresql
+
+import (
+	"billing/internal/lib/audit"
+	"billing/internal/lib/webhook"
+	"billing/internal/storage"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const deliveryColumns = `d.id, d.subscription_id, d.event_id, d.event_type, d.payload, d.status, d.attempts,
+	d.last_status_code, d.last_error, d.next_attempt_at, d.created_at, d.delivered_at`
+
+// CreateWebhookSubscription stores the subscription and records it in the audit log as
+// entry, without its secret.
+func (s *Storage) CreateWebhookSubscription(sub webhook.Subscription, entry audit.Entry) (*webhook.Subscription, error) {
+	const op = "storage.postgresql.CreateWebhookSubscription"
+
+	sub.CreatedAt = time.Now()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("INSERT INTO webhook_subscriptions (account_id, url, event_types, secret, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		sub.AccountID, sub.URL, strings.Join(sub.EventTypes, ","), sub.Secret, sub.CreatedAt).Scan(&sub.ID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := appendAudit(tx, entry.WithResult(map[string]any{"id": sub.ID})); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &sub, nil
+}
+
+// GetWebhookSubscriptions returns the subscriptions of the account without their secrets.
+func (s *Storage) GetWebhookSubscriptions(accountID string) ([]webhook.Subscription, error) {
+	const op = "storage.postgresql.GetWebhookSubscriptions"
+
+	subs, err := s.queryWebhookSubscriptions("SELECT id, account_id, url, event_types, '', created_at FROM webhook_subscriptions WHERE account_id = $1 ORDER BY id", accountID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return subs, nil
+}
+
+// DeleteWebhookSubscription deletes the subscription and records it in the audit log as
+// entry.
+func (s *Storage) DeleteWebhookSubscription(id int, entry audit.Entry) error {
+	const op = "storage.postgresql.DeleteWebhookSubscription"
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM webhook_subscriptions WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if deleted == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrWebhookNotFound)
+	}
+
+	if err := appendAudit(tx, entry); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// GetWalletAccount returns the account the wallet belongs to.
+func (s *Storage) GetWalletAccount(walletID string) (string, error) {
+	const op = "storage.postgresql.GetWalletAccount"
+
+	var accountID sql.NullString
+
+	err := s.db.QueryRow("SELECT account_id FROM wallets WHERE id = $1", walletID).Scan(&accountID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%s: %w", op, storage.ErrWalletNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return accountID.String, nil
+}
+
+// EnqueueWebhookDeliveries adds a pending delivery of the event for every subscription of
+// the account that wants its type, and returns how many were added. An event that was
+// enqueued before is not enqueued again.
+func (s *Storage) EnqueueWebhookDeliveries(accountID string, eventID string, eventType string, payload []byte) (int, error) {
+	const op = "storage.postgresql.EnqueueWebhookDeliveries"
+
+	subs, err := s.queryWebhookSubscriptions("SELECT id, account_id, url, event_types, '', created_at FROM webhook_subscriptions WHERE account_id = $1", accountID)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := time.Now()
+	enqueued := 0
+
+	for _, sub := range subs {
+		if !sub.Wants(eventType) {
+			continue
+		}
+
+		res, err := s.db.Exec(`INSERT INTO webhook_deliveries (subscription_id, event_id, event_type, payload, status, next_attempt_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $6) ON CONFLICT (subscription_id, event_id) DO NOTHING`,
+			sub.ID, eventID, eventType, payload, webhook.StatusPending, now)
+		if err != nil {
+			return enqueued, fmt.Errorf("%s: %w", op, err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return enqueued, fmt.Errorf("%s: %w", op, err)
+		}
+		enqueued += int(n)
+	}
+
+	return enqueued, nil
+}
+
+// ClaimDueWebhookDeliveries returns up to limit pending deliveries that are due, with
+// their subscription's URL and secret. They are not due again for lease, so that several
+// billing instances don't deliver the same one at once.
+func (s *Storage) ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]webhook.Delivery, error) {
+	const op = "storage.postgresql.ClaimDueWebhookDeliveries"
+
+	now := time.Now()
+
+	rows, err := s.db.Query(`WITH due AS (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $1 AND next_attempt_at <= $2
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_deliveries d SET next_attempt_at = $4
+		FROM due, webhook_subscriptions sub
+		WHERE d.id = due.id AND sub.id = d.subscription_id
+		RETURNING `+deliveryColumns+`, sub.url, sub.secret`,
+		webhook.StatusPending, now, limit, now.Add(lease))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var deliveries []webhook.Delivery
+	for rows.Next() {
+		var d webhook.Delivery
+		if err := scanDelivery(rows, &d, &d.URL, &d.Secret); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt records an attempt of the delivery and its resulting status.
+// statusCode is 0 if no response was received.
+func (s *Storage) RecordWebhookAttempt(id int, status string, statusCode int, lastError string, nextAttemptAt time.Time) error {
+	const op = "storage.postgresql.RecordWebhookAttempt"
+
+	var deliveredAt *time.Time
+	if status == webhook.StatusDelivered {
+		now := time.Now()
+		deliveredAt = &now
+	}
+
+	_, err := s.db.Exec(`UPDATE webhook_deliveries SET status = $1, attempts = attempts + 1, last_status_code = NULLIF($2, 0),
+		last_error = NULLIF($3, ''), next_attempt_at = $4, delivered_at = $5 WHERE id = $6`,
+		status, statusCode, lastError, nextAttemptAt, deliveredAt, id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// GetWebhookDeliveries returns the deliveries matching the filter, newest first.
+func (s *Storage) GetWebhookDeliveries(filter webhook.DeliveryFilter) ([]webhook.Delivery, error) {
+	const op = "storage.postgresql.GetWebhookDeliveries"
+
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries d JOIN webhook_subscriptions sub ON sub.id = d.subscription_id WHERE TRUE"
+	var args []any
+
+	if filter.AccountID != "" {
+		args = append(args, filter.AccountID)
+		query += fmt.Sprintf(" AND sub.account_id = $%d", len(args))
+	}
+	if filter.SubscriptionID != 0 {
+		args = append(args, filter.SubscriptionID)
+		query += fmt.Sprintf(" AND d.subscription_id = $%d", len(args))
+	}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += fmt.Sprintf(" AND d.status = $%d", len(args))
+	}
+
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY d.id DESC LIMIT $%d", len(args))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var deliveries []webhook.Delivery
+	for rows.Next() {
+		var d webhook.Delivery
+		if err := scanDelivery(rows, &d); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deliveries, nil
+}
+
+// RedeliverWebhook makes a failed delivery pending again and due at once. Its attempts
+// are kept. The redelivery is recorded in the audit log as entry.
+func (s *Storage) RedeliverWebhook(id int, entry audit.Entry) (*webhook.Delivery, error) {
+	const op = "storage.postgresql.RedeliverWebhook"
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer tx.Rollback()
+
+	var d webhook.Delivery
+
+	err = scanDelivery(tx.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries d WHERE d.id = $1 FOR UPDATE", id), &d)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrDeliveryNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if d.Status != webhook.StatusFailed {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrDeliveryNotFailed)
+	}
+
+	d.Status = webhook.StatusPending
+	d.NextAttemptAt = time.Now()
+
+	_, err = tx.Exec("UPDATE webhook_deliveries SET status = $1, next_attempt_at = $2 WHERE id = $3", d.Status, d.NextAttemptAt, id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := appendAudit(tx, entry); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &d, nil
+}
+
+func (s *Storage) queryWebhookSubscriptions(query string, args ...any) ([]webhook.Subscription, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []webhook.Subscription
+	for rows.Next() {
+		var sub webhook.Subscription
+		var eventTypes string
+		if err := rows.Scan(&sub.ID, &sub.AccountID, &sub.URL, &eventTypes, &sub.Secret, &sub.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		sub.EventTypes = []string{}
+		if eventTypes != "" {
+			sub.EventTypes = strings.Split(eventTypes, ",")
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return subs, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanDelivery scans the deliveryColumns followed by extra columns.
+func scanDelivery(row scanner, d *webhook.Delivery, extra ...any) error {
+	var statusCode sql.NullInt64
+	var lastError sql.NullString
+	var deliveredAt sql.NullTime
+	var payload []byte
+
+	dest := append([]any{&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts,
+		&statusCode, &lastError, &d.NextAttemptAt, &d.CreatedAt, &deliveredAt}, extra...)
+
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+
+	d.Payload = payload
+	d.LastStatusCode = int(statusCode.Int64)
+	d.LastError = lastError.String
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+
+	return nil
+}
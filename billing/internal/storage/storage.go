@@ -4,5 +4,11 @@ import "errors"
 
 var (
 	ErrWalletNotFound      = errors.New("wallet not found")
+	ErrAccountHasWallet    = errors.New("account has a wallet already")
 	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrSubwalletNotFound   = errors.New("subwallet not found")
+	ErrMessageProcessed    = errors.New("message already processed")
+	ErrWebhookNotFound     = errors.New("webhook subscription not found")
+	ErrDeliveryNotFound    = errors.New("webhook delivery not found")
+	ErrDeliveryNotFailed   = errors.New("webhook delivery has not failed")
 )
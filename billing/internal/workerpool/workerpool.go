@@ -0,0 +1,153 @@
+package workerpool
+
+import (
+	"billing/internal/lib/logger/sl"
+	"bus"
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+)
+
+// Committer commits the offsets of handled messages, as bus.Subscription does.
+type Committer interface {
+	Commit(ctx context.Context, messages ...bus.Message) error
+}
+
+// Pool handles messages on a fixed number of workers. Messages with the same key, the
+// wallet ID, always go to the same worker, so the messages of a wallet are handled one
+// at a time and in order while different wallets are handled in parallel.
+//
+// Every worker has a queue of queueSize messages. Submit blocks while the queue of the
+// message's worker is full, so a slow wallet holds back the fetching instead of piling up
+// messages in memory.
+//
+// A partition's offset is only committed up to the lowest message that isn't handled
+// yet, so that a crash never skips a message that was still in flight.
+type Pool struct {
+	log       *slog.Logger
+	workers   []chan bus.Message
+	handle    func(ctx context.Context, message bus.Message) error
+	committer Committer
+	wg        sync.WaitGroup
+
+	mu       sync.Mutex
+	inFlight map[int][]*entry
+}
+
+type entry struct {
+	message bus.Message
+	done    bool
+}
+
+// New starts the workers. Once ctx is done, the workers hand it to the messages they are
+// handling and drop the queued ones without handling them.
+func New(ctx context.Context, log *slog.Logger, workers int, queueSize int, committer Committer, handle func(ctx context.Context, message bus.Message) error) *Pool {
+	p := &Pool{
+		log:       log,
+		workers:   make([]chan bus.Message, max(workers, 1)),
+		handle:    handle,
+		committer: committer,
+		inFlight:  map[int][]*entry{},
+	}
+
+	for i := range p.workers {
+		p.workers[i] = make(chan bus.Message, max(queueSize, 0))
+
+		p.wg.Add(1)
+		go p.work(ctx, p.workers[i])
+	}
+
+	return p
+}
+
+// Submit queues the message on the worker of its key. It blocks while that worker's queue
+// is full. Messages of a partition must be submitted in offset order.
+func (p *Pool) Submit(message bus.Message) {
+	p.track(message)
+
+	p.workers[p.worker(message)] <- message
+}
+
+// Close waits for the submitted messages to be handled.
+func (p *Pool) Close() {
+	for _, worker := range p.workers {
+		close(worker)
+	}
+
+	p.wg.Wait()
+}
+
+func (p *Pool) worker(message bus.Message) int {
+	if len(message.Key) == 0 {
+		return message.Partition % len(p.workers)
+	}
+
+	h := fnv.New32a()
+	h.Write(message.Key)
+
+	return int(h.Sum32() % uint32(len(p.workers)))
+}
+
+// track adds the message to the messages in flight of its partition.
+func (p *Pool) track(message bus.Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inFlight[message.Partition] = append(p.inFlight[message.Partition], &entry{message: message})
+}
+
+// work handles the messages of a worker. A message whose handling fails, because ctx is
+// done or a write it needs didn't happen, stays in flight: neither it nor the messages
+// after it in its partition are committed, so they are delivered again.
+func (p *Pool) work(ctx context.Context, messages <-chan bus.Message) {
+	defer p.wg.Done()
+
+	for message := range messages {
+		if ctx.Err() != nil {
+			continue
+		}
+
+		if err := p.handle(ctx, message); err != nil {
+			p.log.Warn("message left uncommitted", slog.Int("partition", message.Partition), slog.Int64("offset", message.Offset), sl.Err(err))
+			continue
+		}
+
+		p.done(ctx, message)
+	}
+}
+
+// done marks the message as handled and commits the partition up to the last message
+// before the first one still in flight. Committing under the lock keeps the commits of a
+// partition in order.
+func (p *Pool) done(ctx context.Context, message bus.Message) {
+	const op = "workerpool.done"
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending := p.inFlight[message.Partition]
+
+	for _, e := range pending {
+		if e.message.Offset == message.Offset {
+			e.done = true
+			break
+		}
+	}
+
+	n := 0
+	for n < len(pending) && pending[n].done {
+		n++
+	}
+
+	if n == 0 {
+		return
+	}
+
+	commit := pending[n-1].message
+	p.inFlight[message.Partition] = pending[n:]
+
+	if err := p.committer.Commit(ctx, commit); err != nil {
+		p.log.Error("failed to commit offset", slog.String("op", op), slog.Int("partition", commit.Partition), slog.Int64("offset", commit.Offset), sl.Err(err))
+	}
+}
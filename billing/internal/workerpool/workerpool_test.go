@@ -0,0 +1,282 @@
+package workerpool
+
+import (
+	"bus"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCommitter records the committed offsets of every partition.
+type fakeCommitter struct {
+	mu        sync.Mutex
+	err       error
+	committed map[int][]int64
+}
+
+func (f *fakeCommitter) Commit(ctx context.Context, messages ...bus.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.committed == nil {
+		f.committed = map[int][]int64{}
+	}
+	for _, m := range messages {
+		f.committed[m.Partition] = append(f.committed[m.Partition], m.Offset)
+	}
+
+	return f.err
+}
+
+func (f *fakeCommitter) offsets() map[int][]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.committed
+}
+
+func discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func message(partition int, offset int64) bus.Message {
+	return bus.Message{Partition: partition, Offset: offset}
+}
+
+// TestCommitOrder drives the bookkeeping without workers, so that the messages complete in
+// exactly the given order.
+func TestCommitOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		submitted []bus.Message
+		completed []bus.Message
+		want      map[int][]int64
+	}{
+		{
+			name:      "in order",
+			submitted: []bus.Message{message(0, 0), message(0, 1), message(0, 2)},
+			completed: []bus.Message{message(0, 0), message(0, 1), message(0, 2)},
+			want:      map[int][]int64{0: {0, 1, 2}},
+		},
+		{
+			name:      "later message first",
+			submitted: []bus.Message{message(0, 0), message(0, 1), message(0, 2)},
+			completed: []bus.Message{message(0, 2), message(0, 0), message(0, 1)},
+			want:      map[int][]int64{0: {0, 2}},
+		},
+		{
+			name:      "reverse order",
+			submitted: []bus.Message{message(0, 0), message(0, 1), message(0, 2)},
+			completed: []bus.Message{message(0, 2), message(0, 1), message(0, 0)},
+			want:      map[int][]int64{0: {2}},
+		},
+		{
+			name:      "gaps between offsets",
+			submitted: []bus.Message{message(0, 10), message(0, 12), message(0, 15)},
+			completed: []bus.Message{message(0, 12), message(0, 10), message(0, 15)},
+			want:      map[int][]int64{0: {12, 15}},
+		},
+		{
+			name:      "first message still in flight",
+			submitted: []bus.Message{message(0, 5), message(0, 6), message(0, 7)},
+			completed: []bus.Message{message(0, 7), message(0, 6)},
+			want:      nil,
+		},
+		{
+			name:      "partitions are independent",
+			submitted: []bus.Message{message(0, 0), message(1, 0), message(0, 1), message(1, 1)},
+			completed: []bus.Message{message(1, 1), message(0, 0), message(1, 0), message(0, 1)},
+			want:      map[int][]int64{0: {0, 1}, 1: {1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			committer := &fakeCommitter{}
+			p := &Pool{log: discard(), committer: committer, inFlight: map[int][]*entry{}}
+
+			for _, m := range tt.submitted {
+				p.track(m)
+			}
+			for _, m := range tt.completed {
+				p.done(context.Background(), m)
+			}
+
+			if got := committer.offsets(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("committed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommitErrorIsLogged(t *testing.T) {
+	var logs bytes.Buffer
+
+	committer := &fakeCommitter{err: errors.New("broker down")}
+	p := &Pool{log: slog.New(slog.NewTextHandler(&logs, nil)), committer: committer, inFlight: map[int][]*entry{}}
+
+	p.track(message(3, 41))
+	p.track(message(3, 42))
+	p.done(context.Background(), message(3, 41))
+	p.done(context.Background(), message(3, 42))
+
+	if !strings.Contains(logs.String(), "broker down") || !strings.Contains(logs.String(), "offset=41") {
+		t.Errorf("logs = %s", logs.String())
+	}
+
+	// A failed commit is not retried, the next one covers its offset
+	if got := committer.offsets()[3]; !reflect.DeepEqual(got, []int64{41, 42}) {
+		t.Errorf("committed %v, want [41 42]", got)
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	committer := &fakeCommitter{}
+
+	var mu sync.Mutex
+	handled := map[string][]int64{}
+
+	p := New(context.Background(), discard(), 4, 2, committer, func(ctx context.Context, m bus.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		handled[string(m.Key)] = append(handled[string(m.Key)], m.Offset)
+		return nil
+	})
+
+	for offset := int64(0); offset < 30; offset++ {
+		key := []string{"w-1", "w-2", "w-3"}[offset%3]
+		p.Submit(bus.Message{Key: []byte(key), Partition: 0, Offset: offset})
+	}
+	p.Close()
+
+	for key, offsets := range handled {
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Errorf("%s handled out of order: %v", key, offsets)
+				break
+			}
+		}
+	}
+
+	// Close waited for every message, so the last commit is the last offset
+	committed := committer.offsets()[0]
+	if len(committed) == 0 || committed[len(committed)-1] != 29 {
+		t.Errorf("committed %v, want it to end at 29", committed)
+	}
+}
+
+func TestSubmitBlocksOnFullQueue(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+
+	p := New(context.Background(), discard(), 1, 1, &fakeCommitter{}, func(ctx context.Context, m bus.Message) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return nil
+	})
+
+	// The worker holds the first message, the queue the second
+	p.Submit(message(0, 0))
+	<-started
+	p.Submit(message(0, 1))
+
+	submitted := make(chan struct{})
+	go func() {
+		p.Submit(message(0, 2))
+		close(submitted)
+	}()
+
+	select {
+	case <-submitted:
+		t.Fatal("Submit didn't block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+
+	select {
+	case <-submitted:
+	case <-time.After(time.Second):
+		t.Fatal("Submit still blocked after the worker caught up")
+	}
+
+	p.Close()
+}
+
+func TestFailedMessageIsNotCommitted(t *testing.T) {
+	committer := &fakeCommitter{}
+
+	p := New(context.Background(), discard(), 1, 4, committer, func(ctx context.Context, m bus.Message) error {
+		if m.Offset == 1 {
+			return errors.New("broker down")
+		}
+		return nil
+	})
+
+	for offset := int64(0); offset < 4; offset++ {
+		p.Submit(message(0, offset))
+	}
+	p.Close()
+
+	// Offset 1 stays in flight, so nothing after it is committed either
+	if got := committer.offsets()[0]; !reflect.DeepEqual(got, []int64{0}) {
+		t.Errorf("committed %v, want [0]", got)
+	}
+}
+
+func TestCloseAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	committer := &fakeCommitter{}
+	started := make(chan struct{})
+
+	var mu sync.Mutex
+	handled := 0
+
+	p := New(ctx, discard(), 1, 4, committer, func(ctx context.Context, m bus.Message) error {
+		mu.Lock()
+		handled++
+		mu.Unlock()
+
+		close(started)
+
+		// A write that can't succeed, e.g. with the broker down, until shutdown
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	for offset := int64(0); offset < 3; offset++ {
+		p.Submit(message(0, offset))
+	}
+	<-started
+
+	cancel()
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() hangs after the context was cancelled")
+	}
+
+	// The queued messages are dropped, none of them is committed
+	if handled != 1 || len(committer.offsets()) != 0 {
+		t.Errorf("handled %d messages and committed %v, want 1 and nothing", handled, committer.offsets())
+	}
+}
@@ -0,0 +1,83 @@
+// Package bus is the message transport between gwapi and billing, shared by both modules.
+// Kafka, in package kafka, is used in production, the in-process transport in package
+// memory runs without a broker; both services use the same one when they run in one
+// process, see devstack.
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrClosed is returned by a Subscription after Close.
+var ErrClosed = errors.New("bus: closed")
+
+// Message is a message on a topic. Partition and Offset are set on consumed messages.
+// Messages with the same key are kept in order.
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Time      time.Time
+}
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Header returns the value of the message header, or "" if it isn't set.
+func (m Message) Header(key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+
+	return ""
+}
+
+// PublishErrors is returned by Publish when only some of the messages were published. It
+// holds the error of each message by its index, nil for the ones that were published.
+type PublishErrors []error
+
+func (e PublishErrors) Error() string {
+	failed := 0
+	var first error
+	for _, err := range e {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+		}
+	}
+
+	return fmt.Sprintf("bus: %d of %d messages not published: %v", failed, len(e), first)
+}
+
+// Publisher sends messages to the topic set on each of them. An error that is not
+// PublishErrors applies to all messages.
+type Publisher interface {
+	Publish(ctx context.Context, messages ...Message) error
+	Close() error
+}
+
+// Subscriber subscribes consumer groups to topics. Every group gets each message once,
+// the subscriptions of a group share its messages.
+type Subscriber interface {
+	Subscribe(topic string, groupID string) Subscription
+}
+
+// Subscription fetches the messages of a topic for a group. A fetched message is
+// delivered again to the group unless it is committed.
+type Subscription interface {
+	Fetch(ctx context.Context) (Message, error)
+	Commit(ctx context.Context, messages ...Message) error
+	Close() error
+}
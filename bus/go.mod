@@ -0,0 +1,15 @@
+module bus
+
+go 1.21.5
+
+require (
+	github.com/bufbuild/protocompile v0.6.0
+	github.com/segmentio/kafka-go v0.4.47
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+)
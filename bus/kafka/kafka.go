@@ -0,0 +1,260 @@
+// Package kafka is the Kafka transport of the bus. The services pass their own writer
+// settings to NewPublisher.
+package kafka
+
+import (
+	"bus"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// WriterConfig tunes the writers of a Publisher. Zero values keep the kafka-go defaults.
+// Writes are always synchronous: Publish returns once the messages were written or
+// failed, so that the caller can retry them.
+type WriterConfig struct {
+	BatchSize    int
+	BatchTimeout time.Duration
+	// RequiredAcks is "none", "one" or "all".
+	RequiredAcks string
+	// Compression is "none", "gzip", "snappy", "lz4" or "zstd".
+	Compression string
+}
+
+// Publisher publishes to Kafka, partitioned by message key. It keeps one long-lived writer
+// per topic, so that messages are batched per topic and connections are reused.
+type Publisher struct {
+	brokers      []string
+	config       WriterConfig
+	requiredAcks kafkago.RequiredAcks
+	compression  kafkago.Compression
+
+	mu      sync.Mutex
+	writers map[string]*kafkago.Writer
+}
+
+func NewPublisher(brokers []string, config WriterConfig) (*Publisher, error) {
+	const op = "kafka.NewPublisher"
+
+	requiredAcks, err := parseRequiredAcks(config.RequiredAcks)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	compression, err := parseCompression(config.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &Publisher{
+		brokers:      brokers,
+		config:       config,
+		requiredAcks: requiredAcks,
+		compression:  compression,
+		writers:      map[string]*kafkago.Writer{},
+	}, nil
+}
+
+func (p *Publisher) Publish(ctx context.Context, messages ...bus.Message) error {
+	const op = "kafka.Publisher.Publish"
+
+	byTopic := map[string][]kafkago.Message{}
+	// indexes holds the index in messages of each message of a topic
+	indexes := map[string][]int{}
+	for i, m := range messages {
+		message := toKafka(m)
+		// The topic is set on the writer
+		message.Topic = ""
+		byTopic[m.Topic] = append(byTopic[m.Topic], message)
+		indexes[m.Topic] = append(indexes[m.Topic], i)
+	}
+
+	// The topics are written one after the other, a failed one doesn't stop the others
+	errs := make(bus.PublishErrors, len(messages))
+	failed := false
+
+	for topic, kafkaMessages := range byTopic {
+		err := p.writer(topic).WriteMessages(ctx, kafkaMessages...)
+		if err == nil {
+			continue
+		}
+		failed = true
+
+		var writeErrs kafkago.WriteErrors
+		if !errors.As(err, &writeErrs) {
+			if len(byTopic) == 1 {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+			writeErrs = make(kafkago.WriteErrors, len(kafkaMessages))
+			for i := range writeErrs {
+				writeErrs[i] = err
+			}
+		}
+
+		for i, writeErr := range writeErrs {
+			errs[indexes[topic][i]] = writeErr
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("%s: %w", op, errs)
+	}
+
+	return nil
+}
+
+// Close flushes and closes the writers.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var errs []error
+	for topic, writer := range p.writers {
+		errs = append(errs, writer.Close())
+		delete(p.writers, topic)
+	}
+
+	return errors.Join(errs...)
+}
+
+// writer returns the writer of the topic, creating it on first use.
+func (p *Publisher) writer(topic string) *kafkago.Writer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	writer, ok := p.writers[topic]
+	if ok {
+		return writer
+	}
+
+	writer = &kafkago.Writer{
+		Addr:                   kafkago.TCP(p.brokers...),
+		Topic:                  topic,
+		Balancer:               &kafkago.Hash{},
+		BatchSize:              p.config.BatchSize,
+		BatchTimeout:           p.config.BatchTimeout,
+		RequiredAcks:           p.requiredAcks,
+		Compression:            p.compression,
+		AllowAutoTopicCreation: true,
+	}
+
+	p.writers[topic] = writer
+
+	return writer
+}
+
+func parseRequiredAcks(acks string) (kafkago.RequiredAcks, error) {
+	switch acks {
+	case "none":
+		return kafkago.RequireNone, nil
+	case "one":
+		return kafkago.RequireOne, nil
+	case "", "all":
+		return kafkago.RequireAll, nil
+	default:
+		return 0, fmt.Errorf("unknown required acks %q", acks)
+	}
+}
+
+func parseCompression(compression string) (kafkago.Compression, error) {
+	switch compression {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafkago.Gzip, nil
+	case "snappy":
+		return kafkago.Snappy, nil
+	case "lz4":
+		return kafkago.Lz4, nil
+	case "zstd":
+		return kafkago.Zstd, nil
+	default:
+		return 0, fmt.Errorf("unknown compression %q", compression)
+	}
+}
+
+// Subscriber consumes Kafka topics with consumer groups.
+type Subscriber struct {
+	brokers []string
+}
+
+func NewSubscriber(brokers []string) *Subscriber {
+	return &Subscriber{brokers: brokers}
+}
+
+func (s *Subscriber) Subscribe(topic string, groupID string) bus.Subscription {
+	return &subscription{
+		reader: kafkago.NewReader(kafkago.ReaderConfig{
+			Brokers:        s.brokers,
+			CommitInterval: 0,
+			GroupID:        groupID,
+			Topic:          topic,
+			MaxBytes:       10e6,
+		}),
+	}
+}
+
+type subscription struct {
+	reader *kafkago.Reader
+}
+
+// Fetch reads the next message without committing it.
+func (s *subscription) Fetch(ctx context.Context) (bus.Message, error) {
+	m, err := s.reader.FetchMessage(ctx)
+	if err != nil {
+		return bus.Message{}, err
+	}
+
+	return fromKafka(m), nil
+}
+
+func (s *subscription) Commit(ctx context.Context, messages ...bus.Message) error {
+	kafkaMessages := make([]kafkago.Message, len(messages))
+	for i, m := range messages {
+		kafkaMessages[i] = toKafka(m)
+	}
+
+	return s.reader.CommitMessages(ctx, kafkaMessages...)
+}
+
+func (s *subscription) Close() error {
+	return s.reader.Close()
+}
+
+func toKafka(m bus.Message) kafkago.Message {
+	headers := make([]kafkago.Header, len(m.Headers))
+	for i, h := range m.Headers {
+		headers[i] = kafkago.Header{Key: h.Key, Value: h.Value}
+	}
+
+	return kafkago.Message{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+		Headers:   headers,
+		Time:      m.Time,
+	}
+}
+
+func fromKafka(m kafkago.Message) bus.Message {
+	headers := make([]bus.Header, len(m.Headers))
+	for i, h := range m.Headers {
+		headers[i] = bus.Header{Key: h.Key, Value: h.Value}
+	}
+
+	return bus.Message{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+		Headers:   headers,
+		Time:      m.Time,
+	}
+}
@@ -0,0 +1,132 @@
+package kafka
+
+import (
+	"bus"
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+func TestMessageConversion(t *testing.T) {
+	m := bus.Message{
+		Topic:     "invoices",
+		Partition: 3,
+		Offset:    42,
+		Key:       []byte("w-1"),
+		Value:     []byte(`{"wallet_id":"w-1"}`),
+		Headers:   []bus.Header{{Key: "operation-id", Value: []byte("op-1")}, {Key: "actor", Value: []byte("jwt:alice")}},
+		Time:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	if got := fromKafka(toKafka(m)); !reflect.DeepEqual(got, m) {
+		t.Errorf("got %+v, want %+v", got, m)
+	}
+}
+
+func TestNewPublisher(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  WriterConfig
+		wantErr bool
+	}{
+		{"defaults", WriterConfig{}, false},
+		{"tuned", WriterConfig{BatchSize: 10, BatchTimeout: time.Millisecond, RequiredAcks: "one", Compression: "zstd"}, false},
+		{"unknown acks", WriterConfig{RequiredAcks: "some"}, true},
+		{"unknown compression", WriterConfig{Compression: "brotli"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPublisher([]string{"localhost:9092"}, tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewPublisher() error = %v, want error %v", err, tt.wantErr)
+			}
+			if p != nil {
+				p.Close()
+			}
+		})
+	}
+}
+
+// BenchmarkPublish compares the long-lived writers of Publisher with a new kafka-go
+// writer per publish, as gwapi created for every command before. Requests are published
+// from parallel goroutines like the HTTP handlers do. It needs a broker; from the bus
+// module:
+//
+//	KAFKA_BROKERS=localhost:9092 go test -run '^$' -bench Publish ./kafka
+func BenchmarkPublish(b *testing.B) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		b.Skip("KAFKA_BROKERS is not set")
+	}
+	addrs := strings.Split(brokers, ",")
+
+	config := WriterConfig{BatchSize: 100, BatchTimeout: 10 * time.Millisecond, RequiredAcks: "all"}
+	topic := fmt.Sprintf("bench-publish-%d", time.Now().UnixNano())
+
+	var n atomic.Int64
+	message := func() bus.Message {
+		key := strconv.FormatInt(n.Add(1)%64, 10)
+		return bus.Message{Topic: topic, Key: []byte(key), Value: []byte(`{"wallet_id":"` + key + `","currency":"USD","amount":10}`)}
+	}
+
+	publisher, err := NewPublisher(addrs, config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer publisher.Close()
+
+	// The first write creates the topic, neither strategy pays for it
+	if err := publisher.Publish(context.Background(), message()); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("pooled writers", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := publisher.Publish(context.Background(), message()); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+	})
+
+	b.Run("writer per publish", func(b *testing.B) {
+		requiredAcks, _ := parseRequiredAcks(config.RequiredAcks)
+
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				writer := &kafkago.Writer{
+					Addr:                   kafkago.TCP(addrs...),
+					Topic:                  topic,
+					Balancer:               &kafkago.Hash{},
+					BatchSize:              config.BatchSize,
+					BatchTimeout:           config.BatchTimeout,
+					RequiredAcks:           requiredAcks,
+					AllowAutoTopicCreation: true,
+				}
+
+				m := toKafka(message())
+				m.Topic = ""
+
+				err := writer.WriteMessages(context.Background(), m)
+				writer.Close()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+	})
+}
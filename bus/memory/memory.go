@@ -0,0 +1,187 @@
+// Package memory is an in-process bus transport for local development and tests. It
+// keeps messages in memory only, so they are lost when the process exits.
+package memory
+
+import (
+	"bus"
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Bus is a Publisher and Subscriber. Like Kafka, topics are split into partitions by
+// message key and every consumer group has its own offsets.
+type Bus struct {
+	partitions int
+
+	mu     sync.Mutex
+	topics map[string]*topic
+	// published is closed and replaced whenever a message is published
+	published chan struct{}
+	next      int
+}
+
+type topic struct {
+	partitions [][]bus.Message
+	groups     map[string]*group
+}
+
+type group struct {
+	subscriptions int
+	next          []int64
+	committed     []int64
+	// rr is the partition the next fetch looks at first, so no partition starves
+	rr int
+}
+
+func New(partitions int) *Bus {
+	return &Bus{
+		partitions: max(partitions, 1),
+		topics:     map[string]*topic{},
+		published:  make(chan struct{}),
+	}
+}
+
+func (b *Bus) Publish(ctx context.Context, messages ...bus.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, m := range messages {
+		t := b.topic(m.Topic)
+
+		m.Partition = b.partition(m.Key)
+		m.Offset = int64(len(t.partitions[m.Partition]))
+		m.Headers = append([]bus.Header(nil), m.Headers...)
+		m.Time = time.Now()
+
+		t.partitions[m.Partition] = append(t.partitions[m.Partition], m)
+	}
+
+	close(b.published)
+	b.published = make(chan struct{})
+
+	return nil
+}
+
+func (b *Bus) Close() error {
+	return nil
+}
+
+// Subscribe starts from the committed offsets of the group if it has no other open
+// subscription, so that messages fetched but not committed are delivered again.
+func (b *Bus) Subscribe(topic string, groupID string) bus.Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.topic(topic)
+
+	g, ok := t.groups[groupID]
+	if !ok {
+		g = &group{
+			next:      make([]int64, b.partitions),
+			committed: make([]int64, b.partitions),
+		}
+		t.groups[groupID] = g
+	}
+
+	if g.subscriptions == 0 {
+		copy(g.next, g.committed)
+	}
+	g.subscriptions++
+
+	return &subscription{bus: b, topic: t, group: g}
+}
+
+// topic returns the topic, creating it on first use. b.mu must be held.
+func (b *Bus) topic(name string) *topic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{
+			partitions: make([][]bus.Message, b.partitions),
+			groups:     map[string]*group{},
+		}
+		b.topics[name] = t
+	}
+
+	return t
+}
+
+// partition hashes the key like kafka.Hash does. Messages without a key are spread
+// round-robin. b.mu must be held.
+func (b *Bus) partition(key []byte) int {
+	if len(key) == 0 {
+		b.next = (b.next + 1) % b.partitions
+		return b.next
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+
+	return int(h.Sum32() % uint32(b.partitions))
+}
+
+type subscription struct {
+	bus    *Bus
+	topic  *topic
+	group  *group
+	closed bool
+}
+
+// Fetch returns the next message of the group, waiting until one is published or ctx is
+// done.
+func (s *subscription) Fetch(ctx context.Context) (bus.Message, error) {
+	for {
+		s.bus.mu.Lock()
+
+		if s.closed {
+			s.bus.mu.Unlock()
+			return bus.Message{}, bus.ErrClosed
+		}
+
+		g := s.group
+		for i := range g.next {
+			p := (g.rr + i) % len(g.next)
+			if g.next[p] < int64(len(s.topic.partitions[p])) {
+				m := s.topic.partitions[p][g.next[p]]
+				g.next[p]++
+				g.rr = p + 1
+
+				s.bus.mu.Unlock()
+				return m, nil
+			}
+		}
+
+		published := s.bus.published
+		s.bus.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return bus.Message{}, ctx.Err()
+		case <-published:
+		}
+	}
+}
+
+func (s *subscription) Commit(ctx context.Context, messages ...bus.Message) error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	for _, m := range messages {
+		s.group.committed[m.Partition] = max(s.group.committed[m.Partition], m.Offset+1)
+	}
+
+	return nil
+}
+
+func (s *subscription) Close() error {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		s.group.subscriptions--
+	}
+
+	return nil
+}
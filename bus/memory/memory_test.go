@@ -0,0 +1,185 @@
+package memory
+
+import (
+	"bus"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func publish(t *testing.T, b *Bus, topic string, keys ...string) {
+	t.Helper()
+
+	messages := make([]bus.Message, len(keys))
+	for i, key := range keys {
+		messages[i] = bus.Message{Topic: topic, Key: []byte(key), Value: []byte(fmt.Sprintf("%s-%d", key, i))}
+	}
+
+	if err := b.Publish(context.Background(), messages...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fetch(t *testing.T, sub bus.Subscription) bus.Message {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m, err := sub.Fetch(ctx)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+
+	return m
+}
+
+// fetchNone checks that nothing is left for the subscription.
+func fetchNone(t *testing.T, sub bus.Subscription) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if m, err := sub.Fetch(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Fetch() = %s, %v, want nothing", m.Value, err)
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	b := New(4)
+
+	publish(t, b, "invoices", "a", "b", "a", "c", "a", "b")
+
+	sub := b.Subscribe("invoices", "billing")
+	defer sub.Close()
+
+	partitions := map[string]int{}
+	var values []string
+
+	for i := 0; i < 6; i++ {
+		m := fetch(t, sub)
+
+		key := string(m.Key)
+		if p, ok := partitions[key]; ok && p != m.Partition {
+			t.Errorf("key %s on partitions %d and %d", key, p, m.Partition)
+		}
+		partitions[key] = m.Partition
+
+		if key == "a" {
+			values = append(values, string(m.Value))
+		}
+	}
+
+	if fmt.Sprint(values) != "[a-0 a-2 a-4]" {
+		t.Errorf("messages of key a fetched as %v", values)
+	}
+
+	fetchNone(t, sub)
+}
+
+func TestGroups(t *testing.T) {
+	b := New(2)
+
+	billing := b.Subscribe("events", "billing")
+	defer billing.Close()
+	gwapi := b.Subscribe("events", "gwapi")
+	defer gwapi.Close()
+
+	publish(t, b, "events", "a")
+
+	// Every group gets each message
+	for _, sub := range []bus.Subscription{billing, gwapi} {
+		if m := fetch(t, sub); string(m.Value) != "a-0" || m.Topic != "events" {
+			t.Errorf("message = %+v", m)
+		}
+	}
+
+	// The subscriptions of a group share its messages
+	second := b.Subscribe("events", "billing")
+	defer second.Close()
+
+	publish(t, b, "events", "b", "c")
+
+	fetched := map[string]bool{}
+	fetched[string(fetch(t, billing).Value)] = true
+	fetched[string(fetch(t, second).Value)] = true
+
+	if !fetched["b-0"] || !fetched["c-1"] {
+		t.Errorf("fetched %v, want b-0 and c-1", fetched)
+	}
+
+	fetchNone(t, billing)
+	fetchNone(t, second)
+}
+
+func TestRedelivery(t *testing.T) {
+	b := New(1)
+
+	publish(t, b, "invoices", "a", "a", "a")
+
+	sub := b.Subscribe("invoices", "billing")
+	first := fetch(t, sub)
+	fetch(t, sub)
+
+	if err := sub.Commit(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+
+	// The second message was fetched but not committed
+	sub = b.Subscribe("invoices", "billing")
+	defer sub.Close()
+
+	if m := fetch(t, sub); m.Offset != 1 || string(m.Value) != "a-1" {
+		t.Errorf("fetched offset %d %s after resubscribing, want offset 1", m.Offset, m.Value)
+	}
+}
+
+func TestFetchWaits(t *testing.T) {
+	b := New(2)
+
+	sub := b.Subscribe("invoices", "billing")
+	defer sub.Close()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Publish(context.Background(), bus.Message{Topic: "invoices", Key: []byte("a"), Value: []byte("a-0")})
+	}()
+
+	if m := fetch(t, sub); string(m.Value) != "a-0" {
+		t.Errorf("message = %+v", m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := sub.Fetch(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Fetch() error = %v, want context.Canceled", err)
+	}
+
+	sub.Close()
+
+	if _, err := sub.Fetch(context.Background()); !errors.Is(err, bus.ErrClosed) {
+		t.Errorf("Fetch() error = %v after Close, want bus.ErrClosed", err)
+	}
+}
+
+func TestPublishCopiesHeaders(t *testing.T) {
+	b := New(1)
+
+	headers := []bus.Header{{Key: "actor", Value: []byte("jwt:alice")}}
+	if err := b.Publish(context.Background(), bus.Message{Topic: "invoices", Headers: headers}); err != nil {
+		t.Fatal(err)
+	}
+	headers[0] = bus.Header{Key: "actor", Value: []byte("changed")}
+
+	sub := b.Subscribe("invoices", "billing")
+	defer sub.Close()
+
+	if got := fetch(t, sub).Header("actor"); got != "jwt:alice" {
+		t.Errorf("actor = %q, want jwt:alice", got)
+	}
+}
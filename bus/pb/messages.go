@@ -0,0 +1,221 @@
+// Package pb encodes and decodes the messages of proto/billing/v1/messages.proto that
+// gwapi and billing exchange. It is written against the wire format directly, so the
+// build doesn't depend on protoc; the tests check it against the .proto file.
+package pb
+
+import (
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type Envelope struct {
+	ID            string
+	Type          string
+	Version       int
+	ProducedAt    time.Time
+	CorrelationID string
+	Payload       []byte
+}
+
+var envelopeFields = fields{
+	1: protowire.BytesType,
+	2: protowire.BytesType,
+	3: protowire.VarintType,
+	4: protowire.BytesType,
+	5: protowire.BytesType,
+	6: protowire.BytesType,
+}
+
+func (m *Envelope) Marshal() []byte {
+	var e encoder
+	e.string(1, m.ID)
+	e.string(2, m.Type)
+	e.int64(3, int64(int32(m.Version)))
+	e.timestamp(4, m.ProducedAt)
+	e.string(5, m.CorrelationID)
+	if len(m.Payload) > 0 {
+		e.message(6, m.Payload)
+	}
+
+	return e.b
+}
+
+func (m *Envelope) Unmarshal(b []byte) error {
+	return decode(b, envelopeFields, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.ID = f.string()
+		case 2:
+			m.Type = f.string()
+		case 3:
+			m.Version = int(f.int32())
+		case 4:
+			m.ProducedAt, err = f.timestamp()
+		case 5:
+			m.CorrelationID = f.string()
+		case 6:
+			m.Payload = f.bytes
+		}
+		return err
+	})
+}
+
+// Command is the layout shared by InvoiceRequested and WithdrawRequested.
+type Command struct {
+	WalletID string
+	Currency string
+	Amount   float64
+}
+
+var commandFields = fields{
+	1: protowire.BytesType,
+	2: protowire.BytesType,
+	3: protowire.Fixed64Type,
+}
+
+func (m *Command) Marshal() []byte {
+	var e encoder
+	e.string(1, m.WalletID)
+	e.string(2, m.Currency)
+	e.double(3, m.Amount)
+
+	return e.b
+}
+
+func (m *Command) Unmarshal(b []byte) error {
+	return decode(b, commandFields, func(f field) error {
+		switch f.num {
+		case 1:
+			m.WalletID = f.string()
+		case 2:
+			m.Currency = f.string()
+		case 3:
+			m.Amount = f.double()
+		}
+		return nil
+	})
+}
+
+type Balance struct {
+	WalletID     string
+	Currency     string
+	Amount       float64
+	FrozenAmount float64
+}
+
+var balanceFields = fields{
+	1: protowire.BytesType,
+	2: protowire.BytesType,
+	3: protowire.Fixed64Type,
+	4: protowire.Fixed64Type,
+}
+
+func (m *Balance) Marshal() []byte {
+	var e encoder
+	e.string(1, m.WalletID)
+	e.string(2, m.Currency)
+	e.double(3, m.Amount)
+	e.double(4, m.FrozenAmount)
+
+	return e.b
+}
+
+func (m *Balance) Unmarshal(b []byte) error {
+	return decode(b, balanceFields, func(f field) error {
+		switch f.num {
+		case 1:
+			m.WalletID = f.string()
+		case 2:
+			m.Currency = f.string()
+		case 3:
+			m.Amount = f.double()
+		case 4:
+			m.FrozenAmount = f.double()
+		}
+		return nil
+	})
+}
+
+type TransactionResult struct {
+	Type            string
+	OperationID     string
+	WalletID        string
+	TransactionID   int64
+	TransactionType string
+	Currency        string
+	Amount          float64
+	Status          string
+	DateCreated     time.Time
+	Balance         *Balance
+	Error           string
+	OccurredAt      time.Time
+}
+
+var transactionResultFields = fields{
+	1:  protowire.BytesType,
+	2:  protowire.BytesType,
+	3:  protowire.BytesType,
+	4:  protowire.VarintType,
+	5:  protowire.BytesType,
+	6:  protowire.BytesType,
+	7:  protowire.Fixed64Type,
+	8:  protowire.BytesType,
+	9:  protowire.BytesType,
+	10: protowire.BytesType,
+	11: protowire.BytesType,
+	12: protowire.BytesType,
+}
+
+func (m *TransactionResult) Marshal() []byte {
+	var e encoder
+	e.string(1, m.Type)
+	e.string(2, m.OperationID)
+	e.string(3, m.WalletID)
+	e.int64(4, m.TransactionID)
+	e.string(5, m.TransactionType)
+	e.string(6, m.Currency)
+	e.double(7, m.Amount)
+	e.string(8, m.Status)
+	e.timestamp(9, m.DateCreated)
+	if m.Balance != nil {
+		e.message(10, m.Balance.Marshal())
+	}
+	e.string(11, m.Error)
+	e.timestamp(12, m.OccurredAt)
+
+	return e.b
+}
+
+func (m *TransactionResult) Unmarshal(b []byte) error {
+	return decode(b, transactionResultFields, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			m.Type = f.string()
+		case 2:
+			m.OperationID = f.string()
+		case 3:
+			m.WalletID = f.string()
+		case 4:
+			m.TransactionID = f.int64()
+		case 5:
+			m.TransactionType = f.string()
+		case 6:
+			m.Currency = f.string()
+		case 7:
+			m.Amount = f.double()
+		case 8:
+			m.Status = f.string()
+		case 9:
+			m.DateCreated, err = f.timestamp()
+		case 10:
+			m.Balance = &Balance{}
+			err = m.Balance.Unmarshal(f.bytes)
+		case 11:
+			m.Error = f.string()
+		case 12:
+			m.OccurredAt, err = f.timestamp()
+		}
+		return err
+	})
+}
@@ -0,0 +1,342 @@
+package pb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type message interface {
+	Marshal() []byte
+	Unmarshal(b []byte) error
+}
+
+// schema compiles proto/billing/v1/messages.proto, the file the codec is written against.
+func schema(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: []string{"../../proto"},
+		}),
+	}
+
+	files, err := compiler.Compile(context.Background(), "billing/v1/messages.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files[0]
+}
+
+// set fills m from values keyed by field name. Nested maps are messages and times are
+// google.protobuf.Timestamp messages.
+func set(m protoreflect.Message, values map[string]any) {
+	for name, v := range values {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+
+		switch v := v.(type) {
+		case map[string]any:
+			set(m.Mutable(fd).Message(), v)
+		case time.Time:
+			set(m.Mutable(fd).Message(), map[string]any{"seconds": v.Unix(), "nanos": int32(v.Nanosecond())})
+		default:
+			m.Set(fd, protoreflect.ValueOf(v))
+		}
+	}
+}
+
+var (
+	created  = time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	occurred = time.Date(1969, 12, 31, 23, 59, 59, 500_000_000, time.UTC)
+)
+
+var messageTests = []struct {
+	name    string
+	message string
+	ours    message
+	values  map[string]any
+}{
+	{
+		name:    "envelope",
+		message: "Envelope",
+		ours: &Envelope{
+			ID:            "e-1",
+			Type:          "InvoiceRequested",
+			Version:       2,
+			ProducedAt:    created,
+			CorrelationID: "c-1",
+			Payload:       []byte{0x0a, 0x03, 'w', '-', '1'},
+		},
+		values: map[string]any{
+			"id":             "e-1",
+			"type":           "InvoiceRequested",
+			"version":        int32(2),
+			"produced_at":    created,
+			"correlation_id": "c-1",
+			"payload":        []byte{0x0a, 0x03, 'w', '-', '1'},
+		},
+	},
+	{
+		name:    "envelope with negative version and time before 1970",
+		message: "Envelope",
+		ours:    &Envelope{ID: "e-2", Version: -1, ProducedAt: occurred},
+		values:  map[string]any{"id": "e-2", "version": int32(-1), "produced_at": occurred},
+	},
+	{
+		name:    "empty envelope",
+		message: "Envelope",
+		ours:    &Envelope{},
+		values:  map[string]any{},
+	},
+	{
+		name:    "invoice requested",
+		message: "InvoiceRequested",
+		ours:    &Command{WalletID: "w-1", Currency: "USD", Amount: 10.25},
+		values:  map[string]any{"wallet_id": "w-1", "currency": "USD", "amount": 10.25},
+	},
+	{
+		name:    "withdraw requested",
+		message: "WithdrawRequested",
+		ours:    &Command{WalletID: "w-1", Currency: "EUR", Amount: -0.5},
+		values:  map[string]any{"wallet_id": "w-1", "currency": "EUR", "amount": -0.5},
+	},
+	{
+		name:    "balance",
+		message: "Balance",
+		ours:    &Balance{WalletID: "w-1", Currency: "USD", Amount: 100, FrozenAmount: 12.5},
+		values:  map[string]any{"wallet_id": "w-1", "currency": "USD", "amount": 100.0, "frozen_amount": 12.5},
+	},
+	{
+		name:    "transaction result",
+		message: "TransactionResult",
+		ours: &TransactionResult{
+			Type:            "TransactionCompleted",
+			OperationID:     "op-1",
+			WalletID:        "w-1",
+			TransactionID:   1 << 40,
+			TransactionType: "Invoice",
+			Currency:        "USD",
+			Amount:          10,
+			Status:          "Success",
+			DateCreated:     created,
+			Balance:         &Balance{WalletID: "w-1", Currency: "USD", Amount: 110},
+			OccurredAt:      occurred,
+		},
+		values: map[string]any{
+			"type":             "TransactionCompleted",
+			"operation_id":     "op-1",
+			"wallet_id":        "w-1",
+			"transaction_id":   int64(1 << 40),
+			"transaction_type": "Invoice",
+			"currency":         "USD",
+			"amount":           10.0,
+			"status":           "Success",
+			"date_created":     created,
+			"balance":          map[string]any{"wallet_id": "w-1", "currency": "USD", "amount": 110.0},
+			"occurred_at":      occurred,
+		},
+	},
+	{
+		name:    "failed transaction with empty balance",
+		message: "TransactionResult",
+		ours:    &TransactionResult{Type: "TransactionFailed", OperationID: "op-2", Balance: &Balance{}, Error: "insufficient funds"},
+		values:  map[string]any{"type": "TransactionFailed", "operation_id": "op-2", "balance": map[string]any{}, "error": "insufficient funds"},
+	},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range messageTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := reflect.New(reflect.TypeOf(tt.ours).Elem()).Interface().(message)
+			if err := got.Unmarshal(tt.ours.Marshal()); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.ours) {
+				t.Errorf("got %+v, want %+v", got, tt.ours)
+			}
+		})
+	}
+}
+
+func TestSchemaCompatibility(t *testing.T) {
+	file := schema(t)
+
+	for _, tt := range messageTests {
+		desc := file.Messages().ByName(protoreflect.Name(tt.message))
+		if desc == nil {
+			t.Fatalf("%s is not in messages.proto", tt.message)
+		}
+
+		want := dynamicpb.NewMessage(desc)
+		set(want, tt.values)
+
+		t.Run(tt.name+" decoded by protobuf", func(t *testing.T) {
+			got := dynamicpb.NewMessage(desc)
+			if err := proto.Unmarshal(tt.ours.Marshal(), got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !proto.Equal(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+
+		t.Run(tt.name+" encoded by protobuf", func(t *testing.T) {
+			b, err := proto.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := reflect.New(reflect.TypeOf(tt.ours).Elem()).Interface().(message)
+			if err := got.Unmarshal(b); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.ours) {
+				t.Errorf("got %+v, want %+v", got, tt.ours)
+			}
+		})
+	}
+}
+
+// TestFieldTypes checks the wire types decode expects against every message of the schema.
+func TestFieldTypes(t *testing.T) {
+	file := schema(t)
+
+	known := map[protoreflect.FullName]fields{
+		"billing.v1.Envelope":          envelopeFields,
+		"billing.v1.InvoiceRequested":  commandFields,
+		"billing.v1.WithdrawRequested": commandFields,
+		"billing.v1.Balance":           balanceFields,
+		"billing.v1.TransactionResult": transactionResultFields,
+		"google.protobuf.Timestamp":    timestampFields,
+	}
+
+	wireTypes := map[protoreflect.Kind]protowire.Type{
+		protoreflect.StringKind:  protowire.BytesType,
+		protoreflect.BytesKind:   protowire.BytesType,
+		protoreflect.MessageKind: protowire.BytesType,
+		protoreflect.DoubleKind:  protowire.Fixed64Type,
+		protoreflect.Int32Kind:   protowire.VarintType,
+		protoreflect.Int64Kind:   protowire.VarintType,
+	}
+
+	check := func(desc protoreflect.MessageDescriptor) {
+		want, ok := known[desc.FullName()]
+		if !ok {
+			t.Errorf("%s has no codec", desc.FullName())
+			return
+		}
+
+		if desc.Fields().Len() != len(want) {
+			t.Errorf("%s has %d fields, the codec knows %d", desc.FullName(), desc.Fields().Len(), len(want))
+		}
+
+		for i := 0; i < desc.Fields().Len(); i++ {
+			fd := desc.Fields().Get(i)
+
+			typ, ok := wireTypes[fd.Kind()]
+			if !ok || fd.IsList() || fd.IsMap() {
+				t.Errorf("%s: the codec doesn't handle %s", fd.FullName(), fd.Kind())
+				continue
+			}
+			if got, ok := want[fd.Number()]; !ok || got != typ {
+				t.Errorf("%s (%d): codec expects wire type %d, schema has %d", fd.FullName(), fd.Number(), got, typ)
+			}
+		}
+	}
+
+	for i := 0; i < file.Messages().Len(); i++ {
+		desc := file.Messages().Get(i)
+		check(desc)
+
+		for j := 0; j < desc.Fields().Len(); j++ {
+			if m := desc.Fields().Get(j).Message(); m != nil && m.ParentFile() != file {
+				check(m)
+			}
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	valid := (&Command{WalletID: "w-1", Currency: "USD", Amount: 1}).Marshal()
+
+	tests := []struct {
+		name string
+		b    []byte
+		into message
+	}{
+		{
+			name: "string sent as varint",
+			b:    protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 7),
+			into: &Envelope{},
+		},
+		{
+			name: "amount sent as varint",
+			b:    protowire.AppendVarint(protowire.AppendTag(nil, 3, protowire.VarintType), 10),
+			into: &Command{},
+		},
+		{
+			name: "version sent as fixed64",
+			b:    protowire.AppendFixed64(protowire.AppendTag(nil, 3, protowire.Fixed64Type), 2),
+			into: &Envelope{},
+		},
+		{
+			name: "balance sent as fixed32",
+			b:    protowire.AppendFixed32(protowire.AppendTag(nil, 10, protowire.Fixed32Type), 1),
+			into: &TransactionResult{},
+		},
+		{
+			name: "timestamp seconds sent as bytes",
+			b: protowire.AppendBytes(protowire.AppendTag(nil, 4, protowire.BytesType),
+				protowire.AppendString(protowire.AppendTag(nil, 1, protowire.BytesType), "now")),
+			into: &Envelope{},
+		},
+		{
+			name: "message of another type",
+			b:    (&Envelope{ID: "e-1", Version: 1}).Marshal(),
+			into: &Command{},
+		},
+		{
+			name: "truncated",
+			b:    valid[:len(valid)-1],
+			into: &Command{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.into.Unmarshal(tt.b); err == nil {
+				t.Errorf("Unmarshal() succeeded: %+v", tt.into)
+			}
+		})
+	}
+}
+
+func TestUnmarshalSkipsUnknownFields(t *testing.T) {
+	want := &Command{WalletID: "w-1", Currency: "USD", Amount: 1}
+
+	b := want.Marshal()
+	b = protowire.AppendVarint(protowire.AppendTag(b, 4, protowire.VarintType), 1)
+	b = protowire.AppendString(protowire.AppendTag(b, 5, protowire.BytesType), "memo")
+	b = protowire.AppendFixed32(protowire.AppendTag(b, 6, protowire.Fixed32Type), 1)
+	b = protowire.AppendFixed64(protowire.AppendTag(b, 99, protowire.Fixed64Type), 1)
+
+	var got Command
+	if err := got.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if got != *want {
+		t.Errorf("got %+v, want %+v", got, *want)
+	}
+}
@@ -0,0 +1,157 @@
+package pb
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// encoder appends fields in the protobuf wire format. Zero values are left out, as proto3
+// does for scalar fields.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) string(num protowire.Number, v string) {
+	if v == "" {
+		return
+	}
+	e.b = protowire.AppendTag(e.b, num, protowire.BytesType)
+	e.b = protowire.AppendString(e.b, v)
+}
+
+func (e *encoder) double(num protowire.Number, v float64) {
+	if v == 0 {
+		return
+	}
+	e.b = protowire.AppendTag(e.b, num, protowire.Fixed64Type)
+	e.b = protowire.AppendFixed64(e.b, math.Float64bits(v))
+}
+
+func (e *encoder) int64(num protowire.Number, v int64) {
+	if v == 0 {
+		return
+	}
+	e.b = protowire.AppendTag(e.b, num, protowire.VarintType)
+	e.b = protowire.AppendVarint(e.b, uint64(v))
+}
+
+func (e *encoder) message(num protowire.Number, v []byte) {
+	e.b = protowire.AppendTag(e.b, num, protowire.BytesType)
+	e.b = protowire.AppendBytes(e.b, v)
+}
+
+// timestamp encodes t as a google.protobuf.Timestamp.
+func (e *encoder) timestamp(num protowire.Number, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+
+	var ts encoder
+	ts.int64(1, t.Unix())
+	ts.int64(2, int64(t.Nanosecond()))
+
+	e.message(num, ts.b)
+}
+
+// fields maps the field numbers of a message to their wire types.
+type fields map[protowire.Number]protowire.Type
+
+var timestampFields = fields{
+	1: protowire.VarintType,
+	2: protowire.VarintType,
+}
+
+type field struct {
+	num    protowire.Number
+	varint uint64
+	fixed  uint64
+	bytes  []byte
+}
+
+func (f field) string() string {
+	return string(f.bytes)
+}
+
+func (f field) double() float64 {
+	return math.Float64frombits(f.fixed)
+}
+
+func (f field) int64() int64 {
+	return int64(f.varint)
+}
+
+func (f field) int32() int32 {
+	return int32(f.varint)
+}
+
+// timestamp decodes a google.protobuf.Timestamp.
+func (f field) timestamp() (time.Time, error) {
+	var seconds, nanos int64
+
+	err := decode(f.bytes, timestampFields, func(ts field) error {
+		switch ts.num {
+		case 1:
+			seconds = ts.int64()
+		case 2:
+			nanos = int64(ts.int32())
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(seconds, nanos).UTC(), nil
+}
+
+// decode calls fn for every field of a message that is in known. Other fields are
+// skipped, so that messages from a newer schema can be read. A known field with another
+// wire type than its own is an error: the message is of another type or schema.
+func decode(b []byte, known fields, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		want, ok := known[num]
+		if !ok {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		if typ != want {
+			return fmt.Errorf("pb: field %d has wire type %d, want %d", num, typ, want)
+		}
+
+		f := field{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.fixed, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+// Command devstack runs billing and gwapi in one process, connected by one in-process
+// memory bus instead of Kafka, for local development. Each service reads its own config
+// file, their bus settings are ignored. Environment variables override both files, so
+// they are best left unset. billing still needs its database.
+package main
+
+import (
+	billingapp "billing/app"
+	"bus/memory"
+	"context"
+	"flag"
+	gwapiapp "gwapi/app"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	billingConfig := flag.String("billing-config", "config/billing.yaml", "billing's config file")
+	gwapiConfig := flag.String("gwapi-config", "config/gwapi.yaml", "gwapi's config file")
+	partitions := flag.Int("partitions", 6, "partitions of every topic on the bus")
+	flag.Parse()
+
+	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	billingCfg, err := billingapp.LoadConfig(*billingConfig)
+	if err != nil {
+		log.Error("failed to load billing config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	gwapiCfg, err := gwapiapp.LoadConfig(*gwapiConfig)
+	if err != nil {
+		log.Error("failed to load gwapi config", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	b := memory.New(*partitions)
+	defer b.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- billingapp.Run(ctx, log.With(slog.String("service", "billing")), billingCfg, b, b)
+	}()
+	go func() {
+		errs <- gwapiapp.Run(ctx, log.With(slog.String("service", "gwapi")), gwapiCfg, b, b)
+	}()
+
+	// A service that stops on its own stops the other one as well
+	code := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			log.Error("service failed", slog.String("error", err.Error()))
+			code = 1
+		}
+		stop()
+	}
+
+	os.Exit(code)
+}
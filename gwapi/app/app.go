@@ -0,0 +1,169 @@
+// Package app wires gwapi's HTTP server, outbox relay and event reader. cmd/gwapi runs it
+// on its own, devstack runs it next to billing in one process with a shared in-process
+// bus.
+package app
+
+import (
+	"bus"
+	"context"
+	"errors"
+	"fmt"
+	"gwapi/internal/auth"
+	"gwapi/internal/billing"
+	"gwapi/internal/breaker"
+	"gwapi/internal/config"
+	"gwapi/internal/http-server/handler"
+	"gwapi/internal/lib/envelope"
+	"gwapi/internal/outbox"
+	"gwapi/internal/publisher"
+	"gwapi/internal/readers/eventReader"
+	"gwapi/internal/service"
+	"gwapi/internal/stream"
+	"log/slog"
+	"net/http"
+)
+
+// LoadConfig reads the config file at path, overridden by the environment, and validates
+// it.
+func LoadConfig(path string) (*config.Config, error) {
+	const op = "app.LoadConfig"
+
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: invalid config:\n%w", op, err)
+	}
+
+	return cfg, nil
+}
+
+// Run opens the outbox, starts the server, the relay and the event reader, and serves
+// until ctx is done. Commands are published to publisher and events consumed from
+// subscriber, which the caller closes.
+func Run(ctx context.Context, log *slog.Logger, cfg *config.Config, busPublisher bus.Publisher, subscriber bus.Subscriber) error {
+	const op = "app.Run"
+
+	contentType, err := envelope.ContentType(cfg.Kafka.Encoding)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	commandOutbox, err := outbox.Open(cfg.Outbox.Path, cfg.Outbox.Retention)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer commandOutbox.Close()
+
+	var authenticator handler.Authenticator
+	if cfg.Auth.Enabled {
+		authenticator, err = newAuthenticator(cfg.Auth)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	} else {
+		log.Warn("authentication is disabled, every caller may act on every wallet")
+	}
+
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	relayDone := make(chan struct{})
+
+	kafkaBreaker := newBreaker("kafka", cfg.Kafka.Breaker, nil)
+
+	relay := outbox.NewRelay(log, commandOutbox, publisher.New(busPublisher, contentType, kafkaBreaker), cfg.Kafka.Writer.BatchSize, cfg.Outbox.MaxAttempts, cfg.Outbox.MinBackoff, cfg.Outbox.MaxBackoff)
+	hub := stream.New(cfg.Stream.RecentEvents, cfg.Stream.Retention)
+	eventReader := eventReader.New(log, commandOutbox, hub, subscriber, cfg.Events.Topic, cfg.Events.GroupID)
+	go func() {
+		defer close(relayDone)
+		relay.Run(relayCtx)
+	}()
+	go eventReader.Read(relayCtx)
+	go commandOutbox.RunCompaction(relayCtx, log, cfg.Outbox.CompactInterval)
+
+	billingBreaker := newBreaker("billing", cfg.Billing.Breaker, billing.Failed)
+	billingClient := billing.New(cfg.Billing.URL, cfg.Billing.Timeout, cfg.Billing.Retries, cfg.Billing.Backoff, billingBreaker)
+
+	service := service.New(log, *cfg, commandOutbox, billingClient)
+
+	handler := handler.New(service, cfg.Commands.Mode, hub, cfg.Stream.Heartbeat, authenticator, billingBreaker, kafkaBreaker)
+
+	router := handler.InitRoutes()
+
+	log.Info("starting server", slog.String("address", cfg.HTTPServer.Address))
+
+	srv := &http.Server{
+		Addr:        ":" + cfg.HTTPServer.Address,
+		Handler:     router,
+		ReadTimeout: cfg.HTTPServer.Timeout,
+		IdleTimeout: cfg.HTTPServer.IdleTimeout,
+	}
+	// Streams never end on their own, let clients reconnect to another instance
+	srv.RegisterOnShutdown(hub.Close)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+	}()
+
+	log.Info("server started")
+
+	select {
+	case <-ctx.Done():
+	case err := <-serveErr:
+		stopRelay()
+		<-relayDone
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("stopping server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTPServer.Timeout)
+	defer cancel()
+
+	shutdownErr := srv.Shutdown(shutdownCtx)
+
+	// Commands accepted until the server stopped are still published if the brokers allow
+	stopRelay()
+	<-relayDone
+
+	if shutdownErr != nil {
+		return fmt.Errorf("%s: %w", op, shutdownErr)
+	}
+
+	log.Info("server stopped")
+
+	return nil
+}
+
+func newAuthenticator(cfg config.Auth) (*auth.Authenticator, error) {
+	var verifier *auth.Verifier
+	if cfg.JWT.JWKSPath != "" {
+		var err error
+
+		verifier, err = auth.NewVerifier(cfg.JWT.JWKSPath, cfg.JWT.Issuer, cfg.JWT.Audience, cfg.JWT.AccountClaim, cfg.JWT.Leeway)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]auth.APIKey, 0, len(cfg.APIKeys))
+	for _, k := range cfg.APIKeys {
+		keys = append(keys, auth.APIKey{Name: k.Name, SHA256: k.SHA256, AccountID: k.AccountID, Admin: k.Admin})
+	}
+
+	return auth.New(keys, verifier)
+}
+
+func newBreaker(name string, cfg config.Breaker, isFailure func(error) bool) *breaker.Breaker {
+	return breaker.New(name, breaker.Config{
+		FailureThreshold: cfg.FailureThreshold,
+		OpenTimeout:      cfg.OpenTimeout,
+		HalfOpenProbes:   cfg.HalfOpenProbes,
+		MaxConcurrent:    cfg.MaxConcurrent,
+	}, isFailure)
+}
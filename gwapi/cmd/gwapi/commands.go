@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"gwapi/internal/config"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `usage: gwapi [command]
+
+Without a command gwapi starts the server. Commands:
+  dump-config  print the effective config as YAML, with secrets masked
+`
+
+// runCommand runs a one-off administrative command and returns the process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "dump-config":
+		return dumpConfig()
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+}
+
+// dumpConfig prints the config after defaults and environment overrides were applied,
+// then the problems that keep it from validating, if any.
+func dumpConfig() int {
+	cfg, err := config.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+
+	if err := enc.Encode(cfg.Redacted()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode config: %v\n", err)
+		return 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%s\n", err)
+		return 1
+	}
+
+	return 0
+}
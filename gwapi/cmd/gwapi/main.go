@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bus"
+	"bus/kafka"
+	"bus/memory"
 	"context"
+	"fmt"
+	"gwapi/app"
 	"gwapi/internal/config"
-	"gwapi/internal/http-server/handler"
-	"gwapi/internal/service"
+	"gwapi/internal/lib/logger/sl"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -30,6 +33,11 @@ const (
 // @contact.email  zhiborkin_ei@mail.ru
 
 func main() {
+	// Commands run before validation so that dump-config also shows a config that doesn't load
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	cfg := config.MustLoad()
 
 	log := setupLogger(cfg.Env)
@@ -41,45 +49,43 @@ func main() {
 	)
 	log.Debug("debug messages are enabled")
 
-	service := service.New(log, *cfg)
-	handler := handler.New(service)
-
-	router := handler.InitRoutes()
-
-	log.Info("starting server", slog.String("address", cfg.HTTPServer.Address))
+	busPublisher, subscriber, err := newBus(cfg)
+	if err != nil {
+		log.Error("failed to initialize bus", sl.Err(err))
+		os.Exit(1)
+	}
+	defer busPublisher.Close()
 
-	done := make(chan os.Signal, 1)
-	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	srv := &http.Server{
-		Addr:        ":" + cfg.HTTPServer.Address,
-		Handler:     router,
-		ReadTimeout: cfg.HTTPServer.Timeout,
-		IdleTimeout: cfg.HTTPServer.IdleTimeout,
+	if err := app.Run(ctx, log, cfg, busPublisher, subscriber); err != nil {
+		log.Error("failed to run", sl.Err(err))
+		os.Exit(1)
 	}
+}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Error("failed to start server")
+// newBus returns the transport selected by the config.
+func newBus(cfg *config.Config) (bus.Publisher, bus.Subscriber, error) {
+	switch cfg.Bus.Transport {
+	case "kafka":
+		publisher, err := kafka.NewPublisher(cfg.Kafka.Brokers, kafka.WriterConfig{
+			BatchSize:    cfg.Kafka.Writer.BatchSize,
+			BatchTimeout: cfg.Kafka.Writer.BatchTimeout,
+			RequiredAcks: cfg.Kafka.Writer.RequiredAcks,
+			Compression:  cfg.Kafka.Writer.Compression,
+		})
+		if err != nil {
+			return nil, nil, err
 		}
-	}()
 
-	log.Info("server started")
-
-	<-done
-	log.Info("stopping server")
-
-	ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTPServer.Timeout)
-	defer cancel()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Error("failed to stop server", err)
-
-		return
+		return publisher, kafka.NewSubscriber(cfg.Kafka.Brokers), nil
+	case "memory":
+		b := memory.New(cfg.Bus.Partitions)
+		return b, b, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown bus transport %q", cfg.Bus.Transport)
 	}
-
-	log.Info("server stopped")
-
 }
 
 func setupLogger(env string) *slog.Logger {
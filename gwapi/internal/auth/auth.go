@@ -0,0 +1,134 @@
+// Package auth authenticates the callers of gwapi by API key or JWT.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Methods a caller authenticated with.
+const (
+	MethodAPIKey = "api_key"
+	MethodJWT    = "jwt"
+)
+
+var (
+	// ErrNoCredentials is returned for a request without an API key or token.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is matched by unknown API keys and rejected tokens.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is an authenticated caller. It acts on the wallet of AccountID, or on every
+// wallet if it is an admin.
+type Principal struct {
+	Subject   string
+	AccountID string
+	Admin     bool
+	Method    string
+}
+
+// Owns reports whether the caller may act on a wallet of the account.
+func (p Principal) Owns(accountID string) bool {
+	return p.Admin || (p.AccountID != "" && p.AccountID == accountID)
+}
+
+// Actor names the caller in billing's audit log, e.g. "jwt:alice" or "api_key:backoffice".
+// Tokens without a subject are named by their account.
+func (p Principal) Actor() string {
+	if p.Method == "" {
+		return ""
+	}
+
+	if p.Subject == "" {
+		return p.Method + ":account:" + p.AccountID
+	}
+
+	return p.Method + ":" + p.Subject
+}
+
+type ctxKey struct{}
+
+// NewContext returns a copy of ctx that carries the caller.
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+// FromContext returns the caller ctx carries, if any.
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(ctxKey{}).(Principal)
+	return p, ok
+}
+
+// APIKey is a key gwapi accepts. Only the SHA-256 of the key, hex encoded, is configured.
+type APIKey struct {
+	Name      string
+	SHA256    string
+	AccountID string
+	Admin     bool
+}
+
+// Authenticator checks API keys and, if it has a verifier, JWTs.
+type Authenticator struct {
+	keys     map[[sha256.Size]byte]Principal
+	verifier *Verifier
+}
+
+// New accepts the API keys and the JWTs verifier accepts. verifier may be nil, then JWTs
+// are rejected.
+func New(keys []APIKey, verifier *Verifier) (*Authenticator, error) {
+	const op = "auth.New"
+
+	a := &Authenticator{
+		keys:     map[[sha256.Size]byte]Principal{},
+		verifier: verifier,
+	}
+
+	for _, k := range keys {
+		decoded, err := hex.DecodeString(k.SHA256)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("%s: API key %q: sha256 must be 64 hex digits", op, k.Name)
+		}
+
+		var hash [sha256.Size]byte
+		copy(hash[:], decoded)
+
+		a.keys[hash] = Principal{
+			Subject:   k.Name,
+			AccountID: k.AccountID,
+			Admin:     k.Admin,
+			Method:    MethodAPIKey,
+		}
+	}
+
+	return a, nil
+}
+
+// Authenticate returns the caller of the API key or, if there is none, the bearer token.
+func (a *Authenticator) Authenticate(apiKey string, bearer string) (Principal, error) {
+	switch {
+	case apiKey != "":
+		// Keys are looked up by their hash, which a timing attack can't learn the key from
+		principal, ok := a.keys[sha256.Sum256([]byte(apiKey))]
+		if !ok {
+			return Principal{}, invalid("unknown API key")
+		}
+
+		return principal, nil
+	case bearer != "":
+		if a.verifier == nil {
+			return Principal{}, invalid("tokens are not accepted")
+		}
+
+		return a.verifier.Verify(bearer)
+	default:
+		return Principal{}, ErrNoCredentials
+	}
+}
+
+func invalid(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidCredentials, reason)
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAuthenticate(t *testing.T) {
+	verifier, err := NewVerifier(writeJWKS(t, octJWK("hs", hmacSecret)), testIssuer, testAudience, "account_id", testLeeway)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New([]APIKey{
+		{Name: "shop", SHA256: hashKey("shop-key"), AccountID: "acc-1"},
+		{Name: "backoffice", SHA256: strings.ToUpper(hashKey("admin-key")), Admin: true},
+	}, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := sign(t, map[string]any{"alg": AlgHS256}, validClaims(), hmacSecret, nil)
+
+	tests := []struct {
+		name    string
+		apiKey  string
+		bearer  string
+		want    Principal
+		wantErr error
+	}{
+		{"api key", "shop-key", "", Principal{Subject: "shop", AccountID: "acc-1", Method: MethodAPIKey}, nil},
+		{"upper case hash", "admin-key", "", Principal{Subject: "backoffice", Admin: true, Method: MethodAPIKey}, nil},
+		{"unknown api key", "shop-key ", "", Principal{}, ErrInvalidCredentials},
+		{"the hash as key", hashKey("shop-key"), "", Principal{}, ErrInvalidCredentials},
+		{"api key wins over token", "shop-key", "not a token", Principal{Subject: "shop", AccountID: "acc-1", Method: MethodAPIKey}, nil},
+		{"unknown api key with valid token", "wrong", token, Principal{}, ErrInvalidCredentials},
+		{"token", "", token, Principal{Subject: "alice", AccountID: "acc-1", Method: MethodJWT}, nil},
+		{"bad token", "", "not a token", Principal{}, ErrInvalidCredentials},
+		{"no credentials", "", "", Principal{}, ErrNoCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := a.Authenticate(tt.apiKey, tt.bearer)
+
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if p != tt.want {
+				t.Errorf("Authenticate() = %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithoutVerifier(t *testing.T) {
+	a, err := New(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := sign(t, map[string]any{"alg": AlgHS256}, validClaims(), hmacSecret, nil)
+
+	if _, err := a.Authenticate("", token); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Authenticate() error = %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestNewRejectsMalformedHashes(t *testing.T) {
+	for _, hash := range []string{"", "abc", hashKey("k")[:62], hashKey("k") + "00", strings.Repeat("zz", 32)} {
+		if _, err := New([]APIKey{{Name: "k", SHA256: hash}}, nil); err == nil {
+			t.Errorf("New() accepted sha256 %q", hash)
+		}
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	tests := []struct {
+		p         Principal
+		owns      string
+		wantOwns  bool
+		wantActor string
+	}{
+		{Principal{Subject: "shop", AccountID: "acc-1", Method: MethodAPIKey}, "acc-1", true, "api_key:shop"},
+		{Principal{Subject: "shop", AccountID: "acc-1", Method: MethodAPIKey}, "acc-2", false, "api_key:shop"},
+		{Principal{Subject: "ops", Admin: true, Method: MethodAPIKey}, "acc-2", true, "api_key:ops"},
+		{Principal{AccountID: "acc-1", Method: MethodJWT}, "acc-1", true, "jwt:account:acc-1"},
+		{Principal{Subject: "alice", Method: MethodJWT}, "", false, "jwt:alice"},
+		{Principal{}, "", false, ""},
+	}
+
+	for _, tt := range tests {
+		if got := tt.p.Owns(tt.owns); got != tt.wantOwns {
+			t.Errorf("%+v.Owns(%q) = %v, want %v", tt.p, tt.owns, got, tt.wantOwns)
+		}
+		if got := tt.p.Actor(); got != tt.wantActor {
+			t.Errorf("%+v.Actor() = %q, want %q", tt.p, got, tt.wantActor)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+
+	if _, ok := FromContext(ctx); ok {
+		t.Fatal("FromContext() found a principal in an empty context")
+	}
+
+	want := Principal{Subject: "alice", AccountID: "acc-1", Method: MethodJWT}
+
+	ctx, cancel := context.WithTimeout(NewContext(ctx, want), time.Minute)
+	defer cancel()
+
+	if got, ok := FromContext(ctx); !ok || got != want {
+		t.Errorf("FromContext() = %+v, %v, want %+v", got, ok, want)
+	}
+}
@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// Algorithms of the accepted JWTs.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+)
+
+// key is a verification key of the JWKS. Symmetric ("oct") keys verify HS256, RSA keys
+// RS256; a token is never checked against a key of the other kind.
+type key struct {
+	id     string
+	alg    string
+	secret []byte
+	public *rsa.PublicKey
+}
+
+// Verifier checks JWTs signed with the keys of a local JWKS file.
+type Verifier struct {
+	keys         []key
+	issuer       string
+	audience     string
+	accountClaim string
+	leeway       time.Duration
+}
+
+// NewVerifier loads the JSON Web Key Set at jwksPath. Tokens must be issued by issuer
+// and for audience unless they are empty. The account of the caller is read from the
+// claim accountClaim. leeway allows for clock skew when checking exp and nbf.
+func NewVerifier(jwksPath string, issuer string, audience string, accountClaim string, leeway time.Duration) (*Verifier, error) {
+	const op = "auth.NewVerifier"
+
+	keys, err := loadJWKS(jwksPath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &Verifier{
+		keys:         keys,
+		issuer:       issuer,
+		audience:     audience,
+		accountClaim: accountClaim,
+		leeway:       leeway,
+	}, nil
+}
+
+// Verify checks the signature and claims of the token and returns its caller.
+func (v *Verifier) Verify(token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, invalid("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Principal{}, invalid("malformed header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Principal{}, invalid("malformed signature")
+	}
+
+	if !v.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature) {
+		return Principal{}, invalid("bad signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Principal{}, invalid("malformed claims")
+	}
+
+	return v.principal(claims)
+}
+
+// verifySignature checks the signature against the key named by kid, or against every key
+// of the algorithm if the token names none.
+func (v *Verifier) verifySignature(alg string, kid string, signed string, signature []byte) bool {
+	if alg != AlgHS256 && alg != AlgRS256 {
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(signed))
+
+	for _, k := range v.keys {
+		if k.alg != alg || (kid != "" && k.id != kid) {
+			continue
+		}
+
+		switch alg {
+		case AlgHS256:
+			mac := hmac.New(sha256.New, k.secret)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case AlgRS256:
+			if rsa.VerifyPKCS1v15(k.public, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// principal checks the registered claims and returns the caller they name.
+func (v *Verifier) principal(claims map[string]any) (Principal, error) {
+	now := time.Now()
+
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return Principal{}, invalid("exp is required")
+	}
+	if now.After(exp.Add(v.leeway)) {
+		return Principal{}, invalid("token expired")
+	}
+
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(v.leeway).Before(nbf) {
+		return Principal{}, invalid("token not valid yet")
+	}
+
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return Principal{}, invalid("wrong issuer")
+	}
+
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return Principal{}, invalid("wrong audience")
+	}
+
+	accountID, _ := claims[v.accountClaim].(string)
+	if accountID == "" {
+		return Principal{}, invalid(v.accountClaim + " is required")
+	}
+
+	subject, _ := claims["sub"].(string)
+
+	return Principal{
+		Subject:   subject,
+		AccountID: accountID,
+		Method:    MethodJWT,
+	}, nil
+}
+
+func loadJWKS(path string) ([]key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []key
+	for i, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		k := key{id: jwk.Kid}
+
+		switch jwk.Kty {
+		case "oct":
+			k.alg = AlgHS256
+			k.secret, err = base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil || len(k.secret) < 32 {
+				return nil, fmt.Errorf("key %d: k must be at least 32 bytes of base64url", i)
+			}
+		case "RSA":
+			k.alg = AlgRS256
+			k.public, err = rsaPublicKey(jwk.N, jwk.E)
+			if err != nil {
+				return nil, fmt.Errorf("key %d: %w", i, err)
+			}
+		default:
+			return nil, fmt.Errorf("key %d: unsupported kty %q", i, jwk.Kty)
+		}
+
+		if jwk.Alg != "" && jwk.Alg != k.alg {
+			return nil, fmt.Errorf("key %d: alg %q doesn't fit kty %q", i, jwk.Alg, jwk.Kty)
+		}
+
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+
+	return keys, nil
+}
+
+func rsaPublicKey(n string, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, errors.New("malformed n")
+	}
+
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil || len(exponent) == 0 || len(exponent) > 4 {
+		return nil, errors.New("malformed e")
+	}
+
+	public := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}
+
+	if public.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys must have at least 2048 bits")
+	}
+
+	return public, nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func numericDate(v any) (time.Time, bool) {
+	seconds, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(seconds), 0), true
+}
+
+// hasAudience reports whether aud, a string or an array of strings, contains audience.
+func hasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,298 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example"
+	testAudience = "gwapi"
+	testLeeway   = time.Minute
+)
+
+var hmacSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func rsaJWK(kid string, public *rsa.PublicKey) map[string]any {
+	return map[string]any{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   b64(public.N.Bytes()),
+		"e":   b64(big.NewInt(int64(public.E)).Bytes()),
+	}
+}
+
+func octJWK(kid string, secret []byte) map[string]any {
+	return map[string]any{"kty": "oct", "kid": kid, "k": b64(secret)}
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]any) string {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// sign returns a token of header and claims. The signature is made with an HMAC of secret
+// for HS* algorithms, with private for RS256 and left empty otherwise.
+func sign(t *testing.T, header map[string]any, claims map[string]any, secret []byte, private *rsa.PrivateKey) string {
+	t.Helper()
+
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := b64(h) + "." + b64(c)
+
+	alg, _ := header["alg"].(string)
+
+	var signature []byte
+	switch {
+	case alg == AlgRS256 && private != nil:
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case strings.HasPrefix(alg, "HS") && secret != nil:
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+
+	return signed + "." + b64(signature)
+}
+
+func validClaims() map[string]any {
+	now := time.Now()
+
+	return map[string]any{
+		"sub":        "alice",
+		"iss":        testIssuer,
+		"aud":        testAudience,
+		"exp":        now.Add(time.Hour).Unix(),
+		"nbf":        now.Add(-time.Hour).Unix(),
+		"account_id": "acc-1",
+	}
+}
+
+func with(claims map[string]any, key string, value any) map[string]any {
+	if value == nil {
+		delete(claims, key)
+		return claims
+	}
+
+	claims[key] = value
+	return claims
+}
+
+func TestVerify(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewVerifier(writeJWKS(t, octJWK("hs", hmacSecret), rsaJWK("rs", &private.PublicKey)), testIssuer, testAudience, "account_id", testLeeway)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	hs := map[string]any{"alg": AlgHS256, "kid": "hs"}
+	rs := map[string]any{"alg": AlgRS256, "kid": "rs"}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string // reason of the rejection, empty if the token is accepted
+	}{
+		{"hs256", sign(t, hs, validClaims(), hmacSecret, nil), ""},
+		{"rs256", sign(t, rs, validClaims(), nil, private), ""},
+		{"hs256 without kid", sign(t, map[string]any{"alg": AlgHS256}, validClaims(), hmacSecret, nil), ""},
+
+		{"alg none", sign(t, map[string]any{"alg": "none"}, validClaims(), nil, nil), "bad signature"},
+		{"alg none with kid", sign(t, map[string]any{"alg": "none", "kid": "hs"}, validClaims(), nil, nil), "bad signature"},
+		{"alg unknown", sign(t, map[string]any{"alg": "HS512", "kid": "hs"}, validClaims(), hmacSecret, nil), "bad signature"},
+		{"alg missing", sign(t, map[string]any{"kid": "hs"}, validClaims(), nil, nil), "bad signature"},
+		{
+			// The RSA public key is known to everyone, a token MACed with it must not pass
+			"hs256 signed with the rsa public key",
+			sign(t, map[string]any{"alg": AlgHS256, "kid": "rs"}, validClaims(), private.PublicKey.N.Bytes(), nil),
+			"bad signature",
+		},
+		{"rs256 naming the hmac key", sign(t, map[string]any{"alg": AlgRS256, "kid": "hs"}, validClaims(), nil, private), "bad signature"},
+		{"rs256 signed by another key", sign(t, rs, validClaims(), nil, other), "bad signature"},
+		{"hs256 signed by another secret", sign(t, hs, validClaims(), []byte("another secret of at least 32 bytes"), nil), "bad signature"},
+
+		{"kid mismatch", sign(t, map[string]any{"alg": AlgHS256, "kid": "unknown"}, validClaims(), hmacSecret, nil), "bad signature"},
+		{"kid of the other kind", sign(t, map[string]any{"alg": AlgHS256, "kid": "rs"}, validClaims(), hmacSecret, nil), "bad signature"},
+
+		{"exp missing", sign(t, hs, with(validClaims(), "exp", nil), hmacSecret, nil), "exp is required"},
+		{"exp not a number", sign(t, hs, with(validClaims(), "exp", "tomorrow"), hmacSecret, nil), "exp is required"},
+		{"exp passed within leeway", sign(t, hs, with(validClaims(), "exp", now.Add(-testLeeway+5*time.Second).Unix()), hmacSecret, nil), ""},
+		{"exp passed beyond leeway", sign(t, hs, with(validClaims(), "exp", now.Add(-testLeeway-5*time.Second).Unix()), hmacSecret, nil), "token expired"},
+		{"nbf ahead within leeway", sign(t, hs, with(validClaims(), "nbf", now.Add(testLeeway-5*time.Second).Unix()), hmacSecret, nil), ""},
+		{"nbf ahead beyond leeway", sign(t, hs, with(validClaims(), "nbf", now.Add(testLeeway+5*time.Second).Unix()), hmacSecret, nil), "token not valid yet"},
+		{"nbf missing", sign(t, hs, with(validClaims(), "nbf", nil), hmacSecret, nil), ""},
+
+		{"iss wrong", sign(t, hs, with(validClaims(), "iss", "https://other.example"), hmacSecret, nil), "wrong issuer"},
+		{"iss missing", sign(t, hs, with(validClaims(), "iss", nil), hmacSecret, nil), "wrong issuer"},
+		{"iss as array", sign(t, hs, with(validClaims(), "iss", []string{testIssuer}), hmacSecret, nil), "wrong issuer"},
+		{"aud as array", sign(t, hs, with(validClaims(), "aud", []string{"other", testAudience}), hmacSecret, nil), ""},
+		{"aud wrong", sign(t, hs, with(validClaims(), "aud", "other"), hmacSecret, nil), "wrong audience"},
+		{"aud array without audience", sign(t, hs, with(validClaims(), "aud", []string{"other"}), hmacSecret, nil), "wrong audience"},
+		{"aud missing", sign(t, hs, with(validClaims(), "aud", nil), hmacSecret, nil), "wrong audience"},
+
+		{"account claim missing", sign(t, hs, with(validClaims(), "account_id", nil), hmacSecret, nil), "account_id is required"},
+		{"account claim empty", sign(t, hs, with(validClaims(), "account_id", ""), hmacSecret, nil), "account_id is required"},
+		{"account claim not a string", sign(t, hs, with(validClaims(), "account_id", 42), hmacSecret, nil), "account_id is required"},
+
+		{"two segments", "a.b", "malformed token"},
+		{"header not base64", "!!!." + b64([]byte("{}")) + ".", "malformed header"},
+		{"signature not base64", b64([]byte(`{"alg":"HS256"}`)) + "." + b64([]byte("{}")) + ".!!!", "malformed signature"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := verifier.Verify(tt.token)
+
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Verify() error = %v, want accepted", err)
+				}
+				if p.AccountID != "acc-1" || p.Subject != "alice" || p.Method != MethodJWT || p.Admin {
+					t.Errorf("Verify() = %+v", p)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Fatalf("Verify() error = %v, want ErrInvalidCredentials", err)
+			}
+			if !strings.HasSuffix(err.Error(), tt.want) {
+				t.Errorf("Verify() error = %q, want reason %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutIssuerAndAudience(t *testing.T) {
+	verifier, err := NewVerifier(writeJWKS(t, octJWK("", hmacSecret)), "", "", "tenant", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{"exp": time.Now().Add(time.Minute).Unix(), "tenant": "acc-2"}
+
+	p, err := verifier.Verify(sign(t, map[string]any{"alg": AlgHS256}, claims, hmacSecret, nil))
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if p.AccountID != "acc-2" {
+		t.Errorf("AccountID = %q, want acc-2", p.AccountID)
+	}
+
+	// Without leeway a token is rejected as soon as it expired
+	claims["exp"] = time.Now().Add(-2 * time.Second).Unix()
+
+	if _, err := verifier.Verify(sign(t, map[string]any{"alg": AlgHS256}, claims, hmacSecret, nil)); err == nil {
+		t.Error("Verify() accepted an expired token")
+	}
+}
+
+func TestNewVerifierKeys(t *testing.T) {
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withAlg := func(jwk map[string]any, alg string) map[string]any {
+		jwk["alg"] = alg
+		return jwk
+	}
+	withUse := func(jwk map[string]any, use string) map[string]any {
+		jwk["use"] = use
+		return jwk
+	}
+
+	tests := []struct {
+		name    string
+		keys    []map[string]any
+		wantErr string
+	}{
+		{"hmac key of 32 bytes", []map[string]any{octJWK("a", hmacSecret)}, ""},
+		{"hmac key of 31 bytes", []map[string]any{octJWK("a", hmacSecret[:31])}, "at least 32 bytes"},
+		{"hmac key not base64", []map[string]any{{"kty": "oct", "k": "!!!"}}, "at least 32 bytes"},
+		{"rsa key of 2048 bits", []map[string]any{rsaJWK("a", &large.PublicKey)}, ""},
+		{"rsa key of 1024 bits", []map[string]any{rsaJWK("a", &small.PublicKey)}, "at least 2048 bits"},
+		{"rsa key without exponent", []map[string]any{{"kty": "RSA", "n": b64(large.PublicKey.N.Bytes())}}, "malformed e"},
+		{"alg fitting kty", []map[string]any{withAlg(octJWK("a", hmacSecret), AlgHS256)}, ""},
+		{"hs256 on an rsa key", []map[string]any{withAlg(rsaJWK("a", &large.PublicKey), AlgHS256)}, "doesn't fit"},
+		{"rs256 on an hmac key", []map[string]any{withAlg(octJWK("a", hmacSecret), AlgRS256)}, "doesn't fit"},
+		{"unsupported kty", []map[string]any{{"kty": "EC", "crv": "P-256"}}, "unsupported kty"},
+		{"encryption keys only", []map[string]any{withUse(octJWK("a", hmacSecret), "enc")}, "no signing keys"},
+		{"no keys", nil, "no signing keys"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewVerifier(writeJWKS(t, tt.keys...), "", "", "account_id", 0)
+
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("NewVerifier() error = %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("NewVerifier() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewVerifierMissingFile(t *testing.T) {
+	if _, err := NewVerifier(filepath.Join(t.TempDir(), "missing.json"), "", "", "account_id", 0); err == nil {
+		t.Fatal("NewVerifier() accepted a missing JWKS file")
+	}
+}
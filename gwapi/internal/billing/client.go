@@ -0,0 +1,337 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gwapi/internal/auth"
+	"gwapi/internal/breaker"
+	br "gwapi/internal/lib/balance"
+	"gwapi/internal/lib/iwrequest"
+	opr "gwapi/internal/lib/operation"
+	st "gwapi/internal/lib/statement"
+	ts "gwapi/internal/lib/transaction"
+	wl "gwapi/internal/lib/wallet"
+	"gwapi/internal/publisher"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HeaderActor names the caller a request is made for, billing records it in its audit log.
+const HeaderActor = "X-Actor"
+
+// Errors a StatusError matches by its status code.
+var (
+	ErrBadRequest  = errors.New("billing rejected the request")
+	ErrNotFound    = errors.New("not found in billing")
+	ErrConflict    = errors.New("conflicts with billing's state")
+	ErrUnavailable = errors.New("billing is unavailable")
+)
+
+// StatusError is a response of billing with a status other than 2xx. Message is the error
+// billing gave, if any.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("billing responded with %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("billing responded with %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrUnavailable:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+	}
+
+	return false
+}
+
+// Client calls billing's HTTP API. Every call is bounded by the timeout unless its context
+// has a deadline already. Reads are attempted again after transport errors and
+// ErrUnavailable responses, up to retries times with doubling backoff; calls that change
+// billing's state are attempted once.
+//
+// Calls go through the breaker, which fails them with a *breaker.RejectedError while
+// billing is failing or too many calls are waiting for it.
+type Client struct {
+	baseURL string
+	client  *http.Client
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+	breaker *breaker.Breaker
+}
+
+func New(baseURL string, timeout time.Duration, retries int, backoff time.Duration, b *breaker.Breaker) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client: &http.Client{
+			// Statements are streamed, only the wait for the response is bounded here
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: timeout,
+				MaxIdleConnsPerHost:   16,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		timeout: timeout,
+		retries: max(retries, 0),
+		backoff: backoff,
+		breaker: b,
+	}
+}
+
+// Failed reports whether err means billing is in trouble, as opposed to a request billing
+// rejected or a caller that went away. It decides what counts against the breaker.
+func Failed(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return errors.Is(err, ErrUnavailable)
+	}
+
+	return true
+}
+
+// CreateWallet creates a wallet for the account, or for a new account if accountID is
+// empty. It fails with ErrConflict if the account has a wallet already.
+func (c *Client) CreateWallet(ctx context.Context, accountID string) (wl.WalletResponse, error) {
+	const op = "billing.CreateWallet"
+
+	var result wl.WalletResponse
+
+	path := "/wallet"
+	if accountID != "" {
+		path += "?" + url.Values{"account_id": {accountID}}.Encode()
+	}
+
+	// billing creates wallets on GET, which is not safe to repeat
+	if err := c.doJSON(ctx, http.MethodGet, path, nil, nil, &result, false); err != nil {
+		return wl.WalletResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return result, nil
+}
+
+// Wallet returns the wallet with the account it belongs to.
+func (c *Client) Wallet(ctx context.Context, walletID string) (wl.WalletResponse, error) {
+	const op = "billing.Wallet"
+
+	var result wl.WalletResponse
+
+	if err := c.doJSON(ctx, http.MethodGet, "/wallet/"+url.PathEscape(walletID), nil, nil, &result, true); err != nil {
+		return wl.WalletResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return result, nil
+}
+
+// Balance returns the balances of a wallet.
+func (c *Client) Balance(ctx context.Context, walletID string) (br.BalanceResponse, error) {
+	const op = "billing.Balance"
+
+	var result br.BalanceResponse
+
+	if err := c.doJSON(ctx, http.MethodGet, "/balance/"+url.PathEscape(walletID), nil, nil, &result, true); err != nil {
+		return br.BalanceResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return result, nil
+}
+
+// Transaction returns a transaction by its ID.
+func (c *Client) Transaction(ctx context.Context, id string) (ts.TransactionResponse, error) {
+	const op = "billing.Transaction"
+
+	var result ts.TransactionResponse
+
+	if err := c.doJSON(ctx, http.MethodGet, "/transaction/"+url.PathEscape(id), nil, nil, &result, true); err != nil {
+		return ts.TransactionResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return result, nil
+}
+
+// Operation returns the transaction billing recorded for an operation. It fails with
+// ErrNotFound until billing has processed the operation.
+func (c *Client) Operation(ctx context.Context, operationID string) (ts.TransactionResponse, error) {
+	const op = "billing.Operation"
+
+	var result ts.TransactionResponse
+
+	if err := c.doJSON(ctx, http.MethodGet, "/operation/"+url.PathEscape(operationID), nil, nil, &result, true); err != nil {
+		return ts.TransactionResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return result, nil
+}
+
+// Apply posts an invoice or withdrawal, path "/invoice" or "/withdraw". billing applies an
+// operation ID at most once.
+func (c *Client) Apply(ctx context.Context, path string, operationID string, request iwrequest.IWRequest) (opr.CommandResponse, error) {
+	const op = "billing.Apply"
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return opr.CommandResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set(publisher.HeaderOperationID, operationID)
+
+	result := opr.CommandResponse{OperationID: operationID}
+
+	if err := c.doJSON(ctx, http.MethodPost, path, body, header, &result, false); err != nil {
+		return opr.CommandResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return result, nil
+}
+
+// Statement requests a wallet statement. The body is not read here so that large
+// statements are streamed to the client as they are produced; the caller closes it.
+func (c *Client) Statement(ctx context.Context, walletID string, from string, to string, format string) (st.StatementResponse, error) {
+	const op = "billing.Statement"
+
+	query := url.Values{}
+	query.Set("from", from)
+	query.Set("to", to)
+	query.Set("format", format)
+
+	resp, err := c.do(ctx, http.MethodGet, "/wallet/"+url.PathEscape(walletID)+"/statement?"+query.Encode(), nil, nil, true)
+	if err != nil {
+		return st.StatementResponse{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return st.StatementResponse{
+		StatusCode:         resp.StatusCode,
+		ContentType:        resp.Header.Get("Content-Type"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		Body:               resp.Body,
+	}, nil
+}
+
+// doJSON sends the request and decodes the response into out.
+func (c *Client) doJSON(ctx context.Context, method string, path string, body []byte, header http.Header, out any, retry bool) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	resp, err := c.do(ctx, method, path, body, header, retry)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends the request through the breaker until billing answers with a 2xx status and
+// returns the response. Any other status is returned as a StatusError.
+func (c *Client) do(ctx context.Context, method string, path string, body []byte, header http.Header, retry bool) (*http.Response, error) {
+	var resp *http.Response
+
+	err := c.breaker.Do(func() error {
+		var err error
+		resp, err = c.attempt(ctx, method, path, body, header, retry)
+		return err
+	})
+
+	return resp, err
+}
+
+func (c *Client) attempt(ctx context.Context, method string, path string, body []byte, header http.Header, retry bool) (*http.Response, error) {
+	attempts := 1
+	if retry {
+		attempts += c.retries
+	}
+
+	delay := c.backoff
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+
+		resp, err = c.send(ctx, method, path, body, header)
+		if err == nil {
+			return resp, nil
+		}
+
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && !errors.Is(err, ErrUnavailable) {
+			return nil, err
+		}
+
+		if attempt >= attempts || ctx.Err() != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body []byte, header http.Header) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if p, ok := auth.FromContext(ctx); ok {
+		req.Header.Set(HeaderActor, p.Actor())
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var message struct {
+		Error string `json:"error"`
+	}
+	// billing answers errors with {"error": "..."}, other bodies leave the message empty
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&message)
+
+	return nil, &StatusError{StatusCode: resp.StatusCode, Message: message.Error}
+}
@@ -0,0 +1,368 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gwapi/internal/auth"
+	"gwapi/internal/breaker"
+	"gwapi/internal/lib/iwrequest"
+	"gwapi/internal/publisher"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc, retries int) *Client {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return New(server.URL, time.Second, retries, time.Millisecond, breaker.New("billing", breaker.Config{FailureThreshold: 100, MaxConcurrent: 100}, Failed))
+}
+
+func TestActorHeader(t *testing.T) {
+	var actors []string
+
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		actors = append(actors, r.Header.Get(HeaderActor))
+		w.Write([]byte(`{}`))
+	}, 0)
+
+	ctx := auth.NewContext(context.Background(), auth.Principal{Subject: "alice", AccountID: "acc-1", Method: auth.MethodJWT})
+
+	if _, err := client.Balance(ctx, "w-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Balance(context.Background(), "w-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(actors) != 2 || actors[0] != "jwt:alice" || actors[1] != "" {
+		t.Errorf("%s headers = %q, want [jwt:alice \"\"]", HeaderActor, actors)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		want        error
+		wantMessage string
+		failed      bool
+	}{
+		{"bad request", http.StatusBadRequest, `{"error":"invalid amount"}`, ErrBadRequest, "invalid amount", false},
+		{"not found", http.StatusNotFound, `{"error":"wallet not found"}`, ErrNotFound, "wallet not found", false},
+		{"conflict", http.StatusConflict, `{"error":"account has a wallet"}`, ErrConflict, "account has a wallet", false},
+		{"too many requests", http.StatusTooManyRequests, ``, ErrUnavailable, "", true},
+		{"internal error", http.StatusInternalServerError, `{"error":"database is down"}`, ErrUnavailable, "database is down", true},
+		{"bad gateway", http.StatusBadGateway, `<html>bad gateway</html>`, ErrUnavailable, "", true},
+		{"unknown client error", http.StatusTeapot, `{"error":"teapot"}`, nil, "teapot", false},
+	}
+
+	sentinels := []error{ErrBadRequest, ErrNotFound, ErrConflict, ErrUnavailable}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}, 0)
+
+			_, err := client.Wallet(context.Background(), "w-1")
+
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("error = %v, want a *StatusError", err)
+			}
+			if statusErr.StatusCode != tt.status || statusErr.Message != tt.wantMessage {
+				t.Errorf("error = %+v, want status %d and message %q", statusErr, tt.status, tt.wantMessage)
+			}
+
+			for _, sentinel := range sentinels {
+				if got := errors.Is(err, sentinel); got != (sentinel == tt.want) {
+					t.Errorf("errors.Is(err, %q) = %t", sentinel, got)
+				}
+			}
+
+			if got := Failed(err); got != tt.failed {
+				t.Errorf("Failed() = %t, want %t", got, tt.failed)
+			}
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(c *Client) error
+		// status billing answers with until the last attempt
+		status       int
+		wantAttempts int
+		wantErr      error
+	}{
+		{
+			name:         "balance retried until it succeeds",
+			call:         func(c *Client) error { _, err := c.Balance(context.Background(), "w-1"); return err },
+			status:       http.StatusServiceUnavailable,
+			wantAttempts: 3,
+		},
+		{
+			name:         "operation retried until it succeeds",
+			call:         func(c *Client) error { _, err := c.Operation(context.Background(), "op-1"); return err },
+			status:       http.StatusBadGateway,
+			wantAttempts: 3,
+		},
+		{
+			name: "statement retried until it succeeds",
+			call: func(c *Client) error {
+				resp, err := c.Statement(context.Background(), "w-1", "", "", "csv")
+				closeBody(resp.Body)
+				return err
+			},
+			status:       http.StatusInternalServerError,
+			wantAttempts: 3,
+		},
+		{
+			name:         "read not retried after a rejection",
+			call:         func(c *Client) error { _, err := c.Transaction(context.Background(), "1"); return err },
+			status:       http.StatusNotFound,
+			wantAttempts: 1,
+			wantErr:      ErrNotFound,
+		},
+		{
+			name:         "wallet creation not retried",
+			call:         func(c *Client) error { _, err := c.CreateWallet(context.Background(), "acc-1"); return err },
+			status:       http.StatusServiceUnavailable,
+			wantAttempts: 1,
+			wantErr:      ErrUnavailable,
+		},
+		{
+			name: "apply not retried",
+			call: func(c *Client) error {
+				_, err := c.Apply(context.Background(), "/invoice", "op-1", iwrequest.IWRequest{WalletID: "w-1", Currency: "USD", Amount: 10})
+				return err
+			},
+			status:       http.StatusServiceUnavailable,
+			wantAttempts: 1,
+			wantErr:      ErrUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts < 3 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Write([]byte(`{}`))
+			}, 2)
+
+			err := tt.call(client)
+
+			if attempts != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	var attempts int
+
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, 2)
+
+	if _, err := client.Balance(context.Background(), "w-1"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("error = %v, want ErrUnavailable", err)
+	}
+	if attempts != 3 {
+		t.Errorf("%d attempts, want 3", attempts)
+	}
+}
+
+func TestPostIsSentOnce(t *testing.T) {
+	var (
+		attempts int
+		request  iwrequest.IWRequest
+		header   http.Header
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		header = r.Header.Clone()
+		json.NewDecoder(r.Body).Decode(&request)
+		// The connection drops before billing answers, the operation may have been applied
+		panic(http.ErrAbortHandler)
+	}))
+	t.Cleanup(server.Close)
+
+	client := New(server.URL, time.Second, 3, time.Millisecond, breaker.New("billing", breaker.Config{FailureThreshold: 100, MaxConcurrent: 100}, Failed))
+
+	_, err := client.Apply(context.Background(), "/withdraw", "op-1", iwrequest.IWRequest{WalletID: "w-1", Currency: "USD", Amount: 10})
+	if err == nil {
+		t.Fatal("Apply() succeeded")
+	}
+
+	// Waits for the handler, the request it recorded is read below
+	server.Close()
+
+	if attempts != 1 {
+		t.Errorf("%d attempts, want 1", attempts)
+	}
+	if request.WalletID != "w-1" || request.Amount != 10 {
+		t.Errorf("request = %+v", request)
+	}
+	if header.Get(publisher.HeaderOperationID) != "op-1" || header.Get("Content-Type") != "application/json" {
+		t.Errorf("header = %v", header)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var attempts atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		<-r.Context().Done()
+	}))
+	t.Cleanup(server.Close)
+
+	client := New(server.URL, 50*time.Millisecond, 2, time.Millisecond, breaker.New("billing", breaker.Config{FailureThreshold: 100, MaxConcurrent: 100}, Failed))
+
+	start := time.Now()
+
+	_, err := client.Balance(context.Background(), "w-1")
+	if err == nil {
+		t.Fatal("Balance() succeeded")
+	}
+
+	// The timeout bounds the call with its retries, not each attempt
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("call took %s with a timeout of 50ms", elapsed)
+	}
+	if n := attempts.Load(); n > 2 {
+		t.Errorf("%d attempts within the timeout", n)
+	}
+	if !Failed(err) {
+		t.Error("a timeout doesn't count as a failure of billing")
+	}
+}
+
+func TestContextDeadlineOverridesTimeout(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+			w.Write([]byte(`{"wallet_id":"w-1"}`))
+		}
+	}, 0)
+
+	// The client's timeout is a second, the caller's deadline wins
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.Wallet(ctx, "w-1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	var attempts atomic.Int32
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		// The caller goes away while billing is failing, the retries are abandoned
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, 5)
+
+	_, err := client.Balance(ctx, "w-1")
+	if err == nil {
+		t.Fatal("Balance() succeeded")
+	}
+
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("%d attempts after cancellation, want 1", n)
+	}
+
+	_, err = client.Balance(ctx, "w-1")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	if Failed(err) {
+		t.Error("a cancelled call counts as a failure of billing")
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	t.Run("body", func(t *testing.T) {
+		client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/wallet" || r.URL.Query().Get("account_id") != "acc 1" {
+				t.Errorf("request %s", r.URL)
+			}
+			w.Write([]byte(`{"wallet_id":"w-1","account_id":"acc 1"}`))
+		}, 0)
+
+		wallet, err := client.CreateWallet(context.Background(), "acc 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wallet.WalletID != "w-1" || wallet.AccountID != "acc 1" {
+			t.Errorf("wallet = %+v", wallet)
+		}
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"wallet_id":`))
+		}, 0)
+
+		_, err := client.Wallet(context.Background(), "w-1")
+
+		var statusErr *StatusError
+		if err == nil || errors.As(err, &statusErr) {
+			t.Errorf("error = %v, want a decoding error", err)
+		}
+	})
+
+	t.Run("large error body", func(t *testing.T) {
+		client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"` + strings.Repeat("x", 128<<10) + `"}`))
+		}, 0)
+
+		_, err := client.Wallet(context.Background(), "w-1")
+
+		// Only the first 64 KiB are read, the message is lost but not the status
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || statusErr.Message != "" {
+			t.Errorf("error = %v", err)
+		}
+	})
+}
+
+func closeBody(body io.ReadCloser) {
+	if body != nil {
+		body.Close()
+	}
+}
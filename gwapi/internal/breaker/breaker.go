@@ -0,0 +1,211 @@
+// Package breaker guards calls to a dependency with a circuit breaker and a bulkhead, so
+// that a slow or failing dependency is answered fast instead of tying up callers.
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// States of a breaker.
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// fullRetryAfter is suggested to callers rejected by the bulkhead, slots free up quickly.
+const fullRetryAfter = time.Second
+
+var (
+	// ErrOpen is matched by calls rejected while the breaker is open.
+	ErrOpen = errors.New("circuit breaker is open")
+	// ErrFull is matched by calls rejected because all slots are taken.
+	ErrFull = errors.New("too many concurrent calls")
+)
+
+// RejectedError is returned for a call the breaker didn't let through. It matches ErrOpen
+// or ErrFull. RetryAfter is when the call may be let through again.
+type RejectedError struct {
+	Name       string
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Err)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// Config tunes a breaker. It opens after FailureThreshold failures in a row and stays open
+// for OpenTimeout. Then it is half-open and lets HalfOpenProbes calls through: if they all
+// succeed it closes, if one fails it opens again. At most MaxConcurrent calls run at once,
+// further calls are rejected rather than queued.
+type Config struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	HalfOpenProbes   int
+	MaxConcurrent    int
+}
+
+// Status is a snapshot of a breaker for health output.
+type Status struct {
+	Name          string     `json:"name"`
+	State         string     `json:"state"`
+	Failures      int        `json:"consecutive_failures"`
+	InFlight      int        `json:"in_flight"`
+	MaxConcurrent int        `json:"max_concurrent"`
+	OpenedAt      *time.Time `json:"opened_at,omitempty"`
+}
+
+type Breaker struct {
+	name      string
+	cfg       Config
+	isFailure func(error) bool
+	slots     chan struct{}
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	probes    int
+	successes int
+}
+
+// New returns a closed breaker. isFailure decides which errors count against the
+// dependency; nil counts every error.
+func New(name string, cfg Config, isFailure func(error) bool) *Breaker {
+	if isFailure == nil {
+		isFailure = func(err error) bool { return err != nil }
+	}
+
+	cfg.FailureThreshold = max(cfg.FailureThreshold, 1)
+	cfg.HalfOpenProbes = max(cfg.HalfOpenProbes, 1)
+	cfg.MaxConcurrent = max(cfg.MaxConcurrent, 1)
+
+	return &Breaker{
+		name:      name,
+		cfg:       cfg,
+		isFailure: isFailure,
+		slots:     make(chan struct{}, cfg.MaxConcurrent),
+		state:     StateClosed,
+	}
+}
+
+// Do runs fn unless the breaker is open or all slots are taken, and records its outcome.
+// A rejected call returns a *RejectedError without running fn.
+func (b *Breaker) Do(fn func() error) error {
+	select {
+	case b.slots <- struct{}{}:
+	default:
+		return &RejectedError{Name: b.name, Err: ErrFull, RetryAfter: fullRetryAfter}
+	}
+	defer func() { <-b.slots }()
+
+	probe, err := b.allow()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	b.record(probe, err != nil && b.isFailure(err))
+
+	return err
+}
+
+// Status reports the state of the breaker.
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := Status{
+		Name:          b.name,
+		State:         b.currentState(time.Now()),
+		Failures:      b.failures,
+		InFlight:      len(b.slots),
+		MaxConcurrent: b.cfg.MaxConcurrent,
+	}
+
+	if status.State != StateClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+
+	return status
+}
+
+// allow reports whether the call may go ahead and whether it is a probe of a half-open
+// breaker.
+func (b *Breaker) allow() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	switch b.currentState(now) {
+	case StateOpen:
+		return false, &RejectedError{Name: b.name, Err: ErrOpen, RetryAfter: b.openedAt.Add(b.cfg.OpenTimeout).Sub(now)}
+	case StateHalfOpen:
+		if b.state == StateOpen {
+			b.state = StateHalfOpen
+			b.probes = 0
+			b.successes = 0
+		}
+
+		if b.probes >= b.cfg.HalfOpenProbes {
+			return false, &RejectedError{Name: b.name, Err: ErrOpen, RetryAfter: fullRetryAfter}
+		}
+		b.probes++
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// record counts the outcome of a call. Outcomes of calls let through before the breaker
+// opened don't count once it is open, only probes decide when it closes.
+func (b *Breaker) record(probe bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.state == StateClosed && failed:
+		b.failures++
+		if b.failures >= b.cfg.FailureThreshold {
+			b.open()
+		}
+	case b.state == StateClosed:
+		b.failures = 0
+	case b.state == StateHalfOpen && probe && failed:
+		b.failures++
+		b.open()
+	case b.state == StateHalfOpen && probe:
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenProbes {
+			b.state = StateClosed
+			b.failures = 0
+		}
+	}
+}
+
+// open opens the breaker. b.mu must be held.
+func (b *Breaker) open() {
+	b.state = StateOpen
+	b.openedAt = time.Now()
+}
+
+// currentState is the state at now; an open breaker is half-open once its timeout has
+// passed. b.mu must be held.
+func (b *Breaker) currentState(now time.Time) string {
+	if b.state == StateOpen && now.Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		return StateHalfOpen
+	}
+
+	return b.state
+}
@@ -0,0 +1,267 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const openTimeout = 20 * time.Millisecond
+
+var (
+	errFailed   = errors.New("dependency failed")
+	errNotFound = errors.New("not found")
+)
+
+// isFailure doesn't count errNotFound, the dependency answered.
+func isFailure(err error) bool {
+	return !errors.Is(err, errNotFound)
+}
+
+// step is a call returning err, made after waiting wait. wantErr is what Do should return,
+// wantState the state of the breaker after the call.
+type step struct {
+	wait      time.Duration
+	err       error
+	wantErr   error
+	wantState string
+}
+
+func TestTransitions(t *testing.T) {
+	cfg := Config{FailureThreshold: 3, OpenTimeout: openTimeout, HalfOpenProbes: 2, MaxConcurrent: 4}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens after the failure threshold",
+			steps: []step{
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateOpen},
+				{wantErr: ErrOpen, wantState: StateOpen},
+			},
+		},
+		{
+			name: "a success resets the failures",
+			steps: []step{
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+			},
+		},
+		{
+			name: "errors that aren't failures don't count",
+			steps: []step{
+				{err: errNotFound, wantErr: errNotFound, wantState: StateClosed},
+				{err: errNotFound, wantErr: errNotFound, wantState: StateClosed},
+				{err: errNotFound, wantErr: errNotFound, wantState: StateClosed},
+				{err: errNotFound, wantErr: errNotFound, wantState: StateClosed},
+			},
+		},
+		{
+			name: "half-open after the open timeout",
+			steps: []step{
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateOpen},
+				{wait: 2 * openTimeout, wantState: StateHalfOpen},
+				{wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+			},
+		},
+		{
+			name: "a failed probe opens the breaker again",
+			steps: []step{
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateClosed},
+				{err: errFailed, wantErr: errFailed, wantState: StateOpen},
+				{wait: 2 * openTimeout, wantState: StateHalfOpen},
+				{err: errFailed, wantErr: errFailed, wantState: StateOpen},
+				{wantErr: ErrOpen, wantState: StateOpen},
+				{wait: 2 * openTimeout, wantState: StateHalfOpen},
+				{wantState: StateClosed},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New("billing", cfg, isFailure)
+
+			for i, s := range tt.steps {
+				time.Sleep(s.wait)
+
+				ran := false
+				err := b.Do(func() error {
+					ran = true
+					return s.err
+				})
+
+				if !errors.Is(err, s.wantErr) {
+					t.Fatalf("step %d: Do() = %v, want %v", i, err, s.wantErr)
+				}
+				if rejected := errors.Is(err, ErrOpen); ran == rejected {
+					t.Fatalf("step %d: fn ran = %t with Do() = %v", i, ran, err)
+				}
+				if got := b.Status().State; got != s.wantState {
+					t.Fatalf("step %d: state %s, want %s", i, got, s.wantState)
+				}
+			}
+		})
+	}
+}
+
+// call is a call to Do that is held in fn until it is finished.
+type call struct {
+	release chan struct{}
+	result  chan error
+}
+
+// begin starts a call that returns err once finished, and waits until it runs.
+func begin(t *testing.T, b *Breaker, err error) *call {
+	t.Helper()
+
+	c := &call{release: make(chan struct{}), result: make(chan error, 1)}
+	started := make(chan struct{})
+
+	go func() {
+		c.result <- b.Do(func() error {
+			close(started)
+			<-c.release
+			return err
+		})
+	}()
+
+	select {
+	case <-started:
+	case err := <-c.result:
+		t.Fatalf("call rejected: %v", err)
+	}
+
+	return c
+}
+
+func (c *call) finish() error {
+	close(c.release)
+	return <-c.result
+}
+
+// openAndWait opens b, which must have a FailureThreshold of 1, and waits until it is half-open.
+func openAndWait(t *testing.T, b *Breaker) {
+	t.Helper()
+
+	if err := b.Do(func() error { return errFailed }); !errors.Is(err, errFailed) {
+		t.Fatalf("Do() = %v", err)
+	}
+	if got := b.Status().State; got != StateOpen {
+		t.Fatalf("state %s, want open", got)
+	}
+
+	time.Sleep(2 * openTimeout)
+}
+
+func TestHalfOpenProbes(t *testing.T) {
+	b := New("billing", Config{FailureThreshold: 1, OpenTimeout: openTimeout, HalfOpenProbes: 2, MaxConcurrent: 4}, nil)
+	openAndWait(t, b)
+
+	first, second := begin(t, b, nil), begin(t, b, nil)
+
+	// Both probes are in flight, further calls wait for their outcome
+	err := b.Do(func() error { return nil })
+
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || !errors.Is(err, ErrOpen) || rejected.RetryAfter != fullRetryAfter {
+		t.Fatalf("Do() during the probes = %v, want ErrOpen after %s", err, fullRetryAfter)
+	}
+
+	if err := first.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Status().State; got != StateHalfOpen {
+		t.Fatalf("state %s after one of two probes, want half_open", got)
+	}
+
+	if err := second.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Status().State; got != StateClosed {
+		t.Fatalf("state %s after both probes, want closed", got)
+	}
+}
+
+// TestStaleOutcomes checks that calls let through before the breaker opened don't decide
+// its state once they finish, only the probes do.
+func TestStaleOutcomes(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"stale failure", errFailed},
+		{"stale success", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New("billing", Config{FailureThreshold: 1, OpenTimeout: openTimeout, HalfOpenProbes: 1, MaxConcurrent: 4}, nil)
+
+			stale := begin(t, b, tt.err)
+			openAndWait(t, b)
+			probe := begin(t, b, nil)
+
+			if err := stale.finish(); !errors.Is(err, tt.err) {
+				t.Fatalf("stale call: Do() = %v", err)
+			}
+			if got := b.Status().State; got != StateHalfOpen {
+				t.Fatalf("state %s after the stale call, want half_open", got)
+			}
+
+			if err := probe.finish(); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.Status().State; got != StateClosed {
+				t.Fatalf("state %s after the probe, want closed", got)
+			}
+		})
+	}
+}
+
+func TestFull(t *testing.T) {
+	b := New("billing", Config{FailureThreshold: 1, OpenTimeout: openTimeout, HalfOpenProbes: 1, MaxConcurrent: 2}, nil)
+
+	first, second := begin(t, b, nil), begin(t, b, nil)
+
+	if got := b.Status().InFlight; got != 2 {
+		t.Errorf("in flight %d, want 2", got)
+	}
+
+	ran := false
+	err := b.Do(func() error {
+		ran = true
+		return nil
+	})
+
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || !errors.Is(err, ErrFull) || rejected.RetryAfter != fullRetryAfter || ran {
+		t.Fatalf("Do() with all slots taken = %v, fn ran = %t, want ErrFull", err, ran)
+	}
+
+	// A rejected call isn't a failure of the dependency
+	if got := b.Status(); got.State != StateClosed || got.Failures != 0 {
+		t.Errorf("status %+v after ErrFull, want closed", got)
+	}
+
+	if err := first.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Do(func() error { return nil }); err != nil {
+		t.Errorf("Do() after a slot was freed = %v", err)
+	}
+
+	if err := second.finish(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,40 +1,291 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
+// Config is read from the YAML file at CONFIG_PATH, if set. Environment variables override
+// the file, e.g. HTTP_SERVER_ADDRESS, BILLING_URL or KAFKA_BROKERS=a:9092,b:9092.
 type Config struct {
-	Env        string `yaml:"env"`
-	HTTPServer `yaml:"http_server"`
+	Env        string `yaml:"env" env:"ENV" env-default:"local"`
+	HTTPServer `yaml:"http_server" env-prefix:"HTTP_SERVER_"`
+	Billing    `yaml:"billing" env-prefix:"BILLING_"`
+	Commands   `yaml:"commands" env-prefix:"COMMANDS_"`
+	Outbox     `yaml:"outbox" env-prefix:"OUTBOX_"`
+	Events     `yaml:"events" env-prefix:"EVENTS_"`
+	Bus        `yaml:"bus" env-prefix:"BUS_"`
+	Kafka      `yaml:"kafka" env-prefix:"KAFKA_"`
+	Stream     `yaml:"stream" env-prefix:"STREAM_"`
+	Auth       `yaml:"auth" env-prefix:"AUTH_"`
 }
 
 type HTTPServer struct {
-	Address     string        `yaml:"address"`
-	Timeout     time.Duration `yaml:"timeout"`
-	IdleTimeout time.Duration `yaml:"idle-timeout"`
+	Address     string        `yaml:"address" env:"ADDRESS" env-default:"8080"`
+	Timeout     time.Duration `yaml:"timeout" env:"TIMEOUT" env-default:"4s"`
+	IdleTimeout time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT" env-default:"60s"`
 }
 
+// Billing configures the client of billing's HTTP API. Timeout bounds a call, reads are
+// attempted again up to Retries times, waiting Backoff and then twice as long each time.
+type Billing struct {
+	URL     string        `yaml:"url" env:"URL" env-default:"http://billing:8081"`
+	Timeout time.Duration `yaml:"timeout" env:"TIMEOUT" env-default:"5s"`
+	Retries int           `yaml:"retries" env:"RETRIES" env-default:"2"`
+	Backoff time.Duration `yaml:"backoff" env:"BACKOFF" env-default:"100ms"`
+	Breaker `yaml:"breaker" env-prefix:"BREAKER_"`
+}
+
+// Breaker configures the circuit breaker and bulkhead around a dependency, see
+// breaker.Config.
+type Breaker struct {
+	FailureThreshold int           `yaml:"failure_threshold" env:"FAILURE_THRESHOLD" env-default:"5"`
+	OpenTimeout      time.Duration `yaml:"open_timeout" env:"OPEN_TIMEOUT" env-default:"30s"`
+	HalfOpenProbes   int           `yaml:"half_open_probes" env:"HALF_OPEN_PROBES" env-default:"1"`
+	MaxConcurrent    int           `yaml:"max_concurrent" env:"MAX_CONCURRENT" env-default:"64"`
+}
+
+// Commands selects how invoices and withdrawals reach billing unless a request asks for a
+// mode with the mode query parameter: "async" publishes them through the outbox, "sync"
+// calls billing over HTTP and answers with the outcome. Timeout bounds a sync call. Async
+// commands are published to InvoiceTopic and WithdrawTopic.
+type Commands struct {
+	Mode          string        `yaml:"mode" env:"MODE" env-default:"async"`
+	Timeout       time.Duration `yaml:"timeout" env:"TIMEOUT" env-default:"10s"`
+	InvoiceTopic  string        `yaml:"invoice_topic" env:"INVOICE_TOPIC" env-default:"invoices"`
+	WithdrawTopic string        `yaml:"withdraw_topic" env:"WITHDRAW_TOPIC" env-default:"withdraws"`
+}
+
+// Outbox configures the journal that holds invoice and withdraw commands until they are
+// published to Kafka. It is compacted every CompactInterval, published and failed commands
+// are kept for Retention.
+type Outbox struct {
+	Path            string        `yaml:"path" env:"PATH" env-default:"./data/outbox.jsonl"`
+	Retention       time.Duration `yaml:"retention" env:"RETENTION" env-default:"168h"`
+	CompactInterval time.Duration `yaml:"compact_interval" env:"COMPACT_INTERVAL" env-default:"1h"`
+	MaxAttempts     int           `yaml:"max_attempts" env:"MAX_ATTEMPTS" env-default:"10"`
+	MinBackoff      time.Duration `yaml:"min_backoff" env:"MIN_BACKOFF" env-default:"1s"`
+	MaxBackoff      time.Duration `yaml:"max_backoff" env:"MAX_BACKOFF" env-default:"1m"`
+}
+
+// Events configures the consumer of billing's transaction events. Every gwapi instance
+// keeps its own outbox and needs its own group ID to see the events of all operations, so
+// GroupID defaults to gwapi-events-<hostname>. Instances that share a hostname must set it.
+type Events struct {
+	Topic   string `yaml:"topic" env:"TOPIC" env-default:"transaction-events"`
+	GroupID string `yaml:"group_id" env:"GROUP_ID"`
+}
+
+// Bus selects the message transport, "kafka" or "memory". The in-process memory
+// transport needs no broker but loses its messages on exit, it's meant for local
+// development and tests.
+type Bus struct {
+	Transport  string `yaml:"transport" env:"TRANSPORT" env-default:"kafka"`
+	Partitions int    `yaml:"partitions" env:"PARTITIONS" env-default:"6"`
+}
+
+// Kafka configures the brokers and the encoding of the commands gwapi produces, "json" or
+// "protobuf". Consumed events are decoded by their content-type header.
+type Kafka struct {
+	Brokers  []string `yaml:"brokers" env:"BROKERS" env-default:"kafka:9093"`
+	Encoding string   `yaml:"encoding" env:"ENCODING" env-default:"json"`
+	Writer   `yaml:"writer" env-prefix:"WRITER_"`
+	Breaker  `yaml:"breaker" env-prefix:"BREAKER_"`
+}
+
+// Writer tunes the Kafka writers, see kafka.WriterConfig in package bus/kafka. The outbox relay publishes up
+// to BatchSize operations at once.
+type Writer struct {
+	BatchSize    int           `yaml:"batch_size" env:"BATCH_SIZE" env-default:"100"`
+	BatchTimeout time.Duration `yaml:"batch_timeout" env:"BATCH_TIMEOUT" env-default:"10ms"`
+	RequiredAcks string        `yaml:"required_acks" env:"REQUIRED_ACKS" env-default:"all"`
+	Compression  string        `yaml:"compression" env:"COMPRESSION" env-default:"none"`
+}
+
+// Stream configures the live wallet streams. The last RecentEvents events of a wallet are
+// kept for clients that reconnect, for Retention after the wallet's last event.
+type Stream struct {
+	RecentEvents int           `yaml:"recent_events" env:"RECENT_EVENTS" env-default:"100"`
+	Retention    time.Duration `yaml:"retention" env:"RETENTION" env-default:"10m"`
+	Heartbeat    time.Duration `yaml:"heartbeat" env:"HEARTBEAT" env-default:"15s"`
+}
+
+// Auth configures who may call gwapi. Callers send an API key in the X-API-Key header or
+// a JWT in Authorization: Bearer, and may only act on the wallet of their account. API keys
+// can only be set in the file.
+type Auth struct {
+	Enabled bool     `yaml:"enabled" env:"ENABLED"`
+	APIKeys []APIKey `yaml:"api_keys"`
+	JWT     `yaml:"jwt" env-prefix:"JWT_"`
+}
+
+// APIKey is an accepted key, configured by its hex SHA-256. Admin keys may act on every
+// wallet.
+type APIKey struct {
+	Name      string `yaml:"name"`
+	SHA256    string `yaml:"sha256"`
+	AccountID string `yaml:"account_id"`
+	Admin     bool   `yaml:"admin"`
+}
+
+// JWT configures the accepted tokens: HS256 or RS256, signed with a key of the JWKS file
+// at JWKSPath, for Issuer and Audience unless they are empty. The caller's account is
+// read from AccountClaim. JWTs are rejected if JWKSPath is empty.
+type JWT struct {
+	JWKSPath     string        `yaml:"jwks_path" env:"JWKS_PATH"`
+	Issuer       string        `yaml:"issuer" env:"ISSUER"`
+	Audience     string        `yaml:"audience" env:"AUDIENCE"`
+	AccountClaim string        `yaml:"account_claim" env:"ACCOUNT_CLAIM" env-default:"account_id"`
+	Leeway       time.Duration `yaml:"leeway" env:"LEEWAY" env-default:"1m"`
+}
+
+// MustLoad reads and validates the config and exits with the problems found if it is
+// invalid.
 func MustLoad() *Config {
-	//env
-	configPath := os.Getenv("CONFIG_PATH")
-	if configPath == "" {
-		log.Fatal("CONFIG_PATH is not set")
+	cfg, err := Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid config:\n%s", err)
+	}
+
+	return cfg
+}
+
+// Load reads the config from CONFIG_PATH, or from the environment alone if it is not set,
+// without validating it.
+func Load() (*Config, error) {
+	return LoadFile(os.Getenv("CONFIG_PATH"))
+}
+
+// LoadFile reads the config from the file at configPath, or from the environment alone if
+// it is empty, without validating it.
+func LoadFile(configPath string) (*Config, error) {
+	// cleanenv would replace a false from the file with an env-default of true, so
+	// switches that are on by default are set before the file is read
+	cfg := Config{
+		Auth: Auth{Enabled: true},
+	}
+
+	if configPath != "" {
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			return nil, fmt.Errorf("config file does not exist: %s", configPath)
+		}
+
+		if err := cleanenv.ReadConfig(configPath, &cfg); err != nil {
+			return nil, fmt.Errorf("cannot read config: %w", err)
+		}
+	} else if err := cleanenv.ReadEnv(&cfg); err != nil {
+		return nil, fmt.Errorf("cannot read config from the environment: %w", err)
+	}
+
+	if cfg.Events.GroupID == "" {
+		cfg.Events.GroupID = defaultGroupID()
+	}
+
+	return &cfg, nil
+}
+
+// defaultGroupID returns the group ID of this instance's event consumer, empty if the
+// hostname is unknown.
+func defaultGroupID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return ""
+	}
+
+	return "gwapi-events-" + hostname
+}
+
+// Validate returns every problem of the config, one per line, named by its YAML key.
+func (c *Config) Validate() error {
+	var errs []error
+
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.HTTPServer.Address != "", "http_server.address is required")
+	check(c.HTTPServer.Timeout > 0, "http_server.timeout must be positive")
+	check(c.HTTPServer.IdleTimeout > 0, "http_server.idle_timeout must be positive")
+
+	if u, err := url.Parse(c.Billing.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("billing.url must be an absolute URL, got %q", c.Billing.URL))
 	}
+	check(c.Billing.Timeout > 0, "billing.timeout must be positive")
+	check(c.Billing.Retries >= 0, "billing.retries must not be negative")
+	check(c.Billing.Retries == 0 || c.Billing.Backoff > 0, "billing.backoff must be positive")
+	c.Billing.Breaker.validate("billing.breaker", check)
+
+	check(c.Commands.Mode == "async" || c.Commands.Mode == "sync", "commands.mode must be async or sync, got %q", c.Commands.Mode)
+	check(c.Commands.Timeout > 0, "commands.timeout must be positive")
+	check(c.Commands.InvoiceTopic != "", "commands.invoice_topic is required")
+	check(c.Commands.WithdrawTopic != "", "commands.withdraw_topic is required")
+	check(c.Commands.InvoiceTopic != c.Commands.WithdrawTopic, "commands.invoice_topic and commands.withdraw_topic must differ")
+
+	check(c.Outbox.Path != "", "outbox.path is required")
+	check(c.Outbox.Retention > 0, "outbox.retention must be positive")
+	check(c.Outbox.CompactInterval > 0, "outbox.compact_interval must be positive")
+	check(c.Outbox.MaxAttempts > 0, "outbox.max_attempts must be positive")
+	check(c.Outbox.MinBackoff > 0, "outbox.min_backoff must be positive")
+	check(c.Outbox.MaxBackoff >= c.Outbox.MinBackoff, "outbox.max_backoff must not be less than outbox.min_backoff")
+
+	check(c.Events.Topic != "", "events.topic is required")
+	check(c.Events.GroupID != "", "events.group_id is required")
+
+	check(c.Bus.Transport == "kafka" || c.Bus.Transport == "memory", "bus.transport must be kafka or memory, got %q", c.Bus.Transport)
+	check(c.Bus.Partitions > 0, "bus.partitions must be positive")
 
-	// check if file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		log.Fatalf("config file does not exist: %s", configPath)
+	check(c.Bus.Transport != "kafka" || len(c.Kafka.Brokers) > 0, "kafka.brokers is required")
+	for i, broker := range c.Kafka.Brokers {
+		check(broker != "", "kafka.brokers[%d] is empty", i)
 	}
+	check(c.Kafka.Encoding == "json" || c.Kafka.Encoding == "protobuf", "kafka.encoding must be json or protobuf, got %q", c.Kafka.Encoding)
+	check(c.Kafka.Writer.BatchSize > 0, "kafka.writer.batch_size must be positive")
+	check(c.Kafka.Writer.BatchTimeout > 0, "kafka.writer.batch_timeout must be positive")
+	c.Kafka.Breaker.validate("kafka.breaker", check)
+
+	check(c.Stream.RecentEvents > 0, "stream.recent_events must be positive")
+	check(c.Stream.Retention > 0, "stream.retention must be positive")
+	check(c.Stream.Heartbeat > 0, "stream.heartbeat must be positive")
+
+	if c.Auth.Enabled {
+		check(len(c.Auth.APIKeys) > 0 || c.Auth.JWT.JWKSPath != "", "auth.api_keys or auth.jwt.jwks_path is required while auth.enabled is set")
+		for i, k := range c.Auth.APIKeys {
+			check(k.Name != "", "auth.api_keys[%d].name is required", i)
+			check(len(k.SHA256) == 64, "auth.api_keys[%d].sha256 must be 64 hex digits", i)
+			check(k.Admin || k.AccountID != "", "auth.api_keys[%d].account_id is required unless admin is set", i)
+		}
+		check(c.Auth.JWT.AccountClaim != "", "auth.jwt.account_claim is required")
+		check(c.Auth.JWT.Leeway >= 0, "auth.jwt.leeway must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b Breaker) validate(key string, check func(ok bool, format string, args ...any)) {
+	check(b.FailureThreshold > 0, "%s.failure_threshold must be positive", key)
+	check(b.OpenTimeout > 0, "%s.open_timeout must be positive", key)
+	check(b.HalfOpenProbes > 0, "%s.half_open_probes must be positive", key)
+	check(b.MaxConcurrent > 0, "%s.max_concurrent must be positive", key)
+}
 
-	var cfg Config
-	if err := cleanenv.ReadConfig(configPath, &cfg); err != nil {
-		log.Fatalf("cannot read config: %s", err)
+// Redacted returns a copy of the config that is safe to print: credentials in the billing
+// URL are masked.
+func (c Config) Redacted() Config {
+	if u, err := url.Parse(c.Billing.URL); err == nil && u.User != nil {
+		c.Billing.URL = u.Redacted()
 	}
 
-	return &cfg
+	return c
 }
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no batch size", func(c *Config) { c.Kafka.Writer.BatchSize = 0 }, "kafka.writer.batch_size must be positive"},
+		{"no batch timeout", func(c *Config) { c.Kafka.Writer.BatchTimeout = 0 }, "kafka.writer.batch_timeout must be positive"},
+		{"no group id", func(c *Config) { c.Events.GroupID = "" }, "events.group_id is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := LoadFile("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// API keys can only be set in the file
+			cfg.Auth.Enabled = false
+
+			tt.modify(cfg)
+
+			err = cfg.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate() = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadFileSwitches(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		wantEnabled bool
+	}{
+		{"default", "env: local\n", true},
+		{"enabled", "auth:\n  enabled: true\n", true},
+		{"disabled", "auth:\n  enabled: false\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Auth.Enabled != tt.wantEnabled {
+				t.Errorf("auth.enabled = %t, want %t", cfg.Auth.Enabled, tt.wantEnabled)
+			}
+		})
+	}
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("AUTH_ENABLED", "false")
+
+		cfg, err := LoadFile("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Auth.Enabled {
+			t.Error("AUTH_ENABLED=false is ignored")
+		}
+	})
+}
+
+func TestLoadFileGroupID(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		env  string
+		want string
+	}{
+		{"default", "env: local\n", "", "gwapi-events-" + hostname},
+		{"file", "events:\n  group_id: gwapi-a\n", "", "gwapi-a"},
+		{"environment", "", "gwapi-b", "gwapi-b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("EVENTS_GROUP_ID", tt.env)
+			}
+
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cfg, err := LoadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if cfg.Events.GroupID != tt.want {
+				t.Errorf("events.group_id = %q, want %q", cfg.Events.GroupID, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"errors"
+	"gwapi/internal/auth"
+	"gwapi/internal/service"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	headerAPIKey = "X-API-Key"
+	principalKey = "principal"
+)
+
+type Authenticator interface {
+	Authenticate(apiKey string, bearer string) (auth.Principal, error)
+}
+
+// authenticate rejects requests without valid credentials and keeps the caller for the
+// handlers.
+func (h *Handler) authenticate(c *gin.Context) {
+	const op = "handler.authenticate"
+
+	if h.authenticator == nil {
+		c.Next()
+		return
+	}
+
+	bearer, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+	p, err := h.authenticator.Authenticate(c.GetHeader(headerAPIKey), bearer)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer realm="gwapi"`)
+
+		message := "authentication required"
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			message = err.Error()
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{op: message})
+		return
+	}
+
+	c.Set(principalKey, p)
+	// The services forward the caller to billing from the request context
+	c.Request = c.Request.WithContext(auth.NewContext(c.Request.Context(), p))
+	c.Next()
+}
+
+// queryToken takes the bearer token from the access_token query parameter for clients
+// that can't set headers.
+func queryToken(c *gin.Context) {
+	if token := c.Query("access_token"); token != "" && c.GetHeader("Authorization") == "" {
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	c.Next()
+}
+
+// principal returns the authenticated caller, the zero principal if authentication is off.
+func principal(c *gin.Context) auth.Principal {
+	p, _ := c.Get(principalKey)
+	principal, _ := p.(auth.Principal)
+
+	return principal
+}
+
+// authorizeWallet answers the request unless the caller owns the wallet, and reports
+// whether it may go on.
+func (h *Handler) authorizeWallet(c *gin.Context, op string, walletID string) bool {
+	owns, err := h.callerOwns(c, walletID)
+	if errors.Is(err, service.ErrWalletNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{op: "wallet not found"})
+		return false
+	}
+	if err != nil {
+		respondBillingError(c, op, err, "failed to check wallet owner")
+		return false
+	}
+
+	if !owns {
+		c.JSON(http.StatusForbidden, gin.H{op: "wallet belongs to another account"})
+		return false
+	}
+
+	return true
+}
+
+// authorizeLookup is authorizeWallet for resources looked up by their own ID. A resource of
+// another account is answered like an unknown ID, with notFound, so that callers can't probe
+// which IDs exist.
+func (h *Handler) authorizeLookup(c *gin.Context, op string, walletID string, notFound string) bool {
+	owns, err := h.callerOwns(c, walletID)
+	if err != nil && !errors.Is(err, service.ErrWalletNotFound) {
+		respondBillingError(c, op, err, "failed to check wallet owner")
+		return false
+	}
+
+	if !owns {
+		c.JSON(http.StatusNotFound, gin.H{op: notFound})
+		return false
+	}
+
+	return true
+}
+
+// callerOwns reports whether the caller may act on the wallet. Admins and anonymous callers
+// with authentication off may act on every wallet.
+func (h *Handler) callerOwns(c *gin.Context, walletID string) (bool, error) {
+	if h.authenticator == nil {
+		return true, nil
+	}
+
+	p := principal(c)
+	if p.Admin {
+		return true, nil
+	}
+
+	accountID, err := h.billingWorker.WalletAccount(c.Request.Context(), walletID)
+	if err != nil {
+		return false, err
+	}
+
+	return p.Owns(accountID), nil
+}
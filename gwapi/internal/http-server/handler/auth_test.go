@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"gwapi/internal/auth"
+	"gwapi/internal/billing"
+	br "gwapi/internal/lib/balance"
+	opr "gwapi/internal/lib/operation"
+	ts "gwapi/internal/lib/transaction"
+	"gwapi/internal/outbox"
+	"gwapi/internal/service"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeWorker knows the account of every wallet in accounts and records the caller of the
+// last command. Calls it doesn't implement panic on the nil BillingWorker.
+type fakeWorker struct {
+	BillingWorker
+	accounts map[string]string
+	caller   auth.Principal
+}
+
+func (w *fakeWorker) WalletAccount(ctx context.Context, walletID string) (string, error) {
+	accountID, ok := w.accounts[walletID]
+	if !ok {
+		return "", service.ErrWalletNotFound
+	}
+
+	return accountID, nil
+}
+
+func (w *fakeWorker) Balance(ctx context.Context, walletID string) (br.BalanceResponse, error) {
+	return br.BalanceResponse{}, nil
+}
+
+func (w *fakeWorker) Invoice(ctx context.Context, walletID string, currency string, amount float64) (string, error) {
+	w.caller, _ = auth.FromContext(ctx)
+	return "op-1", nil
+}
+
+// Transaction and Operation take the wallet from the ID, "w-1-t1" and "w-1-op1" belong to w-1.
+func (w *fakeWorker) Transaction(ctx context.Context, id string) (ts.TransactionResponse, error) {
+	walletID, _, _ := strings.Cut(id, "-t")
+	if _, ok := w.accounts[walletID]; !ok {
+		return ts.TransactionResponse{}, &billing.StatusError{StatusCode: http.StatusNotFound, Message: "transaction not found"}
+	}
+
+	return ts.TransactionResponse{Transaction: ts.Transaction{WalletID: walletID}}, nil
+}
+
+func (w *fakeWorker) Operation(ctx context.Context, id string) (opr.OperationResponse, error) {
+	walletID, _, _ := strings.Cut(id, "-op")
+	if _, ok := w.accounts[walletID]; !ok {
+		return opr.OperationResponse{}, outbox.ErrNotFound
+	}
+
+	return opr.OperationResponse{OperationID: id, WalletID: walletID}, nil
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestRouter(t *testing.T, authenticated bool) (*gin.Engine, *fakeWorker) {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+
+	worker := &fakeWorker{accounts: map[string]string{"w-1": "acc-1", "w-2": "acc-2"}}
+
+	var authenticator Authenticator
+	if authenticated {
+		a, err := auth.New([]auth.APIKey{
+			{Name: "shop", SHA256: hashKey("shop-key"), AccountID: "acc-1"},
+			{Name: "backoffice", SHA256: hashKey("admin-key"), Admin: true},
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authenticator = a
+	}
+
+	return New(worker, opr.ModeAsync, nil, time.Second, authenticator).InitRoutes(), worker
+}
+
+func TestAuthentication(t *testing.T) {
+	router, _ := newTestRouter(t, true)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		header     map[string]string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{"health is open", http.MethodGet, "/health", nil, "", http.StatusOK, ""},
+		{"no credentials", http.MethodGet, "/balance/w-1", nil, "", http.StatusUnauthorized, "authentication required"},
+		{"unknown api key", http.MethodGet, "/balance/w-1", map[string]string{"X-API-Key": "wrong"}, "", http.StatusUnauthorized, "invalid credentials: unknown API key"},
+		{"the hash as api key", http.MethodGet, "/balance/w-1", map[string]string{"X-API-Key": hashKey("shop-key")}, "", http.StatusUnauthorized, "invalid credentials: unknown API key"},
+		{"token without verifier", http.MethodGet, "/balance/w-1", map[string]string{"Authorization": "Bearer a.b.c"}, "", http.StatusUnauthorized, "invalid credentials: tokens are not accepted"},
+		{"token in the query outside streams", http.MethodGet, "/balance/w-1?access_token=a.b.c", nil, "", http.StatusUnauthorized, "authentication required"},
+		{"stream with bad query token", http.MethodGet, "/wallet/w-1/stream?access_token=a.b.c", nil, "", http.StatusUnauthorized, "invalid credentials: tokens are not accepted"},
+		{"owner", http.MethodGet, "/balance/w-1", map[string]string{"X-API-Key": "shop-key"}, "", http.StatusOK, ""},
+		{"other account", http.MethodGet, "/balance/w-2", map[string]string{"X-API-Key": "shop-key"}, "", http.StatusForbidden, "wallet belongs to another account"},
+		{"unknown wallet", http.MethodGet, "/balance/w-3", map[string]string{"X-API-Key": "shop-key"}, "", http.StatusNotFound, "wallet not found"},
+		{"admin", http.MethodGet, "/balance/w-2", map[string]string{"X-API-Key": "admin-key"}, "", http.StatusOK, ""},
+		{
+			"invoice to other account", http.MethodPost, "/invoice", map[string]string{"X-API-Key": "shop-key"},
+			`{"wallet_id":"w-2","currency":"USD","amount":1}`, http.StatusForbidden, "wallet belongs to another account",
+		},
+		{
+			"invoice without credentials", http.MethodPost, "/invoice", nil,
+			`{"wallet_id":"w-1","currency":"USD","amount":1}`, http.StatusUnauthorized, "authentication required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for key, value := range tt.header {
+				req.Header.Set(key, value)
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without WWW-Authenticate header")
+			}
+
+			if tt.wantError == "" {
+				return
+			}
+
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %s: %v", rec.Body, err)
+			}
+
+			found := false
+			for _, message := range body {
+				found = found || message == tt.wantError
+			}
+			if !found {
+				t.Errorf("body = %s, want error %q", rec.Body, tt.wantError)
+			}
+		})
+	}
+}
+
+// TestLookupOfOtherAccounts checks that the IDs of other accounts can't be told apart from
+// unknown IDs.
+func TestLookupOfOtherAccounts(t *testing.T) {
+	router, _ := newTestRouter(t, true)
+
+	get := func(target, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-API-Key", key)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	tests := []struct {
+		name    string
+		own     string
+		other   string
+		unknown string
+	}{
+		{"transaction", "/transaction/w-1-t1", "/transaction/w-2-t1", "/transaction/w-3-t1"},
+		{"operation", "/operation/w-1-op1", "/operation/w-2-op1", "/operation/w-3-op1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := get(tt.own, "shop-key"); rec.Code != http.StatusOK {
+				t.Fatalf("own: status = %d, want 200, body %s", rec.Code, rec.Body)
+			}
+			if rec := get(tt.other, "admin-key"); rec.Code != http.StatusOK {
+				t.Fatalf("admin: status = %d, want 200, body %s", rec.Code, rec.Body)
+			}
+
+			other, unknown := get(tt.other, "shop-key"), get(tt.unknown, "shop-key")
+
+			if other.Code != http.StatusNotFound || unknown.Code != http.StatusNotFound {
+				t.Fatalf("status = %d for another account, %d for an unknown ID, want 404", other.Code, unknown.Code)
+			}
+			if other.Body.String() != unknown.Body.String() {
+				t.Errorf("body = %s for another account, %s for an unknown ID", other.Body, unknown.Body)
+			}
+		})
+	}
+}
+
+func TestAuthenticationDisabled(t *testing.T) {
+	router, _ := newTestRouter(t, false)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/balance/w-2", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200, body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestCallerIsForwarded(t *testing.T) {
+	router, worker := newTestRouter(t, true)
+
+	req := httptest.NewRequest(http.MethodPost, "/invoice", strings.NewReader(`{"wallet_id":"w-1","currency":"USD","amount":1}`))
+	req.Header.Set("X-API-Key", "shop-key")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want 202, body %s", rec.Code, rec.Body)
+	}
+
+	if got := worker.caller.Actor(); got != "api_key:shop" {
+		t.Errorf("caller = %q, want api_key:shop", got)
+	}
+}
@@ -1,11 +1,25 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gwapi/internal/billing"
+	"gwapi/internal/breaker"
 	br "gwapi/internal/lib/balance"
 	"gwapi/internal/lib/iwrequest"
+	opr "gwapi/internal/lib/operation"
+	st "gwapi/internal/lib/statement"
 	ts "gwapi/internal/lib/transaction"
 	wl "gwapi/internal/lib/wallet"
+	"gwapi/internal/outbox"
+	"gwapi/internal/service"
+	"gwapi/internal/stream"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -13,38 +27,100 @@ import (
 
 type Handler struct {
 	billingWorker BillingWorker
+	commandMode   string
+	stream        Stream
+	heartbeat     time.Duration
+	authenticator Authenticator
+	breakers      []Breaker
 }
 
 type BillingWorker interface {
-	Invoice(walletID string, currency string, amount float64) error
-	Withdraw(walletID string, currency string, amount float64) error
-	Balance(wallet_id string) (br.BalanceResponse, error)
-	Transaction(id string) (ts.TransactionResponse, error)
-	Wallet() (wl.WalletResponse, error)
+	Invoice(ctx context.Context, walletID string, currency string, amount float64) (string, error)
+	Withdraw(ctx context.Context, walletID string, currency string, amount float64) (string, error)
+	InvoiceSync(ctx context.Context, walletID string, currency string, amount float64) (opr.CommandResponse, error)
+	WithdrawSync(ctx context.Context, walletID string, currency string, amount float64) (opr.CommandResponse, error)
+	Operation(ctx context.Context, id string) (opr.OperationResponse, error)
+	Balance(ctx context.Context, walletID string) (br.BalanceResponse, error)
+	Transaction(ctx context.Context, id string) (ts.TransactionResponse, error)
+	Wallet(ctx context.Context, accountID string) (wl.WalletResponse, error)
+	WalletAccount(ctx context.Context, walletID string) (string, error)
+	Statement(ctx context.Context, walletID string, from string, to string, format string) (st.StatementResponse, error)
 }
 
-func New(billingWorker BillingWorker) *Handler {
+type Breaker interface {
+	Status() breaker.Status
+}
+
+type Stream interface {
+	Subscribe(walletID string, after string) (missed []stream.Update, updates <-chan stream.Update, resumed bool, cancel func())
+}
+
+// New answers invoices and withdrawals in commandMode, operation.ModeAsync or
+// operation.ModeSync, unless a request asks for the other one. Live wallet streams send a
+// heartbeat every heartbeat. Callers are authenticated by authenticator and may only act
+// on their own wallets; without an authenticator every caller may act on every wallet.
+// The states of the breakers are reported by /health.
+func New(billingWorker BillingWorker, commandMode string, stream Stream, heartbeat time.Duration, authenticator Authenticator, breakers ...Breaker) *Handler {
 	return &Handler{
 		billingWorker: billingWorker,
+		commandMode:   commandMode,
+		stream:        stream,
+		heartbeat:     heartbeat,
+		authenticator: authenticator,
+		breakers:      breakers,
 	}
 }
 
 func (h *Handler) InitRoutes() *gin.Engine {
 	router := gin.New()
 
-	router.Use(cors.Default())
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowAllOrigins = true
+	corsConfig.AddAllowHeaders("Authorization", headerAPIKey, "Last-Event-ID")
+	router.Use(cors.New(corsConfig))
 
-	router.POST("/wallet", h.createWallet)
-	router.GET("/balance/:id", h.getBalance)
-	router.POST("/invoice", h.createInvoice)
-	router.POST("/withdraw", h.createWithdraw)
-	router.GET("/transaction/:id", h.getTransaction)
+	router.GET("/health", h.getHealth)
+
+	// EventSource can't set headers, streams take the token from the query as well
+	router.GET("/wallet/:id/stream", queryToken, h.authenticate, h.streamWallet)
+
+	api := router.Group("/", h.authenticate)
+	api.POST("/wallet", h.createWallet)
+	api.GET("/balance/:id", h.getBalance)
+	api.POST("/invoice", h.createInvoice)
+	api.POST("/withdraw", h.createWithdraw)
+	api.GET("/transaction/:id", h.getTransaction)
+	api.GET("/wallet/:id/statement", h.getStatement)
+	api.GET("/operation/:id", h.getOperation)
 
 	// router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	return router
 }
 
+// @Summary Get health
+// @Description Report the state of the circuit breakers in front of billing and Kafka. The
+// @Description status is "degraded" while a breaker is not closed.
+// @Tags APIs
+// @Produce json
+// @Success 200
+// @Router /health [get]
+func (h *Handler) getHealth(c *gin.Context) {
+	status := "ok"
+
+	breakers := make([]breaker.Status, 0, len(h.breakers))
+	for _, b := range h.breakers {
+		s := b.Status()
+		if s.State != breaker.StateClosed {
+			status = "degraded"
+		}
+
+		breakers = append(breakers, s)
+	}
+
+	c.JSON(200, gin.H{"status": status, "breakers": breakers})
+}
+
 // @Summary Get transaction info
 // @Description Get transaction info based on id
 // @Tags APIs
@@ -58,9 +134,14 @@ func (h *Handler) getTransaction(c *gin.Context) {
 
 	id := c.Param("id")
 
-	result, err := h.billingWorker.Transaction(id)
+	result, err := h.billingWorker.Transaction(c.Request.Context(), id)
 	if err != nil {
-		c.JSON(500, gin.H{op: "failed to get transaction"})
+		respondBillingError(c, op, err, "failed to get transaction")
+		return
+	}
+
+	if !h.authorizeLookup(c, op, result.Transaction.WalletID, "not found") {
+		return
 	}
 
 	c.JSON(200, result)
@@ -76,13 +157,31 @@ func (h *Handler) createInvoice(c *gin.Context) {
 		return
 	}
 
-	err := h.billingWorker.Invoice(request.WalletID, request.Currency, request.Amount)
+	mode := c.DefaultQuery("mode", h.commandMode)
+	if mode != opr.ModeAsync && mode != opr.ModeSync {
+		c.JSON(http.StatusBadRequest, gin.H{op: "mode must be async or sync"})
+		return
+	}
+
+	if !h.authorizeWallet(c, op, request.WalletID) {
+		return
+	}
+
+	if mode == opr.ModeSync {
+		result, err := h.billingWorker.InvoiceSync(c.Request.Context(), request.WalletID, request.Currency, request.Amount)
+		if !respondSyncError(c, op, err) {
+			c.JSON(http.StatusOK, gin.H{"invoice": request, "operation_id": result.OperationID, "transaction_id": result.TransactionID, "status": result.Status})
+		}
+		return
+	}
+
+	operationID, err := h.billingWorker.Invoice(c.Request.Context(), request.WalletID, request.Currency, request.Amount)
 	if err != nil {
 		c.JSON(500, gin.H{op: "internal error"})
 		return
 	}
 
-	c.JSON(200, gin.H{"invoice": request})
+	c.JSON(http.StatusAccepted, gin.H{"invoice": request, "operation_id": operationID})
 }
 
 func (h *Handler) createWithdraw(c *gin.Context) {
@@ -95,21 +194,82 @@ func (h *Handler) createWithdraw(c *gin.Context) {
 		return
 	}
 
-	err := h.billingWorker.Withdraw(request.WalletID, request.Currency, request.Amount)
+	mode := c.DefaultQuery("mode", h.commandMode)
+	if mode != opr.ModeAsync && mode != opr.ModeSync {
+		c.JSON(http.StatusBadRequest, gin.H{op: "mode must be async or sync"})
+		return
+	}
+
+	if !h.authorizeWallet(c, op, request.WalletID) {
+		return
+	}
+
+	if mode == opr.ModeSync {
+		result, err := h.billingWorker.WithdrawSync(c.Request.Context(), request.WalletID, request.Currency, request.Amount)
+		if !respondSyncError(c, op, err) {
+			c.JSON(http.StatusOK, gin.H{"withdraw": request, "operation_id": result.OperationID, "transaction_id": result.TransactionID, "status": result.Status})
+		}
+		return
+	}
+
+	operationID, err := h.billingWorker.Withdraw(c.Request.Context(), request.WalletID, request.Currency, request.Amount)
 	if err != nil {
 		c.JSON(500, gin.H{op: "internal error"})
 		return
 	}
 
-	c.JSON(200, gin.H{"withdraw": request})
+	c.JSON(http.StatusAccepted, gin.H{"withdraw": request, "operation_id": operationID})
+}
+
+// respondSyncError answers a failed sync command and reports whether it did.
+func respondSyncError(c *gin.Context, op string, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, service.ErrWalletNotFound):
+		c.JSON(http.StatusNotFound, gin.H{op: "wallet not found"})
+	default:
+		respondBillingError(c, op, err, "internal error")
+	}
+
+	return true
+}
+
+// respondBillingError answers a failed call to billing, passing on what billing rejected.
+func respondBillingError(c *gin.Context, op string, err error, message string) {
+	var statusErr *billing.StatusError
+	var rejected *breaker.RejectedError
+
+	switch {
+	case errors.As(err, &rejected):
+		// Clients are told to come back once the breaker lets calls through again
+		retryAfter := int(math.Ceil(rejected.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		c.JSON(http.StatusServiceUnavailable, gin.H{op: "billing is unavailable, retry later"})
+	case errors.Is(err, billing.ErrBadRequest) && errors.As(err, &statusErr):
+		c.JSON(http.StatusBadRequest, gin.H{op: statusErr.Message})
+	case errors.Is(err, billing.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{op: "not found"})
+	case errors.Is(err, billing.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		c.JSON(http.StatusBadGateway, gin.H{op: "billing is unavailable"})
+	default:
+		c.JSON(500, gin.H{op: message})
+	}
 }
 
 func (h *Handler) createWallet(c *gin.Context) {
 	const op = "handler.createWallet"
 
-	result, err := h.billingWorker.Wallet()
+	// Authenticated callers get the wallet of their account, admins and anonymous callers
+	// one of a new account
+	result, err := h.billingWorker.Wallet(c.Request.Context(), principal(c).AccountID)
+	if errors.Is(err, service.ErrAccountHasWallet) {
+		c.JSON(http.StatusConflict, gin.H{op: "account has a wallet already"})
+		return
+	}
 	if err != nil {
-		c.JSON(500, gin.H{op: "failed to create wallet"})
+		respondBillingError(c, op, err, "failed to create wallet")
+		return
 	}
 
 	c.JSON(200, gin.H{"wallet": result})
@@ -120,10 +280,184 @@ func (h *Handler) getBalance(c *gin.Context) {
 
 	wallet_id := c.Param("id")
 
-	result, err := h.billingWorker.Balance(wallet_id)
+	if !h.authorizeWallet(c, op, wallet_id) {
+		return
+	}
+
+	result, err := h.billingWorker.Balance(c.Request.Context(), wallet_id)
+	if err != nil {
+		respondBillingError(c, op, err, "failed to get balance")
+		return
+	}
+
+	c.JSON(200, result)
+}
+
+// @Summary Get wallet statement
+// @Description Download the statement of a wallet with opening balance, transactions and closing balance per currency
+// @Tags APIs
+// @Produce json,text/csv,application/x-ofx,application/xml
+// @Param id path string true "Wallet ID"
+// @Param from query string false "Start of the period, RFC 3339 or YYYY-MM-DD"
+// @Param to query string false "End of the period, RFC 3339 or YYYY-MM-DD (inclusive)"
+// @Param format query string false "csv, json, ofx or camt053"
+// @Success 200
+// @Failure 400
+// @Failure 500
+// @Router /wallet/:id/statement [get]
+func (h *Handler) getStatement(c *gin.Context) {
+	const op = "handler.getStatement"
+
+	wallet_id := c.Param("id")
+
+	if !h.authorizeWallet(c, op, wallet_id) {
+		return
+	}
+
+	result, err := h.billingWorker.Statement(c.Request.Context(), wallet_id, c.Query("from"), c.Query("to"), c.DefaultQuery("format", "json"))
+	if err != nil {
+		respondBillingError(c, op, err, "failed to get statement")
+		return
+	}
+	defer result.Body.Close()
+
+	extraHeaders := map[string]string{}
+	if result.ContentDisposition != "" {
+		extraHeaders["Content-Disposition"] = result.ContentDisposition
+	}
+
+	c.DataFromReader(result.StatusCode, -1, result.ContentType, result.Body, extraHeaders)
+}
+
+// @Summary Get operation status
+// @Description Get the delivery and processing status of an invoice or withdraw by its operation id
+// @Tags APIs
+// @Produce json
+// @Param id path string true "Operation ID"
+// @Success 200 {object} operation.OperationResponse
+// @Failure 404
+// @Failure 500
+// @Router /operation/:id [get]
+func (h *Handler) getOperation(c *gin.Context) {
+	const op = "handler.getOperation"
+
+	id := c.Param("id")
+
+	result, err := h.billingWorker.Operation(c.Request.Context(), id)
+	if errors.Is(err, outbox.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{op: "operation not found"})
+		return
+	}
 	if err != nil {
-		c.JSON(500, gin.H{op: "failed to get balance"})
+		respondBillingError(c, op, err, "failed to get operation")
+		return
+	}
+
+	if !h.authorizeLookup(c, op, result.WalletID, "operation not found") {
+		return
 	}
 
 	c.JSON(200, result)
 }
+
+// @Summary Stream wallet updates
+// @Description Server-sent events of a wallet. A "snapshot" event carries the current balance, every
+// @Description "transaction" event a completed or failed transaction with the balance after it. Clients
+// @Description resume with the Last-Event-ID header; a snapshot is sent again if the updates since are gone.
+// @Tags APIs
+// @Produce text/event-stream
+// @Param id path string true "Wallet ID"
+// @Param Last-Event-ID header string false "ID of the last event received"
+// @Param resume query string false "Same as Last-Event-ID, for clients that can't set headers"
+// @Success 200
+// @Failure 500
+// @Router /wallet/:id/stream [get]
+func (h *Handler) streamWallet(c *gin.Context) {
+	const op = "handler.streamWallet"
+
+	walletID := c.Param("id")
+
+	if !h.authorizeWallet(c, op, walletID) {
+		return
+	}
+
+	after := c.GetHeader("Last-Event-ID")
+	if after == "" {
+		after = c.Query("resume")
+	}
+
+	// Subscribe before loading the balance, so no update falls in between
+	missed, updates, resumed, cancel := h.stream.Subscribe(walletID, after)
+	defer cancel()
+
+	var snapshot br.BalanceResponse
+	if !resumed {
+		var err error
+
+		snapshot, err = h.billingWorker.Balance(c.Request.Context(), walletID)
+		if err != nil {
+			respondBillingError(c, op, err, "failed to get balance")
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	if !resumed && !writeEvent(c, "", "snapshot", snapshot) {
+		return
+	}
+
+	for _, update := range missed {
+		if !writeEvent(c, update.Token, "transaction", update.Event) {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case update, ok := <-updates:
+			// The client fell behind or the server is stopping, it resumes from its last event
+			if !ok {
+				return
+			}
+
+			if !writeEvent(c, update.Token, "transaction", update.Event) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+
+		c.Writer.Flush()
+	}
+}
+
+// writeEvent writes a server-sent event and reports whether the client is still there.
+func writeEvent(c *gin.Context, id string, name string, data any) bool {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return false
+	}
+
+	if id != "" {
+		if _, err := fmt.Fprintf(c.Writer, "id: %s\n", id); err != nil {
+			return false
+		}
+	}
+
+	_, err = fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", name, payload)
+
+	return err == nil
+}
@@ -0,0 +1,60 @@
+package envelope
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Message types of the commands gwapi sends to billing.
+const (
+	TypeInvoice  = "invoice"
+	TypeWithdraw = "withdraw"
+)
+
+// Version is the schema version of the payloads gwapi produces.
+const Version = 1
+
+// HeaderContentType tells how a message is encoded. Messages without it are JSON.
+const (
+	HeaderContentType   = "content-type"
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// Envelope wraps every command payload with what a consumer needs to know about it before
+// decoding the payload itself.
+type Envelope struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	Version       int             `json:"version"`
+	ProducedAt    time.Time       `json:"produced_at"`
+	CorrelationID string          `json:"correlation_id,omitempty"`
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// ContentType returns the content type of an encoding name as used in the config.
+func ContentType(encoding string) (string, error) {
+	const op = "envelope.ContentType"
+
+	switch encoding {
+	case "", "json":
+		return ContentTypeJSON, nil
+	case "protobuf":
+		return ContentTypeProtobuf, nil
+	default:
+		return "", fmt.Errorf("%s: unknown encoding %q", op, encoding)
+	}
+}
+
+// New wraps a payload produced at producedAt.
+func New(id string, messageType string, correlationID string, producedAt time.Time, payload json.RawMessage) Envelope {
+	return Envelope{
+		ID:            id,
+		Type:          messageType,
+		Version:       Version,
+		ProducedAt:    producedAt.UTC(),
+		CorrelationID: correlationID,
+		Payload:       payload,
+	}
+}
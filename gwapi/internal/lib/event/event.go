@@ -0,0 +1,26 @@
+package event
+
+import (
+	br "gwapi/internal/lib/balance"
+	"time"
+)
+
+const (
+	TypeCompleted = "transaction.completed"
+	TypeFailed    = "transaction.failed"
+)
+
+type Event struct {
+	Type            string           `json:"type"`
+	OperationID     string           `json:"operation_id,omitempty"`
+	WalletID        string           `json:"wallet_id"`
+	TransactionID   int              `json:"transaction_id,omitempty"`
+	TransactionType string           `json:"transaction_type"`
+	Currency        string           `json:"currency"`
+	Amount          float64          `json:"amount"`
+	Status          string           `json:"status"`
+	DateCreated     *time.Time       `json:"date_created,omitempty"`
+	Balance         *br.BalanceEntry `json:"balance,omitempty"`
+	Error           string           `json:"error,omitempty"`
+	OccurredAt      time.Time        `json:"occurred_at"`
+}
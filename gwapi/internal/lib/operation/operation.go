@@ -0,0 +1,45 @@
+package operation
+
+import (
+	br "gwapi/internal/lib/balance"
+	ts "gwapi/internal/lib/transaction"
+	"time"
+)
+
+const (
+	ProcessingPending      = "pending"
+	ProcessingCompleted    = "completed"
+	ProcessingFailed       = "failed"
+	ProcessingNotDelivered = "not_delivered"
+)
+
+// Modes of invoices and withdrawals: async commands are published to billing through the
+// outbox, sync commands are applied by billing before gwapi answers.
+const (
+	ModeAsync = "async"
+	ModeSync  = "sync"
+)
+
+// CommandResponse is the outcome of an invoice or withdraw that was applied synchronously.
+type CommandResponse struct {
+	OperationID   string `json:"operation_id"`
+	TransactionID int    `json:"transaction_id"`
+	Status        string `json:"status,omitempty"`
+}
+
+// OperationResponse reports how far an invoice or withdraw command got: whether it was
+// delivered to Kafka and whether billing has processed it.
+type OperationResponse struct {
+	OperationID      string           `json:"operation_id"`
+	WalletID         string           `json:"wallet_id"`
+	Topic            string           `json:"topic"`
+	DeliveryStatus   string           `json:"delivery_status"`
+	DeliveryAttempts int              `json:"delivery_attempts"`
+	LastError        string           `json:"last_error,omitempty"`
+	CreatedAt        time.Time        `json:"created_at"`
+	PublishedAt      *time.Time       `json:"published_at,omitempty"`
+	ProcessingStatus string           `json:"processing_status"`
+	Transaction      *ts.Transaction  `json:"transaction,omitempty"`
+	Balance          *br.BalanceEntry `json:"balance,omitempty"`
+	Error            string           `json:"error,omitempty"`
+}
@@ -0,0 +1,11 @@
+package statement
+
+import "io"
+
+// StatementResponse is a statement streamed from billing. Body must be closed by the caller.
+type StatementResponse struct {
+	StatusCode         int
+	ContentType        string
+	ContentDisposition string
+	Body               io.ReadCloser
+}
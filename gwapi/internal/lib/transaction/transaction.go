@@ -7,7 +7,9 @@ type TransactionResponse struct {
 }
 
 type Transaction struct {
+	ID          int       `json:"id"`
 	WalletID    string    `json:"wallet_id"`
+	Currency    string    `json:"currency"`
 	Type        string    `json:"type"`
 	Status      string    `json:"status"`
 	Amount      float64   `json:"amount"`
@@ -0,0 +1,410 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gwapi/internal/lib/logger/sl"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusPublished = "published"
+	StatusFailed    = "failed"
+)
+
+var ErrNotFound = errors.New("operation not found")
+
+// Operation is a command recorded in the outbox before it is published. Result holds the
+// transaction event billing published once it handled the command.
+type Operation struct {
+	ID          string          `json:"id"`
+	Topic       string          `json:"topic"`
+	Type        string          `json:"type,omitempty"`
+	Key         string          `json:"key"`
+	Actor       string          `json:"actor,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	PublishedAt *time.Time      `json:"published_at,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+}
+
+// Outbox is a durable journal of operations. Every change is appended to the journal file
+// as a snapshot of the operation and synced to disk before it is acknowledged, so that no
+// accepted command is lost if gwapi stops before it was published.
+type Outbox struct {
+	mu         sync.Mutex
+	path       string
+	retention  time.Duration
+	file       *os.File
+	operations map[string]*Operation
+	// queue holds the IDs of pending operations in the order they were enqueued. IDs of
+	// operations that are no longer pending are dropped from it by Pending.
+	queue  []string
+	notify chan struct{}
+}
+
+// Open replays the journal at path and compacts it to one line per operation. Published
+// and failed operations older than retention are dropped while compacting, see Compact.
+func Open(path string, retention time.Duration) (*Outbox, error) {
+	const op = "outbox.Open"
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	o := &Outbox{
+		path:       path,
+		retention:  retention,
+		operations: map[string]*Operation{},
+		notify:     make(chan struct{}, 1),
+	}
+
+	if err := o.replay(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := o.compact(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var pending []*Operation
+	for _, operation := range o.operations {
+		if operation.Status == StatusPending {
+			pending = append(pending, operation)
+		}
+	}
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+
+	for _, operation := range pending {
+		o.queue = append(o.queue, operation.ID)
+	}
+
+	return o, nil
+}
+
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.file.Close()
+}
+
+// Enqueue records a new pending operation and wakes up the relay. actor is the caller the
+// operation is made for, empty if unknown.
+func (o *Outbox) Enqueue(topic string, messageType string, key string, actor string, payload []byte) (Operation, error) {
+	const op = "outbox.Enqueue"
+
+	id, err := NewID()
+	if err != nil {
+		return Operation{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := time.Now().UTC()
+	operation := &Operation{
+		ID:        id,
+		Topic:     topic,
+		Type:      messageType,
+		Key:       key,
+		Actor:     actor,
+		Payload:   payload,
+		Status:    StatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	o.mu.Lock()
+	err = o.append(operation)
+	if err == nil {
+		o.operations[id] = operation
+		o.queue = append(o.queue, id)
+	}
+	o.mu.Unlock()
+
+	if err != nil {
+		return Operation{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+
+	return *operation, nil
+}
+
+func (o *Outbox) Get(id string) (Operation, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	operation, ok := o.operations[id]
+	if !ok {
+		return Operation{}, ErrNotFound
+	}
+
+	return *operation, nil
+}
+
+// Pending returns the operations that still have to be published, oldest first.
+func (o *Outbox) Pending() []Operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	pending := make([]Operation, 0, len(o.queue))
+	queue := o.queue[:0]
+
+	for _, id := range o.queue {
+		operation, ok := o.operations[id]
+		if !ok || operation.Status != StatusPending {
+			continue
+		}
+
+		queue = append(queue, id)
+		pending = append(pending, *operation)
+	}
+
+	clear(o.queue[len(queue):])
+	o.queue = queue
+
+	return pending
+}
+
+// Notify is signalled whenever a new operation is enqueued.
+func (o *Outbox) Notify() <-chan struct{} {
+	return o.notify
+}
+
+// MarkPublished marks the operations published with a single write to the journal.
+func (o *Outbox) MarkPublished(ids ...string) error {
+	now := time.Now().UTC()
+
+	return o.update(ids, func(operation *Operation) {
+		operation.Status = StatusPublished
+		operation.Attempts++
+		operation.LastError = ""
+		operation.PublishedAt = &now
+	})
+}
+
+// MarkFailedAttempt records a failed publish. The operation stays pending unless final is set.
+func (o *Outbox) MarkFailedAttempt(id string, attemptErr error, final bool) error {
+	return o.update([]string{id}, func(operation *Operation) {
+		operation.Attempts++
+		operation.LastError = attemptErr.Error()
+		if final {
+			operation.Status = StatusFailed
+		}
+	})
+}
+
+// RecordResult stores the outcome billing reported for the operation.
+func (o *Outbox) RecordResult(id string, result []byte) error {
+	return o.update([]string{id}, func(operation *Operation) {
+		operation.Result = result
+	})
+}
+
+// update applies fn to the operations and journals their snapshots together. None of them
+// is changed if one is not found.
+func (o *Outbox) update(ids []string, fn func(operation *Operation)) error {
+	const op = "outbox.update"
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	updated := make([]*Operation, len(ids))
+	for i, id := range ids {
+		current, ok := o.operations[id]
+		if !ok {
+			return fmt.Errorf("%s: %s: %w", op, id, ErrNotFound)
+		}
+
+		operation := *current
+		fn(&operation)
+		operation.UpdatedAt = now
+
+		updated[i] = &operation
+	}
+
+	if err := o.append(updated...); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	for _, operation := range updated {
+		o.operations[operation.ID] = operation
+	}
+
+	return nil
+}
+
+// append writes snapshots of the operations to the journal and syncs it once. Callers
+// hold o.mu.
+func (o *Outbox) append(operations ...*Operation) error {
+	var buf []byte
+	for _, operation := range operations {
+		line, err := json.Marshal(operation)
+		if err != nil {
+			return err
+		}
+
+		buf = append(append(buf, line...), '\n')
+	}
+
+	if _, err := o.file.Write(buf); err != nil {
+		return err
+	}
+
+	return o.file.Sync()
+}
+
+func (o *Outbox) replay() error {
+	file, err := os.Open(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var operation Operation
+		if err := json.Unmarshal(scanner.Bytes(), &operation); err != nil {
+			// A torn last line from a crash in the middle of a write is skipped, the
+			// operation it belonged to was never acknowledged.
+			continue
+		}
+		o.operations[operation.ID] = &operation
+	}
+
+	return scanner.Err()
+}
+
+// Compact rewrites the journal with the latest snapshot of every operation, so that it
+// doesn't keep growing with every update. Published and failed operations that haven't
+// changed for longer than the retention are dropped from the journal and from memory.
+func (o *Outbox) Compact() error {
+	const op = "outbox.Compact"
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.compact(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// RunCompaction compacts the outbox every interval until ctx is done.
+func (o *Outbox) RunCompaction(ctx context.Context, log *slog.Logger, interval time.Duration) {
+	const op = "outbox.RunCompaction"
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := o.Compact(); err != nil {
+			log.Error("failed to compact outbox", slog.String("op", op), sl.Err(err))
+		}
+	}
+}
+
+// compact writes the journal to a new file and replaces the old one with it. The new file
+// is opened for appending before the old one is replaced, so the journal is never left
+// without a file to append to. Callers hold o.mu.
+func (o *Outbox) compact() (err error) {
+	cutoff := time.Now().Add(-o.retention)
+
+	tmpPath := o.path + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	var expired []string
+
+	writer := bufio.NewWriter(tmp)
+	for id, operation := range o.operations {
+		if operation.Status != StatusPending && operation.UpdatedAt.Before(cutoff) {
+			expired = append(expired, id)
+			continue
+		}
+
+		line, err := json.Marshal(operation)
+		if err != nil {
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return err
+	}
+
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file = tmp
+
+	for _, id := range expired {
+		delete(o.operations, id)
+	}
+
+	return nil
+}
+
+// NewID returns a random (version 4) UUID, the format of operation IDs.
+func NewID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,162 @@
+package outbox
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lines++
+	}
+
+	return lines
+}
+
+func TestPendingOrder(t *testing.T) {
+	o := openTestOutbox(t)
+
+	first := enqueue(t, o, "a")
+	second := enqueue(t, o, "b")
+	third := enqueue(t, o, "a")
+
+	if err := o.MarkPublished(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.MarkFailedAttempt(third, errors.New("leader not available"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := o.Pending()
+	if len(pending) != 2 || pending[0].ID != first || pending[1].ID != third {
+		t.Fatalf("pending = %v, want [%s %s]", ids(pending), first, third)
+	}
+	if pending[1].Attempts != 1 {
+		t.Errorf("pending operation = %+v, want the latest snapshot", pending[1])
+	}
+
+	// Operations that are no longer pending leave the queue
+	if len(o.queue) != 2 {
+		t.Errorf("queue holds %d IDs, want 2", len(o.queue))
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+
+	o, err := Open(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := enqueue(t, o, "a")
+	failed := enqueue(t, o, "b")
+	pending := enqueue(t, o, "c")
+
+	if err := o.MarkPublished(published); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.MarkFailedAttempt(failed, errors.New("message too large"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	recent := enqueue(t, o, "d")
+	if err := o.MarkPublished(recent); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := journalLines(t, path); lines != 7 {
+		t.Fatalf("journal has %d lines before compaction, want 7", lines)
+	}
+
+	if err := o.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Published and failed operations past the retention are gone, pending ones stay
+	for _, id := range []string{published, failed} {
+		if _, err := o.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%s) error = %v, want ErrNotFound", id, err)
+		}
+	}
+	for _, id := range []string{pending, recent} {
+		if _, err := o.Get(id); err != nil {
+			t.Errorf("Get(%s) error = %v", id, err)
+		}
+	}
+
+	if lines := journalLines(t, path); lines != 2 {
+		t.Errorf("journal has %d lines after compaction, want 2", lines)
+	}
+
+	// The compacted journal is appended to
+	if err := o.MarkPublished(pending); err != nil {
+		t.Fatal(err)
+	}
+	o.Close()
+
+	reopened, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if operation, err := reopened.Get(pending); err != nil || operation.Status != StatusPublished {
+		t.Errorf("reopened operation = %+v, %v", operation, err)
+	}
+	if len(reopened.Pending()) != 0 {
+		t.Errorf("pending after reopening = %v", ids(reopened.Pending()))
+	}
+}
+
+func TestReplayPendingOrder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+
+	o, err := Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		want = append(want, enqueue(t, o, key))
+	}
+	o.Close()
+
+	o, err = Open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	got := ids(o.Pending())
+	for i := range want {
+		if i >= len(got) || got[i] != want[i] {
+			t.Fatalf("pending after replay = %v, want %v", got, want)
+		}
+	}
+}
+
+func ids(operations []Operation) []string {
+	ids := make([]string, len(operations))
+	for i, operation := range operations {
+		ids[i] = operation.ID
+	}
+
+	return ids
+}
@@ -0,0 +1,168 @@
+package outbox
+
+import (
+	"bus"
+	"context"
+	"errors"
+	"gwapi/internal/breaker"
+	"gwapi/internal/lib/logger/sl"
+	"log/slog"
+	"time"
+)
+
+// Relay publishes pending operations from the outbox in batches of up to batchSize,
+// retrying failed publishes with exponential backoff. Operations sharing a key are
+// published in the order they were enqueued: while one is waiting for a retry the ones
+// behind it wait too. Operations of a key in the same batch go to the same partition and
+// are written together.
+type Relay struct {
+	log         *slog.Logger
+	outbox      *Outbox
+	publisher   Publisher
+	batchSize   int
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	retryAt     map[string]time.Time
+}
+
+// Publisher publishes a batch of operations. If only some of them failed the error is a
+// bus.PublishErrors indexed like operations, any other error applies to all of them.
+type Publisher interface {
+	Publish(ctx context.Context, operations ...Operation) error
+}
+
+func NewRelay(log *slog.Logger, outbox *Outbox, publisher Publisher, batchSize int, maxAttempts int, minBackoff time.Duration, maxBackoff time.Duration) *Relay {
+	return &Relay{
+		log:         log,
+		outbox:      outbox,
+		publisher:   publisher,
+		batchSize:   max(batchSize, 1),
+		maxAttempts: maxAttempts,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		retryAt:     map[string]time.Time{},
+	}
+}
+
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.minBackoff)
+	defer ticker.Stop()
+
+	for {
+		r.publishPending(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.outbox.Notify():
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Relay) publishPending(ctx context.Context) {
+	blocked := map[string]bool{}
+	now := time.Now()
+
+	batch := make([]Operation, 0, r.batchSize)
+
+	for _, operation := range r.outbox.Pending() {
+		if blocked[operation.Key] || now.Before(r.retryAt[operation.ID]) {
+			blocked[operation.Key] = true
+			continue
+		}
+
+		batch = append(batch, operation)
+		if len(batch) < r.batchSize {
+			continue
+		}
+
+		if !r.publish(ctx, batch, blocked, now) {
+			return
+		}
+		batch = batch[:0]
+	}
+
+	if len(batch) > 0 {
+		r.publish(ctx, batch, blocked, now)
+	}
+}
+
+// publish publishes a batch and records the outcome of every operation. Keys of operations
+// that failed are added to blocked. It returns false if the pass should stop.
+func (r *Relay) publish(ctx context.Context, batch []Operation, blocked map[string]bool, now time.Time) bool {
+	const op = "outbox.Relay.publish"
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	err := r.publisher.Publish(ctx, batch...)
+
+	// The brokers are failing or busy, nothing was attempted and the rest of the pass
+	// would be rejected as well
+	var rejected *breaker.RejectedError
+	if errors.As(err, &rejected) {
+		r.log.Debug("publishing paused", slog.String("op", op), sl.Err(err))
+		return false
+	}
+
+	var publishErrs bus.PublishErrors
+	errors.As(err, &publishErrs)
+
+	published := make([]string, 0, len(batch))
+
+	for i, operation := range batch {
+		operationErr := err
+		if publishErrs != nil {
+			operationErr = publishErrs[i]
+		}
+
+		if operationErr == nil {
+			delete(r.retryAt, operation.ID)
+			published = append(published, operation.ID)
+			continue
+		}
+
+		attempts := operation.Attempts + 1
+		final := attempts >= r.maxAttempts
+
+		r.log.Warn("failed to publish operation",
+			slog.String("op", op),
+			slog.String("operation_id", operation.ID),
+			slog.Int("attempt", attempts),
+			slog.Bool("final", final),
+			sl.Err(operationErr),
+		)
+
+		if err := r.outbox.MarkFailedAttempt(operation.ID, operationErr, final); err != nil {
+			r.log.Error("failed to record publish attempt", slog.String("op", op), slog.String("operation_id", operation.ID), sl.Err(err))
+		}
+
+		if final {
+			delete(r.retryAt, operation.ID)
+			continue
+		}
+
+		r.retryAt[operation.ID] = now.Add(r.backoff(attempts))
+		blocked[operation.Key] = true
+	}
+
+	if len(published) > 0 {
+		if err := r.outbox.MarkPublished(published...); err != nil {
+			r.log.Error("failed to mark operations published", slog.String("op", op), slog.Int("count", len(published)), sl.Err(err))
+		}
+	}
+
+	return true
+}
+
+func (r *Relay) backoff(attempts int) time.Duration {
+	backoff := r.minBackoff
+	for i := 1; i < attempts && backoff < r.maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, r.maxBackoff)
+}
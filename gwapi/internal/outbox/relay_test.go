@@ -0,0 +1,238 @@
+package outbox
+
+import (
+	"bus"
+	"context"
+	"errors"
+	"fmt"
+	"gwapi/internal/breaker"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakePublisher publishes after latency, the round trip to the brokers. Operations in
+// fail are not published.
+type fakePublisher struct {
+	latency time.Duration
+	fail    map[string]error
+	err     error
+
+	batches   [][]string
+	published []string
+}
+
+func (f *fakePublisher) Publish(ctx context.Context, operations ...Operation) error {
+	time.Sleep(f.latency)
+
+	if f.err != nil {
+		return f.err
+	}
+
+	var ids []string
+	errs := make(bus.PublishErrors, len(operations))
+	failed := false
+
+	for i, operation := range operations {
+		ids = append(ids, operation.ID)
+
+		if err := f.fail[operation.ID]; err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		f.published = append(f.published, operation.ID)
+	}
+	f.batches = append(f.batches, ids)
+
+	if failed {
+		return errs
+	}
+
+	return nil
+}
+
+func openTestOutbox(tb testing.TB) *Outbox {
+	tb.Helper()
+
+	o, err := Open(filepath.Join(tb.TempDir(), "outbox.jsonl"), time.Hour)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { o.Close() })
+
+	return o
+}
+
+func enqueue(tb testing.TB, o *Outbox, key string) string {
+	tb.Helper()
+
+	operation, err := o.Enqueue("invoices", "invoice", key, "", []byte(`{}`))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return operation.ID
+}
+
+func newTestRelay(o *Outbox, p Publisher, batchSize int) *Relay {
+	return NewRelay(slog.New(slog.NewTextHandler(io.Discard, nil)), o, p, batchSize, 3, time.Minute, time.Hour)
+}
+
+func status(t *testing.T, o *Outbox, id string) Operation {
+	t.Helper()
+
+	operation, err := o.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return operation
+}
+
+func TestRelayPublishesInBatches(t *testing.T) {
+	o := openTestOutbox(t)
+	p := &fakePublisher{}
+
+	for i := 0; i < 25; i++ {
+		enqueue(t, o, fmt.Sprintf("w-%d", i%3))
+	}
+
+	newTestRelay(o, p, 10).publishPending(context.Background())
+
+	if len(p.batches) != 3 || len(p.batches[0]) != 10 || len(p.batches[2]) != 5 {
+		t.Errorf("batches of %v, want 10, 10 and 5", batchSizes(p.batches))
+	}
+	if len(o.Pending()) != 0 {
+		t.Errorf("%d operations pending", len(o.Pending()))
+	}
+	if operation := status(t, o, p.published[0]); operation.Status != StatusPublished || operation.Attempts != 1 || operation.PublishedAt == nil {
+		t.Errorf("operation = %+v", operation)
+	}
+}
+
+func TestRelayPartialFailure(t *testing.T) {
+	o := openTestOutbox(t)
+
+	a1 := enqueue(t, o, "a")
+	b1 := enqueue(t, o, "b")
+	a2 := enqueue(t, o, "a")
+	c1 := enqueue(t, o, "c")
+
+	p := &fakePublisher{fail: map[string]error{a1: errors.New("not enough replicas")}}
+
+	newTestRelay(o, p, 2).publishPending(context.Background())
+
+	// a2 waits behind a1, which failed in the first batch
+	if len(p.batches) != 2 || len(p.batches[1]) != 1 || p.batches[1][0] != c1 {
+		t.Errorf("batches %v, want [[a1 b1] [c1]]", p.batches)
+	}
+
+	if operation := status(t, o, a1); operation.Status != StatusPending || operation.Attempts != 1 || operation.LastError != "not enough replicas" {
+		t.Errorf("failed operation = %+v", operation)
+	}
+	if operation := status(t, o, a2); operation.Status != StatusPending || operation.Attempts != 0 {
+		t.Errorf("operation behind it = %+v", operation)
+	}
+	for _, id := range []string{b1, c1} {
+		if operation := status(t, o, id); operation.Status != StatusPublished {
+			t.Errorf("operation = %+v", operation)
+		}
+	}
+}
+
+func TestRelayFailedBatch(t *testing.T) {
+	o := openTestOutbox(t)
+
+	first := enqueue(t, o, "a")
+	second := enqueue(t, o, "b")
+
+	p := &fakePublisher{err: errors.New("leader not available")}
+	relay := newTestRelay(o, p, 10)
+
+	relay.publishPending(context.Background())
+
+	for _, id := range []string{first, second} {
+		if operation := status(t, o, id); operation.Status != StatusPending || operation.Attempts != 1 {
+			t.Errorf("operation = %+v", operation)
+		}
+	}
+
+	// Both wait for their backoff
+	relay.publishPending(context.Background())
+	if len(p.batches) != 0 {
+		t.Errorf("published %v during the backoff", p.batches)
+	}
+}
+
+func TestRelayRejected(t *testing.T) {
+	o := openTestOutbox(t)
+
+	id := enqueue(t, o, "a")
+
+	p := &fakePublisher{err: &breaker.RejectedError{Name: "kafka", Err: breaker.ErrOpen, RetryAfter: time.Second}}
+
+	newTestRelay(o, p, 10).publishPending(context.Background())
+
+	// Nothing was attempted, the operation is published on the next pass without a backoff
+	if operation := status(t, o, id); operation.Attempts != 0 || operation.Status != StatusPending {
+		t.Errorf("operation = %+v", operation)
+	}
+}
+
+func TestRelayLastAttempt(t *testing.T) {
+	o := openTestOutbox(t)
+
+	id := enqueue(t, o, "a")
+
+	p := &fakePublisher{fail: map[string]error{id: errors.New("message too large")}}
+	relay := newTestRelay(o, p, 10)
+
+	for i := 0; i < 3; i++ {
+		relay.publishPending(context.Background())
+		delete(relay.retryAt, id)
+	}
+
+	if operation := status(t, o, id); operation.Status != StatusFailed || operation.Attempts != 3 {
+		t.Errorf("operation = %+v", operation)
+	}
+	if len(o.Pending()) != 0 {
+		t.Error("failed operation is still pending")
+	}
+}
+
+func batchSizes(batches [][]string) []int {
+	sizes := make([]int, len(batches))
+	for i, batch := range batches {
+		sizes[i] = len(batch)
+	}
+
+	return sizes
+}
+
+// BenchmarkRelay publishes 100 operations per iteration to brokers a millisecond away.
+func BenchmarkRelay(b *testing.B) {
+	for _, batchSize := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			o := openTestOutbox(b)
+			p := &fakePublisher{latency: time.Millisecond}
+			relay := newTestRelay(o, p, batchSize)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < 100; j++ {
+					enqueue(b, o, fmt.Sprintf("w-%d", j%10))
+				}
+				b.StartTimer()
+
+				relay.publishPending(context.Background())
+			}
+
+			b.ReportMetric(float64(len(p.published))/b.Elapsed().Seconds(), "ops/s")
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package publisher
+
+import (
+	"bus"
+	"bus/pb"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gwapi/internal/breaker"
+	"gwapi/internal/lib/envelope"
+	"gwapi/internal/lib/iwrequest"
+	"gwapi/internal/outbox"
+)
+
+const (
+	// HeaderOperationID carries the outbox operation ID to billing.
+	HeaderOperationID = "operation-id"
+	// HeaderActor carries the caller the operation is made for to billing's audit log.
+	HeaderActor = "actor"
+)
+
+// Publisher delivers outbox operations to their topic.
+type Publisher struct {
+	publisher   bus.Publisher
+	contentType string
+	breaker     *breaker.Breaker
+}
+
+// New publishes messages encoded as contentType, envelope.ContentTypeJSON or
+// envelope.ContentTypeProtobuf. Publishing goes through the breaker, which rejects it
+// while the brokers are failing.
+func New(publisher bus.Publisher, contentType string, b *breaker.Breaker) *Publisher {
+	return &Publisher{
+		publisher:   publisher,
+		contentType: contentType,
+		breaker:     b,
+	}
+}
+
+// Publish publishes the operations in one call to the bus. If only some of them failed,
+// including ones that could not be encoded, the error is a bus.PublishErrors indexed like
+// operations.
+func (p *Publisher) Publish(ctx context.Context, operations ...outbox.Operation) error {
+	const op = "publisher.Publish"
+
+	errs := make(bus.PublishErrors, len(operations))
+	failed := false
+
+	messages := make([]bus.Message, 0, len(operations))
+	// indexes holds the index in operations of each message
+	indexes := make([]int, 0, len(operations))
+
+	for i, operation := range operations {
+		message, err := p.message(operation)
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+
+		messages = append(messages, message)
+		indexes = append(indexes, i)
+	}
+
+	if len(messages) > 0 {
+		err := p.breaker.Do(func() error {
+			return p.publisher.Publish(ctx, messages...)
+		})
+
+		var publishErrs bus.PublishErrors
+		switch {
+		case err == nil:
+		case errors.As(err, &publishErrs):
+			for i, publishErr := range publishErrs {
+				errs[indexes[i]] = publishErr
+			}
+			failed = true
+		case !failed:
+			// Every operation failed the same way
+			return fmt.Errorf("%s: %w", op, err)
+		default:
+			for _, i := range indexes {
+				errs[i] = err
+			}
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("%s: %w", op, errs)
+	}
+
+	return nil
+}
+
+// message returns the message an operation is published as.
+func (p *Publisher) message(operation outbox.Operation) (bus.Message, error) {
+	value, contentType, err := p.encode(operation)
+	if err != nil {
+		return bus.Message{}, err
+	}
+
+	message := bus.Message{
+		Topic: operation.Topic,
+		Key:   []byte(operation.Key),
+		Value: value,
+		Headers: []bus.Header{
+			{Key: HeaderOperationID, Value: []byte(operation.ID)},
+			{Key: envelope.HeaderContentType, Value: []byte(contentType)},
+		},
+	}
+
+	if operation.Actor != "" {
+		message.Headers = append(message.Headers, bus.Header{Key: HeaderActor, Value: []byte(operation.Actor)})
+	}
+
+	return message, nil
+}
+
+// encode wraps the payload in the envelope and returns it with its content type.
+// Operations that were enqueued before the envelope was introduced have no type and are
+// published as bare JSON.
+func (p *Publisher) encode(operation outbox.Operation) ([]byte, string, error) {
+	if operation.Type == "" {
+		return operation.Payload, envelope.ContentTypeJSON, nil
+	}
+
+	// The command was produced when it was enqueued, retries don't change that
+	env := envelope.New(operation.ID, operation.Type, operation.ID, operation.CreatedAt, operation.Payload)
+
+	if p.contentType != envelope.ContentTypeProtobuf {
+		value, err := json.Marshal(env)
+		return value, envelope.ContentTypeJSON, err
+	}
+
+	// The outbox keeps payloads as JSON, they are converted when they are published
+	var request iwrequest.IWRequest
+	if err := json.Unmarshal(operation.Payload, &request); err != nil {
+		return nil, "", err
+	}
+
+	payload := pb.Command{
+		WalletID: request.WalletID,
+		Currency: request.Currency,
+		Amount:   request.Amount,
+	}
+
+	value := (&pb.Envelope{
+		ID:            env.ID,
+		Type:          env.Type,
+		Version:       env.Version,
+		ProducedAt:    env.ProducedAt,
+		CorrelationID: env.CorrelationID,
+		Payload:       payload.Marshal(),
+	}).Marshal()
+
+	return value, envelope.ContentTypeProtobuf, nil
+}
@@ -0,0 +1,159 @@
+package publisher
+
+import (
+	"bus"
+	"bus/memory"
+	"context"
+	"encoding/json"
+	"errors"
+	"gwapi/internal/breaker"
+	"gwapi/internal/lib/envelope"
+	"gwapi/internal/outbox"
+	"testing"
+	"time"
+)
+
+func TestPublishHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		actor     string
+		wantActor bool
+	}{
+		{"with actor", "jwt:alice", true},
+		{"without actor", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := memory.New(1)
+			defer b.Close()
+
+			sub := b.Subscribe("invoices", "test")
+			defer sub.Close()
+
+			p := New(b, envelope.ContentTypeJSON, breaker.New("kafka", breaker.Config{}, nil))
+
+			operation := outbox.Operation{
+				ID:      "op-1",
+				Topic:   "invoices",
+				Type:    envelope.TypeInvoice,
+				Key:     "w-1",
+				Actor:   tt.actor,
+				Payload: []byte(`{"wallet_id":"w-1","currency":"USD","amount":1}`),
+			}
+
+			if err := p.Publish(context.Background(), operation); err != nil {
+				t.Fatalf("Publish() error = %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			m, err := sub.Fetch(ctx)
+			if err != nil {
+				t.Fatalf("Fetch() error = %v", err)
+			}
+
+			if got := m.Header(HeaderOperationID); got != "op-1" {
+				t.Errorf("%s = %q, want op-1", HeaderOperationID, got)
+			}
+			if got := m.Header(envelope.HeaderContentType); got != envelope.ContentTypeJSON {
+				t.Errorf("%s = %q, want %s", envelope.HeaderContentType, got, envelope.ContentTypeJSON)
+			}
+
+			got := m.Header(HeaderActor)
+			if tt.wantActor && got != tt.actor {
+				t.Errorf("%s = %q, want %q", HeaderActor, got, tt.actor)
+			}
+
+			for _, h := range m.Headers {
+				if !tt.wantActor && h.Key == HeaderActor {
+					t.Errorf("%s header set for an operation without actor", HeaderActor)
+				}
+			}
+		})
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	b := memory.New(1)
+	defer b.Close()
+
+	sub := b.Subscribe("invoices", "test")
+	defer sub.Close()
+
+	p := New(b, envelope.ContentTypeProtobuf, breaker.New("kafka", breaker.Config{}, nil))
+
+	operations := []outbox.Operation{
+		{ID: "op-1", Topic: "invoices", Type: envelope.TypeInvoice, Key: "w-1", Payload: []byte(`{"wallet_id":"w-1","currency":"USD","amount":1}`)},
+		// The payload can't be converted to protobuf
+		{ID: "op-2", Topic: "invoices", Type: envelope.TypeInvoice, Key: "w-2", Payload: []byte(`{"amount":"one"}`)},
+		{ID: "op-3", Topic: "invoices", Type: envelope.TypeInvoice, Key: "w-1", Payload: []byte(`{"wallet_id":"w-1","currency":"USD","amount":2}`)},
+	}
+
+	err := p.Publish(context.Background(), operations...)
+
+	var errs bus.PublishErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Publish() error = %v, want bus.PublishErrors", err)
+	}
+	if len(errs) != 3 || errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("errors = %v, want only op-2 failed", errs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, want := range []string{"op-1", "op-3"} {
+		m, err := sub.Fetch(ctx)
+		if err != nil {
+			t.Fatalf("Fetch() error = %v", err)
+		}
+		if got := m.Header(HeaderOperationID); got != want {
+			t.Errorf("published %s, want %s", got, want)
+		}
+	}
+}
+
+func TestProducedAt(t *testing.T) {
+	b := memory.New(1)
+	defer b.Close()
+
+	sub := b.Subscribe("invoices", "test")
+	defer sub.Close()
+
+	p := New(b, envelope.ContentTypeJSON, breaker.New("kafka", breaker.Config{}, nil))
+
+	enqueued := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	operation := outbox.Operation{
+		ID:        "op-1",
+		Topic:     "invoices",
+		Type:      envelope.TypeInvoice,
+		Key:       "w-1",
+		Payload:   []byte(`{"wallet_id":"w-1","currency":"USD","amount":1}`),
+		CreatedAt: enqueued,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// A retry is produced at the same time as the first attempt
+	for i := 0; i < 2; i++ {
+		if err := p.Publish(ctx, operation); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := sub.Fetch(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var env envelope.Envelope
+		if err := json.Unmarshal(m.Value, &env); err != nil {
+			t.Fatal(err)
+		}
+		if !env.ProducedAt.Equal(enqueued) {
+			t.Errorf("produced_at = %s, want %s", env.ProducedAt, enqueued)
+		}
+	}
+}
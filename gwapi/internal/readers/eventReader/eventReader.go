@@ -0,0 +1,161 @@
+package eventReader
+
+import (
+	"bus"
+	"bus/pb"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	br "gwapi/internal/lib/balance"
+	"gwapi/internal/lib/envelope"
+	"gwapi/internal/lib/event"
+	"gwapi/internal/lib/logger/sl"
+	"gwapi/internal/outbox"
+	"log/slog"
+	"time"
+)
+
+const recordRetryInterval = time.Second
+
+// EventReader records billing's transaction events on the operations they belong to and
+// hands them to the live streams of their wallet.
+type EventReader struct {
+	log            *slog.Logger
+	resultRecorder ResultRecorder
+	broadcaster    Broadcaster
+	subscriber     bus.Subscriber
+	topic          string
+	groupID        string
+}
+
+type ResultRecorder interface {
+	RecordResult(id string, result []byte) error
+}
+
+type Broadcaster interface {
+	Publish(partition int, offset int64, e event.Event)
+}
+
+// New reads the events from topic as consumer group groupID.
+func New(log *slog.Logger, resultRecorder ResultRecorder, broadcaster Broadcaster, subscriber bus.Subscriber, topic string, groupID string) *EventReader {
+	return &EventReader{
+		log:            log,
+		resultRecorder: resultRecorder,
+		broadcaster:    broadcaster,
+		subscriber:     subscriber,
+		topic:          topic,
+		groupID:        groupID,
+	}
+}
+
+func (r *EventReader) Read(ctx context.Context) {
+	const op = "eventReader.Read"
+
+	log := r.log.With(slog.String("op", op))
+
+	subscription := r.subscriber.Subscribe(r.topic, r.groupID)
+	defer subscription.Close()
+
+	for {
+		message, err := subscription.Fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Error("failed to read event", sl.Err(err))
+			continue
+		}
+
+		e, err := decode(message)
+		if err != nil {
+			log.Error("skipping undecodable event", slog.Int64("offset", message.Offset), sl.Err(err))
+		} else {
+			if e.OperationID != "" && !r.record(ctx, log, e) {
+				return
+			}
+
+			r.broadcaster.Publish(message.Partition, message.Offset, e)
+		}
+
+		if err := subscription.Commit(ctx, message); err != nil {
+			log.Error("failed to commit event", slog.Int64("offset", message.Offset), sl.Err(err))
+		}
+	}
+}
+
+// record stores the event on its operation, retrying until it is stored or ctx is done.
+// Events of operations that were published by another gwapi instance or that expired from
+// the outbox are skipped.
+func (r *EventReader) record(ctx context.Context, log *slog.Logger, e event.Event) bool {
+	// Results are kept as JSON whatever encoding billing published them in
+	value, err := json.Marshal(e)
+	if err != nil {
+		log.Error("failed to encode event", slog.String("operation_id", e.OperationID), sl.Err(err))
+		return true
+	}
+
+	for {
+		err := r.resultRecorder.RecordResult(e.OperationID, value)
+		if err == nil || errors.Is(err, outbox.ErrNotFound) {
+			return true
+		}
+
+		log.Error("failed to record event", slog.String("operation_id", e.OperationID), sl.Err(err))
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(recordRetryInterval):
+		}
+	}
+}
+
+// decode decodes the event by its content-type header.
+func decode(message bus.Message) (event.Event, error) {
+	contentType := message.Header(envelope.HeaderContentType)
+
+	var e event.Event
+
+	switch contentType {
+	case "", envelope.ContentTypeJSON:
+		err := json.Unmarshal(message.Value, &e)
+		return e, err
+	case envelope.ContentTypeProtobuf:
+	default:
+		return e, fmt.Errorf("unknown content type %q", contentType)
+	}
+
+	var m pb.TransactionResult
+	if err := m.Unmarshal(message.Value); err != nil {
+		return e, err
+	}
+
+	e = event.Event{
+		Type:            m.Type,
+		OperationID:     m.OperationID,
+		WalletID:        m.WalletID,
+		TransactionID:   int(m.TransactionID),
+		TransactionType: m.TransactionType,
+		Currency:        m.Currency,
+		Amount:          m.Amount,
+		Status:          m.Status,
+		Error:           m.Error,
+		OccurredAt:      m.OccurredAt,
+	}
+
+	if !m.DateCreated.IsZero() {
+		e.DateCreated = &m.DateCreated
+	}
+
+	if m.Balance != nil {
+		e.Balance = &br.BalanceEntry{
+			WalletID:     m.Balance.WalletID,
+			Currency:     m.Balance.Currency,
+			Amount:       m.Balance.Amount,
+			FrozenAmount: m.Balance.FrozenAmount,
+		}
+	}
+
+	return e, nil
+}
@@ -3,194 +3,340 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"gwapi/internal/auth"
+	"gwapi/internal/billing"
 	"gwapi/internal/config"
 	br "gwapi/internal/lib/balance"
+	"gwapi/internal/lib/envelope"
+	"gwapi/internal/lib/event"
 	"gwapi/internal/lib/iwrequest"
+	opr "gwapi/internal/lib/operation"
+	st "gwapi/internal/lib/statement"
 	ts "gwapi/internal/lib/transaction"
 	wl "gwapi/internal/lib/wallet"
-	"io"
+	"gwapi/internal/outbox"
 	"log/slog"
-	"net/http"
+	"sync"
+	"time"
+)
+
+// maxCachedAccounts bounds the wallet accounts kept for ownership checks.
+const maxCachedAccounts = 100000
 
-	"github.com/segmentio/kafka-go"
+var (
+	// ErrWalletNotFound is returned by sync commands for a wallet or currency billing
+	// doesn't know, and by WalletAccount for an unknown wallet.
+	ErrWalletNotFound = errors.New("wallet not found")
+	// ErrAccountHasWallet is returned by Wallet for an account that has a wallet already.
+	ErrAccountHasWallet = errors.New("account has a wallet already")
 )
 
 type Service struct {
-	log *slog.Logger
+	log            *slog.Logger
+	commandOutbox  CommandOutbox
+	billingClient  BillingClient
+	commandTimeout time.Duration
+	invoiceTopic   string
+	withdrawTopic  string
+
+	accountsMu sync.Mutex
+	accounts   map[string]string
+}
+
+type CommandOutbox interface {
+	Enqueue(topic string, messageType string, key string, actor string, payload []byte) (outbox.Operation, error)
+	Get(id string) (outbox.Operation, error)
+}
+
+type BillingClient interface {
+	CreateWallet(ctx context.Context, accountID string) (wl.WalletResponse, error)
+	Wallet(ctx context.Context, walletID string) (wl.WalletResponse, error)
+	Balance(ctx context.Context, walletID string) (br.BalanceResponse, error)
+	Transaction(ctx context.Context, id string) (ts.TransactionResponse, error)
+	Operation(ctx context.Context, operationID string) (ts.TransactionResponse, error)
+	Apply(ctx context.Context, path string, operationID string, request iwrequest.IWRequest) (opr.CommandResponse, error)
+	Statement(ctx context.Context, walletID string, from string, to string, format string) (st.StatementResponse, error)
 }
 
-func New(log *slog.Logger, cfg config.Config) *Service {
+func New(log *slog.Logger, cfg config.Config, commandOutbox CommandOutbox, billingClient BillingClient) *Service {
 	return &Service{
-		log: log,
+		log:            log,
+		commandOutbox:  commandOutbox,
+		billingClient:  billingClient,
+		commandTimeout: cfg.Commands.Timeout,
+		invoiceTopic:   cfg.Commands.InvoiceTopic,
+		withdrawTopic:  cfg.Commands.WithdrawTopic,
+		accounts:       map[string]string{},
 	}
 }
 
-func (s *Service) Wallet() (wl.WalletResponse, error) {
+// Wallet creates a wallet for the account, or for a new account if accountID is empty.
+func (s *Service) Wallet(ctx context.Context, accountID string) (wl.WalletResponse, error) {
 	const op = "service.Wallet"
 
-	var result wl.WalletResponse
-
-	url := "http://billing:8081/wallet"
-
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", url, nil)
+	result, err := s.billingClient.CreateWallet(ctx, accountID)
+	if errors.Is(err, billing.ErrConflict) {
+		return wl.WalletResponse{}, fmt.Errorf("%s: %w", op, ErrAccountHasWallet)
+	}
 	if err != nil {
 		return wl.WalletResponse{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	fmt.Println("0")
+	return result, nil
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return wl.WalletResponse{}, fmt.Errorf("%s: %w", op, err)
+// WalletAccount returns the account the wallet belongs to. Wallets never change their
+// account, so the answers of billing are kept.
+func (s *Service) WalletAccount(ctx context.Context, walletID string) (string, error) {
+	const op = "service.WalletAccount"
+
+	s.accountsMu.Lock()
+	accountID, ok := s.accounts[walletID]
+	s.accountsMu.Unlock()
+
+	if ok {
+		return accountID, nil
 	}
-	defer resp.Body.Close()
 
-	fmt.Println("1")
-	body, err := io.ReadAll(resp.Body)
+	wallet, err := s.billingClient.Wallet(ctx, walletID)
+	if errors.Is(err, billing.ErrNotFound) {
+		return "", fmt.Errorf("%s: %w", op, ErrWalletNotFound)
+	}
 	if err != nil {
-		return wl.WalletResponse{}, fmt.Errorf("%s: %w", op, err)
+		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	fmt.Println("2")
-	err = json.Unmarshal(body, &result)
-	if err != nil {
-		return wl.WalletResponse{}, fmt.Errorf("%s: %w", op, err)
+	s.accountsMu.Lock()
+	if len(s.accounts) >= maxCachedAccounts {
+		clear(s.accounts)
 	}
+	s.accounts[walletID] = wallet.AccountID
+	s.accountsMu.Unlock()
 
-	fmt.Println("3")
-	return result, nil
+	return wallet.AccountID, nil
 }
 
-func (s *Service) Balance(wallet_id string) (br.BalanceResponse, error) {
+func (s *Service) Balance(ctx context.Context, walletID string) (br.BalanceResponse, error) {
 	const op = "service.Balance"
 
-	url := "http://billing:8081/balance/" + wallet_id
-
-	var result br.BalanceResponse
-
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", url, nil)
+	result, err := s.billingClient.Balance(ctx, walletID)
 	if err != nil {
 		return br.BalanceResponse{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return br.BalanceResponse{}, fmt.Errorf("%s: %w", op, err)
-	}
-	defer resp.Body.Close()
+	return result, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// Invoice records the invoice in the outbox and returns the operation ID. The command is
+// published to Kafka by the outbox relay.
+func (s *Service) Invoice(ctx context.Context, walletID string, currency string, amount float64) (string, error) {
+	const op = "service.Invoice"
+
+	id, err := s.enqueue(ctx, s.invoiceTopic, envelope.TypeInvoice, walletID, currency, amount)
 	if err != nil {
-		return br.BalanceResponse{}, fmt.Errorf("%s: %w", op, err)
+		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = json.Unmarshal(body, &result)
+	return id, nil
+}
+
+// Withdraw records the withdrawal in the outbox and returns the operation ID. The command
+// is published to Kafka by the outbox relay.
+func (s *Service) Withdraw(ctx context.Context, walletID string, currency string, amount float64) (string, error) {
+	const op = "service.Withdraw"
+
+	id, err := s.enqueue(ctx, s.withdrawTopic, envelope.TypeWithdraw, walletID, currency, amount)
 	if err != nil {
-		return br.BalanceResponse{}, fmt.Errorf("%s: %w", op, err)
+		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	return result, nil
+	return id, nil
 }
 
-func (s *Service) Invoice(walletID string, currency string, amount float64) error {
-	const op = "service.Invoice"
-
+func (s *Service) enqueue(ctx context.Context, topic string, messageType string, walletID string, currency string, amount float64) (string, error) {
 	value := iwrequest.IWRequest{
 		WalletID: walletID,
 		Currency: currency,
 		Amount:   amount,
 	}
 
-	invoiceWriter := &kafka.Writer{
-		Addr:     kafka.TCP("kafka:9093"),
-		Topic:    "invoices",
-		Balancer: &kafka.LeastBytes{},
+	jsonValue, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal struct to JSON: %w", err)
 	}
 
-	jsonValue, err := json.Marshal(value)
+	// The caller is kept with the operation, the relay publishes it long after the request
+	var actor string
+	if p, ok := auth.FromContext(ctx); ok {
+		actor = p.Actor()
+	}
+
+	// Keyed by wallet, so that the commands of a wallet land on one partition and are
+	// applied in order
+	operation, err := s.commandOutbox.Enqueue(topic, messageType, walletID, actor, jsonValue)
 	if err != nil {
-		return fmt.Errorf("%s: failed to marshal struct to JSON: %w", op, err)
+		return "", err
 	}
 
-	message := kafka.Message{
-		Key:   []byte("invoice-key"),
-		Value: []byte(jsonValue),
+	return operation.ID, nil
+}
+
+// InvoiceSync has billing apply the invoice over HTTP and returns the recorded
+// transaction, bypassing the outbox and Kafka.
+func (s *Service) InvoiceSync(ctx context.Context, walletID string, currency string, amount float64) (opr.CommandResponse, error) {
+	const op = "service.InvoiceSync"
+
+	result, err := s.applySync(ctx, "/invoice", walletID, currency, amount)
+	if err != nil {
+		return opr.CommandResponse{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = invoiceWriter.WriteMessages(context.Background(), message)
+	return result, nil
+}
+
+// WithdrawSync has billing apply the withdrawal over HTTP and returns the recorded
+// transaction, bypassing the outbox and Kafka.
+func (s *Service) WithdrawSync(ctx context.Context, walletID string, currency string, amount float64) (opr.CommandResponse, error) {
+	const op = "service.WithdrawSync"
+
+	result, err := s.applySync(ctx, "/withdraw", walletID, currency, amount)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return opr.CommandResponse{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return nil
+	return result, nil
 }
 
-func (s *Service) Withdraw(walletID string, currency string, amount float64) error {
-	const op = "service.Withdraw"
+// applySync posts the command to billing with a new operation ID, which billing uses to
+// apply it at most once.
+func (s *Service) applySync(ctx context.Context, path string, walletID string, currency string, amount float64) (opr.CommandResponse, error) {
+	operationID, err := outbox.NewID()
+	if err != nil {
+		return opr.CommandResponse{}, err
+	}
 
-	value := iwrequest.IWRequest{
+	ctx, cancel := context.WithTimeout(ctx, s.commandTimeout)
+	defer cancel()
+
+	result, err := s.billingClient.Apply(ctx, path, operationID, iwrequest.IWRequest{
 		WalletID: walletID,
 		Currency: currency,
 		Amount:   amount,
+	})
+	if errors.Is(err, billing.ErrNotFound) {
+		return opr.CommandResponse{}, ErrWalletNotFound
 	}
-
-	withdrawWriter := &kafka.Writer{
-		Addr:     kafka.TCP("kafka:9093"),
-		Topic:    "withdraws",
-		Balancer: &kafka.LeastBytes{},
+	if err != nil {
+		return opr.CommandResponse{}, err
 	}
 
-	jsonValue, err := json.Marshal(value)
+	return result, nil
+}
+
+// Operation reports the delivery state of a command from the outbox and, once it was
+// delivered, its processing state from billing.
+func (s *Service) Operation(ctx context.Context, id string) (opr.OperationResponse, error) {
+	const op = "service.Operation"
+
+	operation, err := s.commandOutbox.Get(id)
 	if err != nil {
-		return fmt.Errorf("%s: failed to marshal struct to JSON: %w", op, err)
+		return opr.OperationResponse{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	message := kafka.Message{
-		Key:   []byte("invoice-key"),
-		Value: []byte(jsonValue),
+	result := opr.OperationResponse{
+		OperationID:      operation.ID,
+		WalletID:         operation.Key,
+		Topic:            operation.Topic,
+		DeliveryStatus:   operation.Status,
+		DeliveryAttempts: operation.Attempts,
+		LastError:        operation.LastError,
+		CreatedAt:        operation.CreatedAt,
+		PublishedAt:      operation.PublishedAt,
+		ProcessingStatus: opr.ProcessingPending,
 	}
 
-	err = withdrawWriter.WriteMessages(context.Background(), message)
-	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+	switch operation.Status {
+	case outbox.StatusFailed:
+		result.ProcessingStatus = opr.ProcessingNotDelivered
+		return result, nil
+	case outbox.StatusPending:
+		return result, nil
 	}
 
-	return nil
-}
+	if operation.Result != nil {
+		var e event.Event
+		if err := json.Unmarshal(operation.Result, &e); err != nil {
+			return opr.OperationResponse{}, fmt.Errorf("%s: %w", op, err)
+		}
 
-func (s *Service) Transaction(id string) (ts.TransactionResponse, error) {
-	const op = "service.Transaction"
+		applyEvent(&result, e)
 
-	var result ts.TransactionResponse
-
-	url := "http://billing:8081/transaction/" + id
+		return result, nil
+	}
 
-	client := &http.Client{}
+	// No event arrived yet, billing may have processed the operation all the same
+	transaction, err := s.billingClient.Operation(ctx, id)
 
-	req, err := http.NewRequest("GET", url, nil)
+	// billing answers 404 until it has processed the operation
+	if errors.Is(err, billing.ErrNotFound) {
+		return result, nil
+	}
 	if err != nil {
-		return ts.TransactionResponse{}, fmt.Errorf("%s: %w", op, err)
+		return opr.OperationResponse{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return ts.TransactionResponse{}, fmt.Errorf("%s: %w", op, err)
+	result.ProcessingStatus = opr.ProcessingCompleted
+	if transaction.Transaction.Status != "Success" {
+		result.ProcessingStatus = opr.ProcessingFailed
+	}
+	result.Transaction = &transaction.Transaction
+
+	return result, nil
+}
+
+func applyEvent(result *opr.OperationResponse, e event.Event) {
+	result.ProcessingStatus = opr.ProcessingCompleted
+	if e.Type == event.TypeFailed {
+		result.ProcessingStatus = opr.ProcessingFailed
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if e.TransactionID != 0 && e.DateCreated != nil {
+		result.Transaction = &ts.Transaction{
+			ID:          e.TransactionID,
+			WalletID:    e.WalletID,
+			Currency:    e.Currency,
+			Type:        e.TransactionType,
+			Status:      e.Status,
+			Amount:      e.Amount,
+			DateCreated: *e.DateCreated,
+		}
+	}
+
+	result.Balance = e.Balance
+	result.Error = e.Error
+}
+
+func (s *Service) Transaction(ctx context.Context, id string) (ts.TransactionResponse, error) {
+	const op = "service.Transaction"
+
+	result, err := s.billingClient.Transaction(ctx, id)
 	if err != nil {
 		return ts.TransactionResponse{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = json.Unmarshal(body, &result)
+	return result, nil
+}
+
+// Statement requests a wallet statement from billing. The body is not read here so that
+// large statements are streamed to the client as they are produced.
+func (s *Service) Statement(ctx context.Context, walletID string, from string, to string, format string) (st.StatementResponse, error) {
+	const op = "service.Statement"
+
+	result, err := s.billingClient.Statement(ctx, walletID, from, to, format)
 	if err != nil {
-		return ts.TransactionResponse{}, fmt.Errorf("%s: %w", op, err)
+		return st.StatementResponse{}, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return result, nil
@@ -0,0 +1,224 @@
+package stream
+
+import (
+	"fmt"
+	"gwapi/internal/lib/event"
+	"sync"
+	"time"
+)
+
+const subscriberBuffer = 64
+
+// Update is a transaction event of a wallet. Token identifies its position in the events
+// topic, a client passes the token of the last update it saw to resume after it.
+type Update struct {
+	Token string
+	Event event.Event
+}
+
+// Hub fans billing's transaction events out to the subscribers of their wallet and keeps
+// the latest events of every wallet, so that a client that reconnects misses nothing.
+//
+// Events of a wallet share a partition, so their offsets grow. The hub tracks from which
+// offset on it holds every event of a wallet; a token older than that can't be resumed.
+type Hub struct {
+	recentSize int
+	retention  time.Duration
+
+	mu        sync.Mutex
+	wallets   map[string]*wallet
+	partition map[int]int64
+	closed    bool
+	swept     time.Time
+}
+
+type wallet struct {
+	recent      []entry
+	completeAt  int64
+	subscribers map[*subscriber]struct{}
+	updatedAt   time.Time
+}
+
+type entry struct {
+	partition int
+	offset    int64
+	update    Update
+}
+
+type subscriber struct {
+	updates chan Update
+}
+
+// New keeps up to recentSize events per wallet. Wallets without subscribers are forgotten
+// retention after their last event.
+func New(recentSize int, retention time.Duration) *Hub {
+	return &Hub{
+		recentSize: max(recentSize, 1),
+		retention:  retention,
+		wallets:    map[string]*wallet{},
+		partition:  map[int]int64{},
+		swept:      time.Now(),
+	}
+}
+
+// Publish hands the event at partition and offset to the subscribers of its wallet. A
+// subscriber that can't keep up is disconnected and has to resume.
+func (h *Hub) Publish(partition int, offset int64, e event.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.partition[partition]; !ok {
+		h.partition[partition] = offset
+	}
+
+	w := h.wallet(e.WalletID)
+	switch {
+	case len(w.recent) == 0:
+		// Every event of the wallet since the hub started on the partition was this one
+		w.completeAt = h.partition[partition]
+	case w.recent[0].partition != partition:
+		// The topic was repartitioned, older tokens mean nothing any more
+		w.recent = nil
+		w.completeAt = offset
+	}
+
+	update := Update{Token: token(partition, offset), Event: e}
+
+	w.recent = append(w.recent, entry{partition: partition, offset: offset, update: update})
+	if len(w.recent) > h.recentSize {
+		w.completeAt = w.recent[0].offset + 1
+		w.recent = w.recent[1:]
+	}
+	w.updatedAt = time.Now()
+
+	for s := range w.subscribers {
+		select {
+		case s.updates <- update:
+		default:
+			delete(w.subscribers, s)
+			close(s.updates)
+		}
+	}
+
+	h.sweep()
+}
+
+// Subscribe returns the updates of the wallet after the token and a channel of the ones
+// that follow. resumed is false if the token is empty or too old, the client then has to
+// load the current balance. The channel is closed when the subscriber falls behind or the
+// hub is closed. cancel must be called once the client is gone.
+func (h *Hub) Subscribe(walletID string, after string) (missed []Update, updates <-chan Update, resumed bool, cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &subscriber{updates: make(chan Update, subscriberBuffer)}
+
+	if h.closed {
+		close(s.updates)
+		return nil, s.updates, false, func() {}
+	}
+
+	partition, offset, err := parseToken(after)
+	w := h.wallets[walletID]
+
+	if after != "" && err == nil {
+		completeAt, known := h.partition[partition]
+		if w != nil && len(w.recent) > 0 {
+			completeAt, known = w.completeAt, w.recent[0].partition == partition
+		}
+
+		// Every event after the token is still held
+		resumed = known && offset+1 >= completeAt
+	}
+
+	if w == nil {
+		w = h.wallet(walletID)
+	}
+
+	// A client that can't resume loads the current balance, older events would be stale
+	if resumed {
+		for _, e := range w.recent {
+			if e.offset > offset {
+				missed = append(missed, e.update)
+			}
+		}
+	}
+
+	w.subscribers[s] = struct{}{}
+
+	cancel = func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if _, ok := w.subscribers[s]; ok {
+			delete(w.subscribers, s)
+			close(s.updates)
+		}
+	}
+
+	return missed, s.updates, resumed, cancel
+}
+
+// Close disconnects every subscriber.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+
+	for _, w := range h.wallets {
+		for s := range w.subscribers {
+			delete(w.subscribers, s)
+			close(s.updates)
+		}
+	}
+}
+
+// wallet returns the wallet, creating it on first use. h.mu must be held.
+func (h *Hub) wallet(walletID string) *wallet {
+	w, ok := h.wallets[walletID]
+	if !ok {
+		w = &wallet{
+			subscribers: map[*subscriber]struct{}{},
+			updatedAt:   time.Now(),
+		}
+		h.wallets[walletID] = w
+	}
+
+	return w
+}
+
+// sweep forgets idle wallets once per retention. Tokens of the forgotten events can't
+// be resumed any more, so the partition is only complete after them. h.mu must be held.
+func (h *Hub) sweep() {
+	if time.Since(h.swept) < h.retention {
+		return
+	}
+	h.swept = time.Now()
+
+	for walletID, w := range h.wallets {
+		if len(w.subscribers) > 0 || time.Since(w.updatedAt) < h.retention {
+			continue
+		}
+
+		if n := len(w.recent); n > 0 {
+			last := w.recent[n-1]
+			h.partition[last.partition] = max(h.partition[last.partition], last.offset+1)
+		}
+
+		delete(h.wallets, walletID)
+	}
+}
+
+func token(partition int, offset int64) string {
+	return fmt.Sprintf("%d-%d", partition, offset)
+}
+
+func parseToken(token string) (int, int64, error) {
+	var partition int
+	var offset int64
+
+	_, err := fmt.Sscanf(token, "%d-%d", &partition, &offset)
+
+	return partition, offset, err
+}
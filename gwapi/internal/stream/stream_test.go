@@ -0,0 +1,308 @@
+package stream
+
+import (
+	"gwapi/internal/lib/event"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// published is an event of walletID at partition and offset.
+type published struct {
+	walletID  string
+	partition int
+	offset    int64
+}
+
+func publish(h *Hub, events []published) {
+	for _, p := range events {
+		h.Publish(p.partition, p.offset, event.Event{WalletID: p.walletID})
+	}
+}
+
+func tokens(updates []Update) []string {
+	var got []string
+	for _, u := range updates {
+		got = append(got, u.Token)
+	}
+
+	return got
+}
+
+func TestSubscribe(t *testing.T) {
+	tests := []struct {
+		name        string
+		recentSize  int
+		published   []published
+		walletID    string
+		after       string
+		wantResumed bool
+		wantMissed  []string
+	}{
+		{
+			name:        "no token",
+			recentSize:  10,
+			published:   []published{{"w-1", 0, 0}},
+			walletID:    "w-1",
+			wantResumed: false,
+		},
+		{
+			name:        "malformed token",
+			recentSize:  10,
+			published:   []published{{"w-1", 0, 0}},
+			walletID:    "w-1",
+			after:       "latest",
+			wantResumed: false,
+		},
+		{
+			name:        "up to date",
+			recentSize:  10,
+			published:   []published{{"w-1", 0, 0}, {"w-1", 0, 1}},
+			walletID:    "w-1",
+			after:       "0-1",
+			wantResumed: true,
+		},
+		{
+			name:        "missed range",
+			recentSize:  10,
+			published:   []published{{"w-1", 0, 0}, {"w-1", 0, 1}, {"w-2", 0, 2}, {"w-1", 0, 3}, {"w-1", 0, 4}},
+			walletID:    "w-1",
+			after:       "0-1",
+			wantResumed: true,
+			wantMissed:  []string{"0-3", "0-4"},
+		},
+		{
+			name:        "token of another wallet's event",
+			recentSize:  10,
+			published:   []published{{"w-1", 0, 0}, {"w-2", 0, 1}, {"w-1", 0, 2}},
+			walletID:    "w-1",
+			after:       "0-1",
+			wantResumed: true,
+			wantMissed:  []string{"0-2"},
+		},
+		{
+			name:        "oldest held event",
+			recentSize:  2,
+			published:   []published{{"w-1", 0, 0}, {"w-1", 0, 1}, {"w-1", 0, 2}, {"w-1", 0, 3}},
+			walletID:    "w-1",
+			after:       "0-1",
+			wantResumed: true,
+			wantMissed:  []string{"0-2", "0-3"},
+		},
+		{
+			name:        "expired token",
+			recentSize:  2,
+			published:   []published{{"w-1", 0, 0}, {"w-1", 0, 1}, {"w-1", 0, 2}, {"w-1", 0, 3}},
+			walletID:    "w-1",
+			after:       "0-0",
+			wantResumed: false,
+		},
+		{
+			name:        "token before the hub started",
+			recentSize:  10,
+			published:   []published{{"w-1", 0, 10}, {"w-1", 0, 11}},
+			walletID:    "w-1",
+			after:       "0-8",
+			wantResumed: false,
+		},
+		{
+			name:        "token right before the hub started",
+			recentSize:  10,
+			published:   []published{{"w-1", 0, 10}, {"w-1", 0, 11}},
+			walletID:    "w-1",
+			after:       "0-9",
+			wantResumed: true,
+			wantMissed:  []string{"0-10", "0-11"},
+		},
+		{
+			name:        "token of another partition",
+			recentSize:  10,
+			published:   []published{{"w-1", 0, 0}, {"w-1", 0, 9}, {"w-1", 1, 5}},
+			walletID:    "w-1",
+			after:       "0-9",
+			wantResumed: false,
+		},
+		{
+			name:        "wallet without events",
+			recentSize:  10,
+			published:   []published{{"w-2", 0, 10}, {"w-2", 0, 11}},
+			walletID:    "w-1",
+			after:       "0-9",
+			wantResumed: true,
+		},
+		{
+			name:        "baseline of the token's partition",
+			recentSize:  10,
+			published:   []published{{"w-2", 0, 10}, {"w-3", 1, 50}, {"w-2", 0, 11}, {"w-1", 1, 55}},
+			walletID:    "w-1",
+			after:       "1-49",
+			wantResumed: true,
+			wantMissed:  []string{"1-55"},
+		},
+		{
+			name:        "token before the baseline of its partition",
+			recentSize:  10,
+			published:   []published{{"w-2", 0, 10}, {"w-3", 1, 50}, {"w-2", 0, 11}, {"w-1", 1, 55}},
+			walletID:    "w-1",
+			after:       "1-20",
+			wantResumed: false,
+		},
+		{
+			name:        "unseen wallet on a partition with a later baseline",
+			recentSize:  10,
+			published:   []published{{"w-2", 0, 10}, {"w-3", 1, 50}},
+			walletID:    "w-1",
+			after:       "1-30",
+			wantResumed: false,
+		},
+		{
+			name:        "unseen wallet on an earlier baseline",
+			recentSize:  10,
+			published:   []published{{"w-2", 0, 10}, {"w-3", 1, 50}},
+			walletID:    "w-1",
+			after:       "0-30",
+			wantResumed: true,
+		},
+		{
+			name:        "partition the hub hasn't seen",
+			recentSize:  10,
+			published:   []published{{"w-2", 0, 10}, {"w-3", 1, 50}},
+			walletID:    "w-1",
+			after:       "2-100",
+			wantResumed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(tt.recentSize, time.Hour)
+			publish(h, tt.published)
+
+			missed, _, resumed, cancel := h.Subscribe(tt.walletID, tt.after)
+			defer cancel()
+
+			if resumed != tt.wantResumed {
+				t.Errorf("resumed = %t, want %t", resumed, tt.wantResumed)
+			}
+			if got := tokens(missed); !reflect.DeepEqual(got, tt.wantMissed) {
+				t.Errorf("missed %v, want %v", got, tt.wantMissed)
+			}
+		})
+	}
+}
+
+func TestSubscribeReceivesUpdates(t *testing.T) {
+	h := New(10, time.Hour)
+	publish(h, []published{{"w-1", 0, 0}, {"w-1", 0, 1}, {"w-1", 0, 2}})
+
+	missed, updates, resumed, cancel := h.Subscribe("w-1", "0-0")
+	defer cancel()
+
+	if !resumed || !reflect.DeepEqual(tokens(missed), []string{"0-1", "0-2"}) {
+		t.Fatalf("Subscribe() = %v, %t", tokens(missed), resumed)
+	}
+
+	publish(h, []published{{"w-2", 0, 3}, {"w-1", 0, 4}})
+
+	select {
+	case u := <-updates:
+		if u.Token != "0-4" || u.Event.WalletID != "w-1" {
+			t.Errorf("update %+v, want 0-4 of w-1", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no update")
+	}
+
+	// The update the client sees last resumes right after it
+	cancel()
+
+	missed, _, resumed, cancel = h.Subscribe("w-1", "0-4")
+	defer cancel()
+
+	if !resumed || len(missed) != 0 {
+		t.Errorf("Subscribe() after the last update = %v, %t", tokens(missed), resumed)
+	}
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	h := New(1, time.Hour)
+
+	_, updates, _, cancel := h.Subscribe("w-1", "")
+	defer cancel()
+
+	for offset := int64(0); offset <= subscriberBuffer; offset++ {
+		h.Publish(0, offset, event.Event{WalletID: "w-1"})
+	}
+
+	received := 0
+	for range updates {
+		received++
+	}
+
+	if received != subscriberBuffer {
+		t.Errorf("received %d updates before the channel was closed, want %d", received, subscriberBuffer)
+	}
+}
+
+// TestSweepExpiresTokens checks that the tokens of forgotten wallets can't be resumed, while
+// the tokens after them still can.
+func TestSweepExpiresTokens(t *testing.T) {
+	h := New(10, 20*time.Millisecond)
+	publish(h, []published{{"w-1", 0, 0}, {"w-1", 0, 1}, {"w-3", 1, 7}})
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The next event sweeps the idle wallets
+	publish(h, []published{{"w-2", 0, 2}})
+
+	h.mu.Lock()
+	_, kept := h.wallets["w-1"]
+	h.mu.Unlock()
+	if kept {
+		t.Fatal("w-1 wasn't forgotten")
+	}
+
+	tests := []struct {
+		walletID    string
+		after       string
+		wantResumed bool
+	}{
+		// Events of w-1 after offset 0 are gone
+		{"w-1", "0-0", false},
+		{"w-1", "0-1", true},
+		// Partition 1 is only complete after w-3's last event
+		{"w-3", "1-6", false},
+		{"w-3", "1-7", true},
+		{"w-2", "0-1", true},
+	}
+
+	for _, tt := range tests {
+		_, _, resumed, cancel := h.Subscribe(tt.walletID, tt.after)
+		cancel()
+
+		if resumed != tt.wantResumed {
+			t.Errorf("Subscribe(%s, %s): resumed = %t, want %t", tt.walletID, tt.after, resumed, tt.wantResumed)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	h := New(10, time.Hour)
+
+	_, updates, _, cancel := h.Subscribe("w-1", "")
+	h.Close()
+
+	if _, ok := <-updates; ok {
+		t.Error("update after Close()")
+	}
+
+	// cancel after Close doesn't close the channel twice
+	cancel()
+
+	_, updates, resumed, cancel := h.Subscribe("w-1", "")
+	defer cancel()
+
+	if _, ok := <-updates; ok || resumed {
+		t.Error("Subscribe() after Close() isn't closed")
+	}
+}
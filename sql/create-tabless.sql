@@ -18,9 +18,137 @@ CREATE TABLE subwallets (
 CREATE TABLE transactions (
     id SERIAL PRIMARY KEY,
     wallet_id VARCHAR(255) NOT NULL,
+    currency VARCHAR(255) NOT NULL,
     amount FLOAT NOT NULL,
     type VARCHAR(255) NOT NULL,
     date_created TIMESTAMP,
     status VARCHAR(255) NOT NULL,
+    operation_id VARCHAR(255) UNIQUE,
+    chain_seq BIGINT,
+    prev_hash VARCHAR(64),
+    hash VARCHAR(64),
+    FOREIGN KEY (wallet_id) REFERENCES wallets(id),
+    UNIQUE (wallet_id, chain_seq)
+);
+
+-- Table 4: interest_rates
+CREATE TABLE interest_rates (
+    currency VARCHAR(255) PRIMARY KEY,
+    annual_rate FLOAT NOT NULL,
+    date_updated TIMESTAMP
+);
+
+-- Table 5: interest_days
+-- One row per calendar day (UTC) whose interest has been accrued, so a day is never accrued twice.
+CREATE TABLE interest_days (
+    day DATE PRIMARY KEY,
+    date_processed TIMESTAMP
+);
+
+-- Table 6: interest_accruals
+CREATE TABLE interest_accruals (
+    wallet_id VARCHAR(255) NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    day DATE NOT NULL,
+    balance FLOAT NOT NULL,
+    annual_rate FLOAT NOT NULL,
+    amount FLOAT NOT NULL,
+    transaction_id INTEGER,
+    PRIMARY KEY (wallet_id, currency, day),
+    FOREIGN KEY (wallet_id) REFERENCES wallets(id),
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+);
+
+-- Table 7: audit_log
+-- Append-only record of every mutating operation, UPDATE, DELETE and TRUNCATE are rejected.
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    occurred_at TIMESTAMP NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    source VARCHAR(255) NOT NULL,
+    operation VARCHAR(255) NOT NULL,
+    params JSONB,
+    result JSONB,
+    error TEXT
+);
+
+CREATE INDEX audit_log_occurred_at_idx ON audit_log (occurred_at);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+-- Table 8: chain_heads
+-- Latest link of every wallet's transaction hash chain.
+CREATE TABLE chain_heads (
+    wallet_id VARCHAR(255) PRIMARY KEY,
+    seq BIGINT NOT NULL,
+    hash VARCHAR(64) NOT NULL,
+    date_updated TIMESTAMP,
     FOREIGN KEY (wallet_id) REFERENCES wallets(id)
-);
\ No newline at end of file
+);
+
+-- Table 9: chain_head_signatures
+CREATE TABLE chain_head_signatures (
+    id BIGSERIAL PRIMARY KEY,
+    wallet_id VARCHAR(255) NOT NULL,
+    seq BIGINT NOT NULL,
+    hash VARCHAR(64) NOT NULL,
+    key_id VARCHAR(255) NOT NULL,
+    signature TEXT NOT NULL,
+    signed_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (wallet_id) REFERENCES wallets(id),
+    UNIQUE (wallet_id, seq, key_id)
+);
+
+-- Table 10: processed_messages
+-- Kafka messages that were applied, written in the same transaction as the balance change
+-- so that a redelivered message is recognised and skipped.
+CREATE TABLE processed_messages (
+    message_id VARCHAR(255) PRIMARY KEY,
+    transaction_id INT,
+    processed_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (transaction_id) REFERENCES transactions(id)
+);
+
+-- Table 11: webhook_subscriptions
+-- Endpoints of an account that are notified when its transactions change status.
+-- event_types is a comma-separated list, empty for every event type.
+CREATE TABLE webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    account_id VARCHAR(255) NOT NULL,
+    url TEXT NOT NULL,
+    event_types TEXT NOT NULL DEFAULT '',
+    secret VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX webhook_subscriptions_account_id_idx ON webhook_subscriptions (account_id);
+
+-- Table 12: webhook_deliveries
+-- One delivery per subscription and event. event_id keeps a redelivered transaction event
+-- from being delivered twice.
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    subscription_id INT NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    event_type VARCHAR(255) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_status_code INT,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    delivered_at TIMESTAMP,
+    UNIQUE (subscription_id, event_id),
+    FOREIGN KEY (subscription_id) REFERENCES webhook_subscriptions(id) ON DELETE CASCADE
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';